@@ -0,0 +1,241 @@
+package mongomock
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/mjarkk/mongomock/aggregate"
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Aggregate runs an aggregation pipeline over the documents of the collection
+// The pipeline can be a mongo.Pipeline, bson.A or any other slice of stage documents.
+//
+// The $match, $project, $addFields, $set, $unset, $group, $sort, $limit, $skip, $count, $lookup, $unwind,
+// $replaceRoot, $replaceWith, $sortByCount, $sample, $unionWith, $facet, $bucket, $bucketAuto,
+// $graphLookup, $setWindowFields, $densify, $fill, $out and $merge stages are supported.
+// A $match as the first stage can use $text like a filter of Find, any $match can use $expr.
+// $lookup, $graphLookup and $unionWith read the other collections of the TestConnection, they are read at the same moment as this collection.
+// $sample uses the random number generator of the TestConnection, see TestConnection.SeedRandom.
+// $out and $merge write into collections of the TestConnection after the pipeline ran,
+// $merge with on fields other than _id requires a unique index on them created using CreateIndex.
+// Other stages result in an error wrapping aggregate.ErrNotSupported.
+// Of the options only Let is used, its variables can be referred to as "$$name" within expressions.
+func (c *Collection) Aggregate(pipeline any, opts ...*options.AggregateOptions) (*Cursor, error) {
+	stages, err := aggregate.Parse(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	names, variables, err := parseLet(options.MergeAggregateOptions(opts...).Let)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := c.compileQuery(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) > 0 && stages[0][0].Key == "$match" {
+		filter, _ := match.ToDocument(stages[0][0].Value)
+		textValue, filterWithoutText, err := extractText(filter)
+		if err != nil {
+			return nil, &aggregate.StageError{Index: 0, Stage: "$match", Message: err.Error(), Err: err}
+		}
+		if textValue != nil {
+			// The $text clause is done by the query so it can use the text index, the rest of the filter by the $match stage
+			query, err = c.compileQuery(bson.D{{Key: "$text", Value: textValue}})
+			if err != nil {
+				return nil, &aggregate.StageError{Index: 0, Stage: "$match", Message: err.Error(), Err: err}
+			}
+			stages[0] = bson.D{{Key: "$match", Value: filterWithoutText}}
+		}
+	}
+
+	compiled, err := aggregate.CompileWithVariables(stages, names)
+	if err != nil {
+		return nil, err
+	}
+
+	documents, database, err := c.snapshot(query, compiled.Collections())
+	if err != nil {
+		return nil, err
+	}
+	documents, err = compiled.RunWithDatabase(documents, variables, database)
+	if err != nil {
+		return nil, err
+	}
+
+	cursorResults := make([]resultT, len(documents))
+	for idx, document := range documents {
+		cursorResults[idx].document, err = tryNewDocument(document)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cursor{results: cursorResults}, nil
+}
+
+// snapshot queries the collection and copies the documents of the other collections a pipeline reads
+// The collections are locked in the order of their names, so concurrent aggregations can't deadlock.
+func (c *Collection) snapshot(query *queryT, names []string) ([]bson.D, *databaseSnapshotT, error) {
+	collections := map[string]*Collection{c.name: c}
+	for _, name := range names {
+		if name == c.name {
+			continue
+		}
+		if c.underlayingCollection == nil {
+			return nil, nil, fmt.Errorf("%w: collection %s is not part of a TestConnection to read %s from", aggregate.ErrNotSupported, c.name, name)
+		}
+		collections[name] = c.underlayingCollection.Collection(name)
+	}
+
+	lockOrder := make([]string, 0, len(collections))
+	for name := range collections {
+		lockOrder = append(lockOrder, name)
+	}
+	sort.Strings(lockOrder)
+	for _, name := range lockOrder {
+		collections[name].m.Lock()
+	}
+	defer func() {
+		for idx := len(lockOrder) - 1; idx >= 0; idx-- {
+			collections[lockOrder[idx]].m.Unlock()
+		}
+	}()
+
+	results, err := c.unsafeQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	documents := make([]bson.D, len(results))
+	for idx, result := range results {
+		documents[idx] = result.document.bson
+	}
+
+	database := &databaseSnapshotT{collections: map[string][]bson.D{}, connection: c.underlayingCollection}
+	for _, name := range names {
+		collectionDocuments := make([]bson.D, len(collections[name].documents))
+		for idx, document := range collections[name].documents {
+			collectionDocuments[idx] = document.bson
+		}
+		database.collections[name] = collectionDocuments
+	}
+	return documents, database, nil
+}
+
+// databaseSnapshotT contains the documents of the collections read by a pipeline at the time it started
+type databaseSnapshotT struct {
+	collections map[string][]bson.D
+	connection  *TestConnection
+}
+
+func (d *databaseSnapshotT) Collection(name string) ([]bson.D, error) {
+	return d.collections[name], nil
+}
+
+func (d *databaseSnapshotT) RandomFloat() float64 {
+	if d.connection == nil {
+		return rand.Float64()
+	}
+	return d.connection.randomFloat()
+}
+
+func (d *databaseSnapshotT) UniqueIndexExists(collection string, fields []string) bool {
+	if d.connection == nil {
+		return false
+	}
+	d.connection.m.Lock()
+	target, ok := d.connection.collections[collection]
+	d.connection.m.Unlock()
+	if !ok {
+		return false
+	}
+
+	target.m.Lock()
+	defer target.m.Unlock()
+	return target.unsafeUniqueIndexExists(fields)
+}
+
+// ReplaceCollection replaces the documents of a collection of the connection, used by $out and $merge
+// Unlike the collections read by the pipeline the documents given to update are the current documents of the collection.
+func (d *databaseSnapshotT) ReplaceCollection(collection string, update func(documents []bson.D) ([]bson.D, error)) error {
+	if d.connection == nil {
+		return fmt.Errorf("%w: the collection is not part of a TestConnection to write %s into", aggregate.ErrNotSupported, collection)
+	}
+	target := d.connection.Collection(collection)
+	target.m.Lock()
+	defer target.m.Unlock()
+
+	current := make([]bson.D, len(target.documents))
+	for idx, document := range target.documents {
+		current[idx] = document.bson
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+
+	newDocuments := make([]documentT, len(updated))
+	for idx, document := range updated {
+		newDocuments[idx], err = tryNewDocument(document)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, document := range target.documents {
+		target.unsafeRemoveFromIndexes(document)
+	}
+	for idx, document := range newDocuments {
+		err = target.unsafeAddToIndexes(document)
+		if err != nil {
+			// Restore the indexes of the documents that are kept
+			for _, indexedDocument := range newDocuments[:idx] {
+				target.unsafeRemoveFromIndexes(indexedDocument)
+			}
+			for _, keptDocument := range target.documents {
+				target.unsafeAddToIndexes(keptDocument)
+			}
+			return err
+		}
+	}
+
+	target.documents = newDocuments
+	return nil
+}
+
+// parseLet evaluates the let option of an aggregation like {minimum: 10, total: {$add: [1, 2]}}
+// The values are expressions that can't refer to fields, as there is no document to evaluate them against.
+func parseLet(let any) ([]string, expr.Variables, error) {
+	if let == nil {
+		return nil, nil, nil
+	}
+	document, ok := match.ToDocument(let)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: let must be a document", aggregate.ErrBadValue)
+	}
+
+	names := make([]string, len(document))
+	variables := expr.Variables{}
+	for idx, entry := range document {
+		err := expr.ValidateVariableName(entry.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		expression, err := expr.Compile(entry.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := expression.Evaluate(bson.D{})
+		if err != nil {
+			return nil, nil, err
+		}
+		names[idx] = entry.Key
+		variables[entry.Key] = value
+	}
+	return names, variables, nil
+}
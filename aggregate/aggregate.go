@@ -0,0 +1,277 @@
+// Package aggregate runs MongoDB aggregation pipelines like [{$match: {...}}, {$group: {...}}] over documents
+package aggregate
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Pipeline is a compiled aggregation pipeline
+type Pipeline struct {
+	stages      []stageT
+	collections map[string]bool
+}
+
+// stageT runs a compiled stage over the documents that came out of the previous stage
+// Stages should never modify the documents they get, as they might be shared with the collection.
+type stageT func(documents []bson.D, run *runT) ([]bson.D, error)
+
+// Database gives stages like $lookup access to the other collections of a database
+// A database can also have a RandomFloat() float64 method, it's used by $sample instead of rand.Float64.
+type Database interface {
+	// Collection returns the documents of a collection, a collection that doesn't exist has no documents
+	Collection(name string) ([]bson.D, error)
+}
+
+// runT is the state of a single run of a pipeline
+type runT struct {
+	variables expr.Variables
+	database  Database
+	random    func() float64
+}
+
+// withVariables returns the state for a pipeline within a stage that has other variables
+func (r *runT) withVariables(variables expr.Variables) *runT {
+	return &runT{variables: variables, database: r.database, random: r.random}
+}
+
+// compilerT is the state of compiling a pipeline
+// Pipelines within stages like $lookup share the collections with the pipeline they are part of.
+type compilerT struct {
+	variables   []string
+	collections map[string]bool
+	// within is the stage a pipeline is part of like "$lookup", it's empty for the pipeline of the aggregation itself
+	within string
+}
+
+// subCompiler returns the state to compile a pipeline within a stage
+func (c *compilerT) subCompiler(stage string, variables []string) *compilerT {
+	return &compilerT{variables: variables, collections: c.collections, within: stage}
+}
+
+// Parse converts a pipeline like mongo.Pipeline, bson.A or []bson.M into its stage documents
+// Every stage is validated to be a document with exactly one field, the name of the stage.
+func Parse(pipeline any) ([]bson.D, error) {
+	_, isDocument := match.ToDocument(pipeline)
+	entries, ok := match.ToArray(pipeline)
+	if isDocument || !ok {
+		return nil, newStageError(ErrBadValue, "pipeline must be an array of stages")
+	}
+
+	stages := make([]bson.D, len(entries))
+	for idx, entry := range entries {
+		stage, ok := match.ToDocument(entry)
+		if !ok || len(stage) != 1 {
+			return nil, wrapStageError(
+				newStageError(ErrBadValue, "A pipeline stage specification object must contain exactly one field."),
+				idx,
+				"",
+			)
+		}
+		stages[idx] = stage
+	}
+	return stages, nil
+}
+
+// Compile validates a pipeline and compiles it
+// The pipeline can be anything accepted by Parse, including the result of Parse.
+func Compile(pipeline any) (*Pipeline, error) {
+	return CompileWithVariables(pipeline, nil)
+}
+
+// CompileWithVariables compiles a pipeline that can refer to user defined variables like the let option of an aggregation
+// The values of the variables are given to RunWithVariables.
+func CompileWithVariables(pipeline any, variables []string) (*Pipeline, error) {
+	compiler := &compilerT{variables: variables, collections: map[string]bool{}}
+	return compiler.compile(pipeline)
+}
+
+func (c *compilerT) compile(pipeline any) (*Pipeline, error) {
+	stageDocuments, err := Parse(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := &Pipeline{stages: make([]stageT, len(stageDocuments)), collections: c.collections}
+	for idx, stageDocument := range stageDocuments {
+		name := stageDocument[0].Key
+		if (name == "$out" || name == "$merge") && idx != len(stageDocuments)-1 {
+			return nil, wrapStageError(newStageError(ErrBadValue, "%s can only be the final stage in the pipeline", name), idx, name)
+		}
+		stage, err := compileStage(name, stageDocument[0].Value, c)
+		if err != nil {
+			return nil, wrapStageError(err, idx, name)
+		}
+
+		// Add the position to runtime errors like expressions that fail to evaluate
+		compiled.stages[idx] = func(documents []bson.D, run *runT) ([]bson.D, error) {
+			documents, err := stage(documents, run)
+			return documents, wrapStageError(err, idx, name)
+		}
+	}
+	return compiled, nil
+}
+
+// Collections returns the sorted names of the other collections the pipeline reads, like the from collection of $lookup
+// These have to be provided by the Database given to RunWithDatabase.
+func (p *Pipeline) Collections() []string {
+	names := make([]string, 0, len(p.collections))
+	for name := range p.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs the pipeline over the documents and returns the documents that came out of the last stage
+// The documents given to Run are not modified.
+func (p *Pipeline) Run(documents []bson.D) ([]bson.D, error) {
+	return p.RunWithVariables(documents, nil)
+}
+
+// RunWithVariables runs the pipeline with the values of the user defined variables
+// Like MongoDB $$NOW is the same for all stages, unless it's set within the variables it's the time the run started.
+func (p *Pipeline) RunWithVariables(documents []bson.D, variables expr.Variables) ([]bson.D, error) {
+	return p.RunWithDatabase(documents, variables, nil)
+}
+
+// RunWithDatabase runs the pipeline with a database to read the collections returned by Collections from
+// Without a database stages that read other collections result in an error.
+// The documents are normalized first, so Go values like int and structs behave like their bson counterparts.
+func (p *Pipeline) RunWithDatabase(documents []bson.D, variables expr.Variables, database Database) ([]bson.D, error) {
+	run := newRun(variables, database)
+
+	normalized := make([]bson.D, len(documents))
+	for idx, document := range documents {
+		normalized[idx] = expr.Normalize(document).(bson.D)
+	}
+	return p.run(normalized, run)
+}
+
+// newRun creates the state of a single run of a pipeline
+func newRun(variables expr.Variables, database Database) *runT {
+	if _, ok := variables["NOW"]; !ok {
+		withNow := expr.Variables{"NOW": primitive.NewDateTimeFromTime(time.Now())}
+		for name, value := range variables {
+			withNow[name] = value
+		}
+		variables = withNow
+	}
+	run := &runT{variables: variables, database: database, random: rand.Float64}
+	if source, ok := database.(interface{ RandomFloat() float64 }); ok {
+		run.random = source.RandomFloat
+	}
+	return run
+}
+
+func (p *Pipeline) run(documents []bson.D, run *runT) ([]bson.D, error) {
+	var err error
+	for _, stage := range p.stages {
+		documents, err = stage(documents, run)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return documents, nil
+}
+
+// unsupportedStages are valid MongoDB stages that mongomock does not support
+var unsupportedStages = map[string]bool{
+	"$changeStream":   true,
+	"$collStats":      true,
+	"$currentOp":      true,
+	"$documents":      true,
+	"$geoNear":        true,
+	"$indexStats":     true,
+	"$listSessions":   true,
+	"$planCacheStats": true,
+	"$redact":         true,
+	"$search":         true,
+}
+
+func compileStage(name string, value any, compiler *compilerT) (stageT, error) {
+	switch name {
+	case "$match":
+		return compileMatch(value, compiler.variables)
+	case "$project":
+		return compileProject(value, compiler.variables)
+	case "$addFields", "$set":
+		return compileAddFields(value, name, compiler.variables)
+	case "$unset":
+		return compileUnset(value)
+	case "$group":
+		return compileGroup(value, compiler.variables)
+	case "$sort":
+		return compileSort(value)
+	case "$limit":
+		return compileLimit(value)
+	case "$skip":
+		return compileSkip(value)
+	case "$count":
+		return compileCount(value)
+	case "$lookup":
+		return compileLookup(value, compiler)
+	case "$unwind":
+		return compileUnwind(value)
+	case "$replaceRoot", "$replaceWith":
+		return compileReplaceRoot(value, name, compiler.variables)
+	case "$sortByCount":
+		return compileSortByCount(value, compiler.variables)
+	case "$sample":
+		return compileSample(value)
+	case "$unionWith":
+		return compileUnionWith(value, compiler)
+	case "$facet":
+		return compileFacet(value, compiler)
+	case "$bucket":
+		return compileBucket(value, compiler.variables)
+	case "$bucketAuto":
+		return compileBucketAuto(value, compiler.variables)
+	case "$densify":
+		return compileDensify(value)
+	case "$fill":
+		return compileFill(value, compiler.variables)
+	case "$setWindowFields":
+		return compileSetWindowFields(value, compiler.variables)
+	case "$graphLookup":
+		return compileGraphLookup(value, compiler)
+	case "$out", "$merge":
+		if compiler.within != "" {
+			return nil, newStageError(ErrBadValue, "%s is not allowed to be used within a %s stage", name, compiler.within)
+		}
+		if name == "$out" {
+			return compileOut(value)
+		}
+		return compileMerge(value, compiler)
+	}
+
+	if unsupportedStages[name] {
+		return nil, newStageError(ErrNotSupported, "%s is not supported by mongomock", name)
+	}
+	return nil, newStageError(ErrUnknownStage, "Unrecognized pipeline stage name: '%s'", name)
+}
+
+// validateFieldName validates a field name set by a stage like the name of $count
+func validateFieldName(name string, description string) error {
+	switch {
+	case name == "":
+		return newStageError(ErrBadValue, "%s must be a non-empty string", description)
+	case strings.HasPrefix(name, "$"):
+		return newStageError(ErrBadValue, "%s cannot be a $-prefixed path", description)
+	case strings.Contains(name, "."):
+		return newStageError(ErrBadValue, "%s cannot contain '.'", description)
+	}
+	return nil
+}
+
+// typeName returns the MongoDB alias of the type of a value within a stage specification, like "int" for a Go int
+func typeName(value any) string {
+	return expr.TypeName(expr.Normalize(value))
+}
@@ -0,0 +1,1184 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjarkk/mongomock/expr"
+	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func testDocuments() []bson.D {
+	return []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "category", Value: "fruit"}, {Key: "price", Value: int32(2)}, {Key: "qty", Value: int32(10)}, {Key: "tags", Value: bson.A{"red", "sweet"}}},
+		{{Key: "_id", Value: int32(2)}, {Key: "item", Value: "carrot"}, {Key: "category", Value: "vegetable"}, {Key: "price", Value: int32(1)}, {Key: "qty", Value: int32(5)}},
+		{{Key: "_id", Value: int32(3)}, {Key: "item", Value: "pear"}, {Key: "category", Value: "fruit"}, {Key: "price", Value: 2.5}, {Key: "qty", Value: int32(4)}, {Key: "supplier", Value: bson.D{{Key: "name", Value: "farm"}, {Key: "city", Value: "Utrecht"}}}},
+	}
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Pipeline any
+		Expected []bson.D
+	}{
+		{
+			"empty pipeline",
+			bson.A{},
+			testDocuments(),
+		},
+		{
+			"$match",
+			bson.A{bson.M{"$match": bson.M{"category": "fruit", "price": bson.M{"$gt": 2}}}},
+			testDocuments()[2:],
+		},
+		{
+			"$match with $expr",
+			bson.A{bson.M{"$match": bson.M{"category": "fruit", "$expr": bson.M{"$gt": bson.A{bson.M{"$multiply": bson.A{"$price", "$qty"}}, 10}}}}},
+			testDocuments()[:1],
+		},
+		{
+			"$match with $expr within $or",
+			bson.A{bson.M{"$match": bson.M{"$or": bson.A{
+				bson.M{"$expr": bson.M{"$eq": bson.A{"$qty", 5}}},
+				bson.M{"supplier.city": "Utrecht"},
+			}}}},
+			testDocuments()[1:],
+		},
+		{
+			"$project inclusion",
+			mongo.Pipeline{{{Key: "$project", Value: bson.D{{Key: "qty", Value: 1}, {Key: "item", Value: true}}}}},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "qty", Value: int32(10)}},
+				{{Key: "_id", Value: int32(2)}, {Key: "item", Value: "carrot"}, {Key: "qty", Value: int32(5)}},
+				{{Key: "_id", Value: int32(3)}, {Key: "item", Value: "pear"}, {Key: "qty", Value: int32(4)}},
+			},
+		},
+		{
+			"$project without _id and with computed and nested fields",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$project": bson.D{{Key: "_id", Value: 0}, {Key: "name", Value: "$item"}, {Key: "supplier", Value: bson.M{"city": 1}}, {Key: "source.kind", Value: "farm"}}},
+			},
+			[]bson.D{
+				{{Key: "supplier", Value: bson.D{{Key: "city", Value: "Utrecht"}}}, {Key: "name", Value: "pear"}, {Key: "source", Value: bson.D{{Key: "kind", Value: "farm"}}}},
+			},
+		},
+		{
+			"$project leaves out missing computed fields",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 2}},
+				bson.M{"$project": bson.M{"city": "$supplier.city"}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(2)}},
+			},
+		},
+		{
+			"$project exclusion",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$project": bson.M{"supplier.name": 0, "tags": 0, "price": false, "qty": 0}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(3)}, {Key: "item", Value: "pear"}, {Key: "category", Value: "fruit"}, {Key: "supplier", Value: bson.D{{Key: "city", Value: "Utrecht"}}}},
+			},
+		},
+		{
+			"$project only excluding _id",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 2}},
+				bson.M{"$project": bson.M{"_id": 0}},
+			},
+			[]bson.D{
+				{{Key: "item", Value: "carrot"}, {Key: "category", Value: "vegetable"}, {Key: "price", Value: int32(1)}, {Key: "qty", Value: int32(5)}},
+			},
+		},
+		{
+			"$addFields",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$addFields": bson.D{{Key: "item", Value: "$category"}, {Key: "supplier.country", Value: "NL"}, {Key: "copy", Value: "$qty"}, {Key: "missing", Value: "$nothing"}}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(3)}, {Key: "item", Value: "fruit"}, {Key: "category", Value: "fruit"}, {Key: "price", Value: 2.5}, {Key: "qty", Value: int32(4)}, {Key: "supplier", Value: bson.D{{Key: "name", Value: "farm"}, {Key: "city", Value: "Utrecht"}, {Key: "country", Value: "NL"}}}, {Key: "copy", Value: int32(4)}},
+			},
+		},
+		{
+			"$set embedded documents within arrays",
+			bson.A{
+				bson.D{{Key: "$set", Value: bson.D{{Key: "items", Value: bson.A{bson.M{"a": 1}, int32(2)}}}}},
+				bson.D{{Key: "$set", Value: bson.M{"items": bson.M{"b": true}}}},
+				bson.D{{Key: "$project", Value: bson.M{"_id": 0, "items": 1}}},
+				bson.D{{Key: "$limit", Value: 1}},
+			},
+			[]bson.D{
+				{{Key: "items", Value: bson.A{bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: true}}, bson.D{{Key: "b", Value: true}}}}},
+			},
+		},
+		{
+			"$unset",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 3}},
+				bson.M{"$unset": bson.A{"_id", "supplier.city", "category", "price", "qty"}},
+			},
+			[]bson.D{
+				{{Key: "item", Value: "pear"}, {Key: "supplier", Value: bson.D{{Key: "name", Value: "farm"}}}},
+			},
+		},
+		{
+			"$group",
+			bson.A{bson.M{"$group": bson.D{
+				{Key: "_id", Value: "$category"},
+				{Key: "count", Value: bson.M{"$count": bson.M{}}},
+				{Key: "total", Value: bson.M{"$sum": "$qty"}},
+				{Key: "avgPrice", Value: bson.M{"$avg": "$price"}},
+				{Key: "items", Value: bson.M{"$push": "$item"}},
+				{Key: "maxPrice", Value: bson.M{"$max": "$price"}},
+				{Key: "first", Value: bson.M{"$first": "$supplier"}},
+			}}},
+			[]bson.D{
+				{{Key: "_id", Value: "fruit"}, {Key: "count", Value: int32(2)}, {Key: "total", Value: int32(14)}, {Key: "avgPrice", Value: 2.25}, {Key: "items", Value: bson.A{"apple", "pear"}}, {Key: "maxPrice", Value: 2.5}, {Key: "first", Value: nil}},
+				{{Key: "_id", Value: "vegetable"}, {Key: "count", Value: int32(1)}, {Key: "total", Value: int32(5)}, {Key: "avgPrice", Value: 1.0}, {Key: "items", Value: bson.A{"carrot"}}, {Key: "maxPrice", Value: int32(1)}, {Key: "first", Value: nil}},
+			},
+		},
+		{
+			"$group by documents",
+			bson.A{bson.M{"$group": bson.M{
+				"_id":  bson.M{"price": "$price"},
+				"ids":  bson.M{"$addToSet": "$_id"},
+				"tags": bson.M{"$sum": 1},
+			}}},
+			[]bson.D{
+				{{Key: "_id", Value: bson.D{{Key: "price", Value: int32(2)}}}, {Key: "ids", Value: bson.A{int32(1)}}, {Key: "tags", Value: int32(1)}},
+				{{Key: "_id", Value: bson.D{{Key: "price", Value: int32(1)}}}, {Key: "ids", Value: bson.A{int32(2)}}, {Key: "tags", Value: int32(1)}},
+				{{Key: "_id", Value: bson.D{{Key: "price", Value: 2.5}}}, {Key: "ids", Value: bson.A{int32(3)}}, {Key: "tags", Value: int32(1)}},
+			},
+		},
+		{
+			"$group by compound _id with missing fields",
+			bson.A{bson.M{"$group": bson.D{
+				{Key: "_id", Value: bson.D{{Key: "category", Value: "$category"}, {Key: "city", Value: "$supplier.city"}}},
+				{Key: "cheapest", Value: bson.M{"$bottom": bson.M{"sortBy": bson.M{"price": -1}, "output": "$item"}}},
+				{Key: "mostStocked", Value: bson.M{"$maxN": bson.M{"input": "$qty", "n": 2}}},
+			}}},
+			[]bson.D{
+				{{Key: "_id", Value: bson.D{{Key: "category", Value: "fruit"}, {Key: "city", Value: nil}}}, {Key: "cheapest", Value: "apple"}, {Key: "mostStocked", Value: bson.A{int32(10)}}},
+				{{Key: "_id", Value: bson.D{{Key: "category", Value: "vegetable"}, {Key: "city", Value: nil}}}, {Key: "cheapest", Value: "carrot"}, {Key: "mostStocked", Value: bson.A{int32(5)}}},
+				{{Key: "_id", Value: bson.D{{Key: "category", Value: "fruit"}, {Key: "city", Value: "Utrecht"}}}, {Key: "cheapest", Value: "pear"}, {Key: "mostStocked", Value: bson.A{int32(4)}}},
+			},
+		},
+		{
+			"$group everything",
+			bson.A{
+				bson.M{"$set": bson.M{"price": 2.0}},
+				bson.M{"$group": bson.M{"_id": nil, "prices": bson.M{"$addToSet": "$price"}}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: nil}, {Key: "prices", Value: bson.A{2.0}}},
+			},
+		},
+		{
+			"$sort, $skip and $limit",
+			bson.A{
+				bson.M{"$sort": bson.D{{Key: "category", Value: -1}, {Key: "price", Value: 1}}},
+				bson.M{"$skip": 1},
+				bson.M{"$limit": int64(2)},
+				bson.M{"$project": bson.M{"item": 1}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}},
+				{{Key: "_id", Value: int32(3)}, {Key: "item", Value: "pear"}},
+			},
+		},
+		{
+			"$sort by array",
+			bson.A{
+				bson.M{"$sort": bson.M{"tags": -1}},
+				bson.M{"$project": bson.M{"_id": 1}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}},
+				{{Key: "_id", Value: int32(2)}},
+				{{Key: "_id", Value: int32(3)}},
+			},
+		},
+		{
+			"$skip everything",
+			bson.A{bson.M{"$skip": 3.0}},
+			[]bson.D{},
+		},
+		{
+			"$count",
+			bson.A{bson.M{"$match": bson.M{"category": "fruit"}}, bson.M{"$count": "fruits"}},
+			[]bson.D{{{Key: "fruits", Value: int32(2)}}},
+		},
+		{
+			"$count without documents",
+			bson.A{bson.M{"$match": bson.M{"category": "meat"}}, bson.M{"$count": "meats"}},
+			[]bson.D{},
+		},
+		{
+			"$unwind",
+			bson.A{bson.M{"$unwind": "$tags"}, bson.M{"$project": bson.M{"tags": 1}}},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}, {Key: "tags", Value: "red"}},
+				{{Key: "_id", Value: int32(1)}, {Key: "tags", Value: "sweet"}},
+			},
+		},
+		{
+			"$unwind with options",
+			bson.A{
+				bson.M{"$project": bson.M{"tags": 1, "supplier.name": 1}},
+				bson.M{"$unwind": bson.M{"path": "$tags", "includeArrayIndex": "idx", "preserveNullAndEmptyArrays": true}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}, {Key: "tags", Value: "red"}, {Key: "idx", Value: int64(0)}},
+				{{Key: "_id", Value: int32(1)}, {Key: "tags", Value: "sweet"}, {Key: "idx", Value: int64(1)}},
+				{{Key: "_id", Value: int32(2)}, {Key: "idx", Value: nil}},
+				{{Key: "_id", Value: int32(3)}, {Key: "supplier", Value: bson.D{{Key: "name", Value: "farm"}}}, {Key: "idx", Value: nil}},
+			},
+		},
+		{
+			"$unwind nested field and empty array",
+			bson.A{
+				bson.M{"$project": bson.M{"a": bson.M{"b": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$_id", 1}}, bson.A{}, "$item"}}}}},
+				bson.M{"$unwind": bson.M{"path": "$a.b", "preserveNullAndEmptyArrays": true}},
+			},
+			[]bson.D{
+				{{Key: "_id", Value: int32(1)}, {Key: "a", Value: bson.D{}}},
+				{{Key: "_id", Value: int32(2)}, {Key: "a", Value: bson.D{{Key: "b", Value: "carrot"}}}},
+				{{Key: "_id", Value: int32(3)}, {Key: "a", Value: bson.D{{Key: "b", Value: "pear"}}}},
+			},
+		},
+		{
+			"$replaceRoot",
+			bson.A{bson.M{"$match": bson.M{"_id": 3}}, bson.M{"$replaceRoot": bson.M{"newRoot": "$supplier"}}},
+			[]bson.D{{{Key: "name", Value: "farm"}, {Key: "city", Value: "Utrecht"}}},
+		},
+		{
+			"$replaceWith",
+			bson.A{bson.M{"$match": bson.M{"_id": 1}}, bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{bson.M{"name": "$item"}, "$supplier"}}}},
+			[]bson.D{{{Key: "name", Value: "apple"}}},
+		},
+		{
+			"$sortByCount",
+			bson.A{bson.M{"$sortByCount": "$category"}},
+			[]bson.D{
+				{{Key: "_id", Value: "fruit"}, {Key: "count", Value: int32(2)}},
+				{{Key: "_id", Value: "vegetable"}, {Key: "count", Value: int32(1)}},
+			},
+		},
+		{
+			"$sample larger than the input",
+			bson.A{bson.M{"$sample": bson.M{"size": 5}}, bson.M{"$sort": bson.M{"_id": 1}}},
+			testDocuments(),
+		},
+		{
+			"$facet",
+			bson.A{bson.M{"$facet": bson.D{
+				{Key: "categories", Value: bson.A{bson.M{"$sortByCount": "$category"}}},
+				{Key: "total", Value: bson.A{bson.M{"$count": "items"}}},
+			}}},
+			[]bson.D{{
+				{Key: "categories", Value: bson.A{
+					bson.D{{Key: "_id", Value: "fruit"}, {Key: "count", Value: int32(2)}},
+					bson.D{{Key: "_id", Value: "vegetable"}, {Key: "count", Value: int32(1)}},
+				}},
+				{Key: "total", Value: bson.A{bson.D{{Key: "items", Value: int32(3)}}}},
+			}},
+		},
+		{
+			"$bucket",
+			bson.A{bson.M{"$bucket": bson.M{
+				"groupBy":    "$price",
+				"boundaries": bson.A{0, 2, 5},
+				"output":     bson.D{{Key: "count", Value: bson.M{"$sum": 1}}, {Key: "items", Value: bson.M{"$push": "$item"}}},
+			}}},
+			[]bson.D{
+				{{Key: "_id", Value: int32(0)}, {Key: "count", Value: int32(1)}, {Key: "items", Value: bson.A{"carrot"}}},
+				{{Key: "_id", Value: int32(2)}, {Key: "count", Value: int32(2)}, {Key: "items", Value: bson.A{"apple", "pear"}}},
+			},
+		},
+		{
+			"$bucket with default",
+			bson.A{bson.M{"$bucket": bson.M{"groupBy": "$price", "boundaries": bson.A{0, 2}, "default": "other"}}},
+			[]bson.D{
+				{{Key: "_id", Value: int32(0)}, {Key: "count", Value: int32(1)}},
+				{{Key: "_id", Value: "other"}, {Key: "count", Value: int32(2)}},
+			},
+		},
+		{
+			"expressions with variables",
+			bson.A{
+				bson.M{"$match": bson.M{"category": "fruit"}},
+				bson.M{"$project": bson.D{
+					{Key: "_id", Value: 0},
+					{Key: "value", Value: bson.M{"$let": bson.M{
+						"vars": bson.M{"value": bson.M{"$multiply": bson.A{"$price", "$qty"}}},
+						"in":   bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$$value", 15}}, "$$value", "$$REMOVE"}},
+					}}},
+					{Key: "fields", Value: bson.M{"$size": bson.M{"$objectToArray": "$$ROOT"}}},
+				}},
+			},
+			[]bson.D{
+				{{Key: "value", Value: int32(20)}, {Key: "fields", Value: int32(6)}},
+				{{Key: "fields", Value: int32(6)}},
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pipeline, err := Compile(testCase.Pipeline)
+			NoError(t, err)
+
+			documents := testDocuments()
+			results, err := pipeline.Run(documents)
+			NoError(t, err)
+			Equal(t, testCase.Expected, results)
+			Equal(t, testDocuments(), documents, "the input documents should not be modified")
+		})
+	}
+}
+
+func TestRunWithVariables(t *testing.T) {
+	pipeline, err := CompileWithVariables(bson.A{
+		bson.M{"$project": bson.M{"_id": 0, "limit": "$$limit", "now": "$$NOW"}},
+	}, []string{"limit"})
+	NoError(t, err)
+
+	results, err := pipeline.RunWithVariables(testDocuments(), expr.Variables{"limit": int32(3)})
+	NoError(t, err)
+	Len(t, results, 3)
+	Equal(t, int32(3), results[0][0].Value)
+	for _, result := range results {
+		Equal(t, results[0][1].Value, result[1].Value, "$$NOW should be the same for all documents")
+	}
+
+	_, err = Compile(bson.A{bson.M{"$project": bson.M{"limit": "$$limit"}}})
+	ErrorIs(t, err, expr.ErrBadValue)
+}
+
+func TestRunGoValues(t *testing.T) {
+	pipeline, err := Compile(bson.A{
+		bson.M{"$group": bson.D{
+			{Key: "_id", Value: "$g"},
+			{Key: "s", Value: bson.M{"$sum": "$x"}},
+			{Key: "doubled", Value: bson.M{"$max": bson.M{"$multiply": bson.A{"$x", 2}}}},
+		}},
+	})
+	NoError(t, err)
+
+	documents := []bson.D{
+		{{Key: "g", Value: "a"}, {Key: "x", Value: 1}},
+		{{Key: "g", Value: "a"}, {Key: "x", Value: 2}},
+	}
+	results, err := pipeline.Run(documents)
+	NoError(t, err)
+	Equal(t, []bson.D{{{Key: "_id", Value: "a"}, {Key: "s", Value: int32(3)}, {Key: "doubled", Value: int32(4)}}}, results)
+	Equal(t, 1, documents[0][1].Value, "the input documents should not be modified")
+}
+
+func TestCompileProjection(t *testing.T) {
+	projection, err := CompileProjection(bson.D{{Key: "_id", Value: 0}, {Key: "item", Value: 1}, {Key: "total", Value: bson.M{"$multiply": bson.A{"$price", "$qty"}}}})
+	NoError(t, err)
+
+	document := testDocuments()[0]
+	result, err := projection.Apply(document)
+	NoError(t, err)
+	Equal(t, bson.D{{Key: "item", Value: "apple"}, {Key: "total", Value: int32(20)}}, result)
+	Equal(t, testDocuments()[0], document, "the document should not be modified")
+
+	_, err = CompileProjection(bson.M{"item": 1, "qty": 0})
+	ErrorIs(t, err, ErrBadValue)
+}
+
+type testDatabaseT map[string][]bson.D
+
+func (d testDatabaseT) Collection(name string) ([]bson.D, error) {
+	return d[name], nil
+}
+
+func TestLookup(t *testing.T) {
+	database := testDatabaseT{
+		"orders": {
+			{{Key: "_id", Value: int32(10)}, {Key: "items", Value: bson.A{int32(1), int32(3)}}, {Key: "amount", Value: int32(2)}},
+			{{Key: "_id", Value: int32(11)}, {Key: "items", Value: bson.A{int32(2)}}, {Key: "amount", Value: int32(8)}},
+			{{Key: "_id", Value: int32(12)}, {Key: "items", Value: int32(1)}, {Key: "amount", Value: int32(20)}},
+			{{Key: "_id", Value: int32(13)}},
+		},
+	}
+	orderIDs := func(documents []bson.D, field string) [][]any {
+		results := [][]any{}
+		for _, document := range documents {
+			ids := []any{}
+			for _, order := range lookupField(document, field).(bson.A) {
+				ids = append(ids, order.(bson.D)[0].Value)
+			}
+			results = append(results, ids)
+		}
+		return results
+	}
+
+	cases := []struct {
+		Name     string
+		Pipeline bson.A
+		Field    string
+		Expected [][]any
+	}{
+		{
+			"equality",
+			bson.A{bson.M{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "items", "as": "orders"}}},
+			"orders",
+			[][]any{{int32(10), int32(12)}, {int32(11)}, {int32(10)}},
+		},
+		{
+			"array localField",
+			bson.A{
+				bson.M{"$project": bson.M{"ids": bson.A{"$_id", bson.M{"$add": bson.A{"$_id", 1}}}}},
+				bson.M{"$lookup": bson.M{"from": "orders", "localField": "ids", "foreignField": "items", "as": "orders"}},
+			},
+			"orders",
+			[][]any{{int32(10), int32(11), int32(12)}, {int32(10), int32(11)}, {int32(10)}},
+		},
+		{
+			"missing localField matches missing foreignField",
+			bson.A{
+				bson.M{"$match": bson.M{"_id": 1}},
+				bson.M{"$lookup": bson.M{"from": "orders", "localField": "missing", "foreignField": "items", "as": "orders"}},
+			},
+			"orders",
+			[][]any{{int32(13)}},
+		},
+		{
+			"let and pipeline",
+			bson.A{bson.M{"$lookup": bson.M{
+				"from": "orders",
+				"let":  bson.M{"qty": "$qty"},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"$expr": bson.M{"$gt": bson.A{"$amount", "$$qty"}}}},
+				},
+				"as": "orders",
+			}}},
+			"orders",
+			[][]any{{int32(12)}, {int32(11), int32(12)}, {int32(11), int32(12)}},
+		},
+		{
+			"concise correlated form",
+			bson.A{bson.M{"$lookup": bson.M{
+				"from":         "orders",
+				"localField":   "_id",
+				"foreignField": "items",
+				"let":          bson.M{"qty": "$qty"},
+				"pipeline":     bson.A{bson.M{"$match": bson.M{"$expr": bson.M{"$lt": bson.A{"$amount", "$$qty"}}}}},
+				"as":           "orders",
+			}}},
+			"orders",
+			[][]any{{int32(10)}, {}, {int32(10)}},
+		},
+		{
+			"dotted as",
+			bson.A{bson.M{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "items", "as": "supplier.orders"}}},
+			"supplier",
+			nil,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pipeline, err := Compile(testCase.Pipeline)
+			NoError(t, err)
+			Equal(t, []string{"orders"}, pipeline.Collections())
+
+			documents := testDocuments()
+			results, err := pipeline.RunWithDatabase(documents, nil, database)
+			NoError(t, err)
+			Equal(t, testDocuments(), documents, "the input documents should not be modified")
+			if testCase.Expected != nil {
+				Equal(t, testCase.Expected, orderIDs(results, testCase.Field))
+				return
+			}
+
+			supplier := lookupField(results[2], "supplier").(bson.D)
+			Equal(t, "farm", lookupField(supplier, "name"))
+			Equal(t, [][]any{{int32(10), int32(12)}, {int32(11)}, {int32(10)}}, orderIDs([]bson.D{
+				lookupField(results[0], "supplier").(bson.D),
+				lookupField(results[1], "supplier").(bson.D),
+				supplier,
+			}, "orders"))
+		})
+	}
+
+	pipeline, err := Compile(bson.A{bson.M{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "items", "as": "orders"}}})
+	NoError(t, err)
+	_, err = pipeline.Run(testDocuments())
+	ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestSample(t *testing.T) {
+	pipeline, err := Compile(bson.A{bson.M{"$sample": bson.M{"size": 2}}})
+	NoError(t, err)
+
+	seen := map[any]bool{}
+	for idx := 0; idx < 50; idx++ {
+		results, err := pipeline.Run(testDocuments())
+		NoError(t, err)
+		if Len(t, results, 2) {
+			NotEqual(t, results[0][0].Value, results[1][0].Value)
+			seen[results[0][0].Value] = true
+		}
+	}
+	Len(t, seen, 3, "every document should be sampled at some point")
+}
+
+func TestUnionWith(t *testing.T) {
+	database := testDatabaseT{
+		"archive": {
+			{{Key: "_id", Value: int32(4)}, {Key: "item", Value: "plum"}},
+			{{Key: "_id", Value: int32(5)}, {Key: "item", Value: "leek"}},
+		},
+	}
+
+	pipeline, err := Compile(bson.A{
+		bson.M{"$match": bson.M{"_id": 1}},
+		bson.M{"$unionWith": bson.M{"coll": "archive", "pipeline": bson.A{bson.M{"$match": bson.M{"item": "plum"}}}}},
+		bson.M{"$project": bson.M{"item": 1}},
+	})
+	NoError(t, err)
+	Equal(t, []string{"archive"}, pipeline.Collections())
+	results, err := pipeline.RunWithDatabase(testDocuments(), nil, database)
+	NoError(t, err)
+	Equal(t, []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}},
+		{{Key: "_id", Value: int32(4)}, {Key: "item", Value: "plum"}},
+	}, results)
+
+	pipeline, err = Compile(bson.A{bson.M{"$unionWith": "archive"}, bson.M{"$count": "items"}})
+	NoError(t, err)
+	results, err = pipeline.RunWithDatabase(testDocuments(), nil, database)
+	NoError(t, err)
+	Equal(t, []bson.D{{{Key: "items", Value: int32(5)}}}, results)
+
+	_, err = pipeline.Run(testDocuments())
+	ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestGraphLookup(t *testing.T) {
+	employee := func(id int32, name string, reportsTo any) bson.D {
+		document := bson.D{{Key: "_id", Value: id}, {Key: "name", Value: name}}
+		if reportsTo != nil {
+			document = append(document, bson.E{Key: "reportsTo", Value: reportsTo})
+		}
+		return document
+	}
+	withDepth := func(document bson.D, depth int64) bson.D {
+		return append(append(bson.D{}, document...), bson.E{Key: "depth", Value: depth})
+	}
+	dev := employee(1, "Dev", nil)
+	eliot := employee(2, "Eliot", "Dev")
+	ron := employee(3, "Ron", "Eliot")
+	andrew := employee(4, "Andrew", "Eliot")
+	asya := employee(5, "Asya", "Ron")
+	// Loop reports to itself through Cycle
+	loop := employee(6, "Loop", "Cycle")
+	cycle := employee(7, "Cycle", bson.A{"Loop", "Dev"})
+	database := testDatabaseT{"employees": {dev, eliot, ron, andrew, asya, loop, cycle}}
+
+	cases := []struct {
+		Name     string
+		Spec     bson.M
+		Input    bson.D
+		Expected bson.A
+	}{
+		{
+			"reporting chain",
+			bson.M{"startWith": "$reportsTo", "connectFromField": "reportsTo", "connectToField": "name", "depthField": "depth"},
+			asya,
+			bson.A{withDepth(ron, 0), withDepth(eliot, 1), withDepth(dev, 2)},
+		},
+		{
+			"max depth",
+			bson.M{"startWith": "$reportsTo", "connectFromField": "reportsTo", "connectToField": "name", "maxDepth": 1},
+			asya,
+			bson.A{ron, eliot},
+		},
+		{
+			"reports below",
+			bson.M{"startWith": "$name", "connectFromField": "name", "connectToField": "reportsTo", "depthField": "depth"},
+			eliot,
+			bson.A{withDepth(ron, 0), withDepth(andrew, 0), withDepth(asya, 1)},
+		},
+		{
+			"cycle",
+			bson.M{"startWith": "$reportsTo", "connectFromField": "reportsTo", "connectToField": "name", "depthField": "depth"},
+			loop,
+			bson.A{withDepth(cycle, 0), withDepth(dev, 1), withDepth(loop, 1)},
+		},
+		{
+			"restrict search",
+			bson.M{"startWith": "$name", "connectFromField": "name", "connectToField": "reportsTo", "restrictSearchWithMatch": bson.M{"name": bson.M{"$ne": "Ron"}}},
+			eliot,
+			bson.A{andrew},
+		},
+		{
+			"array start",
+			bson.M{"startWith": bson.A{"Ron", "Andrew"}, "connectFromField": "reportsTo", "connectToField": "name", "maxDepth": 0},
+			dev,
+			bson.A{ron, andrew},
+		},
+		{
+			"nothing found",
+			bson.M{"startWith": "$reportsTo", "connectFromField": "reportsTo", "connectToField": "name"},
+			dev,
+			bson.A{},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			testCase.Spec["from"] = "employees"
+			testCase.Spec["as"] = "chain"
+			pipeline, err := Compile(bson.A{bson.M{"$graphLookup": testCase.Spec}})
+			NoError(t, err)
+			Equal(t, []string{"employees"}, pipeline.Collections())
+			results, err := pipeline.RunWithDatabase([]bson.D{testCase.Input}, nil, database)
+			NoError(t, err)
+			Equal(t, []bson.D{append(append(bson.D{}, testCase.Input...), bson.E{Key: "chain", Value: testCase.Expected})}, results)
+		})
+	}
+}
+
+// writableTestDatabaseT is a testDatabaseT that $out and $merge can write into
+type writableTestDatabaseT struct {
+	testDatabaseT
+	uniqueIndexes map[string][]string
+}
+
+func (d writableTestDatabaseT) UniqueIndexExists(collection string, fields []string) bool {
+	return ObjectsAreEqual(d.uniqueIndexes[collection], fields)
+}
+
+func (d writableTestDatabaseT) ReplaceCollection(collection string, update func([]bson.D) ([]bson.D, error)) error {
+	documents, err := update(d.testDatabaseT[collection])
+	if err == nil {
+		d.testDatabaseT[collection] = documents
+	}
+	return err
+}
+
+func TestOut(t *testing.T) {
+	database := writableTestDatabaseT{testDatabaseT: testDatabaseT{"totals": {{{Key: "_id", Value: "old"}}}}}
+
+	pipeline, err := Compile(bson.A{
+		bson.M{"$group": bson.M{"_id": "$category", "qty": bson.M{"$sum": "$qty"}}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+		bson.M{"$out": "totals"},
+	})
+	NoError(t, err)
+	results, err := pipeline.RunWithDatabase(testDocuments(), nil, database)
+	NoError(t, err)
+	Empty(t, results)
+	Equal(t, []bson.D{
+		{{Key: "_id", Value: "fruit"}, {Key: "qty", Value: int32(14)}},
+		{{Key: "_id", Value: "vegetable"}, {Key: "qty", Value: int32(5)}},
+	}, database.testDatabaseT["totals"])
+
+	pipeline, err = Compile(bson.A{bson.M{"$project": bson.M{"_id": 0, "item": 1}}, bson.M{"$out": bson.M{"coll": "items"}}})
+	NoError(t, err)
+	_, err = pipeline.RunWithDatabase(testDocuments(), nil, database)
+	NoError(t, err)
+	items := database.testDatabaseT["items"]
+	Len(t, items, 3)
+	IsType(t, primitive.ObjectID{}, items[0][0].Value)
+	Equal(t, bson.E{Key: "item", Value: "apple"}, items[0][1])
+
+	pipeline, err = Compile(bson.A{bson.M{"$project": bson.M{"_id": "$category"}}, bson.M{"$out": "totals"}})
+	NoError(t, err)
+	_, err = pipeline.RunWithDatabase(testDocuments(), nil, database)
+	EqualError(t, err, "E11000 duplicate key error collection: totals index: _id_ dup key: { _id: fruit } (at stage 1, $out)")
+	ErrorIs(t, err, ErrWriteFailed)
+	Len(t, database.testDatabaseT["totals"], 2)
+
+	_, err = pipeline.RunWithDatabase(testDocuments(), nil, database.testDatabaseT)
+	ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestMerge(t *testing.T) {
+	target := func() []bson.D {
+		return []bson.D{
+			{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "sold", Value: int32(3)}},
+			{{Key: "_id", Value: int32(9)}, {Key: "item", Value: "kiwi"}, {Key: "sold", Value: int32(1)}},
+		}
+	}
+	source := []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "qty", Value: int32(10)}},
+		{{Key: "_id", Value: int32(2)}, {Key: "item", Value: "carrot"}, {Key: "qty", Value: int32(5)}},
+	}
+	carrot := bson.D{{Key: "_id", Value: int32(2)}, {Key: "item", Value: "carrot"}, {Key: "qty", Value: int32(5)}}
+	kiwi := bson.D{{Key: "_id", Value: int32(9)}, {Key: "item", Value: "kiwi"}, {Key: "sold", Value: int32(1)}}
+
+	cases := []struct {
+		Name     string
+		Spec     any
+		Expected []bson.D
+		Err      string
+	}{
+		{
+			"merge into by name",
+			"target",
+			[]bson.D{{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "sold", Value: int32(3)}, {Key: "qty", Value: int32(10)}}, kiwi, carrot},
+			"",
+		},
+		{
+			"replace",
+			bson.M{"into": bson.M{"coll": "target"}, "whenMatched": "replace"},
+			[]bson.D{source[0], kiwi, carrot},
+			"",
+		},
+		{
+			"keep existing and discard",
+			bson.M{"into": "target", "whenMatched": "keepExisting", "whenNotMatched": "discard"},
+			target(),
+			"",
+		},
+		{
+			"pipeline",
+			bson.M{"into": "target", "let": bson.M{"qty": "$qty"}, "whenMatched": bson.A{bson.M{"$set": bson.M{"sold": bson.M{"$add": bson.A{"$sold", "$$qty"}}}}}},
+			[]bson.D{{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "sold", Value: int32(13)}}, kiwi, carrot},
+			"",
+		},
+		{
+			"pipeline with $$new",
+			bson.M{"into": "target", "whenMatched": bson.A{bson.M{"$replaceWith": bson.M{"item": "$$new.item", "total": bson.M{"$add": bson.A{"$sold", "$$new.qty"}}}}}},
+			[]bson.D{{{Key: "_id", Value: int32(1)}, {Key: "item", Value: "apple"}, {Key: "total", Value: int32(13)}}, kiwi, carrot},
+			"",
+		},
+		{
+			"on a unique index",
+			bson.M{"into": "target", "on": "item", "whenMatched": "replace"},
+			[]bson.D{source[0], kiwi, carrot},
+			"",
+		},
+		{
+			"on without unique index",
+			bson.M{"into": "target", "on": bson.A{"item", "qty"}},
+			nil,
+			"Cannot find index to verify that $merge fields will be unique (at stage 0, $merge)",
+		},
+		{
+			"when matched fail",
+			bson.M{"into": "target", "whenMatched": "fail"},
+			nil,
+			"$merge with whenMatched: fail found an existing document with the same values for the 'on' fields (at stage 0, $merge)",
+		},
+		{
+			"when not matched fail",
+			bson.M{"into": "target", "whenNotMatched": "fail"},
+			nil,
+			"$merge could not find a matching document in the target collection for at least one document in the source collection (at stage 0, $merge)",
+		},
+		{
+			"changing the _id",
+			bson.M{"into": "target", "whenMatched": bson.A{bson.M{"$set": bson.M{"_id": 5}}}},
+			nil,
+			"$merge failed to update the matching document, did you attempt to modify the _id or the shard key? (at stage 0, $merge)",
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			database := writableTestDatabaseT{
+				testDatabaseT: testDatabaseT{"target": target()},
+				uniqueIndexes: map[string][]string{"target": {"item"}},
+			}
+			pipeline, err := Compile(bson.A{bson.M{"$merge": testCase.Spec}})
+			NoError(t, err)
+			_, err = pipeline.RunWithDatabase(source, nil, database)
+			if testCase.Err != "" {
+				EqualError(t, err, testCase.Err)
+				Equal(t, target(), database.testDatabaseT["target"])
+				return
+			}
+			NoError(t, err)
+			Equal(t, testCase.Expected, database.testDatabaseT["target"])
+		})
+	}
+
+	pipeline, err := Compile(bson.A{bson.M{"$merge": bson.M{"into": "target", "on": "item"}}})
+	NoError(t, err)
+	database := writableTestDatabaseT{testDatabaseT: testDatabaseT{}, uniqueIndexes: map[string][]string{"target": {"item"}}}
+	_, err = pipeline.RunWithDatabase([]bson.D{{{Key: "qty", Value: int32(1)}}}, nil, database)
+	EqualError(t, err, "$merge write error: 'on' field 'item' cannot be missing, null, undefined or an array (at stage 0, $merge)")
+	ErrorIs(t, err, ErrWriteFailed)
+}
+
+func TestSetWindowFields(t *testing.T) {
+	sale := func(id int32, state string, day int32, qty int32) bson.D {
+		date := primitive.NewDateTimeFromTime(time.Date(2024, 1, int(day), 0, 0, 0, 0, time.UTC))
+		return bson.D{{Key: "_id", Value: id}, {Key: "state", Value: state}, {Key: "day", Value: day}, {Key: "date", Value: date}, {Key: "qty", Value: qty}}
+	}
+	// In reverse so the results show the documents are sorted
+	documents := []bson.D{sale(5, "WA", 3, 5), sale(4, "WA", 1, 5), sale(3, "CA", 4, 30), sale(2, "CA", 2, 20), sale(1, "CA", 1, 10)}
+
+	cases := []struct {
+		Name     string
+		SortBy   bson.D
+		Output   bson.M
+		Expected []any
+	}{
+		{"running total", bson.D{{Key: "day", Value: 1}}, bson.M{"$sum": "$qty", "window": bson.M{"documents": bson.A{"unbounded", "current"}}}, []any{int32(10), int32(30), int32(60), int32(5), int32(10)}},
+		{"moving average", bson.D{{Key: "day", Value: 1}}, bson.M{"$avg": "$qty", "window": bson.M{"documents": bson.A{-1, 0}}}, []any{10.0, 15.0, 25.0, 5.0, 5.0}},
+		{"whole partition", nil, bson.M{"$sum": "$qty"}, []any{int32(60), int32(60), int32(60), int32(10), int32(10)}},
+		{"range", bson.D{{Key: "day", Value: 1}}, bson.M{"$sum": "$qty", "window": bson.M{"range": bson.A{-1, "current"}}}, []any{int32(10), int32(30), int32(30), int32(5), int32(5)}},
+		{"range descending", bson.D{{Key: "day", Value: -1}}, bson.M{"$push": "$_id", "window": bson.M{"range": bson.A{"unbounded", -1}}}, []any{bson.A{int32(3), int32(2)}, bson.A{int32(3)}, bson.A{}, bson.A{int32(5)}, bson.A{}}},
+		{"range with unit", bson.D{{Key: "date", Value: 1}}, bson.M{"$sum": "$qty", "window": bson.M{"range": bson.A{-1, 0}, "unit": "day"}}, []any{int32(10), int32(30), int32(30), int32(5), int32(5)}},
+		{"empty window", bson.D{{Key: "day", Value: 1}}, bson.M{"$max": "$qty", "window": bson.M{"documents": bson.A{1, 1}}}, []any{int32(20), int32(30), nil, int32(5), nil}},
+		{"rank", bson.D{{Key: "qty", Value: 1}}, bson.M{"$rank": bson.M{}}, []any{int32(1), int32(2), int32(3), int32(1), int32(1)}},
+		{"document number", bson.D{{Key: "qty", Value: 1}}, bson.M{"$documentNumber": bson.M{}}, []any{int32(1), int32(2), int32(3), int32(2), int32(1)}},
+		{"shift", bson.D{{Key: "day", Value: 1}}, bson.M{"$shift": bson.M{"output": "$qty", "by": 1, "default": "none"}}, []any{int32(20), int32(30), "none", int32(5), "none"}},
+		{"exponential moving average", bson.D{{Key: "day", Value: 1}}, bson.M{"$expMovingAvg": bson.M{"input": "$qty", "alpha": 0.5}}, []any{10.0, 15.0, 22.5, 5.0, 5.0}},
+		{"derivative", bson.D{{Key: "day", Value: 1}}, bson.M{"$derivative": bson.M{"input": "$qty"}, "window": bson.M{"documents": bson.A{-1, 0}}}, []any{nil, 10.0, 5.0, nil, 0.0}},
+		{"integral", bson.D{{Key: "date", Value: 1}}, bson.M{"$integral": bson.M{"input": "$qty", "unit": "day"}, "window": bson.M{"documents": bson.A{"unbounded", "current"}}}, []any{0.0, 15.0, 65.0, 0.0, 10.0}},
+		{"covariance", nil, bson.M{"$covarianceSamp": bson.A{"$qty", "$qty"}}, []any{100.0, 100.0, 100.0, 0.0, 0.0}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			spec := bson.M{"partitionBy": "$state", "output": bson.M{"value": testCase.Output}}
+			if testCase.SortBy != nil {
+				spec["sortBy"] = testCase.SortBy
+			}
+			pipeline, err := Compile(bson.A{bson.M{"$setWindowFields": spec}})
+			NoError(t, err)
+			results, err := pipeline.Run(documents)
+			NoError(t, err)
+
+			// The values are compared in the order of the _id
+			values := make([]any, len(results))
+			for _, result := range results {
+				values[result[0].Value.(int32)-1] = result[len(result)-1].Value
+			}
+			Equal(t, testCase.Expected, values)
+		})
+	}
+
+	pipeline, err := Compile(bson.A{
+		bson.M{"$setWindowFields": bson.M{"partitionBy": "$state", "sortBy": bson.M{"day": 1}, "output": bson.M{"total": bson.M{"$sum": "$qty"}}}},
+		bson.M{"$project": bson.M{"_id": 1}},
+	})
+	NoError(t, err)
+	results, err := pipeline.Run(documents)
+	NoError(t, err)
+	Equal(t, []bson.D{{{Key: "_id", Value: int32(1)}}, {{Key: "_id", Value: int32(2)}}, {{Key: "_id", Value: int32(3)}}, {{Key: "_id", Value: int32(4)}}, {{Key: "_id", Value: int32(5)}}}, results)
+}
+
+func TestDensify(t *testing.T) {
+	coffee := []bson.D{
+		{{Key: "altitude", Value: int32(600)}, {Key: "variety", Value: "Arabica"}},
+		{{Key: "altitude", Value: int32(750)}, {Key: "variety", Value: "Arabica"}},
+		{{Key: "altitude", Value: int32(950)}, {Key: "variety", Value: "Arabica"}},
+		{{Key: "altitude", Value: int32(1250)}, {Key: "variety", Value: "Gesha"}},
+		{{Key: "altitude", Value: int32(1700)}, {Key: "variety", Value: "Gesha"}},
+		{{Key: "variety", Value: "Gesha"}},
+	}
+	altitudes := func(documents []bson.D) map[string][]any {
+		results := map[string][]any{}
+		for _, document := range documents {
+			variety := lookupField(document, "variety").(string)
+			results[variety] = append(results[variety], lookupField(document, "altitude"))
+		}
+		return results
+	}
+
+	cases := []struct {
+		Name     string
+		Range    bson.M
+		Expected map[string][]any
+	}{
+		{
+			"full",
+			bson.M{"step": 200, "bounds": "full"},
+			map[string][]any{
+				"Arabica": {int32(600), int32(750), int32(800), int32(950), int32(1000), int32(1200), int32(1400), int32(1600)},
+				"Gesha":   {expr.Missing, int32(600), int32(800), int32(1000), int32(1200), int32(1250), int32(1400), int32(1600), int32(1700)},
+			},
+		},
+		{
+			"partition",
+			bson.M{"step": 200, "bounds": "partition"},
+			map[string][]any{
+				"Arabica": {int32(600), int32(750), int32(800), int32(950)},
+				"Gesha":   {expr.Missing, int32(1250), int32(1450), int32(1650), int32(1700)},
+			},
+		},
+		{
+			"explicit",
+			bson.M{"step": 250, "bounds": bson.A{700, 1200}},
+			map[string][]any{
+				"Arabica": {int32(600), int32(700), int32(750), int32(950)},
+				"Gesha":   {expr.Missing, int32(700), int32(950), int32(1250), int32(1700)},
+			},
+		},
+		{
+			"fractional step",
+			bson.M{"step": 0.5, "bounds": bson.A{599, 600}},
+			map[string][]any{
+				"Arabica": {int32(599), 599.5, int32(600), int32(750), int32(950)},
+				"Gesha":   {expr.Missing, int32(599), 599.5, int32(1250), int32(1700)},
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pipeline, err := Compile(bson.A{bson.M{"$densify": bson.M{"field": "altitude", "partitionByFields": bson.A{"variety"}, "range": testCase.Range}}})
+			NoError(t, err)
+			results, err := pipeline.Run(coffee)
+			NoError(t, err)
+			Equal(t, testCase.Expected, altitudes(results))
+		})
+	}
+
+	start := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC)
+	pipeline, err := Compile(bson.A{bson.M{"$densify": bson.M{"field": "date", "range": bson.M{"step": 1, "unit": "month", "bounds": "full"}}}})
+	NoError(t, err)
+	results, err := pipeline.Run([]bson.D{
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(end)}},
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(start)}},
+	})
+	NoError(t, err)
+	Equal(t, []bson.D{
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(start)}},
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC))}},
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(time.Date(2024, 3, 29, 0, 0, 0, 0, time.UTC))}},
+		{{Key: "date", Value: primitive.NewDateTimeFromTime(end)}},
+	}, results)
+}
+
+func TestFill(t *testing.T) {
+	readings := []bson.D{
+		{{Key: "_id", Value: int32(1)}, {Key: "sensor", Value: "a"}, {Key: "hour", Value: int32(1)}, {Key: "temperature", Value: 10.0}},
+		{{Key: "_id", Value: int32(3)}, {Key: "sensor", Value: "a"}, {Key: "hour", Value: int32(4)}, {Key: "temperature", Value: nil}},
+		{{Key: "_id", Value: int32(2)}, {Key: "sensor", Value: "a"}, {Key: "hour", Value: int32(2)}},
+		{{Key: "_id", Value: int32(4)}, {Key: "sensor", Value: "a"}, {Key: "hour", Value: int32(5)}, {Key: "temperature", Value: 18.0}, {Key: "unit", Value: "F"}},
+		{{Key: "_id", Value: int32(5)}, {Key: "sensor", Value: "b"}, {Key: "hour", Value: int32(1)}},
+	}
+
+	cases := []struct {
+		Name     string
+		Spec     bson.M
+		Expected [][]any
+	}{
+		{
+			"linear",
+			bson.M{"partitionByFields": bson.A{"sensor"}, "sortBy": bson.M{"hour": 1}, "output": bson.M{"temperature": bson.M{"method": "linear"}}},
+			[][]any{{int32(1), 10.0}, {int32(2), 12.0}, {int32(3), 16.0}, {int32(4), 18.0}, {int32(5), nil}},
+		},
+		{
+			"locf",
+			bson.M{"partitionBy": "$sensor", "sortBy": bson.M{"hour": 1}, "output": bson.M{"temperature": bson.M{"method": "locf"}}},
+			[][]any{{int32(1), 10.0}, {int32(2), 10.0}, {int32(3), 10.0}, {int32(4), 18.0}, {int32(5), nil}},
+		},
+		{
+			"value",
+			bson.M{"output": bson.M{"unit": bson.M{"value": "C"}}},
+			[][]any{{int32(1), "C"}, {int32(3), "C"}, {int32(2), "C"}, {int32(4), "F"}, {int32(5), "C"}},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pipeline, err := Compile(bson.A{bson.M{"$fill": testCase.Spec}})
+			NoError(t, err)
+			results, err := pipeline.Run(readings)
+			NoError(t, err)
+
+			output := testCase.Spec["output"].(bson.M)
+			var field string
+			for name := range output {
+				field = name
+			}
+			values := [][]any{}
+			for _, result := range results {
+				values = append(values, []any{lookupField(result, "_id"), lookupField(result, field)})
+			}
+			Equal(t, testCase.Expected, values)
+		})
+	}
+}
+
+func TestBucketAuto(t *testing.T) {
+	documents := []bson.D{}
+	for idx := 10; idx >= 1; idx-- {
+		documents = append(documents, bson.D{{Key: "_id", Value: int32(idx)}, {Key: "price", Value: int32(idx)}})
+	}
+	bucket := func(min any, max any, count int32) bson.D {
+		return bson.D{{Key: "_id", Value: bson.D{{Key: "min", Value: min}, {Key: "max", Value: max}}}, {Key: "count", Value: count}}
+	}
+
+	cases := []struct {
+		Name     string
+		Spec     bson.M
+		Expected []bson.D
+	}{
+		{
+			"without granularity",
+			bson.M{"groupBy": "$price", "buckets": 3},
+			[]bson.D{bucket(int32(1), int32(4), 3), bucket(int32(4), int32(7), 3), bucket(int32(7), int32(10), 4)},
+		},
+		{
+			"more buckets than values",
+			bson.M{"groupBy": bson.M{"$cond": bson.A{bson.M{"$lte": bson.A{"$price", 5}}, "low", "high"}}, "buckets": 5},
+			[]bson.D{bucket("high", "low", 5), bucket("low", "low", 5)},
+		},
+		{
+			"R5 granularity",
+			bson.M{"groupBy": "$price", "buckets": 3, "granularity": "R5"},
+			[]bson.D{bucket(0.63, 4.0, 3), bucket(4.0, 6.3, 3), bucket(6.3, 16.0, 4)},
+		},
+		{
+			"POWERSOF2 granularity",
+			bson.M{"groupBy": "$price", "buckets": 3, "granularity": "POWERSOF2"},
+			[]bson.D{bucket(0.5, int32(4), 3), bucket(int32(4), int32(8), 4), bucket(int32(8), int32(16), 3)},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			pipeline, err := Compile(bson.A{bson.M{"$bucketAuto": testCase.Spec}})
+			NoError(t, err)
+			results, err := pipeline.Run(documents)
+			NoError(t, err)
+			Equal(t, testCase.Expected, results)
+		})
+	}
+
+	pipeline, err := Compile(bson.A{bson.M{"$bucketAuto": bson.M{"groupBy": "$name", "buckets": 2, "granularity": "E12"}}})
+	NoError(t, err)
+	_, err = pipeline.Run(documents)
+	EqualError(t, err, "$bucketAuto can specify a 'granularity' with numeric boundaries only, but found a value with type: null (at stage 0, $bucketAuto)")
+}
+
+func TestRunErrors(t *testing.T) {
+	pipeline, err := Compile(bson.A{bson.M{"$bucket": bson.M{"groupBy": "$price", "boundaries": bson.A{0, 2}}}})
+	NoError(t, err)
+	_, err = pipeline.Run(testDocuments())
+	EqualError(t, err, "$switch could not find a matching branch for an input, and no default was specified. (at stage 0, $bucket)")
+	ErrorIs(t, err, ErrBadValue)
+
+	pipeline, err = Compile(bson.A{bson.M{"$replaceRoot": bson.M{"newRoot": "$supplier"}}})
+	NoError(t, err)
+	_, err = pipeline.Run(testDocuments())
+	EqualError(t, err, "'newRoot' expression must evaluate to an object, but resulting value was: MISSING. Type of resulting value: 'missing'. (at stage 0, $replaceRoot)")
+	ErrorIs(t, err, ErrBadValue)
+
+	pipeline, err = Compile(bson.A{bson.M{"$replaceWith": "$item"}})
+	NoError(t, err)
+	_, err = pipeline.Run(testDocuments())
+	EqualError(t, err, "'replacement document' must evaluate to an object, but resulting value was: apple. Type of resulting value: 'string'. (at stage 0, $replaceWith)")
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Pipeline any
+		Err      error
+		Message  string
+	}{
+		{"pipeline is a document", bson.M{"$match": bson.M{}}, ErrBadValue, "pipeline must be an array of stages"},
+		{"stage with two fields", bson.A{bson.M{"$match": bson.M{}, "$limit": 1}}, ErrBadValue, "A pipeline stage specification object must contain exactly one field. (at stage 0, )"},
+		{"unknown stage", bson.A{bson.M{"$match": bson.M{}}, bson.M{"$foo": 1}}, ErrUnknownStage, "Unrecognized pipeline stage name: '$foo' (at stage 1, $foo)"},
+		{"unsupported stage", bson.A{bson.M{"$changeStream": bson.M{}}}, ErrNotSupported, "$changeStream is not supported by mongomock (at stage 0, $changeStream)"},
+		{"$match with $near", bson.A{bson.M{"$match": bson.M{"loc": bson.M{"$near": bson.A{1, 2}}}}}, ErrBadValue, "$geoNear, $near, and $nearSphere are not allowed in this context (at stage 0, $match)"},
+		{"$match with $text", bson.A{bson.M{"$match": bson.M{"$text": bson.M{"$search": "a"}}}}, ErrBadValue, "$match with $text is only allowed as the first pipeline stage (at stage 0, $match)"},
+		{"empty $project", bson.A{bson.M{"$project": bson.M{}}}, ErrBadValue, "Invalid $project :: caused by :: projection specification must have at least one field (at stage 0, $project)"},
+		{"$project mixing inclusion and exclusion", bson.A{bson.M{"$project": bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 0}}}}, ErrBadValue, "Invalid $project :: caused by :: Cannot do exclusion on field b in inclusion projection (at stage 0, $project)"},
+		{"$project mixing exclusion and inclusion", bson.A{bson.M{"$project": bson.D{{Key: "a", Value: 0}, {Key: "b", Value: 1}}}}, ErrBadValue, "Invalid $project :: caused by :: Cannot do inclusion on field b in exclusion projection (at stage 0, $project)"},
+		{"$project computed field in exclusion", bson.A{bson.M{"$project": bson.D{{Key: "a", Value: 0}, {Key: "b", Value: "$c"}}}}, ErrBadValue, "Invalid $project :: caused by :: Cannot use expression other than $meta in exclusion projection (at stage 0, $project)"},
+		{"$project path collision", bson.A{bson.M{"$project": bson.D{{Key: "a", Value: 1}, {Key: "a.b", Value: 1}}}}, ErrBadValue, "Invalid $project :: caused by :: Path collision at a.b (at stage 0, $project)"},
+		{"$project empty sub projection", bson.A{bson.M{"$project": bson.M{"a": bson.M{}}}}, ErrBadValue, "Invalid $project :: caused by :: An empty sub-projection is not a valid value. Found empty object at path a (at stage 0, $project)"},
+		{"$project unknown expression", bson.A{bson.M{"$project": bson.M{"a": bson.M{"$foo": 1}}}}, expr.ErrUnknownOperator, "Unrecognized expression '$foo' (at $foo) (at stage 0, $project)"},
+		{"$addFields not a document", bson.A{bson.M{"$addFields": "a"}}, ErrBadValue, "$addFields specification stage must be an object (at stage 0, $addFields)"},
+		{"$set field starting with $", bson.A{bson.M{"$set": bson.M{"a.$b": 1}}}, ErrBadValue, "FieldPath field names may not start with '$'. Consider using $getField or $setField. (at stage 0, $set)"},
+		{"$unset number", bson.A{bson.M{"$unset": 1}}, ErrBadValue, "$unset specification must be a string or an array (at stage 0, $unset)"},
+		{"$unset array with number", bson.A{bson.M{"$unset": bson.A{"a", 1}}}, ErrBadValue, "$unset specification must be a string or an array containing only string values (at stage 0, $unset)"},
+		{"$group without _id", bson.A{bson.M{"$group": bson.M{"total": bson.M{"$sum": 1}}}}, ErrBadValue, "a group specification must specify an _id (at stage 0, $group)"},
+		{"$group _id field with dot", bson.A{bson.M{"$group": bson.M{"_id": bson.M{"a.b": "$a"}}}}, ErrBadValue, "FieldPath field names may not contain '.' (at stage 0, $group)"},
+		{"$group field with dot", bson.A{bson.M{"$group": bson.M{"_id": nil, "a.b": bson.M{"$sum": 1}}}}, ErrBadValue, "The field name 'a.b' cannot contain '.' (at stage 0, $group)"},
+		{"$group unknown accumulator", bson.A{bson.M{"$group": bson.M{"_id": nil, "a": bson.M{"$foo": 1}}}}, expr.ErrUnknownOperator, "unknown group operator '$foo' (at a.$foo) (at stage 0, $group)"},
+		{"$group field without accumulator", bson.A{bson.M{"$group": bson.M{"_id": nil, "a": 1}}}, expr.ErrBadValue, "The field 'a' must be an accumulator object (at a) (at stage 0, $group)"},
+		{"$sort without keys", bson.A{bson.M{"$sort": bson.M{}}}, ErrBadValue, "$sort stage must have at least one sort key (at stage 0, $sort)"},
+		{"$sort invalid direction", bson.A{bson.M{"$sort": bson.M{"a": 2}}}, ErrBadValue, "$sort key ordering must be 1 (for ascending) or -1 (for descending) (at stage 0, $sort)"},
+		{"$limit zero", bson.A{bson.M{"$limit": 0}}, ErrBadValue, "the limit must be positive (at stage 0, $limit)"},
+		{"$limit string", bson.A{bson.M{"$limit": "1"}}, ErrBadValue, "invalid argument to $limit stage: Expected a number (at stage 0, $limit)"},
+		{"$limit fraction", bson.A{bson.M{"$limit": 1.5}}, ErrBadValue, "invalid argument to $limit stage: Cannot represent as a 64-bit integer: 1.5 (at stage 0, $limit)"},
+		{"$skip negative", bson.A{bson.M{"$skip": -1}}, ErrBadValue, "invalid argument to $skip stage: Expected a non-negative number in: $skip: -1 (at stage 0, $skip)"},
+		{"$count empty", bson.A{bson.M{"$count": ""}}, ErrBadValue, "the count field must be a non-empty string (at stage 0, $count)"},
+		{"$count with dot", bson.A{bson.M{"$count": "a.b"}}, ErrBadValue, "the count field cannot contain '.' (at stage 0, $count)"},
+		{"$match with invalid $expr", bson.A{bson.M{"$match": bson.M{"$or": bson.A{bson.M{"$expr": bson.M{"$foo": 1}}}}}}, expr.ErrUnknownOperator, "Unrecognized expression '$foo' (at $foo) (at stage 0, $match)"},
+		{"$lookup without as", bson.A{bson.M{"$lookup": bson.M{"from": "a", "localField": "a", "foreignField": "b"}}}, ErrBadValue, "must specify 'as' field for a $lookup (at stage 0, $lookup)"},
+		{"$lookup without foreignField", bson.A{bson.M{"$lookup": bson.M{"from": "a", "localField": "a", "as": "b"}}}, ErrBadValue, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified (at stage 0, $lookup)"},
+		{"$lookup let without pipeline", bson.A{bson.M{"$lookup": bson.M{"from": "a", "let": bson.M{"a": 1}, "localField": "a", "foreignField": "b", "as": "b"}}}, ErrBadValue, "$lookup with 'let' must also specify 'pipeline' (at stage 0, $lookup)"},
+		{"$lookup unknown argument", bson.A{bson.M{"$lookup": bson.M{"from": "a", "foo": 1}}}, ErrBadValue, "unknown argument to $lookup: foo (at stage 0, $lookup)"},
+		{"$lookup pipeline error", bson.A{bson.M{"$lookup": bson.M{"from": "a", "pipeline": bson.A{bson.M{"$limit": 0}}, "as": "b"}}}, ErrBadValue, "the limit must be positive (at stage 0, $limit) (at stage 0, $lookup)"},
+		{"$lookup undefined variable", bson.A{bson.M{"$lookup": bson.M{"from": "a", "pipeline": bson.A{bson.M{"$match": bson.M{"$expr": "$$a"}}}, "as": "b"}}}, expr.ErrBadValue, "Use of undefined variable: a (at stage 0, $match) (at stage 0, $lookup)"},
+		{"$unwind path without $", bson.A{bson.M{"$unwind": "tags"}}, ErrBadValue, "path option to $unwind stage should be prefixed with a '$': tags (at stage 0, $unwind)"},
+		{"$unwind without path", bson.A{bson.M{"$unwind": bson.M{"includeArrayIndex": "idx"}}}, ErrBadValue, "no path specified to $unwind stage (at stage 0, $unwind)"},
+		{"$unwind index with $", bson.A{bson.M{"$unwind": bson.M{"path": "$a", "includeArrayIndex": "$idx"}}}, ErrBadValue, "includeArrayIndex option to $unwind stage should not be prefixed with a '$': $idx (at stage 0, $unwind)"},
+		{"$unwind unknown option", bson.A{bson.M{"$unwind": bson.M{"path": "$a", "foo": 1}}}, ErrBadValue, "unrecognized option to $unwind stage: foo (at stage 0, $unwind)"},
+		{"$replaceRoot without newRoot", bson.A{bson.M{"$replaceRoot": bson.M{}}}, ErrBadValue, "no newRoot specified for the $replaceRoot stage (at stage 0, $replaceRoot)"},
+		{"$replaceRoot unknown option", bson.A{bson.M{"$replaceRoot": bson.M{"root": "$a"}}}, ErrBadValue, "unrecognized option to $replaceRoot stage: root, only valid option is 'newRoot'. (at stage 0, $replaceRoot)"},
+		{"$sortByCount field name", bson.A{bson.M{"$sortByCount": "category"}}, ErrBadValue, "the sortByCount field must be defined as a $-prefixed path or an expression inside an object (at stage 0, $sortByCount)"},
+		{"$sample without size", bson.A{bson.M{"$sample": bson.M{}}}, ErrBadValue, "$sample stage must specify a size (at stage 0, $sample)"},
+		{"$sample negative size", bson.A{bson.M{"$sample": bson.M{"size": -1}}}, ErrBadValue, "size argument to $sample must not be negative (at stage 0, $sample)"},
+		{"$unionWith without coll", bson.A{bson.M{"$unionWith": bson.M{"pipeline": bson.A{}}}}, ErrBadValue, "must specify 'coll' field for a $unionWith (at stage 0, $unionWith)"},
+		{"$facet empty", bson.A{bson.M{"$facet": bson.M{}}}, ErrBadValue, "the $facet specification must be a non-empty object (at stage 0, $facet)"},
+		{"$facet not an array", bson.A{bson.M{"$facet": bson.M{"a": 1}}}, ErrBadValue, "arguments to $facet must be arrays, a is type int (at stage 0, $facet)"},
+		{"$facet within $facet", bson.A{bson.M{"$facet": bson.M{"a": bson.A{bson.M{"$facet": bson.M{}}}}}}, ErrBadValue, "$facet is not allowed to be used within a $facet stage (at stage 0, $facet)"},
+		{"$bucket without boundaries", bson.A{bson.M{"$bucket": bson.M{"groupBy": "$a"}}}, ErrBadValue, "$bucket requires 'groupBy' and 'boundaries' to be specified. (at stage 0, $bucket)"},
+		{"$bucket one boundary", bson.A{bson.M{"$bucket": bson.M{"groupBy": "$a", "boundaries": bson.A{1}}}}, ErrBadValue, "The $bucket 'boundaries' field must have at least 2 values, but found 1 value(s). (at stage 0, $bucket)"},
+		{"$bucket mixed boundaries", bson.A{bson.M{"$bucket": bson.M{"groupBy": "$a", "boundaries": bson.A{1, "b"}}}}, ErrBadValue, "All values in the the 'boundaries' option to $bucket must have the same type. Found conflicting types int and string. (at stage 0, $bucket)"},
+		{"$bucket unsorted boundaries", bson.A{bson.M{"$bucket": bson.M{"groupBy": "$a", "boundaries": bson.A{2, 1.5}}}}, ErrBadValue, "The 'boundaries' option to $bucket must be sorted in ascending order, but elements 0 and 1 are not in ascending order (2 is not less than 1.5). (at stage 0, $bucket)"},
+		{"$bucket default within boundaries", bson.A{bson.M{"$bucket": bson.M{"groupBy": "$a", "boundaries": bson.A{1, 3}, "default": 2}}}, ErrBadValue, "The $bucket 'default' field must be less than the lowest boundary or greater than or equal to the highest boundary. (at stage 0, $bucket)"},
+		{"$bucket groupBy without $", bson.A{bson.M{"$bucket": bson.M{"groupBy": "a", "boundaries": bson.A{1, 3}}}}, ErrBadValue, "The $bucket 'groupBy' field must be defined as a $-prefixed path or an expression object, but found: a. (at stage 0, $bucket)"},
+		{"$bucketAuto zero buckets", bson.A{bson.M{"$bucketAuto": bson.M{"groupBy": "$a", "buckets": 0}}}, ErrBadValue, "The $bucketAuto 'buckets' field must be greater than 0, but found: 0. (at stage 0, $bucketAuto)"},
+		{"$bucketAuto unknown granularity", bson.A{bson.M{"$bucketAuto": bson.M{"groupBy": "$a", "buckets": 2, "granularity": "R7"}}}, ErrBadValue, "Rounding granularity not recognized: R7 (at stage 0, $bucketAuto)"},
+		{"$graphLookup without startWith", bson.A{bson.M{"$graphLookup": bson.M{"from": "a", "as": "a", "connectFromField": "a", "connectToField": "b"}}}, ErrBadValue, "missing 'startWith' option to $graphLookup stage specification (at stage 0, $graphLookup)"},
+		{"$graphLookup negative maxDepth", bson.A{bson.M{"$graphLookup": bson.M{"maxDepth": -1}}}, ErrBadValue, "maxDepth requires a nonnegative argument, found: -1 (at stage 0, $graphLookup)"},
+		{"$graphLookup fractional maxDepth", bson.A{bson.M{"$graphLookup": bson.M{"maxDepth": 1.5}}}, ErrBadValue, "maxDepth could not be represented as a long long: 1.5 (at stage 0, $graphLookup)"},
+		{"$graphLookup unknown argument", bson.A{bson.M{"$graphLookup": bson.M{"foo": 1}}}, ErrBadValue, "Unknown argument to $graphLookup: foo (at stage 0, $graphLookup)"},
+		{"$setWindowFields without output", bson.A{bson.M{"$setWindowFields": bson.M{"partitionBy": "$a"}}}, ErrBadValue, "BSON field '$setWindowFields.output' is missing but a required field (at stage 0, $setWindowFields)"},
+		{"$setWindowFields unknown function", bson.A{bson.M{"$setWindowFields": bson.M{"output": bson.M{"a": bson.M{"$foo": 1}}}}}, ErrBadValue, "Unrecognized window function, $foo (at stage 0, $setWindowFields)"},
+		{"$setWindowFields rank without sortBy", bson.A{bson.M{"$setWindowFields": bson.M{"output": bson.M{"a": bson.M{"$rank": bson.M{}}}}}}, ErrBadValue, "$rank must be specified with a top level sortBy expression with exactly one element (at stage 0, $setWindowFields)"},
+		{"$setWindowFields documents without sortBy", bson.A{bson.M{"$setWindowFields": bson.M{"output": bson.M{"a": bson.M{"$sum": 1, "window": bson.M{"documents": bson.A{-1, 1}}}}}}}, ErrBadValue, "Document-based bounds require a sortBy (at stage 0, $setWindowFields)"},
+		{"$setWindowFields bounds in wrong order", bson.A{bson.M{"$setWindowFields": bson.M{"sortBy": bson.M{"a": 1}, "output": bson.M{"a": bson.M{"$sum": 1, "window": bson.M{"documents": bson.A{1, -1}}}}}}}, ErrBadValue, "Lower bound must not exceed upper bound: [1 -1] (at stage 0, $setWindowFields)"},
+		{"$setWindowFields derivative without window", bson.A{bson.M{"$setWindowFields": bson.M{"sortBy": bson.M{"a": 1}, "output": bson.M{"a": bson.M{"$derivative": bson.M{"input": "$b"}}}}}}, ErrBadValue, "$derivative requires explicit window bounds (at stage 0, $setWindowFields)"},
+		{"$densify without range", bson.A{bson.M{"$densify": bson.M{"field": "a"}}}, ErrBadValue, "BSON field '$densify.range' is missing but a required field (at stage 0, $densify)"},
+		{"$densify negative step", bson.A{bson.M{"$densify": bson.M{"field": "a", "range": bson.M{"step": -1, "bounds": "full"}}}}, ErrBadValue, "The step parameter in a range statement must be a strictly positive numeric value (at stage 0, $densify)"},
+		{"$densify partition on field", bson.A{bson.M{"$densify": bson.M{"field": "a.b", "partitionByFields": bson.A{"a"}, "range": bson.M{"step": 1, "bounds": "full"}}}}, ErrBadValue, "BSON field '$densify.partitionByFields' contains the field that is being densified (at stage 0, $densify)"},
+		{"$densify dates without unit", bson.A{bson.M{"$densify": bson.M{"field": "a", "range": bson.M{"step": 1, "bounds": bson.A{primitive.DateTime(0), primitive.DateTime(1)}}}}}, ErrBadValue, "A bounding array must contain numeric values if 'unit' is not specified (at stage 0, $densify)"},
+		{"$fill method without sortBy", bson.A{bson.M{"$fill": bson.M{"output": bson.M{"a": bson.M{"method": "locf"}}}}}, ErrBadValue, "sortBy is required if any output field specifies a 'method' (at stage 0, $fill)"},
+		{"$fill unknown method", bson.A{bson.M{"$fill": bson.M{"sortBy": bson.M{"a": 1}, "output": bson.M{"a": bson.M{"method": "spline"}}}}}, ErrBadValue, "Method must be either locf or linear, found spline (at stage 0, $fill)"},
+		{"$out not last", bson.A{bson.M{"$out": "a"}, bson.M{"$limit": 1}}, ErrBadValue, "$out can only be the final stage in the pipeline (at stage 0, $out)"},
+		{"$out to another database", bson.A{bson.M{"$out": bson.M{"db": "b", "coll": "a"}}}, ErrNotSupported, "$out to another database is not supported by mongomock (at stage 0, $out)"},
+		{"$merge within $lookup", bson.A{bson.M{"$lookup": bson.M{"from": "a", "as": "a", "pipeline": bson.A{bson.M{"$merge": "b"}}}}}, ErrBadValue, "$merge is not allowed to be used within a $lookup stage (at stage 0, $merge) (at stage 0, $lookup)"},
+		{"$merge without into", bson.A{bson.M{"$merge": bson.M{"on": "a"}}}, ErrBadValue, "BSON field '$merge.into' is missing but a required field (at stage 0, $merge)"},
+		{"$merge empty on", bson.A{bson.M{"$merge": bson.M{"into": "a", "on": bson.A{}}}}, ErrBadValue, "If explicitly specifying $merge 'on', must include at least one field (at stage 0, $merge)"},
+		{"$merge unknown whenMatched", bson.A{bson.M{"$merge": bson.M{"into": "a", "whenMatched": "update"}}}, ErrBadValue, "Enumeration value 'update' for field '$merge.whenMatched' is not a valid value. (at stage 0, $merge)"},
+		{"$merge let without pipeline", bson.A{bson.M{"$merge": bson.M{"into": "a", "let": bson.M{"a": 1}}}}, ErrBadValue, "Cannot use 'let' variables with 'whenMatched: merge' mode (at stage 0, $merge)"},
+		{"$merge $group in pipeline", bson.A{bson.M{"$merge": bson.M{"into": "a", "whenMatched": bson.A{bson.M{"$group": bson.M{"_id": nil}}}}}}, ErrBadValue, "Unsupported stage in $merge whenMatched pipeline: $group (at stage 0, $merge)"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := Compile(testCase.Pipeline)
+			EqualError(t, err, testCase.Message)
+			ErrorIs(t, err, testCase.Err)
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// bucketOutputT are the compiled output fields of $bucket and $bucketAuto
+type bucketOutputT struct {
+	names        []string
+	accumulators []*expr.Accumulator
+}
+
+// compileBucketOutput compiles the output argument of $bucket and $bucketAuto like {total: {$sum: "$price"}}
+// Without output the buckets only contain a count.
+func compileBucketOutput(value any, hasOutput bool, stage string, variables []string) (*bucketOutputT, error) {
+	if !hasOutput {
+		value = bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}
+	}
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "The %s 'output' field must be an object, but found type: %s.", stage, typeName(value))
+	}
+
+	output := &bucketOutputT{}
+	for _, entry := range spec {
+		accumulator, err := compileGroupField(entry, output.names, variables)
+		if err != nil {
+			return nil, err
+		}
+		output.names = append(output.names, entry.Key)
+		output.accumulators = append(output.accumulators, accumulator)
+	}
+	return output, nil
+}
+
+// compileGroupBy compiles the groupBy argument of $bucket and $bucketAuto, it should be a field path or an expression object
+func compileGroupBy(value any, stage string, variables []string) (*expr.Expression, error) {
+	text, isString := value.(string)
+	_, isDocument := match.ToDocument(value)
+	if !isDocument && !(isString && strings.HasPrefix(text, "$")) {
+		return nil, newStageError(ErrBadValue, "The %s 'groupBy' field must be defined as a $-prefixed path or an expression object, but found: %v.", stage, value)
+	}
+	return expr.CompileWithVariables(value, variables)
+}
+
+// isConstant returns false for values that would be evaluated as an expression, like "$price" or {$add: [1, 2]}
+func isConstant(value any) bool {
+	if text, ok := value.(string); ok {
+		return !strings.HasPrefix(text, "$")
+	}
+	document, ok := match.ToDocument(value)
+	return !ok || len(document) == 0 || !strings.HasPrefix(document[0].Key, "$")
+}
+
+// canonicalType returns the type of a value where all numbers have the same type, like the type order of MongoDB
+func canonicalType(value any) string {
+	name := typeName(value)
+	switch name {
+	case "int", "long", "double", "decimal":
+		return "number"
+	}
+	return name
+}
+
+// compileBucket compiles {$bucket: {groupBy: "$price", boundaries: [0, 10, 100], default: "other", output: {...}}}
+func compileBucket(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "The $bucket stage specification must be an object, but found type: %s.", typeName(value))
+	}
+
+	var groupByValue, boundariesValue, defaultValue, outputValue any
+	hasGroupBy, hasBoundaries, hasDefault, hasOutput := false, false, false, false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "groupBy":
+			groupByValue, hasGroupBy = entry.Value, true
+		case "boundaries":
+			boundariesValue, hasBoundaries = entry.Value, true
+		case "default":
+			defaultValue, hasDefault = expr.Normalize(entry.Value), true
+		case "output":
+			outputValue, hasOutput = entry.Value, true
+		default:
+			return nil, newStageError(ErrBadValue, "Unrecognized option to $bucket: %s.", entry.Key)
+		}
+	}
+	if !hasGroupBy || !hasBoundaries {
+		return nil, newStageError(ErrBadValue, "$bucket requires 'groupBy' and 'boundaries' to be specified.")
+	}
+
+	boundaryValues, ok := match.ToArray(boundariesValue)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "The $bucket 'boundaries' field must be an array, but found type: %s.", typeName(boundariesValue))
+	}
+	if len(boundaryValues) < 2 {
+		return nil, newStageError(ErrBadValue, "The $bucket 'boundaries' field must have at least 2 values, but found %d value(s).", len(boundaryValues))
+	}
+	boundaries := make([]any, len(boundaryValues))
+	for idx, boundary := range boundaryValues {
+		boundary = expr.Normalize(boundary)
+		if !isConstant(boundary) {
+			return nil, newStageError(ErrBadValue, "The $bucket 'boundaries' field must be an array of constant values, but found value: %v.", boundary)
+		}
+		boundaries[idx] = boundary
+		if idx == 0 {
+			continue
+		}
+		previous := boundaries[idx-1]
+		if canonicalType(previous) != canonicalType(boundary) {
+			return nil, newStageError(
+				ErrBadValue,
+				"All values in the the 'boundaries' option to $bucket must have the same type. Found conflicting types %s and %s.",
+				typeName(previous), typeName(boundary),
+			)
+		}
+		if match.Compare(previous, boundary) >= 0 {
+			return nil, newStageError(
+				ErrBadValue,
+				"The 'boundaries' option to $bucket must be sorted in ascending order, but elements %d and %d are not in ascending order (%v is not less than %v).",
+				idx-1, idx, previous, boundary,
+			)
+		}
+	}
+
+	if hasDefault {
+		if !isConstant(defaultValue) {
+			return nil, newStageError(ErrBadValue, "The $bucket 'default' field must be a constant, but found: %v.", defaultValue)
+		}
+		inRange := match.Compare(defaultValue, boundaries[0]) >= 0 && match.Compare(defaultValue, boundaries[len(boundaries)-1]) < 0
+		if canonicalType(defaultValue) == canonicalType(boundaries[0]) && inRange {
+			return nil, newStageError(ErrBadValue, "The $bucket 'default' field must be less than the lowest boundary or greater than or equal to the highest boundary.")
+		}
+	}
+
+	groupBy, err := compileGroupBy(groupByValue, "$bucket", variables)
+	if err != nil {
+		return nil, err
+	}
+	output, err := compileBucketOutput(outputValue, hasOutput, "$bucket", variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		groups := make([]*groupT, len(boundaries)-1)
+		var defaultGroup *groupT
+		for _, document := range documents {
+			value, err := groupBy.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if value == expr.Missing {
+				value = nil
+			}
+
+			// The index of the first boundary larger than the value, the value belongs in the bucket before it
+			upperIdx := sort.Search(len(boundaries), func(idx int) bool {
+				return match.Compare(boundaries[idx], value) > 0
+			})
+
+			var group *groupT
+			switch {
+			case upperIdx > 0 && upperIdx < len(boundaries):
+				if groups[upperIdx-1] == nil {
+					groups[upperIdx-1] = &groupT{id: boundaries[upperIdx-1], accumulators: newAccumulations(output.accumulators, run.variables)}
+				}
+				group = groups[upperIdx-1]
+			case hasDefault:
+				if defaultGroup == nil {
+					defaultGroup = &groupT{id: defaultValue, accumulators: newAccumulations(output.accumulators, run.variables)}
+				}
+				group = defaultGroup
+			default:
+				// MongoDB runs $bucket as a $group with a $switch, hence the error
+				return nil, newStageError(ErrBadValue, "$switch could not find a matching branch for an input, and no default was specified.")
+			}
+
+			err = group.add(document)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		results := []bson.D{}
+		for _, group := range groups {
+			if group != nil {
+				results = append(results, group.result(output.names))
+			}
+		}
+		if defaultGroup != nil {
+			if match.Compare(defaultValue, boundaries[0]) < 0 {
+				results = append([]bson.D{defaultGroup.result(output.names)}, results...)
+			} else {
+				results = append(results, defaultGroup.result(output.names))
+			}
+		}
+		return results, nil
+	}, nil
+}
+
+// compileBucketAuto compiles {$bucketAuto: {groupBy: "$price", buckets: 5, granularity: "R5", output: {...}}}
+func compileBucketAuto(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "The $bucketAuto stage specification must be an object, but found type: %s.", typeName(value))
+	}
+
+	var groupByValue, outputValue any
+	hasGroupBy, hasOutput := false, false
+	buckets := int64(0)
+	var rounder *granularityT
+	for _, entry := range spec {
+		switch entry.Key {
+		case "groupBy":
+			groupByValue, hasGroupBy = entry.Value, true
+		case "buckets":
+			number := expr.Normalize(entry.Value)
+			switch typedNumber := number.(type) {
+			case int32:
+				buckets = int64(typedNumber)
+			case int64:
+				buckets = typedNumber
+			case float64:
+				if typedNumber != math.Trunc(typedNumber) {
+					return nil, newStageError(ErrBadValue, "The $bucketAuto 'buckets' field must be representable as a 32-bit integer, but found %v.", typedNumber)
+				}
+				buckets = int64(typedNumber)
+			default:
+				return nil, newStageError(ErrBadValue, "The $bucketAuto 'buckets' field must be a numeric value, but found type: %s.", typeName(number))
+			}
+			if buckets > math.MaxInt32 {
+				return nil, newStageError(ErrBadValue, "The $bucketAuto 'buckets' field must be representable as a 32-bit integer, but found %d.", buckets)
+			}
+			if buckets <= 0 {
+				return nil, newStageError(ErrBadValue, "The $bucketAuto 'buckets' field must be greater than 0, but found: %d.", buckets)
+			}
+		case "granularity":
+			name, ok := entry.Value.(string)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "The $bucketAuto 'granularity' field must be a string, but found type: %s.", typeName(entry.Value))
+			}
+			rounder, ok = granularities[name]
+			if !ok {
+				return nil, newStageError(ErrBadValue, "Rounding granularity not recognized: %s", name)
+			}
+		case "output":
+			outputValue, hasOutput = entry.Value, true
+		default:
+			return nil, newStageError(ErrBadValue, "Unrecognized option to $bucketAuto: %s.", entry.Key)
+		}
+	}
+	if !hasGroupBy || buckets == 0 {
+		return nil, newStageError(ErrBadValue, "$bucketAuto requires 'groupBy' and 'buckets' to be specified")
+	}
+
+	groupBy, err := compileGroupBy(groupByValue, "$bucketAuto", variables)
+	if err != nil {
+		return nil, err
+	}
+	output, err := compileBucketOutput(outputValue, hasOutput, "$bucketAuto", variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		values := make([]any, len(documents))
+		for idx, document := range documents {
+			value, err := groupBy.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if value == expr.Missing {
+				value = nil
+			}
+			if rounder != nil {
+				err = rounder.validate(value)
+				if err != nil {
+					return nil, err
+				}
+			}
+			values[idx] = value
+		}
+
+		order := make([]int, len(documents))
+		for idx := range order {
+			order[idx] = idx
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return match.Compare(values[order[i]], values[order[j]]) < 0
+		})
+
+		autoBuckets, err := fillAutoBuckets(documents, values, order, int(buckets), rounder, output, run)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]bson.D, len(autoBuckets))
+		for idx, bucket := range autoBuckets {
+			bucket.group.id = bson.D{{Key: "min", Value: bucket.min}, {Key: "max", Value: bucket.max}}
+			results[idx] = bucket.group.result(output.names)
+		}
+		return results, nil
+	}, nil
+}
+
+// autoBucketT is a bucket of $bucketAuto
+type autoBucketT struct {
+	min   any
+	max   any
+	group *groupT
+}
+
+// fillAutoBuckets divides the documents in the order of their groupBy values over the buckets like MongoDB
+// Every bucket gets about the same number of documents, but documents with the same value are always in the same bucket.
+// With a granularity the boundaries are rounded to the numbers in its series.
+func fillAutoBuckets(documents []bson.D, values []any, order []int, buckets int, rounder *granularityT, output *bucketOutputT, run *runT) ([]*autoBucketT, error) {
+	size := int(math.Round(float64(len(documents)) / float64(buckets)))
+	if size < 1 {
+		size = 1
+	}
+
+	results := []*autoBucketT{}
+	next := 0
+	for bucketIdx := 0; bucketIdx < buckets && next < len(order); bucketIdx++ {
+		isLast := bucketIdx == buckets-1
+		bucket := &autoBucketT{min: values[order[next]], group: &groupT{accumulators: newAccumulations(output.accumulators, run.variables)}}
+		add := func() error {
+			bucket.max = values[order[next]]
+			err := bucket.group.add(documents[order[next]])
+			next++
+			return err
+		}
+
+		for count := 0; (isLast || count < size) && next < len(order); count++ {
+			err := add()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !isLast && next < len(order) {
+			if rounder != nil {
+				boundary := rounder.roundUp(bucket.max)
+				for next < len(order) && match.Compare(values[order[next]], boundary) < 0 {
+					err := add()
+					if err != nil {
+						return nil, err
+					}
+				}
+				bucket.max = boundary
+			} else {
+				for next < len(order) && match.Compare(values[order[next]], bucket.max) == 0 {
+					err := add()
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		if len(results) > 0 {
+			previous := results[len(results)-1]
+			if rounder != nil {
+				bucket.min = previous.max
+			} else {
+				previous.max = bucket.min
+			}
+		}
+		results = append(results, bucket)
+	}
+
+	if rounder != nil && len(results) > 0 {
+		results[0].min = rounder.roundDown(results[0].min)
+		results[len(results)-1].max = rounder.roundUp(results[len(results)-1].max)
+	}
+	return results, nil
+}
@@ -0,0 +1,54 @@
+package aggregate
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// unitMilliseconds are the lengths of the time units that have a fixed length
+var unitMilliseconds = map[string]int64{
+	"millisecond": 1,
+	"second":      1000,
+	"minute":      60 * 1000,
+	"hour":        60 * 60 * 1000,
+	"day":         24 * 60 * 60 * 1000,
+	"week":        7 * 24 * 60 * 60 * 1000,
+}
+
+// unitMonths are the lengths of the time units that are a number of months
+var unitMonths = map[string]int64{
+	"month":   1,
+	"quarter": 3,
+	"year":    12,
+}
+
+func isTimeUnit(unit string) bool {
+	_, fixed := unitMilliseconds[unit]
+	_, months := unitMonths[unit]
+	return fixed || months
+}
+
+// addTimeUnits adds an amount of a unit like "month" to a date in UTC
+// Like $dateAdd a day that doesn't exist in the resulting month becomes the last day of that month.
+func addTimeUnits(date primitive.DateTime, amount int64, unit string) primitive.DateTime {
+	if milliseconds, ok := unitMilliseconds[unit]; ok {
+		return date + primitive.DateTime(amount*milliseconds)
+	}
+
+	value := date.Time().UTC()
+	months := int64(value.Month()-1) + amount*unitMonths[unit]
+	year := int64(value.Year()) + months/12
+	month := months % 12
+	if month < 0 {
+		month += 12
+		year--
+	}
+	day := value.Day()
+	lastDay := time.Date(int(year), time.Month(month+2), 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	result := time.Date(int(year), time.Month(month+1), day, value.Hour(), value.Minute(), value.Second(), value.Nanosecond(), time.UTC)
+	return primitive.NewDateTimeFromTime(result)
+}
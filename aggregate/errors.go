@@ -0,0 +1,69 @@
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownStage is returned if a pipeline contains a stage that does not exist
+	ErrUnknownStage = errors.New("unknown stage")
+	// ErrBadValue is returned if the specification of a stage is invalid, like {$limit: -1}
+	ErrBadValue = errors.New("bad value")
+	// ErrNotSupported is returned for valid MongoDB stages that are not supported by mongomock
+	ErrNotSupported = errors.New("stage not supported")
+	// ErrWriteFailed is returned if $out or $merge could not write the documents, like $merge with {whenNotMatched: "fail"}
+	ErrWriteFailed = errors.New("write failed")
+)
+
+// StageError describes why a stage of a pipeline is invalid or failed
+// It wraps one of ErrUnknownStage, ErrBadValue, ErrNotSupported, ErrWriteFailed or the error of an expression within the stage
+type StageError struct {
+	// Index is the index of the stage within the pipeline
+	Index int
+	// Stage is the name of the stage like "$group"
+	Stage string
+	// Message is the error message MongoDB would have returned
+	Message string
+	// Err is the kind of error
+	Err error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s (at stage %d, %s)", e.Message, e.Index, e.Stage)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// stageErrorT is an error of a stage that does not know its position within the pipeline yet
+type stageErrorT struct {
+	message string
+	err     error
+}
+
+func (e *stageErrorT) Error() string {
+	return e.message
+}
+
+func (e *stageErrorT) Unwrap() error {
+	return e.err
+}
+
+func newStageError(err error, format string, args ...any) error {
+	return &stageErrorT{message: fmt.Sprintf(format, args...), err: err}
+}
+
+// wrapStageError adds the position of the stage to an error
+func wrapStageError(err error, index int, stage string) error {
+	if err == nil {
+		return nil
+	}
+
+	var stageErr *stageErrorT
+	if errors.As(err, &stageErr) {
+		return &StageError{Index: index, Stage: stage, Message: stageErr.message, Err: stageErr.err}
+	}
+	return &StageError{Index: index, Stage: stage, Message: err.Error(), Err: err}
+}
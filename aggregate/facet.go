@@ -0,0 +1,79 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// facetNotAllowedStages are the stages that can't be used within the pipelines of $facet
+var facetNotAllowedStages = map[string]bool{
+	"$changeStream":   true,
+	"$collStats":      true,
+	"$documents":      true,
+	"$facet":          true,
+	"$geoNear":        true,
+	"$indexStats":     true,
+	"$merge":          true,
+	"$out":            true,
+	"$planCacheStats": true,
+	"$search":         true,
+}
+
+// compileFacet compiles {$facet: {byCategory: [{$sortByCount: "$category"}], count: [{$count: "total"}]}}
+// Every pipeline runs over the same input documents, the result is a single document with the output of every pipeline.
+func compileFacet(value any, compiler *compilerT) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok || len(spec) == 0 {
+		return nil, newStageError(ErrBadValue, "the $facet specification must be a non-empty object")
+	}
+
+	names := make([]string, len(spec))
+	pipelines := make([]*Pipeline, len(spec))
+	for idx, entry := range spec {
+		switch {
+		case entry.Key == "":
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not be empty strings.")
+		case strings.HasPrefix(entry.Key, "$"):
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not start with '$'. Consider using $getField or $setField.")
+		case strings.Contains(entry.Key, "."):
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not contain '.'.")
+		}
+
+		if _, ok := match.ToArray(entry.Value); !ok {
+			return nil, newStageError(ErrBadValue, "arguments to $facet must be arrays, %s is type %s", entry.Key, typeName(entry.Value))
+		}
+		stages, err := Parse(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range stages {
+			if facetNotAllowedStages[stage[0].Key] {
+				return nil, newStageError(ErrBadValue, "%s is not allowed to be used within a $facet stage", stage[0].Key)
+			}
+		}
+
+		names[idx] = entry.Key
+		pipelines[idx], err = compiler.subCompiler("$facet", compiler.variables).compile(stages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		result := make(bson.D, len(pipelines))
+		for idx, pipeline := range pipelines {
+			facetDocuments, err := pipeline.run(documents, run)
+			if err != nil {
+				return nil, err
+			}
+			array := make(bson.A, len(facetDocuments))
+			for documentIdx, document := range facetDocuments {
+				array[documentIdx] = document
+			}
+			result[idx] = bson.E{Key: names[idx], Value: array}
+		}
+		return []bson.D{result}, nil
+	}, nil
+}
@@ -0,0 +1,462 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxDensifyDocuments is the maximum number of documents $densify generates, like the default of MongoDB
+const maxDensifyDocuments = 500000
+
+// densifyT is a compiled $densify stage
+type densifyT struct {
+	field           []string
+	partitionFields [][]string
+	step            any
+	unit            string
+	// bounds is "full", "partition" or "explicit" for an array of bounds
+	bounds string
+	lower  any
+	upper  any
+}
+
+// compileDensify compiles {$densify: {field: "hour", partitionByFields: ["sensor"], range: {step: 1, unit: "hour", bounds: "full"}}}
+// Documents are added for the missing values of field, they only contain field and the partitionByFields.
+func compileDensify(value any) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $densify stage specification must be an object, found %s", typeName(value))
+	}
+
+	densify := &densifyT{}
+	var field string
+	var rangeSpec bson.D
+	hasRange := false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "field":
+			field, ok = entry.Value.(string)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "BSON field '$densify.field' is the wrong type '%s', expected type 'string'", typeName(entry.Value))
+			}
+		case "partitionByFields":
+			fields, ok := match.ToArray(entry.Value)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "BSON field '$densify.partitionByFields' is the wrong type '%s', expected type 'array'", typeName(entry.Value))
+			}
+			for _, partitionField := range fields {
+				name, ok := partitionField.(string)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "BSON field '$densify.partitionByFields' must contain strings, found %s", typeName(partitionField))
+				}
+				parts, err := parseFieldPath(name)
+				if err != nil {
+					return nil, err
+				}
+				densify.partitionFields = append(densify.partitionFields, parts)
+			}
+		case "range":
+			rangeSpec, hasRange = match.ToDocument(entry.Value)
+			if !hasRange {
+				return nil, newStageError(ErrBadValue, "BSON field '$densify.range' is the wrong type '%s', expected type 'object'", typeName(entry.Value))
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "BSON field '$densify.%s' is an unknown field.", entry.Key)
+		}
+	}
+	switch {
+	case field == "":
+		return nil, newStageError(ErrBadValue, "BSON field '$densify.field' is missing but a required field")
+	case !hasRange:
+		return nil, newStageError(ErrBadValue, "BSON field '$densify.range' is missing but a required field")
+	}
+	var err error
+	densify.field, err = parseFieldPath(field)
+	if err != nil {
+		return nil, err
+	}
+	for _, parts := range densify.partitionFields {
+		if isPathPrefix(parts, densify.field) || isPathPrefix(densify.field, parts) {
+			return nil, newStageError(ErrBadValue, "BSON field '$densify.partitionByFields' contains the field that is being densified")
+		}
+	}
+
+	err = densify.parseRange(rangeSpec)
+	if err != nil {
+		return nil, err
+	}
+	return densify.run, nil
+}
+
+// parseRange parses the range of $densify like {step: 1, unit: "hour", bounds: [lower, upper]}
+func (d *densifyT) parseRange(spec bson.D) error {
+	var bounds any
+	for _, entry := range spec {
+		switch entry.Key {
+		case "step":
+			d.step = expr.Normalize(entry.Value)
+		case "unit":
+			unit, ok := entry.Value.(string)
+			if !ok || !isTimeUnit(unit) {
+				return newStageError(ErrBadValue, "unknown time unit value: %v", entry.Value)
+			}
+			d.unit = unit
+		case "bounds":
+			bounds = entry.Value
+		default:
+			return newStageError(ErrBadValue, "BSON field '$densify.range.%s' is an unknown field.", entry.Key)
+		}
+	}
+
+	step, isNumber := toFloat64(d.step)
+	switch {
+	case d.step == nil:
+		return newStageError(ErrBadValue, "BSON field '$densify.range.step' is missing but a required field")
+	case bounds == nil:
+		return newStageError(ErrBadValue, "BSON field '$densify.range.bounds' is missing but a required field")
+	case !isNumber || !(step > 0) || math.IsInf(step, 1):
+		return newStageError(ErrBadValue, "The step parameter in a range statement must be a strictly positive numeric value")
+	case d.unit != "" && step != math.Trunc(step):
+		return newStageError(ErrBadValue, "The step parameter in a range statement must be a whole number when densifying a date range")
+	}
+
+	switch bounds {
+	case "full", "partition":
+		d.bounds = bounds.(string)
+		return nil
+	}
+	entries, ok := match.ToArray(bounds)
+	if !ok || len(entries) != 2 {
+		return newStageError(ErrBadValue, "Range bounds must be 'full', 'partition', or an array of exactly two numeric or two date values")
+	}
+	d.bounds, d.lower, d.upper = "explicit", expr.Normalize(entries[0]), expr.Normalize(entries[1])
+	for _, bound := range []any{d.lower, d.upper} {
+		_, isDate := bound.(primitive.DateTime)
+		_, isNumber := toFloat64(bound)
+		if d.unit != "" && !isDate {
+			return newStageError(ErrBadValue, "A bounding array must contain dates if 'unit' is specified")
+		}
+		if d.unit == "" && !isNumber {
+			return newStageError(ErrBadValue, "A bounding array must contain numeric values if 'unit' is not specified")
+		}
+	}
+	if match.Compare(d.lower, d.upper) > 0 {
+		return newStageError(ErrBadValue, "A bounding array in a range statement must have the lower bound first")
+	}
+	return nil
+}
+
+// isPathPrefix returns true if the path prefix is the same as or a parent of the path
+func isPathPrefix(prefix []string, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for idx, part := range prefix {
+		if path[idx] != part {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *densifyT) run(documents []bson.D, run *runT) ([]bson.D, error) {
+	partitionValues := make([][]any, len(documents))
+	values := make([]any, len(documents))
+	var minimum, maximum any
+	for idx, document := range documents {
+		partitionValues[idx] = make([]any, len(d.partitionFields))
+		for fieldIdx, parts := range d.partitionFields {
+			partitionValues[idx][fieldIdx] = lookupPath(document, parts)
+		}
+
+		value := lookupPath(document, d.field)
+		values[idx] = value
+		if isNullish(value) {
+			continue
+		}
+		if _, isDate := value.(primitive.DateTime); d.unit != "" && !isDate {
+			return nil, newStageError(ErrBadValue, "Densify field type must be a date when 'unit' is specified, but it was %s", typeName(value))
+		}
+		if _, isNumber := toFloat64(expr.Normalize(value)); d.unit == "" && !isNumber {
+			return nil, newStageError(ErrBadValue, "Densify field type must be numeric when 'unit' is not specified, but it was %s", typeName(value))
+		}
+		if minimum == nil || match.Compare(value, minimum) < 0 {
+			minimum = value
+		}
+		if maximum == nil || match.Compare(value, maximum) > 0 {
+			maximum = value
+		}
+	}
+
+	indexes := make([]int, len(documents))
+	for idx := range indexes {
+		indexes[idx] = idx
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		result := comparePartitions(partitionValues[indexes[i]], partitionValues[indexes[j]])
+		if result != 0 {
+			return result < 0
+		}
+		// Documents without a value for the field come first in their partition
+		aNullish, bNullish := isNullish(values[indexes[i]]), isNullish(values[indexes[j]])
+		if aNullish || bNullish {
+			return aNullish && !bNullish
+		}
+		return match.Compare(values[indexes[i]], values[indexes[j]]) < 0
+	})
+
+	results := make([]bson.D, 0, len(documents))
+	generated := 0
+	for start := 0; start < len(indexes); {
+		end := start + 1
+		for end < len(indexes) && comparePartitions(partitionValues[indexes[start]], partitionValues[indexes[end]]) == 0 {
+			end++
+		}
+
+		// The lower bound is inclusive, the upper bound is exclusive for explicit bounds
+		lower, upper, inclusive := d.lower, d.upper, false
+		switch d.bounds {
+		case "full":
+			lower, upper, inclusive = minimum, maximum, true
+		case "partition":
+			lower, upper, inclusive = nil, nil, true
+			for _, documentIdx := range indexes[start:end] {
+				if isNullish(values[documentIdx]) {
+					continue
+				}
+				if lower == nil {
+					lower = values[documentIdx]
+				}
+				upper = values[documentIdx]
+			}
+		}
+		withinUpper := func(value any) bool {
+			result := match.Compare(value, upper)
+			return result < 0 || (inclusive && result == 0)
+		}
+		generate := func(value any) error {
+			generated++
+			if generated > maxDensifyDocuments {
+				return newStageError(ErrBadValue, "Generated %d documents in $densify, which is over the limit of %d", generated, maxDensifyDocuments)
+			}
+			document := bson.D{}
+			for fieldIdx, parts := range d.partitionFields {
+				document = setPath(document, parts, partitionValues[indexes[start]][fieldIdx])
+			}
+			results = append(results, setPath(document, d.field, value))
+			return nil
+		}
+
+		current := lower
+		for _, documentIdx := range indexes[start:end] {
+			value := values[documentIdx]
+			if !isNullish(value) && current != nil {
+				for match.Compare(current, value) < 0 && withinUpper(current) {
+					err := generate(current)
+					if err != nil {
+						return nil, err
+					}
+					current = d.next(current)
+				}
+				if match.Compare(current, value) == 0 {
+					current = d.next(current)
+				}
+			}
+			results = append(results, documents[documentIdx])
+		}
+		for current != nil && withinUpper(current) {
+			err := generate(current)
+			if err != nil {
+				return nil, err
+			}
+			current = d.next(current)
+		}
+		start = end
+	}
+	return results, nil
+}
+
+// next returns the value after a value of the densified field
+// Integers stay integers if the step is an integer, like $add.
+func (d *densifyT) next(value any) any {
+	if d.unit != "" {
+		step, _ := toFloat64(d.step)
+		return addTimeUnits(value.(primitive.DateTime), int64(step), d.unit)
+	}
+
+	value = expr.Normalize(value)
+	number, isInt := wholeInt(value)
+	step, stepIsInt := wholeInt(d.step)
+	if isInt && stepIsInt {
+		sum := number + step
+		_, valueIsInt32 := value.(int32)
+		_, stepIsInt32 := d.step.(int32)
+		if valueIsInt32 && stepIsInt32 && sum <= math.MaxInt32 {
+			return int32(sum)
+		}
+		return sum
+	}
+	floatNumber, _ := toFloat64(value)
+	floatStep, _ := toFloat64(d.step)
+	return floatNumber + floatStep
+}
+
+// wholeInt returns the value of an int32 or int64
+func wholeInt(value any) (int64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return int64(number), true
+	case int64:
+		return number, true
+	}
+	return 0, false
+}
+
+// comparePartitions compares the values of the partitionByFields of two documents, a missing value differs from null
+func comparePartitions(a []any, b []any) int {
+	for idx := range a {
+		aMissing, bMissing := a[idx] == expr.Missing, b[idx] == expr.Missing
+		switch {
+		case aMissing && !bMissing:
+			return -1
+		case !aMissing && bMissing:
+			return 1
+		}
+		result := match.Compare(a[idx], b[idx])
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// compileFill compiles {$fill: {partitionBy: "$sensor", sortBy: {time: 1}, output: {temperature: {method: "linear"}, unit: {value: "celsius"}}}}
+// The methods are done like $setWindowFields using $locf and $linearFill, values like $addFields with $ifNull.
+func compileFill(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $fill stage specification must be an object, found %s", typeName(value))
+	}
+
+	windowSpec := bson.D{}
+	var sortBy any
+	var output bson.D
+	hasPartitionBy, hasPartitionByFields, hasOutput := false, false, false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "partitionBy":
+			windowSpec = append(windowSpec, bson.E{Key: "partitionBy", Value: entry.Value})
+			hasPartitionBy = true
+		case "partitionByFields":
+			fields, ok := match.ToArray(entry.Value)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "BSON field '$fill.partitionByFields' is the wrong type '%s', expected type 'array'", typeName(entry.Value))
+			}
+			// The fields are partitioned on like {partitionBy: {f0: "$sensor", f1: "$site"}}
+			partitionBy := bson.D{}
+			for idx, field := range fields {
+				name, ok := field.(string)
+				if !ok || strings.HasPrefix(name, "$") {
+					return nil, newStageError(ErrBadValue, "Each element of the 'partitionByFields' array must be a string that doesn't start with '$', found %v", field)
+				}
+				partitionBy = append(partitionBy, bson.E{Key: "f" + strconv.Itoa(idx), Value: "$" + name})
+			}
+			windowSpec = append(windowSpec, bson.E{Key: "partitionBy", Value: partitionBy})
+			hasPartitionByFields = true
+		case "sortBy":
+			sortBy = entry.Value
+			windowSpec = append(windowSpec, bson.E{Key: "sortBy", Value: entry.Value})
+		case "output":
+			output, hasOutput = match.ToDocument(entry.Value)
+			if !hasOutput {
+				return nil, newStageError(ErrBadValue, "BSON field '$fill.output' is the wrong type '%s', expected type 'object'", typeName(entry.Value))
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "BSON field '$fill.%s' is an unknown field.", entry.Key)
+		}
+	}
+	switch {
+	case !hasOutput:
+		return nil, newStageError(ErrBadValue, "BSON field '$fill.output' is missing but a required field")
+	case hasPartitionBy && hasPartitionByFields:
+		return nil, newStageError(ErrBadValue, "Only one of 'partitionBy' and 'partitionByFields' can be specified in $fill")
+	}
+
+	windowOutput := bson.D{}
+	valueFields := [][]string{}
+	values := []*expr.Expression{}
+	for _, entry := range output {
+		path, err := parseFieldPath(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		fill, ok := match.ToDocument(entry.Value)
+		if !ok || len(fill) != 1 || (fill[0].Key != "value" && fill[0].Key != "method") {
+			return nil, newStageError(ErrBadValue, "Exactly one of 'value' and 'method' must be specified for the $fill output field '%s'", entry.Key)
+		}
+
+		if fill[0].Key == "value" {
+			expression, err := expr.CompileWithVariables(fill[0].Value, variables)
+			if err != nil {
+				return nil, err
+			}
+			valueFields = append(valueFields, path)
+			values = append(values, expression)
+			continue
+		}
+
+		var function string
+		switch fill[0].Value {
+		case "locf":
+			function = "$locf"
+		case "linear":
+			function = "$linearFill"
+		default:
+			return nil, newStageError(ErrBadValue, "Method must be either locf or linear, found %v", fill[0].Value)
+		}
+		if sortBy == nil {
+			return nil, newStageError(ErrBadValue, "sortBy is required if any output field specifies a 'method'")
+		}
+		windowOutput = append(windowOutput, bson.E{Key: entry.Key, Value: bson.D{{Key: function, Value: "$" + entry.Key}}})
+	}
+
+	var window stageT
+	if sortBy != nil || len(windowOutput) > 0 {
+		var err error
+		window, err = compileSetWindowFields(append(windowSpec, bson.E{Key: "output", Value: windowOutput}), variables)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := documents
+		if len(values) > 0 {
+			results = make([]bson.D, len(documents))
+			for idx, document := range documents {
+				for fieldIdx, path := range valueFields {
+					if !isNullish(lookupPath(document, path)) {
+						continue
+					}
+					value, err := values[fieldIdx].EvaluateWithVariables(documents[idx], run.variables)
+					if err != nil {
+						return nil, err
+					}
+					document = setPath(document, path, nullIfMissing(value))
+				}
+				results[idx] = document
+			}
+		}
+		if window == nil {
+			return results, nil
+		}
+		return window(results, run)
+	}, nil
+}
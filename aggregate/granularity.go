@@ -0,0 +1,206 @@
+package aggregate
+
+import (
+	"math"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// preferredNumbers are the series of the granularities of $bucketAuto in hundredths, from 1 up to 10
+// Every series repeats for every power of 10, so R5 contains 0.16, 1.6, 16 and 160.
+var preferredNumbers = map[string][]int64{
+	"R5": {
+		100, 160, 250, 400, 630,
+	},
+	"R10": {
+		100, 125, 160, 200, 250, 315, 400, 500, 630, 800,
+	},
+	"R20": {
+		100, 112, 125, 140, 160, 180, 200, 224, 250, 280, 315, 355,
+		400, 450, 500, 560, 630, 710, 800, 900,
+	},
+	"R40": {
+		100, 106, 112, 118, 125, 132, 140, 150, 160, 170, 180, 190,
+		200, 212, 224, 236, 250, 265, 280, 300, 315, 335, 355, 375,
+		400, 425, 450, 475, 500, 530, 560, 600, 630, 670, 710, 750,
+		800, 850, 900, 950,
+	},
+	"R80": {
+		100, 103, 106, 109, 112, 115, 118, 122, 125, 128, 132, 136,
+		140, 145, 150, 155, 160, 165, 170, 175, 180, 185, 190, 195,
+		200, 206, 212, 218, 224, 230, 236, 243, 250, 258, 265, 272,
+		280, 290, 300, 307, 315, 325, 335, 345, 355, 365, 375, 387,
+		400, 412, 425, 437, 450, 462, 475, 487, 500, 515, 530, 545,
+		560, 580, 600, 615, 630, 650, 670, 690, 710, 730, 750, 775,
+		800, 825, 850, 875, 900, 925, 950, 975,
+	},
+	"1-2-5": {
+		100, 200, 500,
+	},
+	"E6": {
+		100, 150, 220, 330, 470, 680,
+	},
+	"E12": {
+		100, 120, 150, 180, 220, 270, 330, 390, 470, 560, 680, 820,
+	},
+	"E24": {
+		100, 110, 120, 130, 150, 160, 180, 200, 220, 240, 270, 300,
+		330, 360, 390, 430, 470, 510, 560, 620, 680, 750, 820, 910,
+	},
+	"E48": {
+		100, 105, 110, 115, 121, 127, 133, 140, 147, 154, 162, 169,
+		178, 187, 196, 205, 215, 226, 237, 249, 261, 274, 287, 301,
+		316, 332, 348, 365, 383, 402, 422, 442, 464, 487, 511, 536,
+		562, 590, 619, 649, 681, 715, 750, 787, 825, 866, 909, 953,
+	},
+	"E96": {
+		100, 102, 105, 107, 110, 113, 115, 118, 121, 124, 127, 130,
+		133, 137, 140, 143, 147, 150, 154, 158, 162, 165, 169, 174,
+		178, 182, 187, 191, 196, 200, 205, 210, 215, 221, 226, 232,
+		237, 243, 249, 255, 261, 267, 274, 280, 287, 294, 301, 309,
+		316, 324, 332, 340, 348, 357, 365, 374, 383, 392, 402, 412,
+		422, 432, 442, 453, 464, 475, 487, 499, 511, 523, 536, 549,
+		562, 576, 590, 604, 619, 634, 649, 665, 681, 698, 715, 732,
+		750, 768, 787, 806, 825, 845, 866, 887, 909, 931, 953, 976,
+	},
+	"E192": {
+		100, 101, 102, 104, 105, 106, 107, 109, 110, 111, 113, 114,
+		115, 117, 118, 120, 121, 123, 124, 126, 127, 129, 130, 132,
+		133, 135, 137, 138, 140, 142, 143, 145, 147, 149, 150, 152,
+		154, 156, 158, 160, 162, 164, 165, 167, 169, 172, 174, 176,
+		178, 180, 182, 184, 187, 189, 191, 193, 196, 198, 200, 203,
+		205, 208, 210, 213, 215, 218, 221, 223, 226, 229, 232, 234,
+		237, 240, 243, 246, 249, 252, 255, 258, 261, 264, 267, 271,
+		274, 277, 280, 284, 287, 291, 294, 298, 301, 305, 309, 312,
+		316, 320, 324, 328, 332, 336, 340, 344, 348, 352, 357, 361,
+		365, 370, 374, 379, 383, 388, 392, 397, 402, 407, 412, 417,
+		422, 427, 432, 437, 442, 448, 453, 459, 464, 470, 475, 481,
+		487, 493, 499, 505, 511, 517, 523, 530, 536, 542, 549, 556,
+		562, 569, 576, 583, 590, 597, 604, 612, 619, 626, 634, 642,
+		649, 657, 665, 673, 681, 690, 698, 706, 715, 723, 732, 741,
+		750, 759, 768, 777, 787, 796, 806, 816, 825, 835, 845, 856,
+		866, 876, 887, 898, 909, 920, 931, 942, 953, 965, 976, 988,
+	},
+}
+
+// granularityT rounds the boundaries of $bucketAuto to a series of preferred numbers or to powers of 2
+type granularityT struct {
+	name string
+	// series is nil for POWERSOF2
+	series []int64
+}
+
+// granularities are the supported values of the granularity argument of $bucketAuto
+var granularities = func() map[string]*granularityT {
+	result := map[string]*granularityT{"POWERSOF2": {name: "POWERSOF2"}}
+	for name, series := range preferredNumbers {
+		result[name] = &granularityT{name: name, series: series}
+	}
+	return result
+}()
+
+// validate makes sure a groupBy value can be rounded, only numbers that are not negative can
+func (g *granularityT) validate(value any) error {
+	number, ok := toFloat64(value)
+	if !ok {
+		return newStageError(ErrBadValue, "$bucketAuto can specify a 'granularity' with numeric boundaries only, but found a value with type: %s", typeName(value))
+	}
+	if number < 0 || math.IsNaN(number) {
+		return newStageError(ErrBadValue, "A granularity of %s can only be used with non-negative numbers, but found: %v", g.name, value)
+	}
+	return nil
+}
+
+// roundUp returns the smallest number of the series that is larger than the value, 0 stays 0
+func (g *granularityT) roundUp(value any) any {
+	number, _ := toFloat64(value)
+	if number == 0 || math.IsInf(number, 1) {
+		return value
+	}
+	if g.series == nil {
+		_, exponent := math.Frexp(number)
+		return g.powerOfTwo(value, math.Ldexp(1, exponent))
+	}
+
+	exponent := int(math.Floor(math.Log10(number)))
+	for power := exponent - 1; power <= exponent+1; power++ {
+		for _, hundredths := range g.series {
+			candidate := scaleHundredths(hundredths, power)
+			if candidate > number {
+				return candidate
+			}
+		}
+	}
+	return number
+}
+
+// roundDown returns the largest number of the series that is smaller than the value, 0 stays 0
+func (g *granularityT) roundDown(value any) any {
+	number, _ := toFloat64(value)
+	if number == 0 || math.IsInf(number, 1) {
+		return value
+	}
+	if g.series == nil {
+		fraction, exponent := math.Frexp(number)
+		if fraction == 0.5 {
+			// The value is a power of 2 itself
+			exponent--
+		}
+		return g.powerOfTwo(value, math.Ldexp(1, exponent-1))
+	}
+
+	exponent := int(math.Floor(math.Log10(number)))
+	for power := exponent + 1; power >= exponent-1; power-- {
+		for idx := len(g.series) - 1; idx >= 0; idx-- {
+			candidate := scaleHundredths(g.series[idx], power)
+			if candidate < number {
+				return candidate
+			}
+		}
+	}
+	return number
+}
+
+// powerOfTwo returns a rounded power of 2 as an integer if the value was an integer and the result fits
+func (g *granularityT) powerOfTwo(value any, result float64) any {
+	switch value.(type) {
+	case int32:
+		if result <= math.MaxInt32 && result == math.Trunc(result) {
+			return int32(result)
+		}
+		if result < math.MaxInt64 && result == math.Trunc(result) {
+			return int64(result)
+		}
+	case int64:
+		if result < math.MaxInt64 && result == math.Trunc(result) {
+			return int64(result)
+		}
+	}
+	return result
+}
+
+// scaleHundredths returns a number of a series multiplied by 10 to the power, without floating point errors like 315 * 0.01
+func scaleHundredths(hundredths int64, power int) float64 {
+	power -= 2
+	if power >= 0 {
+		return float64(hundredths) * math.Pow10(power)
+	}
+	return float64(hundredths) / math.Pow10(-power)
+}
+
+// toFloat64 converts a number into a float64
+func toFloat64(value any) (float64, bool) {
+	switch number := value.(type) {
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	case primitive.Decimal128:
+		parsed, err := strconv.ParseFloat(number.String(), 64)
+		return parsed, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,215 @@
+package aggregate
+
+import (
+	"math"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// graphLookupT is a compiled $graphLookup stage
+type graphLookupT struct {
+	from             string
+	startWith        *expr.Expression
+	connectFromField string
+	connectToField   string
+	as               []string
+	maxDepth         int64
+	depthField       []string
+	restrict         filterT
+}
+
+// compileGraphLookup compiles {$graphLookup: {from: "employees", startWith: "$reportsTo", connectFromField: "reportsTo", connectToField: "name", as: "chain"}}
+// Starting with the documents whose connectToField equals startWith, documents whose connectToField equals the
+// connectFromField of a found document are searched recursively. Every document is found at most once.
+func compileGraphLookup(value any, compiler *compilerT) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $graphLookup specification must be an object")
+	}
+
+	graphLookup := &graphLookupT{maxDepth: -1}
+	var startWith any
+	var as, depthField string
+	hasStartWith := false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "from", "as", "connectFromField", "connectToField", "depthField":
+			if _, isDocument := match.ToDocument(entry.Value); isDocument && entry.Key == "from" {
+				return nil, newStageError(ErrNotSupported, "$graphLookup from another database is not supported by mongomock")
+			}
+			text, ok := entry.Value.(string)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "expected string as argument for %s, found: %s", entry.Key, typeName(entry.Value))
+			}
+			switch entry.Key {
+			case "from":
+				graphLookup.from = text
+			case "as":
+				as = text
+			case "connectFromField":
+				graphLookup.connectFromField = text
+			case "connectToField":
+				graphLookup.connectToField = text
+			default:
+				depthField = text
+			}
+		case "startWith":
+			startWith, hasStartWith = entry.Value, true
+		case "maxDepth":
+			maxDepth, err := parseMaxDepth(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			graphLookup.maxDepth = maxDepth
+		case "restrictSearchWithMatch":
+			filter, ok := match.ToDocument(entry.Value)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "restrictSearchWithMatch must be an object, found %s", typeName(entry.Value))
+			}
+			if hasText(filter) {
+				return nil, newStageError(ErrBadValue, "$text is not allowed in this context")
+			}
+			var err error
+			graphLookup.restrict, err = compileFilter(filter, compiler.variables)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "Unknown argument to $graphLookup: %s", entry.Key)
+		}
+	}
+
+	for _, required := range []struct {
+		name    string
+		missing bool
+	}{
+		{"from", graphLookup.from == ""},
+		{"as", as == ""},
+		{"connectFromField", graphLookup.connectFromField == ""},
+		{"connectToField", graphLookup.connectToField == ""},
+		{"startWith", !hasStartWith},
+	} {
+		if required.missing {
+			return nil, newStageError(ErrBadValue, "missing '%s' option to $graphLookup stage specification", required.name)
+		}
+	}
+
+	var err error
+	graphLookup.as, err = parseFieldPath(as)
+	if err != nil {
+		return nil, err
+	}
+	if depthField != "" {
+		graphLookup.depthField, err = parseFieldPath(depthField)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range []string{graphLookup.connectFromField, graphLookup.connectToField} {
+		_, err = parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	graphLookup.startWith, err = expr.CompileWithVariables(startWith, compiler.variables)
+	if err != nil {
+		return nil, err
+	}
+
+	compiler.collections[graphLookup.from] = true
+	return graphLookup.run, nil
+}
+
+// parseMaxDepth parses the maxDepth option of $graphLookup, a non-negative integral number
+func parseMaxDepth(value any) (int64, error) {
+	var maxDepth float64
+	switch number := expr.Normalize(value).(type) {
+	case int32:
+		maxDepth = float64(number)
+	case int64:
+		maxDepth = float64(number)
+	case float64:
+		maxDepth = number
+	default:
+		return 0, newStageError(ErrBadValue, "maxDepth must be numeric, found type: %s", typeName(value))
+	}
+	if maxDepth != math.Trunc(maxDepth) || math.IsInf(maxDepth, 0) {
+		return 0, newStageError(ErrBadValue, "maxDepth could not be represented as a long long: %v", value)
+	}
+	if maxDepth < 0 {
+		return 0, newStageError(ErrBadValue, "maxDepth requires a nonnegative argument, found: %v", value)
+	}
+	return int64(maxDepth), nil
+}
+
+func (g *graphLookupT) run(documents []bson.D, run *runT) ([]bson.D, error) {
+	if run.database == nil {
+		return nil, newStageError(ErrNotSupported, "$graphLookup needs a database to read collection %s from", g.from)
+	}
+	foreignDocuments, err := run.database.Collection(g.from)
+	if err != nil {
+		return nil, err
+	}
+
+	// Documents that don't match restrictSearchWithMatch are left out of the search entirely
+	searchable := []bson.D{}
+	for _, foreignDocument := range foreignDocuments {
+		if g.restrict != nil {
+			matched, err := g.restrict(foreignDocument, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		searchable = append(searchable, foreignDocument)
+	}
+	foreignValues := make([][]any, len(searchable))
+	for idx, foreignDocument := range searchable {
+		foreignValues[idx] = joinValues(foreignDocument, g.connectToField, true)
+	}
+
+	results := make([]bson.D, len(documents))
+	for idx, document := range documents {
+		startWith, err := g.startWith.EvaluateWithVariables(document, run.variables)
+		if err != nil {
+			return nil, err
+		}
+		values, isArray := match.ToArray(startWith)
+		if !isArray {
+			if startWith == expr.Missing {
+				startWith = nil
+			}
+			values = []any{startWith}
+		}
+
+		found := bson.A{}
+		visited := make([]bool, len(searchable))
+		for depth := int64(0); len(values) > 0 && (g.maxDepth < 0 || depth <= g.maxDepth); depth++ {
+			nextValues := []any{}
+			for foreignIdx, foreignDocument := range searchable {
+				if visited[foreignIdx] || !containsEqual(values, foreignValues[foreignIdx]) {
+					continue
+				}
+				visited[foreignIdx] = true
+				for _, value := range match.Lookup(foreignDocument, g.connectFromField) {
+					if entries, isArray := match.ToArray(value); isArray {
+						nextValues = append(nextValues, entries...)
+					} else {
+						nextValues = append(nextValues, value)
+					}
+				}
+				if g.depthField != nil {
+					foreignDocument = setPath(foreignDocument, g.depthField, depth)
+				}
+				found = append(found, foreignDocument)
+			}
+			values = nextValues
+		}
+		results[idx] = setPath(document, g.as, found)
+	}
+	return results, nil
+}
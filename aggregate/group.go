@@ -0,0 +1,257 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// groupT is a group of documents with the same _id
+type groupT struct {
+	id           any
+	accumulators []*expr.Accumulation
+}
+
+// compileGroup compiles a $group stage like {$group: {_id: "$category", total: {$sum: "$price"}}}
+// The groups are returned in the order they are first seen.
+func compileGroup(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "a group's fields must be specified in an object")
+	}
+
+	var id *groupIDT
+	names := []string{}
+	accumulators := []*expr.Accumulator{}
+	for _, entry := range spec {
+		if entry.Key == "_id" {
+			if id != nil {
+				return nil, newStageError(ErrBadValue, "a group's _id may only be specified once")
+			}
+			var err error
+			id, err = compileGroupID(entry.Value, variables)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		accumulator, err := compileGroupField(entry, names, variables)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, entry.Key)
+		accumulators = append(accumulators, accumulator)
+	}
+	if id == nil {
+		return nil, newStageError(ErrBadValue, "a group specification must specify an _id")
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		groups := []*groupT{}
+		groupsByHash := map[string][]*groupT{}
+		for _, document := range documents {
+			groupID, err := id.evaluate(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+
+			group := findGroup(groupsByHash, groupID)
+			if group == nil {
+				group = &groupT{id: groupID, accumulators: newAccumulations(accumulators, run.variables)}
+				hash := hashValue(groupID)
+				groupsByHash[hash] = append(groupsByHash[hash], group)
+				groups = append(groups, group)
+			}
+
+			err = group.add(document)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		results := make([]bson.D, len(groups))
+		for idx, group := range groups {
+			results[idx] = group.result(names)
+		}
+		return results, nil
+	}, nil
+}
+
+// compileGroupField compiles a field of a $group stage like {total: {$sum: "$price"}}
+// names are the fields compiled before it, to detect duplicates.
+func compileGroupField(entry bson.E, names []string, variables []string) (*expr.Accumulator, error) {
+	if strings.HasPrefix(entry.Key, "$") {
+		return nil, newStageError(ErrBadValue, "The field name '%s' cannot be an operator name", entry.Key)
+	}
+	if strings.Contains(entry.Key, ".") {
+		return nil, newStageError(ErrBadValue, "The field name '%s' cannot contain '.'", entry.Key)
+	}
+	for _, name := range names {
+		if name == entry.Key {
+			return nil, newStageError(ErrBadValue, "duplicate field name specified in object literal: %s", entry.Key)
+		}
+	}
+	return expr.CompileAccumulatorWithVariables(entry.Value, entry.Key, variables)
+}
+
+// newAccumulations starts accumulating the fields of a new group
+func newAccumulations(accumulators []*expr.Accumulator, variables expr.Variables) []*expr.Accumulation {
+	accumulations := make([]*expr.Accumulation, len(accumulators))
+	for idx, accumulator := range accumulators {
+		accumulations[idx] = accumulator.NewWithVariables(variables)
+	}
+	return accumulations
+}
+
+// add adds a document to all accumulators of the group
+func (g *groupT) add(document bson.D) error {
+	for _, accumulation := range g.accumulators {
+		err := accumulation.Add(document)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result returns the output document of the group
+func (g *groupT) result(names []string) bson.D {
+	result := make(bson.D, 0, len(names)+1)
+	result = append(result, bson.E{Key: "_id", Value: g.id})
+	for idx, accumulation := range g.accumulators {
+		result = append(result, bson.E{Key: names[idx], Value: accumulation.Result()})
+	}
+	return result
+}
+
+// groupIDT is the compiled _id of a $group stage
+type groupIDT struct {
+	expression *expr.Expression
+	// fields are set for a compound _id like {_id: {year: "$year", month: "$month"}}
+	names  []string
+	fields []*expr.Expression
+}
+
+// compileGroupID compiles the _id of a $group stage
+// Like MongoDB fields of a compound _id that are missing become null, so documents without them are grouped together.
+func compileGroupID(value any, variables []string) (*groupIDT, error) {
+	document, ok := match.ToDocument(value)
+	if !ok || len(document) == 0 || strings.HasPrefix(document[0].Key, "$") {
+		expression, err := expr.CompileWithVariables(value, variables)
+		if err != nil {
+			return nil, err
+		}
+		return &groupIDT{expression: expression}, nil
+	}
+
+	id := &groupIDT{}
+	for _, entry := range document {
+		if strings.HasPrefix(entry.Key, "$") {
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not start with '$'")
+		}
+		if strings.Contains(entry.Key, ".") {
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not contain '.'")
+		}
+		field, err := expr.CompileWithVariables(entry.Value, variables)
+		if err != nil {
+			return nil, err
+		}
+		id.names = append(id.names, entry.Key)
+		id.fields = append(id.fields, field)
+	}
+	return id, nil
+}
+
+func (id *groupIDT) evaluate(document bson.D, variables expr.Variables) (any, error) {
+	if id.expression != nil {
+		value, err := id.expression.EvaluateWithVariables(document, variables)
+		if value == expr.Missing {
+			value = nil
+		}
+		return value, err
+	}
+
+	result := make(bson.D, len(id.fields))
+	for idx, field := range id.fields {
+		value, err := field.EvaluateWithVariables(document, variables)
+		if err != nil {
+			return nil, err
+		}
+		if value == expr.Missing {
+			value = nil
+		}
+		result[idx] = bson.E{Key: id.names[idx], Value: value}
+	}
+	return result, nil
+}
+
+// findGroup returns the group with an _id equal to id, or nil if there is none yet
+func findGroup(groupsByHash map[string][]*groupT, id any) *groupT {
+	for _, group := range groupsByHash[hashValue(id)] {
+		if match.Compare(group.id, id) == 0 {
+			return group
+		}
+	}
+	return nil
+}
+
+// hashValue returns a key for a value where values that are equal according to MongoDB get the same key, like 1 and 1.0
+// Different values might also get the same key, so values with the same key still have to be compared.
+func hashValue(value any) string {
+	builder := &strings.Builder{}
+	writeHash(builder, value)
+	return builder.String()
+}
+
+func writeHash(builder *strings.Builder, value any) {
+	switch typedValue := value.(type) {
+	case bson.D:
+		builder.WriteString("{")
+		for _, entry := range typedValue {
+			builder.WriteString(strconv.Quote(entry.Key))
+			builder.WriteString(":")
+			writeHash(builder, entry.Value)
+			builder.WriteString(",")
+		}
+		builder.WriteString("}")
+	case bson.A:
+		builder.WriteString("[")
+		for _, entry := range typedValue {
+			writeHash(builder, entry)
+			builder.WriteString(",")
+		}
+		builder.WriteString("]")
+	case int32:
+		writeNumberHash(builder, float64(typedValue))
+	case int64:
+		writeNumberHash(builder, float64(typedValue))
+	case float64:
+		writeNumberHash(builder, typedValue)
+	case primitive.Decimal128:
+		number, err := strconv.ParseFloat(typedValue.String(), 64)
+		if err != nil {
+			number = math.NaN()
+		}
+		writeNumberHash(builder, number)
+	case string:
+		builder.WriteString(strconv.Quote(typedValue))
+	default:
+		fmt.Fprintf(builder, "%T:%v", value, value)
+	}
+}
+
+func writeNumberHash(builder *strings.Builder, number float64) {
+	if number == 0 {
+		// Negative zero equals zero
+		number = 0
+	}
+	builder.WriteString("n")
+	builder.WriteString(strconv.FormatFloat(number, 'g', -1, 64))
+}
@@ -0,0 +1,238 @@
+package aggregate
+
+import (
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lookupT is a compiled $lookup stage
+type lookupT struct {
+	from         string
+	localField   string
+	foreignField string
+	as           []string
+	letNames     []string
+	letValues    []*expr.Expression
+	pipeline     *Pipeline
+}
+
+// compileLookup compiles a $lookup stage
+// Supported are the equality form {from: "customers", localField: "customer", foreignField: "_id", as: "customer"},
+// the form with let and pipeline and since MongoDB 5.0 both forms combined.
+func compileLookup(value any, compiler *compilerT) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $lookup specification must be an Object")
+	}
+
+	lookup := &lookupT{}
+	var as string
+	var let bson.D
+	var pipeline any
+	hasLocalField, hasForeignField, hasLet, hasPipeline := false, false, false, false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "from", "as", "localField", "foreignField":
+			if _, isDocument := match.ToDocument(entry.Value); isDocument && entry.Key == "from" {
+				return nil, newStageError(ErrNotSupported, "$lookup from another database is not supported by mongomock")
+			}
+			text, ok := entry.Value.(string)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "$lookup argument '%s' must be a string", entry.Key)
+			}
+			switch entry.Key {
+			case "from":
+				lookup.from = text
+			case "as":
+				as = text
+			case "localField":
+				lookup.localField, hasLocalField = text, true
+			default:
+				lookup.foreignField, hasForeignField = text, true
+			}
+		case "let":
+			let, ok = match.ToDocument(entry.Value)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "$lookup argument 'let' must be an object")
+			}
+			hasLet = true
+		case "pipeline":
+			pipeline, hasPipeline = entry.Value, true
+		default:
+			return nil, newStageError(ErrBadValue, "unknown argument to $lookup: %s", entry.Key)
+		}
+	}
+
+	switch {
+	case lookup.from == "":
+		return nil, newStageError(ErrBadValue, "must specify 'from' field for a $lookup")
+	case as == "":
+		return nil, newStageError(ErrBadValue, "must specify 'as' field for a $lookup")
+	case hasLocalField != hasForeignField:
+		return nil, newStageError(ErrBadValue, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case !hasLocalField && !hasPipeline:
+		return nil, newStageError(ErrBadValue, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	case hasLet && !hasPipeline:
+		return nil, newStageError(ErrBadValue, "$lookup with 'let' must also specify 'pipeline'")
+	}
+
+	var err error
+	lookup.as, err = parseFieldPath(as)
+	if err != nil {
+		return nil, err
+	}
+	if hasLocalField {
+		_, err = parseFieldPath(lookup.localField)
+		if err != nil {
+			return nil, err
+		}
+		_, err = parseFieldPath(lookup.foreignField)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range let {
+		err = expr.ValidateVariableName(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		expression, err := expr.CompileWithVariables(entry.Value, compiler.variables)
+		if err != nil {
+			return nil, err
+		}
+		lookup.letNames = append(lookup.letNames, entry.Key)
+		lookup.letValues = append(lookup.letValues, expression)
+	}
+
+	if hasPipeline {
+		if _, isDocument := match.ToDocument(pipeline); isDocument {
+			return nil, newStageError(ErrBadValue, "'pipeline' option must be specified as an array")
+		}
+		if _, ok := match.ToArray(pipeline); !ok {
+			return nil, newStageError(ErrBadValue, "'pipeline' option must be specified as an array")
+		}
+
+		variables := append(append([]string{}, compiler.variables...), lookup.letNames...)
+		lookup.pipeline, err = compiler.subCompiler("$lookup", variables).compile(pipeline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compiler.collections[lookup.from] = true
+	return lookup.run, nil
+}
+
+func (l *lookupT) run(documents []bson.D, run *runT) ([]bson.D, error) {
+	if run.database == nil {
+		return nil, newStageError(ErrNotSupported, "$lookup needs a database to read collection %s from", l.from)
+	}
+	foreignDocuments, err := run.database.Collection(l.from)
+	if err != nil {
+		return nil, err
+	}
+
+	var foreignValues [][]any
+	if l.localField != "" {
+		foreignValues = make([][]any, len(foreignDocuments))
+		for idx, foreignDocument := range foreignDocuments {
+			foreignValues[idx] = joinValues(foreignDocument, l.foreignField, true)
+		}
+	}
+
+	results := make([]bson.D, len(documents))
+	for idx, document := range documents {
+		joined := foreignDocuments
+		if l.localField != "" {
+			localValues := joinValues(document, l.localField, false)
+			joined = []bson.D{}
+			for foreignIdx, foreignDocument := range foreignDocuments {
+				if containsEqual(localValues, foreignValues[foreignIdx]) {
+					joined = append(joined, foreignDocument)
+				}
+			}
+		}
+
+		if l.pipeline != nil {
+			variables := expr.Variables{}
+			for name, value := range run.variables {
+				variables[name] = value
+			}
+			for letIdx, expression := range l.letValues {
+				value, err := expression.EvaluateWithVariables(document, run.variables)
+				if err != nil {
+					return nil, err
+				}
+				variables[l.letNames[letIdx]] = value
+			}
+
+			joined, err = l.pipeline.run(joined, run.withVariables(variables))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		array := make(bson.A, len(joined))
+		for joinedIdx, joinedDocument := range joined {
+			array[joinedIdx] = joinedDocument
+		}
+		results[idx] = setPath(document, l.as, array)
+	}
+	return results, nil
+}
+
+// joinValues returns the values a document is joined on by $lookup
+// Like an equality match the elements of arrays are used, missing fields are null.
+// The foreign side also matches arrays as a whole.
+func joinValues(document bson.D, key string, keepArrays bool) []any {
+	values := []any{}
+	for _, value := range match.Lookup(document, key) {
+		entries, isArray := match.ToArray(value)
+		if !isArray {
+			values = append(values, value)
+			continue
+		}
+		values = append(values, entries...)
+		if keepArrays {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		values = append(values, nil)
+	}
+	return values
+}
+
+// containsEqual returns true if any value of a equals any value of b
+func containsEqual(a []any, b []any) bool {
+	for _, aValue := range a {
+		for _, bValue := range b {
+			if match.Compare(aValue, bValue) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setPath returns a copy of a document with a dotted field like "customer.orders" set to a value
+// Values on the path that are not documents are replaced by a document.
+func setPath(document bson.D, parts []string, value any) bson.D {
+	result := make(bson.D, len(document), len(document)+1)
+	copy(result, document)
+
+	if len(parts) > 1 {
+		current := lookupField(result, parts[0])
+		subDocument, ok := current.(bson.D)
+		if !ok {
+			subDocument, ok = match.ToDocument(current)
+			if current == expr.Missing || !ok {
+				subDocument = bson.D{}
+			}
+		}
+		value = setPath(subDocument, parts[1:], value)
+	}
+	return setField(result, parts[0], value)
+}
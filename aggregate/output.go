@@ -0,0 +1,423 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WritableDatabase is a Database that $out and $merge can write into
+type WritableDatabase interface {
+	Database
+	// UniqueIndexExists returns true if the collection has a unique index on exactly the fields, in any order
+	UniqueIndexExists(collection string, fields []string) bool
+	// ReplaceCollection atomically replaces the documents of a collection by the documents returned by update
+	// The documents given to update must not be modified, if update returns an error the collection is left unchanged.
+	ReplaceCollection(collection string, update func(documents []bson.D) ([]bson.D, error)) error
+}
+
+// writableDatabase returns the database of a run if it can be written into
+func writableDatabase(run *runT, stage string, collection string) (WritableDatabase, error) {
+	database, ok := run.database.(WritableDatabase)
+	if !ok {
+		return nil, newStageError(ErrNotSupported, "%s needs a writable database to write collection %s", stage, collection)
+	}
+	return database, nil
+}
+
+// compileOut compiles {$out: "totals"} and {$out: {coll: "totals"}}
+// The target collection is replaced by the documents that came into the stage, no documents come out of it.
+func compileOut(value any) (stageT, error) {
+	collection, isString := value.(string)
+	if !isString {
+		spec, ok := match.ToDocument(value)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "$out only supports a string or object argument, but found %s", typeName(value))
+		}
+		for _, entry := range spec {
+			switch entry.Key {
+			case "db":
+				return nil, newStageError(ErrNotSupported, "$out to another database is not supported by mongomock")
+			case "coll":
+				collection, ok = entry.Value.(string)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "BSON field '$out.coll' is the wrong type '%s', expected type 'string'", typeName(entry.Value))
+				}
+			default:
+				return nil, newStageError(ErrBadValue, "BSON field '$out.%s' is an unknown field.", entry.Key)
+			}
+		}
+	}
+	err := validateTargetCollection("$out", collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		database, err := writableDatabase(run, "$out", collection)
+		if err != nil {
+			return nil, err
+		}
+
+		err = database.ReplaceCollection(collection, func([]bson.D) ([]bson.D, error) {
+			results := make([]bson.D, len(documents))
+			ids := []any{}
+			for idx, document := range documents {
+				results[idx] = withID(document)
+				id := lookupField(results[idx], "_id")
+				if containsEqual([]any{id}, ids) {
+					return nil, duplicateKeyError(collection, id)
+				}
+				ids = append(ids, id)
+			}
+			return results, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []bson.D{}, nil
+	}, nil
+}
+
+// validateTargetCollection checks the name of the collection $out or $merge writes into
+func validateTargetCollection(stage string, collection string) error {
+	if collection == "" || strings.HasPrefix(collection, "system.") || strings.Contains(collection, "$") {
+		return newStageError(ErrBadValue, "Invalid %s target namespace, '%s'", stage, collection)
+	}
+	return nil
+}
+
+// withID returns the document with a generated _id if it doesn't have one
+func withID(document bson.D) bson.D {
+	if lookupField(document, "_id") != expr.Missing {
+		return document
+	}
+	return append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, document...)
+}
+
+func duplicateKeyError(collection string, id any) error {
+	return newStageError(ErrWriteFailed, "E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", collection, id)
+}
+
+// mergeT is a compiled $merge stage
+type mergeT struct {
+	into           string
+	on             []string
+	onParts        [][]string
+	whenMatched    string
+	whenNotMatched string
+	letNames       []string
+	letValues      []*expr.Expression
+	pipeline       *Pipeline
+}
+
+// mergeAllowedPipelineStages are the stages that can be used within the whenMatched pipeline of $merge
+var mergeAllowedPipelineStages = map[string]bool{
+	"$addFields":   true,
+	"$set":         true,
+	"$project":     true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+// compileMerge compiles {$merge: "totals"} and {$merge: {into: "totals", on: "_id", whenMatched: "merge", whenNotMatched: "insert"}}
+// Every document that came into the stage is written into the target collection, no documents come out of it.
+func compileMerge(value any, compiler *compilerT) (stageT, error) {
+	merge := &mergeT{on: []string{"_id"}, whenMatched: "merge", whenNotMatched: "insert"}
+	var let bson.D
+	var pipeline []bson.D
+	hasLet := false
+	into, isString := value.(string)
+	if !isString {
+		spec, ok := match.ToDocument(value)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "$merge only supports a string or object argument, but found %s", typeName(value))
+		}
+		hasInto := false
+		for _, entry := range spec {
+			var err error
+			switch entry.Key {
+			case "into":
+				into, err = parseMergeInto(entry.Value)
+				hasInto = true
+			case "on":
+				merge.on, err = parseMergeOn(entry.Value)
+			case "let":
+				let, ok = match.ToDocument(entry.Value)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "BSON field '$merge.let' is the wrong type '%s', expected type 'object'", typeName(entry.Value))
+				}
+				hasLet = true
+			case "whenMatched":
+				merge.whenMatched, pipeline, err = parseWhenMatched(entry.Value)
+			case "whenNotMatched":
+				mode, _ := entry.Value.(string)
+				if mode != "insert" && mode != "discard" && mode != "fail" {
+					return nil, newStageError(ErrBadValue, "Enumeration value '%v' for field '$merge.whenNotMatched' is not a valid value.", entry.Value)
+				}
+				merge.whenNotMatched = mode
+			default:
+				return nil, newStageError(ErrBadValue, "BSON field '$merge.%s' is an unknown field.", entry.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !hasInto {
+			return nil, newStageError(ErrBadValue, "BSON field '$merge.into' is missing but a required field")
+		}
+	}
+	err := validateTargetCollection("$merge", into)
+	if err != nil {
+		return nil, err
+	}
+	merge.into = into
+
+	merge.onParts = make([][]string, len(merge.on))
+	for idx, field := range merge.on {
+		merge.onParts[idx], err = parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if merge.whenMatched == "pipeline" {
+		if !hasLet {
+			// Without let the document that came into the stage is available as $$new
+			let = bson.D{{Key: "new", Value: "$$ROOT"}}
+		}
+		for _, entry := range let {
+			err = expr.ValidateVariableName(entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			expression, err := expr.CompileWithVariables(entry.Value, compiler.variables)
+			if err != nil {
+				return nil, err
+			}
+			merge.letNames = append(merge.letNames, entry.Key)
+			merge.letValues = append(merge.letValues, expression)
+		}
+
+		variables := append(append([]string{}, compiler.variables...), merge.letNames...)
+		merge.pipeline, err = compiler.subCompiler("$merge", variables).compile(pipeline)
+		if err != nil {
+			return nil, err
+		}
+	} else if hasLet {
+		return nil, newStageError(ErrBadValue, "Cannot use 'let' variables with 'whenMatched: %s' mode", merge.whenMatched)
+	}
+
+	return merge.run, nil
+}
+
+// parseMergeInto parses the into field of $merge like "totals" or {coll: "totals"}
+func parseMergeInto(value any) (string, error) {
+	if into, ok := value.(string); ok {
+		return into, nil
+	}
+	target, ok := match.ToDocument(value)
+	if !ok {
+		return "", newStageError(ErrBadValue, "BSON field '$merge.into' is the wrong type '%s', expected types '[string, object]'", typeName(value))
+	}
+	into := ""
+	for _, entry := range target {
+		switch entry.Key {
+		case "db":
+			return "", newStageError(ErrNotSupported, "$merge into another database is not supported by mongomock")
+		case "coll":
+			into, ok = entry.Value.(string)
+			if !ok {
+				return "", newStageError(ErrBadValue, "BSON field '$merge.into.coll' is the wrong type '%s', expected type 'string'", typeName(entry.Value))
+			}
+		default:
+			return "", newStageError(ErrBadValue, "BSON field '$merge.into.%s' is an unknown field.", entry.Key)
+		}
+	}
+	return into, nil
+}
+
+// parseMergeOn parses the on field of $merge like "_id" or ["region", "month"]
+func parseMergeOn(value any) ([]string, error) {
+	if field, ok := value.(string); ok {
+		return []string{field}, nil
+	}
+	entries, ok := match.ToArray(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "BSON field '$merge.on' is the wrong type '%s', expected types '[string, array]'", typeName(value))
+	}
+	if len(entries) == 0 {
+		return nil, newStageError(ErrBadValue, "If explicitly specifying $merge 'on', must include at least one field")
+	}
+	fields := make([]string, len(entries))
+	for idx, entry := range entries {
+		field, ok := entry.(string)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "Array passed to $merge 'on' must contain only strings, but found %s", typeName(entry))
+		}
+		for _, existing := range fields[:idx] {
+			if existing == field {
+				return nil, newStageError(ErrBadValue, "Found a duplicate field '%s' in $merge 'on'", field)
+			}
+		}
+		fields[idx] = field
+	}
+	return fields, nil
+}
+
+// parseWhenMatched parses the whenMatched field of $merge, a mode like "replace" or a pipeline
+func parseWhenMatched(value any) (string, []bson.D, error) {
+	if mode, ok := value.(string); ok {
+		switch mode {
+		case "replace", "keepExisting", "merge", "fail":
+			return mode, nil, nil
+		}
+		return "", nil, newStageError(ErrBadValue, "Enumeration value '%s' for field '$merge.whenMatched' is not a valid value.", mode)
+	}
+	if _, ok := match.ToArray(value); !ok {
+		return "", nil, newStageError(ErrBadValue, "BSON field '$merge.whenMatched' is the wrong type '%s', expected types '[string, array]'", typeName(value))
+	}
+	stages, err := Parse(value)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, stage := range stages {
+		if !mergeAllowedPipelineStages[stage[0].Key] {
+			return "", nil, newStageError(ErrBadValue, "Unsupported stage in $merge whenMatched pipeline: %s", stage[0].Key)
+		}
+	}
+	return "pipeline", stages, nil
+}
+
+func (m *mergeT) run(documents []bson.D, run *runT) ([]bson.D, error) {
+	database, err := writableDatabase(run, "$merge", m.into)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.on) != 1 || m.on[0] != "_id" {
+		if !database.UniqueIndexExists(m.into, m.on) {
+			return nil, newStageError(ErrBadValue, "Cannot find index to verify that $merge fields will be unique")
+		}
+	}
+
+	err = database.ReplaceCollection(m.into, func(targetDocuments []bson.D) ([]bson.D, error) {
+		results := make([]bson.D, len(targetDocuments))
+		copy(results, targetDocuments)
+		for _, document := range documents {
+			results, err = m.write(results, document, run)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []bson.D{}, nil
+}
+
+// write merges a single document into the documents of the target collection
+func (m *mergeT) write(targetDocuments []bson.D, document bson.D, run *runT) ([]bson.D, error) {
+	for _, field := range m.on {
+		if field == "_id" {
+			// A document without _id gets a new one, so it won't match any of the target documents
+			document = withID(document)
+		}
+	}
+
+	onValues := make([]any, len(m.onParts))
+	for idx, parts := range m.onParts {
+		value := lookupPath(document, parts)
+		if _, isArray := match.ToArray(value); isArray || isNullish(value) {
+			return nil, newStageError(ErrWriteFailed, "$merge write error: 'on' field '%s' cannot be missing, null, undefined or an array", m.on[idx])
+		}
+		onValues[idx] = value
+	}
+
+	matchIdx := -1
+	for idx, targetDocument := range targetDocuments {
+		matches := true
+		for onIdx, parts := range m.onParts {
+			if match.Compare(lookupPath(targetDocument, parts), onValues[onIdx]) != 0 {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			matchIdx = idx
+			break
+		}
+	}
+
+	if matchIdx == -1 {
+		switch m.whenNotMatched {
+		case "discard":
+			return targetDocuments, nil
+		case "fail":
+			return nil, newStageError(ErrWriteFailed, "$merge could not find a matching document in the target collection for at least one document in the source collection")
+		}
+		document = withID(document)
+		id := lookupField(document, "_id")
+		for _, targetDocument := range targetDocuments {
+			if match.Compare(lookupField(targetDocument, "_id"), id) == 0 {
+				return nil, duplicateKeyError(m.into, id)
+			}
+		}
+		return append(targetDocuments, document), nil
+	}
+
+	target := targetDocuments[matchIdx]
+	var result bson.D
+	switch m.whenMatched {
+	case "keepExisting":
+		return targetDocuments, nil
+	case "fail":
+		return nil, newStageError(ErrWriteFailed, "$merge with whenMatched: fail found an existing document with the same values for the 'on' fields")
+	case "replace":
+		result = document
+	case "merge":
+		result = append(bson.D{}, target...)
+		for _, entry := range document {
+			result = setField(result, entry.Key, entry.Value)
+		}
+	default:
+		variables := expr.Variables{}
+		for name, value := range run.variables {
+			variables[name] = value
+		}
+		for idx, expression := range m.letValues {
+			value, err := expression.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			variables[m.letNames[idx]] = value
+		}
+		pipelineResults, err := m.pipeline.run([]bson.D{target}, run.withVariables(variables))
+		if err != nil {
+			return nil, err
+		}
+		if len(pipelineResults) != 1 {
+			return nil, newStageError(ErrWriteFailed, "$merge whenMatched pipeline must result in a single document, got %d", len(pipelineResults))
+		}
+		result = pipelineResults[0]
+	}
+
+	// Like MongoDB the _id of the matched document is kept and can't be changed
+	targetID := lookupField(target, "_id")
+	resultID := lookupField(result, "_id")
+	if resultID == expr.Missing {
+		result = append(bson.D{{Key: "_id", Value: targetID}}, result...)
+	} else if match.Compare(resultID, targetID) != 0 {
+		return nil, newStageError(ErrWriteFailed, "$merge failed to update the matching document, did you attempt to modify the _id or the shard key?")
+	}
+
+	results := make([]bson.D, len(targetDocuments))
+	copy(results, targetDocuments)
+	results[matchIdx] = result
+	return results, nil
+}
@@ -0,0 +1,523 @@
+package aggregate
+
+import (
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fieldModeT is what a field of a $project, $addFields or $unset specification does
+type fieldModeT int
+
+const (
+	fieldInclude fieldModeT = iota
+	fieldExclude
+	fieldComputed
+	fieldNested
+)
+
+// projectionTreeT is a parsed specification like {name: 1, "address.city": 1, total: {$add: ["$a", "$b"]}}
+// Dotted fields and embedded specifications like {address: {city: 1}} both become nested trees.
+type projectionTreeT struct {
+	fields []*projectionFieldT
+	byName map[string]*projectionFieldT
+	// hasComputed is true if the tree or one of its subtrees contains a computed field
+	hasComputed bool
+}
+
+type projectionFieldT struct {
+	name       string
+	mode       fieldModeT
+	expression *expr.Expression
+	subtree    *projectionTreeT
+}
+
+func newProjectionTree() *projectionTreeT {
+	return &projectionTreeT{byName: map[string]*projectionFieldT{}}
+}
+
+// add adds a field to the tree, path is the full dotted path of the field used for error messages
+func (t *projectionTreeT) add(parts []string, field *projectionFieldT, stage string, path string) error {
+	existing, exists := t.byName[parts[0]]
+	if field.mode == fieldComputed {
+		t.hasComputed = true
+	}
+
+	if len(parts) == 1 {
+		if exists {
+			return newStageError(ErrBadValue, "Invalid %s :: caused by :: Path collision at %s", stage, path)
+		}
+		field.name = parts[0]
+		t.fields = append(t.fields, field)
+		t.byName[field.name] = field
+		return nil
+	}
+
+	if exists && existing.mode != fieldNested {
+		return newStageError(ErrBadValue, "Invalid %s :: caused by :: Path collision at %s", stage, path)
+	}
+	if !exists {
+		existing = &projectionFieldT{name: parts[0], mode: fieldNested, subtree: newProjectionTree()}
+		t.fields = append(t.fields, existing)
+		t.byName[existing.name] = existing
+	}
+	return existing.subtree.add(parts[1:], field, stage, path)
+}
+
+// parseFieldPath validates and splits a field of a specification like "address.city"
+func parseFieldPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, newStageError(ErrBadValue, "FieldPath cannot be constructed with empty string")
+	}
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, newStageError(ErrBadValue, "FieldPath must not contain empty field names")
+		}
+		if strings.HasPrefix(part, "$") {
+			return nil, newStageError(ErrBadValue, "FieldPath field names may not start with '$'. Consider using $getField or $setField.")
+		}
+	}
+	return parts, nil
+}
+
+// isSubSpecification returns true for embedded specifications like {city: 1} as opposed to expressions like {$add: [1, 2]}
+func isSubSpecification(value any) (bson.D, bool) {
+	document, ok := match.ToDocument(value)
+	if !ok || len(document) == 0 || strings.HasPrefix(document[0].Key, "$") {
+		return nil, false
+	}
+	return document, true
+}
+
+// isFlag returns true for the numbers and booleans that include or exclude fields within $project
+func isFlag(value any) bool {
+	switch value.(type) {
+	case bool, int32, int64, float64, primitive.Decimal128:
+		return true
+	}
+	return false
+}
+
+// compileProject compiles a $project stage like {$project: {name: 1, total: {$add: ["$price", "$tax"]}}}
+// Specifications with included or computed fields are inclusion projections, specifications with only excluded fields are exclusion projections.
+func compileProject(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "$project specification must be an object")
+	}
+	if len(spec) == 0 {
+		return nil, newStageError(ErrBadValue, "Invalid $project :: caused by :: projection specification must have at least one field")
+	}
+
+	parser := &projectParserT{tree: newProjectionTree(), variables: variables}
+	err := parser.parse(spec, "")
+	if err != nil {
+		return nil, err
+	}
+	tree := parser.tree
+
+	inclusion := parser.hasInclusion || parser.hasComputed || parser.includesID && !parser.hasExclusion
+	if !inclusion {
+		return func(documents []bson.D, run *runT) ([]bson.D, error) {
+			results := make([]bson.D, len(documents))
+			for idx, document := range documents {
+				results[idx] = excludeFields(document, tree)
+			}
+			return results, nil
+		}, nil
+	}
+
+	if _, ok := tree.byName["_id"]; !ok {
+		// Like MongoDB the _id is included unless it's excluded explicitly
+		id := &projectionFieldT{name: "_id", mode: fieldInclude}
+		tree.fields = append([]*projectionFieldT{id}, tree.fields...)
+		tree.byName["_id"] = id
+	}
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		for idx, document := range documents {
+			result, err := includeFields(document, tree, document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			results[idx] = result
+		}
+		return results, nil
+	}, nil
+}
+
+// Projection is a compiled projection like {name: 1, "address.city": 1, total: {$add: ["$price", "$tax"]}}
+// It projects documents like a $project stage, so it can also be used for the projection of a find query.
+type Projection struct {
+	project stageT
+}
+
+// CompileProjection validates a projection and compiles it, the projection is the specification of a $project stage
+// Errors wrap ErrBadValue or the error of an expression, they don't contain the position of a stage.
+func CompileProjection(spec any) (*Projection, error) {
+	project, err := compileProject(spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Projection{project: project}, nil
+}
+
+// Apply returns the projected copy of a document
+func (p *Projection) Apply(document bson.D) (bson.D, error) {
+	results, err := p.project([]bson.D{expr.Normalize(document).(bson.D)}, newRun(nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// projectParserT parses a $project specification and keeps track of the kind of projection
+type projectParserT struct {
+	tree         *projectionTreeT
+	hasInclusion bool
+	hasExclusion bool
+	hasComputed  bool
+	includesID   bool
+	variables    []string
+}
+
+func (p *projectParserT) parse(spec bson.D, prefix string) error {
+	for _, entry := range spec {
+		path := entry.Key
+		if prefix != "" {
+			path = prefix + "." + entry.Key
+		}
+		parts, err := parseFieldPath(path)
+		if err != nil {
+			return err
+		}
+
+		if subSpec, ok := isSubSpecification(entry.Value); ok {
+			err = p.parse(subSpec, path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if document, ok := match.ToDocument(entry.Value); ok && len(document) == 0 {
+			return newStageError(ErrBadValue, "Invalid $project :: caused by :: An empty sub-projection is not a valid value. Found empty object at path %s", path)
+		}
+
+		field := &projectionFieldT{}
+		value := expr.Normalize(entry.Value)
+		if isFlag(value) {
+			field.mode = fieldExclude
+			if match.Compare(value, 0) != 0 && match.Compare(value, false) != 0 {
+				field.mode = fieldInclude
+			}
+		} else {
+			field.mode = fieldComputed
+			field.expression, err = expr.CompileWithVariables(entry.Value, p.variables)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case path == "_id" && field.mode == fieldInclude:
+			p.includesID = true
+		case path == "_id" && field.mode == fieldExclude:
+		case field.mode == fieldExclude:
+			if p.hasInclusion || p.hasComputed {
+				return newStageError(ErrBadValue, "Invalid $project :: caused by :: Cannot do exclusion on field %s in inclusion projection", path)
+			}
+			p.hasExclusion = true
+		case field.mode == fieldInclude:
+			if p.hasExclusion {
+				return newStageError(ErrBadValue, "Invalid $project :: caused by :: Cannot do inclusion on field %s in exclusion projection", path)
+			}
+			p.hasInclusion = true
+		default:
+			if p.hasExclusion {
+				return newStageError(ErrBadValue, "Invalid $project :: caused by :: Cannot use expression other than $meta in exclusion projection")
+			}
+			p.hasComputed = true
+		}
+
+		err = p.tree.add(parts, field, "$project", path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileAddFields compiles a $addFields stage or its alias $set like {$set: {total: {$add: ["$price", "$tax"]}}}
+func compileAddFields(value any, stage string, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "%s specification stage must be an object", stage)
+	}
+	if len(spec) == 0 {
+		return nil, newStageError(ErrBadValue, "Invalid %s :: caused by :: specification must have at least one field", stage)
+	}
+
+	tree := newProjectionTree()
+	err := parseAddFields(spec, "", tree, stage, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		for idx, document := range documents {
+			result, err := setFields(document, tree, document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			results[idx] = result
+		}
+		return results, nil
+	}, nil
+}
+
+func parseAddFields(spec bson.D, prefix string, tree *projectionTreeT, stage string, variables []string) error {
+	for _, entry := range spec {
+		path := entry.Key
+		if prefix != "" {
+			path = prefix + "." + entry.Key
+		}
+		parts, err := parseFieldPath(path)
+		if err != nil {
+			return err
+		}
+
+		if subSpec, ok := isSubSpecification(entry.Value); ok {
+			err = parseAddFields(subSpec, path, tree, stage, variables)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		expression, err := expr.CompileWithVariables(entry.Value, variables)
+		if err != nil {
+			return err
+		}
+		err = tree.add(parts, &projectionFieldT{mode: fieldComputed, expression: expression}, stage, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileUnset compiles a $unset stage like {$unset: "password"} or {$unset: ["password", "address.street"]}
+func compileUnset(value any) (stageT, error) {
+	var fields []any
+	if field, ok := value.(string); ok {
+		fields = []any{field}
+	} else if _, isDocument := match.ToDocument(value); !isDocument {
+		fields, _ = match.ToArray(value)
+	}
+	if fields == nil {
+		return nil, newStageError(ErrBadValue, "$unset specification must be a string or an array")
+	}
+	if len(fields) == 0 {
+		return nil, newStageError(ErrBadValue, "$unset specification must be a string or an array with at least one field")
+	}
+
+	tree := newProjectionTree()
+	for _, field := range fields {
+		path, ok := field.(string)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "$unset specification must be a string or an array containing only string values")
+		}
+		parts, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		err = tree.add(parts, &projectionFieldT{mode: fieldExclude}, "$unset", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		for idx, document := range documents {
+			results[idx] = excludeFields(document, tree)
+		}
+		return results, nil
+	}, nil
+}
+
+// includeFields applies an inclusion projection to a document
+// Included fields keep their position, computed fields are evaluated against the root document and added after them.
+func includeFields(document bson.D, tree *projectionTreeT, root bson.D, variables expr.Variables) (bson.D, error) {
+	result := bson.D{}
+	for _, entry := range document {
+		field, ok := tree.byName[entry.Key]
+		if !ok {
+			continue
+		}
+		switch field.mode {
+		case fieldInclude:
+			result = append(result, entry)
+		case fieldNested:
+			value, err := includeNestedFields(entry.Value, field.subtree, root, variables)
+			if err != nil {
+				return nil, err
+			}
+			if value != expr.Missing {
+				result = append(result, bson.E{Key: entry.Key, Value: value})
+			}
+		}
+	}
+
+	for _, field := range tree.fields {
+		var value any
+		var err error
+		switch {
+		case field.mode == fieldComputed:
+			value, err = field.expression.EvaluateWithVariables(root, variables)
+		case field.mode == fieldNested && field.subtree.hasComputed && lookupField(document, field.name) == expr.Missing:
+			value, err = includeFields(bson.D{}, field.subtree, root, variables)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value != expr.Missing {
+			result = append(result, bson.E{Key: field.name, Value: value})
+		}
+	}
+	return result, nil
+}
+
+// includeNestedFields applies an inclusion projection to the value of an embedded field
+// Values other than documents and arrays are left out, unless the projection computes fields within them.
+func includeNestedFields(value any, tree *projectionTreeT, root bson.D, variables expr.Variables) (any, error) {
+	switch typedValue := value.(type) {
+	case bson.D:
+		return includeFields(typedValue, tree, root, variables)
+	case bson.A:
+		results := bson.A{}
+		for _, entry := range typedValue {
+			result, err := includeNestedFields(entry, tree, root, variables)
+			if err != nil {
+				return nil, err
+			}
+			if result != expr.Missing {
+				results = append(results, result)
+			}
+		}
+		return results, nil
+	}
+
+	if tree.hasComputed {
+		return includeFields(bson.D{}, tree, root, variables)
+	}
+	return expr.Missing, nil
+}
+
+// excludeFields applies an exclusion projection to a document
+func excludeFields(document bson.D, tree *projectionTreeT) bson.D {
+	result := bson.D{}
+	for _, entry := range document {
+		field, ok := tree.byName[entry.Key]
+		switch {
+		case !ok || field.mode == fieldInclude:
+			result = append(result, entry)
+		case field.mode == fieldNested:
+			result = append(result, bson.E{Key: entry.Key, Value: excludeNestedFields(entry.Value, field.subtree)})
+		}
+	}
+	return result
+}
+
+func excludeNestedFields(value any, tree *projectionTreeT) any {
+	switch typedValue := value.(type) {
+	case bson.D:
+		return excludeFields(typedValue, tree)
+	case bson.A:
+		results := make(bson.A, len(typedValue))
+		for idx, entry := range typedValue {
+			results[idx] = excludeNestedFields(entry, tree)
+		}
+		return results
+	}
+	return value
+}
+
+// setFields sets the computed fields of a $addFields specification on a copy of the document
+// Existing fields keep their position, fields set to Missing are removed.
+func setFields(document bson.D, tree *projectionTreeT, root bson.D, variables expr.Variables) (bson.D, error) {
+	result := make(bson.D, len(document))
+	copy(result, document)
+
+	for _, field := range tree.fields {
+		var value any
+		var err error
+		if field.mode == fieldComputed {
+			value, err = field.expression.EvaluateWithVariables(root, variables)
+		} else {
+			value, err = setNestedFields(lookupField(result, field.name), field.subtree, root, variables)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = setField(result, field.name, value)
+	}
+	return result, nil
+}
+
+// setNestedFields sets computed fields within an embedded field
+// Like MongoDB the fields are set on every document within arrays and values that are not documents are replaced by one.
+func setNestedFields(value any, tree *projectionTreeT, root bson.D, variables expr.Variables) (any, error) {
+	switch typedValue := value.(type) {
+	case bson.D:
+		return setFields(typedValue, tree, root, variables)
+	case bson.A:
+		results := make(bson.A, len(typedValue))
+		for idx, entry := range typedValue {
+			result, err := setNestedFields(entry, tree, root, variables)
+			if err != nil {
+				return nil, err
+			}
+			results[idx] = result
+		}
+		return results, nil
+	}
+	return setFields(bson.D{}, tree, root, variables)
+}
+
+// lookupField returns the value of a top level field, or Missing if the document does not have it
+func lookupField(document bson.D, key string) any {
+	for _, entry := range document {
+		if entry.Key == key {
+			return entry.Value
+		}
+	}
+	return expr.Missing
+}
+
+// setField replaces or appends a field of a document, setting a field to Missing removes it
+// The document is modified, so it should be owned by the caller.
+func setField(document bson.D, key string, value any) bson.D {
+	for idx, entry := range document {
+		if entry.Key != key {
+			continue
+		}
+		if value == expr.Missing {
+			return append(document[:idx], document[idx+1:]...)
+		}
+		document[idx].Value = value
+		return document
+	}
+
+	if value == expr.Missing {
+		return document
+	}
+	return append(document, bson.E{Key: key, Value: value})
+}
@@ -0,0 +1,323 @@
+package aggregate
+
+import (
+	"math"
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// compileUnwind compiles {$unwind: "$tags"} and {$unwind: {path: "$tags", includeArrayIndex: "idx", preserveNullAndEmptyArrays: true}}
+func compileUnwind(value any) (stageT, error) {
+	var path, indexField string
+	preserve := false
+	if text, ok := value.(string); ok {
+		path = text
+	} else {
+		spec, ok := match.ToDocument(value)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "expected either a string or an object as specification for $unwind stage, got %s", typeName(value))
+		}
+		hasPath := false
+		for _, entry := range spec {
+			switch entry.Key {
+			case "path":
+				path, ok = entry.Value.(string)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "expected a string as the path for $unwind stage, got %s", typeName(entry.Value))
+				}
+				hasPath = true
+			case "includeArrayIndex":
+				indexField, ok = entry.Value.(string)
+				if !ok || indexField == "" {
+					return nil, newStageError(ErrBadValue, "expected a non-empty string for the includeArrayIndex option to $unwind stage, got %s", typeName(entry.Value))
+				}
+				if strings.HasPrefix(indexField, "$") {
+					return nil, newStageError(ErrBadValue, "includeArrayIndex option to $unwind stage should not be prefixed with a '$': %s", indexField)
+				}
+			case "preserveNullAndEmptyArrays":
+				preserve, ok = entry.Value.(bool)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage, got %s", typeName(entry.Value))
+				}
+			default:
+				return nil, newStageError(ErrBadValue, "unrecognized option to $unwind stage: %s", entry.Key)
+			}
+		}
+		if !hasPath {
+			return nil, newStageError(ErrBadValue, "no path specified to $unwind stage")
+		}
+	}
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, newStageError(ErrBadValue, "path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	parts, err := parseFieldPath(path[1:])
+	if err != nil {
+		return nil, err
+	}
+	var indexParts []string
+	if indexField != "" {
+		indexParts, err = parseFieldPath(indexField)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := []bson.D{}
+		for _, document := range documents {
+			value := lookupPath(document, parts)
+			entries, isArray := match.ToArray(value)
+			if !isArray && !isNullish(value) {
+				entries = []any{value}
+			}
+
+			if len(entries) == 0 {
+				if !preserve {
+					continue
+				}
+				result := document
+				if isArray {
+					// Like MongoDB an empty array is left out of the document
+					result = setPath(document, parts, expr.Missing)
+				}
+				if indexParts != nil {
+					result = setPath(result, indexParts, nil)
+				}
+				results = append(results, result)
+				continue
+			}
+
+			for idx, entry := range entries {
+				result := setPath(document, parts, entry)
+				if indexParts != nil {
+					var index any = int64(idx)
+					if !isArray {
+						index = nil
+					}
+					result = setPath(result, indexParts, index)
+				}
+				results = append(results, result)
+			}
+		}
+		return results, nil
+	}, nil
+}
+
+// lookupPath returns the value of a dotted field within nested documents
+// Unlike match.Lookup arrays are not walked through, a path through an array is missing.
+func lookupPath(document bson.D, parts []string) any {
+	var value any = document
+	for _, part := range parts {
+		subDocument, ok := match.ToDocument(value)
+		if !ok {
+			return expr.Missing
+		}
+		value = lookupField(subDocument, part)
+	}
+	return value
+}
+
+func isNullish(value any) bool {
+	return value == nil || value == expr.Missing
+}
+
+// compileReplaceRoot compiles {$replaceRoot: {newRoot: "$address"}} and its alias {$replaceWith: "$address"}
+func compileReplaceRoot(value any, stage string, variables []string) (stageT, error) {
+	description := "'replacement document'"
+	if stage == "$replaceRoot" {
+		description = "'newRoot' expression"
+		spec, ok := match.ToDocument(value)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "expected an object as specification for $replaceRoot stage, got %s", typeName(value))
+		}
+		hasNewRoot := false
+		for _, entry := range spec {
+			if entry.Key != "newRoot" {
+				return nil, newStageError(ErrBadValue, "unrecognized option to $replaceRoot stage: %s, only valid option is 'newRoot'.", entry.Key)
+			}
+			value, hasNewRoot = entry.Value, true
+		}
+		if !hasNewRoot {
+			return nil, newStageError(ErrBadValue, "no newRoot specified for the $replaceRoot stage")
+		}
+	}
+
+	expression, err := expr.CompileWithVariables(value, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		for idx, document := range documents {
+			newRoot, err := expression.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			result, ok := match.ToDocument(newRoot)
+			if !ok || newRoot == expr.Missing {
+				var shown any = newRoot
+				if newRoot == expr.Missing {
+					shown = "MISSING"
+				}
+				return nil, newStageError(
+					ErrBadValue,
+					"%s must evaluate to an object, but resulting value was: %v. Type of resulting value: '%s'.",
+					description, shown, typeName(newRoot),
+				)
+			}
+			results[idx] = result
+		}
+		return results, nil
+	}, nil
+}
+
+// compileSortByCount compiles {$sortByCount: "$category"}
+// It's the same as grouping by the expression with a count followed by sorting on the count in descending order.
+func compileSortByCount(value any, variables []string) (stageT, error) {
+	text, isString := value.(string)
+	spec, isDocument := match.ToDocument(value)
+	isPath := isString && strings.HasPrefix(text, "$")
+	isExpression := isDocument && len(spec) == 1 && strings.HasPrefix(spec[0].Key, "$")
+	if !isPath && !isExpression {
+		return nil, newStageError(ErrBadValue, "the sortByCount field must be defined as a $-prefixed path or an expression inside an object")
+	}
+
+	group, err := compileGroup(bson.D{
+		{Key: "_id", Value: value},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}},
+	}, variables)
+	if err != nil {
+		return nil, err
+	}
+	sortByCount, err := compileSort(bson.D{{Key: "count", Value: int32(-1)}})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		documents, err := group(documents, run)
+		if err != nil {
+			return nil, err
+		}
+		return sortByCount(documents, run)
+	}, nil
+}
+
+// compileSample compiles {$sample: {size: 3}}, it selects documents in a random order without duplicates
+func compileSample(value any) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $sample stage specification must be an object")
+	}
+
+	size := int64(-1)
+	for _, entry := range spec {
+		if entry.Key != "size" {
+			return nil, newStageError(ErrBadValue, "unrecognized option to $sample: %s", entry.Key)
+		}
+		number := expr.Normalize(entry.Value)
+		switch typedNumber := number.(type) {
+		case int32:
+			size = int64(typedNumber)
+		case int64:
+			size = typedNumber
+		case float64:
+			if math.IsNaN(typedNumber) {
+				return nil, newStageError(ErrBadValue, "size argument to $sample must be a number")
+			}
+			size = int64(math.Max(math.Min(typedNumber, math.MaxInt64), math.MinInt64))
+		default:
+			return nil, newStageError(ErrBadValue, "size argument to $sample must be a number")
+		}
+		if size < 0 {
+			return nil, newStageError(ErrBadValue, "size argument to $sample must not be negative")
+		}
+	}
+	if size < 0 {
+		return nil, newStageError(ErrBadValue, "$sample stage must specify a size")
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		copy(results, documents)
+		if int64(len(results)) > size {
+			// Only the first size documents of a Fisher-Yates shuffle are needed
+			for idx := 0; int64(idx) < size; idx++ {
+				swapIdx := idx + int(run.random()*float64(len(results)-idx))
+				results[idx], results[swapIdx] = results[swapIdx], results[idx]
+			}
+			return results[:size], nil
+		}
+
+		for idx := len(results) - 1; idx > 0; idx-- {
+			swapIdx := int(run.random() * float64(idx+1))
+			results[idx], results[swapIdx] = results[swapIdx], results[idx]
+		}
+		return results, nil
+	}, nil
+}
+
+// compileUnionWith compiles {$unionWith: "archive"} and {$unionWith: {coll: "archive", pipeline: [...]}}
+// The documents of the other collection, after running them through the pipeline, are added after the input documents.
+func compileUnionWith(value any, compiler *compilerT) (stageT, error) {
+	collection, isString := value.(string)
+	var pipeline *Pipeline
+	if !isString {
+		spec, ok := match.ToDocument(value)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "the $unionWith stage specification must be an object or string, but found %s", typeName(value))
+		}
+		for _, entry := range spec {
+			switch entry.Key {
+			case "coll":
+				if _, isDocument := match.ToDocument(entry.Value); isDocument {
+					return nil, newStageError(ErrNotSupported, "$unionWith from another database is not supported by mongomock")
+				}
+				collection, ok = entry.Value.(string)
+				if !ok {
+					return nil, newStageError(ErrBadValue, "$unionWith argument 'coll' must be a string, but found %s", typeName(entry.Value))
+				}
+			case "pipeline":
+				if _, ok := match.ToArray(entry.Value); !ok {
+					return nil, newStageError(ErrBadValue, "$unionWith argument 'pipeline' must be an array, but found %s", typeName(entry.Value))
+				}
+				var err error
+				pipeline, err = compiler.subCompiler("$unionWith", compiler.variables).compile(entry.Value)
+				if err != nil {
+					return nil, err
+				}
+			default:
+				return nil, newStageError(ErrBadValue, "unknown argument to $unionWith: %s", entry.Key)
+			}
+		}
+	}
+	if collection == "" {
+		return nil, newStageError(ErrBadValue, "must specify 'coll' field for a $unionWith")
+	}
+	compiler.collections[collection] = true
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		if run.database == nil {
+			return nil, newStageError(ErrNotSupported, "$unionWith needs a database to read collection %s from", collection)
+		}
+		unionDocuments, err := run.database.Collection(collection)
+		if err != nil {
+			return nil, err
+		}
+		if pipeline != nil {
+			unionDocuments, err = pipeline.run(unionDocuments, run)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		results := make([]bson.D, 0, len(documents)+len(unionDocuments))
+		results = append(results, documents...)
+		return append(results, unionDocuments...), nil
+	}, nil
+}
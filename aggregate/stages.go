@@ -0,0 +1,327 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileMatch compiles a $match stage using the match package
+func compileMatch(value any, variables []string) (stageT, error) {
+	filter, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the match filter must be an expression in an object")
+	}
+	if hasText(filter) {
+		return nil, newStageError(ErrBadValue, "$match with $text is only allowed as the first pipeline stage")
+	}
+	matches, err := compileFilter(filter, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := []bson.D{}
+		for _, document := range documents {
+			matched, err := matches(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				results = append(results, document)
+			}
+		}
+		return results, nil
+	}, nil
+}
+
+// filterT is a compiled $match filter
+type filterT func(document bson.D, variables expr.Variables) (bool, error)
+
+// compileFilter compiles a $match filter
+// The match package doesn't know about expressions, so $expr at the top level and within $and, $or and $nor is compiled here.
+func compileFilter(filter bson.D, variables []string) (filterT, error) {
+	plainFilter := bson.D{}
+	filters := []filterT{}
+	for _, entry := range filter {
+		switch {
+		case entry.Key == "$expr":
+			expression, err := expr.CompileWithVariables(entry.Value, variables)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, func(document bson.D, variables expr.Variables) (bool, error) {
+				value, err := expression.EvaluateWithVariables(document, variables)
+				return expr.IsTrue(value), err
+			})
+		case isLogicalOperator(entry.Key) && containsExpr(entry.Value):
+			logicalFilter, err := compileLogicalFilter(entry.Key, entry.Value, variables)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, logicalFilter)
+		default:
+			plainFilter = append(plainFilter, entry)
+		}
+	}
+
+	matcher, err := match.Compile(plainFilter)
+	if err != nil {
+		return nil, err
+	}
+	if matcher.HasNear() {
+		return nil, newStageError(ErrBadValue, "$geoNear, $near, and $nearSphere are not allowed in this context")
+	}
+
+	return func(document bson.D, variables expr.Variables) (bool, error) {
+		if !matcher.Match(document) {
+			return false, nil
+		}
+		for _, filter := range filters {
+			matched, err := filter(document, variables)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+// compileLogicalFilter compiles a $and, $or or $nor that contains $expr
+func compileLogicalFilter(operator string, value any, variables []string) (filterT, error) {
+	entries, ok := match.ToArray(value)
+	if !ok || len(entries) == 0 {
+		return nil, newStageError(ErrBadValue, "%s must be a nonempty array", operator)
+	}
+	filters := make([]filterT, len(entries))
+	for idx, entry := range entries {
+		filter, ok := match.ToDocument(entry)
+		if !ok {
+			return nil, newStageError(ErrBadValue, "$or/$and/$nor entries need to be full objects")
+		}
+		var err error
+		filters[idx], err = compileFilter(filter, variables)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(document bson.D, variables expr.Variables) (bool, error) {
+		for _, filter := range filters {
+			matched, err := filter(document, variables)
+			if err != nil {
+				return false, err
+			}
+			if operator == "$and" && !matched {
+				return false, nil
+			}
+			if operator != "$and" && matched {
+				return operator == "$or", nil
+			}
+		}
+		return operator != "$or", nil
+	}, nil
+}
+
+func isLogicalOperator(key string) bool {
+	return key == "$and" || key == "$or" || key == "$nor"
+}
+
+// containsExpr returns true if the entries of a $and, $or or $nor contain $expr
+func containsExpr(value any) bool {
+	entries, _ := match.ToArray(value)
+	for _, entry := range entries {
+		filter, _ := match.ToDocument(entry)
+		for _, filterEntry := range filter {
+			if filterEntry.Key == "$expr" || isLogicalOperator(filterEntry.Key) && containsExpr(filterEntry.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasText returns true if a filter contains $text at the top level or within a top level $and
+func hasText(filter bson.D) bool {
+	for _, entry := range filter {
+		if entry.Key == "$text" {
+			return true
+		}
+		if entry.Key != "$and" {
+			continue
+		}
+		entries, _ := match.ToArray(entry.Value)
+		for _, andEntry := range entries {
+			andFilter, _ := match.ToDocument(andEntry)
+			if hasText(andFilter) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compileSort compiles a $sort stage like {$sort: {age: -1, name: 1}}
+func compileSort(value any) (stageT, error) {
+	sortDocument, directions, err := parseSort(value, "$sort")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		results := make([]bson.D, len(documents))
+		copy(results, documents)
+
+		sortValues := make([][]any, len(results))
+		for idx, document := range results {
+			sortValues[idx] = documentSortValues(document, sortDocument, directions)
+		}
+
+		indexes := make([]int, len(results))
+		for idx := range indexes {
+			indexes[idx] = idx
+		}
+		sort.SliceStable(indexes, func(i, j int) bool {
+			return compareSortValues(sortValues[indexes[i]], sortValues[indexes[j]], directions) < 0
+		})
+
+		for idx, documentIdx := range indexes {
+			results[idx] = documents[documentIdx]
+		}
+		return results, nil
+	}, nil
+}
+
+// parseSort validates a sort specification like {price: -1, _id: 1} and returns the direction of every key
+func parseSort(value any, stage string) (bson.D, []int, error) {
+	sortDocument, ok := match.ToDocument(value)
+	if !ok {
+		return nil, nil, newStageError(ErrBadValue, "the %s key specification must be an object", stage)
+	}
+	if len(sortDocument) == 0 {
+		return nil, nil, newStageError(ErrBadValue, "%s stage must have at least one sort key", stage)
+	}
+
+	directions := make([]int, len(sortDocument))
+	for idx, entry := range sortDocument {
+		switch {
+		case match.Compare(entry.Value, 1) == 0:
+			directions[idx] = 1
+		case match.Compare(entry.Value, -1) == 0:
+			directions[idx] = -1
+		default:
+			if _, isDocument := match.ToDocument(entry.Value); isDocument {
+				return nil, nil, newStageError(ErrNotSupported, "$meta sort keys are not supported by mongomock within aggregations")
+			}
+			return nil, nil, newStageError(ErrBadValue, "%s key ordering must be 1 (for ascending) or -1 (for descending)", stage)
+		}
+	}
+	return sortDocument, directions, nil
+}
+
+// documentSortValues returns the values a document is sorted on, for arrays this is the lowest or highest element
+func documentSortValues(document bson.D, sortDocument bson.D, directions []int) []any {
+	values := make([]any, len(sortDocument))
+	for idx, entry := range sortDocument {
+		values[idx] = match.SortValue(document, entry.Key, directions[idx] == -1)
+	}
+	return values
+}
+
+// compareSortValues compares the sort values of two documents, it's negative if a sorts before b
+func compareSortValues(a []any, b []any, directions []int) int {
+	for idx, direction := range directions {
+		result := match.Compare(a[idx], b[idx])
+		if result != 0 {
+			return result * direction
+		}
+	}
+	return 0
+}
+
+// compileLimit compiles a $limit stage like {$limit: 10}
+func compileLimit(value any) (stageT, error) {
+	limit, err := parseWholeNumber(value, "$limit")
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, newStageError(ErrBadValue, "the limit must be positive")
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		if int64(len(documents)) > limit {
+			documents = documents[:limit]
+		}
+		return documents, nil
+	}, nil
+}
+
+// compileSkip compiles a $skip stage like {$skip: 10}
+func compileSkip(value any) (stageT, error) {
+	skip, err := parseWholeNumber(value, "$skip")
+	if err != nil {
+		return nil, err
+	}
+	if skip < 0 {
+		return nil, newStageError(ErrBadValue, "invalid argument to $skip stage: Expected a non-negative number in: $skip: %d", skip)
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		if int64(len(documents)) <= skip {
+			return []bson.D{}, nil
+		}
+		return documents[skip:], nil
+	}, nil
+}
+
+// compileCount compiles a $count stage like {$count: "total"}
+// Like MongoDB no document is returned if there are no input documents.
+func compileCount(value any) (stageT, error) {
+	name, ok := expr.Normalize(value).(string)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the count field must be a non-empty string")
+	}
+	err := validateFieldName(name, "the count field")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		if len(documents) == 0 {
+			return []bson.D{}, nil
+		}
+
+		var count any = int32(len(documents))
+		if len(documents) > math.MaxInt32 {
+			count = int64(len(documents))
+		}
+		return []bson.D{{{Key: name, Value: count}}}, nil
+	}, nil
+}
+
+// parseWholeNumber parses the value of stages like $limit and $skip, it should be a number without a fraction like 5 or 5.0
+func parseWholeNumber(value any, stage string) (int64, error) {
+	switch number := expr.Normalize(value).(type) {
+	case int32:
+		return int64(number), nil
+	case int64:
+		return number, nil
+	case float64:
+		if number == math.Trunc(number) && number >= math.MinInt64 && number < math.MaxInt64 {
+			return int64(number), nil
+		}
+		return 0, newStageError(ErrBadValue, "invalid argument to %s stage: Cannot represent as a 64-bit integer: %v", stage, number)
+	case primitive.Decimal128:
+		parsed, err := strconv.ParseFloat(number.String(), 64)
+		if err == nil {
+			return parseWholeNumber(parsed, stage)
+		}
+	}
+	return 0, newStageError(ErrBadValue, "invalid argument to %s stage: Expected a number", stage)
+}
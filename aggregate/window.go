@@ -0,0 +1,468 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// windowFunctionT computes an output field of $setWindowFields for every document of a partition
+type windowFunctionT func(partition *partitionT, run *runT) ([]any, error)
+
+// partitionT contains the documents of a single partition of $setWindowFields, sorted on sortBy
+type partitionT struct {
+	documents []bson.D
+	// sortValues are the values of the sortBy field if sortBy has a single field, as used by range-based windows and ranking
+	sortValues []any
+	descending bool
+}
+
+// windowFieldT is a compiled output field of $setWindowFields
+type windowFieldT struct {
+	path     []string
+	function windowFunctionT
+}
+
+// windowCompilerT is the state of compiling the output fields of $setWindowFields
+type windowCompilerT struct {
+	sortBy     bson.D
+	directions []int
+	variables  []string
+}
+
+// singleSortBy returns true if sortBy has exactly one field, as required by range-based windows and ranking
+func (c *windowCompilerT) singleSortBy() bool {
+	return len(c.sortBy) == 1
+}
+
+// windowAccumulators are the accumulators of $group that can be used as window functions
+var windowAccumulators = map[string]bool{
+	"$addToSet":   true,
+	"$avg":        true,
+	"$bottom":     true,
+	"$bottomN":    true,
+	"$count":      true,
+	"$first":      true,
+	"$firstN":     true,
+	"$last":       true,
+	"$lastN":      true,
+	"$max":        true,
+	"$maxN":       true,
+	"$median":     true,
+	"$min":        true,
+	"$minN":       true,
+	"$percentile": true,
+	"$push":       true,
+	"$stdDevPop":  true,
+	"$stdDevSamp": true,
+	"$sum":        true,
+	"$top":        true,
+	"$topN":       true,
+}
+
+// compileSetWindowFields compiles {$setWindowFields: {partitionBy: "$state", sortBy: {date: 1}, output: {total: {$sum: "$qty", window: {documents: ["unbounded", "current"]}}}}}
+// The documents come out sorted on partitionBy and sortBy, with the output fields added.
+func compileSetWindowFields(value any, variables []string) (stageT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "the $setWindowFields stage specification must be an object, found %s", typeName(value))
+	}
+
+	compiler := &windowCompilerT{variables: variables}
+	var partitionBy *expr.Expression
+	var output bson.D
+	hasOutput := false
+	for _, entry := range spec {
+		var err error
+		switch entry.Key {
+		case "partitionBy":
+			partitionBy, err = expr.CompileWithVariables(entry.Value, variables)
+		case "sortBy":
+			compiler.sortBy, compiler.directions, err = parseSort(entry.Value, "sortBy")
+		case "output":
+			output, hasOutput = match.ToDocument(entry.Value)
+			if !hasOutput {
+				return nil, newStageError(ErrBadValue, "BSON field '$setWindowFields.output' is the wrong type '%s', expected type 'object'", typeName(entry.Value))
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "BSON field '$setWindowFields.%s' is an unknown field.", entry.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !hasOutput {
+		return nil, newStageError(ErrBadValue, "BSON field '$setWindowFields.output' is missing but a required field")
+	}
+
+	fields := make([]windowFieldT, len(output))
+	for idx, entry := range output {
+		path, err := parseFieldPath(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		function, err := compiler.compileField(entry.Key, entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		fields[idx] = windowFieldT{path: path, function: function}
+	}
+
+	var sortParts []string
+	if compiler.singleSortBy() {
+		sortParts = strings.Split(compiler.sortBy[0].Key, ".")
+	}
+
+	return func(documents []bson.D, run *runT) ([]bson.D, error) {
+		partitionValues := make([]any, len(documents))
+		sortValues := make([][]any, len(documents))
+		for idx, document := range documents {
+			if partitionBy != nil {
+				partitionValue, err := partitionBy.EvaluateWithVariables(document, run.variables)
+				if err != nil {
+					return nil, err
+				}
+				if _, isArray := match.ToArray(partitionValue); isArray {
+					return nil, newStageError(ErrBadValue, "An expression used to partition cannot evaluate to value of type array")
+				}
+				if partitionValue != expr.Missing {
+					partitionValues[idx] = partitionValue
+				}
+			}
+			if compiler.sortBy != nil {
+				sortValues[idx] = documentSortValues(document, compiler.sortBy, compiler.directions)
+			}
+		}
+
+		indexes := make([]int, len(documents))
+		for idx := range indexes {
+			indexes[idx] = idx
+		}
+		sort.SliceStable(indexes, func(i, j int) bool {
+			result := match.Compare(partitionValues[indexes[i]], partitionValues[indexes[j]])
+			if result == 0 && compiler.sortBy != nil {
+				result = compareSortValues(sortValues[indexes[i]], sortValues[indexes[j]], compiler.directions)
+			}
+			return result < 0
+		})
+
+		results := make([]bson.D, 0, len(documents))
+		for start := 0; start < len(indexes); {
+			end := start + 1
+			for end < len(indexes) && match.Compare(partitionValues[indexes[start]], partitionValues[indexes[end]]) == 0 {
+				end++
+			}
+
+			partition := &partitionT{documents: make([]bson.D, end-start)}
+			for idx, documentIdx := range indexes[start:end] {
+				partition.documents[idx] = documents[documentIdx]
+			}
+			if sortParts != nil {
+				partition.descending = compiler.directions[0] == -1
+				partition.sortValues = make([]any, len(partition.documents))
+				for idx, document := range partition.documents {
+					partition.sortValues[idx] = lookupPath(document, sortParts)
+				}
+			}
+
+			outputs := make([][]any, len(fields))
+			for idx, field := range fields {
+				var err error
+				outputs[idx], err = field.function(partition, run)
+				if err != nil {
+					return nil, err
+				}
+			}
+			for idx, document := range partition.documents {
+				for fieldIdx, field := range fields {
+					document = setPath(document, field.path, outputs[fieldIdx][idx])
+				}
+				results = append(results, document)
+			}
+			start = end
+		}
+		return results, nil
+	}, nil
+}
+
+// compileField compiles an output field like {$sum: "$qty", window: {documents: [-1, 1]}}
+func (c *windowCompilerT) compileField(name string, value any) (windowFunctionT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "The field '%s' must be an object", name)
+	}
+
+	var operator string
+	var argument any
+	var window *windowT
+	for _, entry := range spec {
+		switch {
+		case entry.Key == "window":
+			var err error
+			window, err = c.parseWindow(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(entry.Key, "$") && operator == "":
+			operator, argument = entry.Key, entry.Value
+		default:
+			return nil, newStageError(ErrBadValue, "Window function found an unknown argument: %s", entry.Key)
+		}
+	}
+	if operator == "" {
+		return nil, newStageError(ErrBadValue, "Expected a window function in the field '%s'", name)
+	}
+
+	switch operator {
+	case "$rank", "$denseRank", "$documentNumber":
+		return c.compileRank(operator, argument, window)
+	case "$shift":
+		return c.compileShift(argument, window)
+	case "$expMovingAvg":
+		return c.compileExpMovingAvg(argument, window)
+	case "$derivative", "$integral":
+		return c.compileCalculus(operator, argument, window)
+	case "$covariancePop", "$covarianceSamp":
+		return c.compileCovariance(operator, argument, window)
+	case "$locf", "$linearFill":
+		return c.compileFill(operator, argument, window)
+	}
+	if !windowAccumulators[operator] {
+		return nil, newStageError(ErrBadValue, "Unrecognized window function, %s", operator)
+	}
+
+	accumulator, err := expr.CompileAccumulatorWithVariables(bson.D{{Key: operator, Value: argument}}, name, c.variables)
+	if err != nil {
+		return nil, err
+	}
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		return eachWindow(partition, window, func(start int, end int) (any, error) {
+			accumulation := accumulator.NewWithVariables(run.variables)
+			for _, document := range partition.documents[start:end] {
+				err := accumulation.Add(document)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nullIfMissing(accumulation.Result()), nil
+		})
+	}, nil
+}
+
+// eachWindow calls compute with the positions [start, end) of the window of every document of a partition
+// Without a window all documents of the partition are used.
+func eachWindow(partition *partitionT, window *windowT, compute func(start int, end int) (any, error)) ([]any, error) {
+	if window == nil {
+		window = &windowT{lower: windowBoundT{unbounded: true}, upper: windowBoundT{unbounded: true}}
+	}
+	results := make([]any, len(partition.documents))
+	for idx := range partition.documents {
+		start, end, err := window.bounds(partition, idx)
+		if err != nil {
+			return nil, err
+		}
+		results[idx], err = compute(start, end)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func nullIfMissing(value any) any {
+	if value == expr.Missing {
+		return nil
+	}
+	return value
+}
+
+// windowT is the window of a window function, like {documents: ["unbounded", "current"]} or {range: [-7, 0], unit: "day"}
+type windowT struct {
+	isRange bool
+	lower   windowBoundT
+	upper   windowBoundT
+	unit    string
+}
+
+// windowBoundT is a lower or upper bound of a window, "current" is an offset of 0
+type windowBoundT struct {
+	unbounded bool
+	offset    float64
+}
+
+const windowSpecificationMessage = "'window' field can only contain 'documents' as the only argument or 'range' with an optional 'unit' field"
+
+// parseWindow parses the window of an output field of $setWindowFields
+func (c *windowCompilerT) parseWindow(value any) (*windowT, error) {
+	spec, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "'window' field must be an object")
+	}
+
+	window := &windowT{}
+	var bounds any
+	hasDocuments, hasRange := false, false
+	for _, entry := range spec {
+		switch entry.Key {
+		case "documents":
+			bounds, hasDocuments = entry.Value, true
+		case "range":
+			bounds, hasRange, window.isRange = entry.Value, true, true
+		case "unit":
+			unit, ok := entry.Value.(string)
+			if !ok {
+				return nil, newStageError(ErrBadValue, "'unit' must be a string")
+			}
+			if !isTimeUnit(unit) {
+				return nil, newStageError(ErrBadValue, "unknown time unit value: %s", unit)
+			}
+			window.unit = unit
+		default:
+			return nil, newStageError(ErrBadValue, windowSpecificationMessage)
+		}
+	}
+	if hasDocuments == hasRange || (hasDocuments && window.unit != "") {
+		return nil, newStageError(ErrBadValue, windowSpecificationMessage)
+	}
+
+	entries, ok := match.ToArray(bounds)
+	if !ok || len(entries) != 2 {
+		return nil, newStageError(ErrBadValue, "Window bounds must be a 2-element array: %v", bounds)
+	}
+	var err error
+	window.lower, err = window.parseBound(entries[0])
+	if err != nil {
+		return nil, err
+	}
+	window.upper, err = window.parseBound(entries[1])
+	if err != nil {
+		return nil, err
+	}
+	if !window.lower.unbounded && !window.upper.unbounded && window.lower.offset > window.upper.offset {
+		return nil, newStageError(ErrBadValue, "Lower bound must not exceed upper bound: %v", bounds)
+	}
+
+	switch {
+	case !window.isRange && window.lower.unbounded && window.upper.unbounded:
+		// The whole partition doesn't depend on the order of the documents
+	case window.isRange && !c.singleSortBy():
+		return nil, newStageError(ErrBadValue, "Range-based window requires sortBy a single field")
+	case !window.isRange && c.sortBy == nil:
+		return nil, newStageError(ErrBadValue, "Document-based bounds require a sortBy")
+	}
+	return window, nil
+}
+
+// parseBound parses a bound of a window, "unbounded", "current" or a number
+func (w *windowT) parseBound(value any) (windowBoundT, error) {
+	switch value {
+	case "unbounded":
+		return windowBoundT{unbounded: true}, nil
+	case "current":
+		return windowBoundT{}, nil
+	}
+	offset, ok := toFloat64(expr.Normalize(value))
+	if !ok || math.IsNaN(offset) {
+		return windowBoundT{}, newStageError(ErrBadValue, "Window bounds must be 'unbounded', 'current', or a number")
+	}
+	if offset != math.Trunc(offset) {
+		if !w.isRange {
+			return windowBoundT{}, newStageError(ErrBadValue, "Numeric document-based bounds must be an integer")
+		}
+		if w.unit != "" {
+			return windowBoundT{}, newStageError(ErrBadValue, "With 'unit', range-based bounds must be an integer")
+		}
+	}
+	return windowBoundT{offset: offset}, nil
+}
+
+// bounds returns the positions [start, end) of the documents within the window of the document at idx
+func (w *windowT) bounds(partition *partitionT, idx int) (int, int, error) {
+	if !w.isRange {
+		start, end := 0, len(partition.documents)
+		if !w.lower.unbounded {
+			start = clampIndex(idx+int(w.lower.offset), len(partition.documents))
+		}
+		if !w.upper.unbounded {
+			end = clampIndex(idx+int(w.upper.offset)+1, len(partition.documents))
+		}
+		if start > end {
+			start = end
+		}
+		return start, end, nil
+	}
+
+	current := partition.sortValues[idx]
+	if w.unit != "" {
+		if _, isDate := current.(primitive.DateTime); !isDate {
+			return 0, 0, newStageError(ErrBadValue, "Invalid range: Expected the sortBy field to be a Date, but it was %s", typeName(current))
+		}
+	} else if _, isNumber := toFloat64(expr.Normalize(current)); !isNumber {
+		return 0, 0, newStageError(ErrBadValue, "Invalid range: Expected the sortBy field to be a number, but it was %s", typeName(current))
+	}
+
+	start, end := len(partition.documents), len(partition.documents)
+	for otherIdx, other := range partition.sortValues {
+		if !w.inRange(current, other, partition.descending) {
+			continue
+		}
+		if start == len(partition.documents) {
+			start = otherIdx
+		}
+		end = otherIdx + 1
+	}
+	if start > end {
+		start = end
+	}
+	return start, end, nil
+}
+
+// inRange returns true if the sort value other is within the range-based window of the sort value current
+// Like the document-based bounds a negative bound comes before the current document in the sort order.
+func (w *windowT) inRange(current any, other any, descending bool) bool {
+	direction := 1.0
+	if descending {
+		direction = -1
+	}
+	within := func(bound windowBoundT, isLower bool) bool {
+		if bound.unbounded {
+			return true
+		}
+		var difference int
+		if w.unit != "" {
+			otherDate, isDate := other.(primitive.DateTime)
+			if !isDate {
+				return false
+			}
+			boundDate := addTimeUnits(current.(primitive.DateTime), int64(bound.offset*direction), w.unit)
+			difference = match.Compare(otherDate, boundDate)
+		} else {
+			currentNumber, _ := toFloat64(expr.Normalize(current))
+			otherNumber, isNumber := toFloat64(expr.Normalize(other))
+			if !isNumber {
+				return false
+			}
+			difference = match.Compare(otherNumber, currentNumber+bound.offset*direction)
+		}
+		if (isLower && !descending) || (!isLower && descending) {
+			return difference >= 0
+		}
+		return difference <= 0
+	}
+	return within(w.lower, true) && within(w.upper, false)
+}
+
+func clampIndex(idx int, length int) int {
+	if idx < 0 {
+		return 0
+	}
+	if idx > length {
+		return length
+	}
+	return idx
+}
@@ -0,0 +1,405 @@
+package aggregate
+
+import (
+	"math"
+
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileRank compiles {$rank: {}}, {$denseRank: {}} and {$documentNumber: {}}
+// Documents with the same sortBy value get the same rank, except for $documentNumber.
+func (c *windowCompilerT) compileRank(operator string, argument any, window *windowT) (windowFunctionT, error) {
+	if !c.singleSortBy() {
+		return nil, newStageError(ErrBadValue, "%s must be specified with a top level sortBy expression with exactly one element", operator)
+	}
+	if spec, ok := match.ToDocument(argument); !ok || len(spec) != 0 || window != nil {
+		return nil, newStageError(ErrBadValue, "Rank style window functions take no other arguments")
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		results := make([]any, len(partition.documents))
+		rank, denseRank := int32(0), int32(0)
+		for idx := range partition.documents {
+			if idx == 0 || match.Compare(partition.sortValues[idx], partition.sortValues[idx-1]) != 0 {
+				rank = int32(idx + 1)
+				denseRank++
+			}
+			switch operator {
+			case "$rank":
+				results[idx] = rank
+			case "$denseRank":
+				results[idx] = denseRank
+			default:
+				results[idx] = int32(idx + 1)
+			}
+		}
+		return results, nil
+	}, nil
+}
+
+// compileShift compiles {$shift: {output: "$qty", by: -1, default: 0}}, the value of a document before or after the current one
+func (c *windowCompilerT) compileShift(argument any, window *windowT) (windowFunctionT, error) {
+	if c.sortBy == nil {
+		return nil, newStageError(ErrBadValue, "'$shift' requires a sortBy")
+	}
+	if window != nil {
+		return nil, newStageError(ErrBadValue, "'$shift' does not accept a 'window' field")
+	}
+	spec, ok := match.ToDocument(argument)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "Argument to $shift must be an object")
+	}
+
+	var output *expr.Expression
+	var by int64
+	var defaultValue any
+	hasBy := false
+	for _, entry := range spec {
+		var err error
+		switch entry.Key {
+		case "output":
+			output, err = expr.CompileWithVariables(entry.Value, c.variables)
+		case "by":
+			number, isNumber := toFloat64(expr.Normalize(entry.Value))
+			if !isNumber || number != math.Trunc(number) {
+				return nil, newStageError(ErrBadValue, "'$shift:by' field must be an integer, but found %v", entry.Value)
+			}
+			by, hasBy = int64(number), true
+		case "default":
+			if !isConstant(entry.Value) {
+				return nil, newStageError(ErrBadValue, "'$shift:default' expression must yield a constant value.")
+			}
+			var expression *expr.Expression
+			expression, err = expr.Compile(entry.Value)
+			if err == nil {
+				defaultValue, err = expression.Evaluate(bson.D{})
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "Unknown argument in $shift: %s", entry.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if output == nil {
+		return nil, newStageError(ErrBadValue, "$shift requires an 'output' expression")
+	}
+	if !hasBy {
+		return nil, newStageError(ErrBadValue, "$shift requires 'by' as an integer value")
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		results := make([]any, len(partition.documents))
+		for idx := range partition.documents {
+			shiftedIdx := int64(idx) + by
+			if shiftedIdx < 0 || shiftedIdx >= int64(len(partition.documents)) {
+				results[idx] = defaultValue
+				continue
+			}
+			value, err := output.EvaluateWithVariables(partition.documents[shiftedIdx], run.variables)
+			if err != nil {
+				return nil, err
+			}
+			results[idx] = nullIfMissing(value)
+		}
+		return results, nil
+	}, nil
+}
+
+// compileExpMovingAvg compiles {$expMovingAvg: {input: "$price", N: 3}} and {$expMovingAvg: {input: "$price", alpha: 0.5}}
+// Values that are not numbers are skipped, the result stays the same as the previous document.
+func (c *windowCompilerT) compileExpMovingAvg(argument any, window *windowT) (windowFunctionT, error) {
+	if c.sortBy == nil {
+		return nil, newStageError(ErrBadValue, "$expMovingAvg requires an explicit 'sortBy'")
+	}
+	if window != nil {
+		return nil, newStageError(ErrBadValue, "$expMovingAvg does not accept a 'window' field")
+	}
+	spec, ok := match.ToDocument(argument)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "$expMovingAvg must have exactly one argument that is an object")
+	}
+
+	var input *expr.Expression
+	alpha := math.NaN()
+	for _, entry := range spec {
+		var err error
+		switch entry.Key {
+		case "input":
+			input, err = expr.CompileWithVariables(entry.Value, c.variables)
+		case "N":
+			if !math.IsNaN(alpha) {
+				return nil, newStageError(ErrBadValue, "$expMovingAvg requires either 'N' or 'alpha'")
+			}
+			n, isNumber := toFloat64(expr.Normalize(entry.Value))
+			if !isNumber || n != math.Trunc(n) {
+				return nil, newStageError(ErrBadValue, "'N' field must be an integer, but found type %s", typeName(entry.Value))
+			}
+			if n <= 0 {
+				return nil, newStageError(ErrBadValue, "'N' must be greater than zero. Got %v", entry.Value)
+			}
+			alpha = 2 / (n + 1)
+		case "alpha":
+			if !math.IsNaN(alpha) {
+				return nil, newStageError(ErrBadValue, "$expMovingAvg requires either 'N' or 'alpha'")
+			}
+			number, isNumber := toFloat64(expr.Normalize(entry.Value))
+			if !isNumber || number <= 0 || number >= 1 {
+				return nil, newStageError(ErrBadValue, "'alpha' must be between 0 and 1 (exclusive), found alpha: %v", entry.Value)
+			}
+			alpha = number
+		default:
+			return nil, newStageError(ErrBadValue, "Got unrecognized field in $expMovingAvg, $expMovingAvg sub object must have exactly two fields: An 'input' field, and either an 'N' field or an 'alpha' field")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input == nil || math.IsNaN(alpha) {
+		return nil, newStageError(ErrBadValue, "$expMovingAvg sub object must have exactly two fields: An 'input' field, and either an 'N' field or an 'alpha' field")
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		results := make([]any, len(partition.documents))
+		var average any
+		for idx, document := range partition.documents {
+			value, err := input.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if number, isNumber := toFloat64(expr.Normalize(value)); isNumber {
+				if previous, ok := average.(float64); ok {
+					average = number*alpha + previous*(1-alpha)
+				} else {
+					average = number
+				}
+			}
+			results[idx] = average
+		}
+		return results, nil
+	}, nil
+}
+
+// compileCalculus compiles {$derivative: {input: "$distance", unit: "hour"}} and {$integral: {input: "$kilowatts", unit: "hour"}}
+// The sortBy field is the x axis, with a unit it has to be a date and the x axis is in that unit.
+func (c *windowCompilerT) compileCalculus(operator string, argument any, window *windowT) (windowFunctionT, error) {
+	if !c.singleSortBy() {
+		return nil, newStageError(ErrBadValue, "%s requires a sortBy with exactly one field", operator)
+	}
+	if operator == "$derivative" && window == nil {
+		return nil, newStageError(ErrBadValue, "$derivative requires explicit window bounds")
+	}
+	spec, ok := match.ToDocument(argument)
+	if !ok {
+		return nil, newStageError(ErrBadValue, "%s expects an object, but got a %s", operator, typeName(argument))
+	}
+
+	var input *expr.Expression
+	unit := ""
+	for _, entry := range spec {
+		var err error
+		switch entry.Key {
+		case "input":
+			input, err = expr.CompileWithVariables(entry.Value, c.variables)
+		case "unit":
+			unit, ok = entry.Value.(string)
+			if !ok || !isTimeUnit(unit) {
+				return nil, newStageError(ErrBadValue, "unknown time unit value: %v", entry.Value)
+			}
+			if _, fixed := unitMilliseconds[unit]; !fixed {
+				return nil, newStageError(ErrBadValue, "%s unit must be week or smaller, found: %s", operator, unit)
+			}
+		default:
+			return nil, newStageError(ErrBadValue, "%s got unexpected argument: %s", operator, entry.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input == nil {
+		return nil, newStageError(ErrBadValue, "%s requires an 'input' expression", operator)
+	}
+
+	// point returns the x and y value of a document
+	point := func(partition *partitionT, documentIdx int, run *runT) (float64, float64, error) {
+		var x float64
+		switch sortValue := partition.sortValues[documentIdx].(type) {
+		case primitive.DateTime:
+			if unit == "" {
+				return 0, 0, newStageError(ErrBadValue, "%s where the sortBy is a Date requires an 'unit'", operator)
+			}
+			x = float64(sortValue) / float64(unitMilliseconds[unit])
+		default:
+			number, isNumber := toFloat64(expr.Normalize(sortValue))
+			if !isNumber || unit != "" {
+				return 0, 0, newStageError(ErrBadValue, "%s with 'unit' expects the sortBy field to be a Date, without 'unit' a number, but it was %s", operator, typeName(sortValue))
+			}
+			x = number
+		}
+		value, err := input.EvaluateWithVariables(partition.documents[documentIdx], run.variables)
+		if err != nil {
+			return 0, 0, err
+		}
+		y, isNumber := toFloat64(expr.Normalize(value))
+		if !isNumber {
+			return 0, 0, newStageError(ErrBadValue, "%s expects the input to be a number, but it was %s", operator, typeName(value))
+		}
+		return x, y, nil
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		return eachWindow(partition, window, func(start int, end int) (any, error) {
+			if start == end || (operator == "$derivative" && end-start < 2) {
+				return nil, nil
+			}
+			if operator == "$derivative" {
+				x1, y1, err := point(partition, start, run)
+				if err != nil {
+					return nil, err
+				}
+				x2, y2, err := point(partition, end-1, run)
+				if err != nil || x1 == x2 {
+					return nil, err
+				}
+				return (y2 - y1) / (x2 - x1), nil
+			}
+
+			integral := 0.0
+			previousX, previousY, err := point(partition, start, run)
+			if err != nil {
+				return nil, err
+			}
+			for documentIdx := start + 1; documentIdx < end; documentIdx++ {
+				x, y, err := point(partition, documentIdx, run)
+				if err != nil {
+					return nil, err
+				}
+				integral += (x - previousX) * (y + previousY) / 2
+				previousX, previousY = x, y
+			}
+			return integral, nil
+		})
+	}, nil
+}
+
+// compileCovariance compiles {$covariancePop: ["$x", "$y"]} and {$covarianceSamp: ["$x", "$y"]}
+// Documents where either value is not a number are skipped.
+func (c *windowCompilerT) compileCovariance(operator string, argument any, window *windowT) (windowFunctionT, error) {
+	if entries, ok := match.ToArray(argument); !ok || len(entries) != 2 {
+		return nil, newStageError(ErrBadValue, "%s requires an array of exactly two expressions", operator)
+	}
+	pair, err := expr.CompileWithVariables(argument, c.variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		return eachWindow(partition, window, func(start int, end int) (any, error) {
+			xs, ys := []float64{}, []float64{}
+			sumX, sumY := 0.0, 0.0
+			for _, document := range partition.documents[start:end] {
+				value, err := pair.EvaluateWithVariables(document, run.variables)
+				if err != nil {
+					return nil, err
+				}
+				values, _ := match.ToArray(value)
+				x, xIsNumber := toFloat64(expr.Normalize(values[0]))
+				y, yIsNumber := toFloat64(expr.Normalize(values[1]))
+				if !xIsNumber || !yIsNumber {
+					continue
+				}
+				xs, ys = append(xs, x), append(ys, y)
+				sumX, sumY = sumX+x, sumY+y
+			}
+
+			count := float64(len(xs))
+			if count == 0 || (operator == "$covarianceSamp" && count == 1) {
+				return nil, nil
+			}
+			covariance := 0.0
+			for idx := range xs {
+				covariance += (xs[idx] - sumX/count) * (ys[idx] - sumY/count)
+			}
+			if operator == "$covarianceSamp" {
+				return covariance / (count - 1), nil
+			}
+			return covariance / count, nil
+		})
+	}, nil
+}
+
+// compileFill compiles {$locf: "$price"} and {$linearFill: "$price"}
+// $locf replaces null and missing values by the last value that wasn't, $linearFill interpolates them using the sortBy field.
+func (c *windowCompilerT) compileFill(operator string, argument any, window *windowT) (windowFunctionT, error) {
+	if operator == "$linearFill" && !c.singleSortBy() {
+		return nil, newStageError(ErrBadValue, "$linearFill requires a sortBy with exactly one field")
+	}
+	if window != nil {
+		return nil, newStageError(ErrBadValue, "%s does not accept a 'window' field", operator)
+	}
+	input, err := expr.CompileWithVariables(argument, c.variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(partition *partitionT, run *runT) ([]any, error) {
+		values := make([]any, len(partition.documents))
+		var last any
+		for idx, document := range partition.documents {
+			value, err := input.EvaluateWithVariables(document, run.variables)
+			if err != nil {
+				return nil, err
+			}
+			if isNullish(value) {
+				value = nil
+				if operator == "$locf" {
+					value = last
+				}
+			}
+			values[idx] = value
+			last = value
+		}
+		if operator == "$locf" {
+			return values, nil
+		}
+		return linearFill(values, partition.sortValues)
+	}, nil
+}
+
+// linearFill interpolates the null values between two numbers, the x axis are the sort values
+func linearFill(values []any, sortValues []any) ([]any, error) {
+	xs := make([]float64, len(sortValues))
+	for idx, sortValue := range sortValues {
+		if date, isDate := sortValue.(primitive.DateTime); isDate {
+			xs[idx] = float64(date)
+			continue
+		}
+		x, isNumber := toFloat64(expr.Normalize(sortValue))
+		if !isNumber {
+			return nil, newStageError(ErrBadValue, "$linearFill expects the sortBy field to be a number or a date, but it was %s", typeName(sortValue))
+		}
+		xs[idx] = x
+	}
+
+	previous := -1
+	for idx, value := range values {
+		if value == nil {
+			continue
+		}
+		y2, isNumber := toFloat64(expr.Normalize(value))
+		if !isNumber {
+			return nil, newStageError(ErrBadValue, "$linearFill expects the values to be numbers, but found %s", typeName(value))
+		}
+		if previous >= 0 && idx-previous > 1 {
+			y1, _ := toFloat64(expr.Normalize(values[previous]))
+			for gapIdx := previous + 1; gapIdx < idx; gapIdx++ {
+				values[gapIdx] = y1 + (y2-y1)*(xs[gapIdx]-xs[previous])/(xs[idx]-xs[previous])
+			}
+		}
+		previous = idx
+	}
+	return values, nil
+}
@@ -0,0 +1,473 @@
+package mongomock
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/mjarkk/mongomock/aggregate"
+	"github.com/mjarkk/mongomock/expr"
+	"github.com/mjarkk/mongomock/match"
+	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestAggregate(t *testing.T) {
+	ordersCollection := NewDB().Collection("orders")
+	NoError(t, ordersCollection.Insert(
+		bson.M{"_id": 1, "customer": "alice", "total": 10, "status": "paid"},
+		bson.M{"_id": 2, "customer": "bob", "total": 2.5, "status": "paid"},
+		bson.M{"_id": 3, "customer": "alice", "total": 5, "status": "open"},
+		bson.M{"_id": 4, "customer": "carol", "total": 1.0, "status": "paid"},
+		bson.M{"_id": 5, "customer": "dave", "total": 1, "status": "paid"},
+	))
+
+	type customerTotal struct {
+		Customer string  `bson:"_id"`
+		Total    float64 `bson:"total"`
+		Orders   int     `bson:"orders"`
+	}
+
+	cursor, err := ordersCollection.Aggregate(mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": "paid"}}},
+		{{Key: "$group", Value: bson.M{"_id": "$customer", "total": bson.M{"$sum": "$total"}, "orders": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "total", Value: -1}, {Key: "_id", Value: 1}}}},
+	})
+	NoError(t, err)
+
+	results := []customerTotal{}
+	for cursor.Next() {
+		result := customerTotal{}
+		NoError(t, cursor.Decode(&result))
+		results = append(results, result)
+	}
+	Equal(t, []customerTotal{
+		{Customer: "alice", Total: 10, Orders: 1},
+		{Customer: "bob", Total: 2.5, Orders: 1},
+		{Customer: "carol", Total: 1, Orders: 1},
+		{Customer: "dave", Total: 1, Orders: 1},
+	}, results)
+
+	// Totals of 1 and 1.0 are the same group
+	cursor, err = ordersCollection.Aggregate(bson.A{
+		bson.M{"$group": bson.M{"_id": "$total", "count": bson.M{"$count": bson.M{}}}},
+		bson.M{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	})
+	NoError(t, err)
+	True(t, cursor.Next())
+	result := bson.M{}
+	NoError(t, cursor.Decode(&result))
+	Equal(t, bson.M{"_id": 1.0, "count": int32(2)}, result)
+	False(t, cursor.Next())
+}
+
+func TestAggregateLet(t *testing.T) {
+	ordersCollection := NewDB().Collection("orders")
+	NoError(t, ordersCollection.Insert(
+		bson.M{"_id": 1, "total": 10},
+		bson.M{"_id": 2, "total": 30},
+	))
+
+	cursor, err := ordersCollection.Aggregate(
+		bson.A{
+			bson.M{"$project": bson.M{"withTax": bson.M{"$multiply": bson.A{"$total", "$$taxRate"}}}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		},
+		options.Aggregate().SetLet(bson.M{"taxRate": bson.M{"$add": bson.A{1, 0.5}}}),
+	)
+	NoError(t, err)
+	results := []bson.M{}
+	for cursor.Next() {
+		result := bson.M{}
+		NoError(t, cursor.Decode(&result))
+		results = append(results, result)
+	}
+	Equal(t, []bson.M{{"_id": int32(1), "withTax": 15.0}, {"_id": int32(2), "withTax": 45.0}}, results)
+
+	_, err = ordersCollection.Aggregate(bson.A{bson.M{"$project": bson.M{"a": "$$taxRate"}}})
+	ErrorIs(t, err, expr.ErrBadValue)
+
+	_, err = ordersCollection.Aggregate(bson.A{}, options.Aggregate().SetLet(bson.M{"TaxRate": 1}))
+	ErrorIs(t, err, expr.ErrBadValue)
+}
+
+func TestAggregateLookup(t *testing.T) {
+	db := NewDB()
+	customers := db.Collection("customers")
+	orders := db.Collection("orders")
+	NoError(t, customers.Insert(
+		bson.M{"_id": "alice", "minimum": 5},
+		bson.M{"_id": "bob", "minimum": 1},
+	))
+	NoError(t, orders.Insert(
+		bson.M{"_id": 1, "customer": "alice", "total": 10},
+		bson.M{"_id": 2, "customer": "bob", "total": 2},
+		bson.M{"_id": 3, "customer": "alice", "total": 3},
+	))
+
+	type customerOrders struct {
+		ID     string `bson:"_id"`
+		Orders []struct {
+			ID int `bson:"_id"`
+		} `bson:"orders"`
+	}
+	decodeAll := func(cursor *Cursor) []customerOrders {
+		results := []customerOrders{}
+		for cursor.Next() {
+			result := customerOrders{}
+			NoError(t, cursor.Decode(&result))
+			results = append(results, result)
+		}
+		return results
+	}
+
+	cursor, err := customers.Aggregate(bson.A{
+		bson.M{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "customer", "as": "orders"}},
+	})
+	NoError(t, err)
+	results := decodeAll(cursor)
+	if Len(t, results, 2) {
+		Len(t, results[0].Orders, 2)
+		Equal(t, 1, results[0].Orders[0].ID)
+		Equal(t, 3, results[0].Orders[1].ID)
+		Len(t, results[1].Orders, 1)
+	}
+
+	cursor, err = customers.Aggregate(bson.A{
+		bson.M{"$lookup": bson.M{
+			"from":         "orders",
+			"localField":   "_id",
+			"foreignField": "customer",
+			"let":          bson.M{"minimum": "$minimum"},
+			"pipeline":     bson.A{bson.M{"$match": bson.M{"$expr": bson.M{"$gte": bson.A{"$total", "$$minimum"}}}}},
+			"as":           "orders",
+		}},
+	})
+	NoError(t, err)
+	results = decodeAll(cursor)
+	if Len(t, results, 2) {
+		Len(t, results[0].Orders, 1)
+		Equal(t, 1, results[0].Orders[0].ID)
+		Len(t, results[1].Orders, 1)
+	}
+
+	// A collection that doesn't exist has no documents
+	cursor, err = customers.Aggregate(bson.A{
+		bson.M{"$lookup": bson.M{"from": "invoices", "localField": "_id", "foreignField": "customer", "as": "orders"}},
+	})
+	NoError(t, err)
+	results = decodeAll(cursor)
+	if Len(t, results, 2) {
+		Empty(t, results[0].Orders)
+	}
+}
+
+func TestAggregateLookupConcurrently(t *testing.T) {
+	db := NewDB()
+	customers := db.Collection("customers")
+	orders := db.Collection("orders")
+
+	// Lookups in both directions lock both collections, which would deadlock without a consistent order
+	var wg sync.WaitGroup
+	for idx := 0; idx < 50; idx++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := customers.Aggregate(bson.A{bson.M{"$lookup": bson.M{"from": "orders", "localField": "_id", "foreignField": "customer", "as": "orders"}}})
+			NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := orders.Aggregate(bson.A{bson.M{"$lookup": bson.M{"from": "customers", "localField": "customer", "foreignField": "_id", "as": "customer"}}})
+			NoError(t, err)
+		}()
+		go func(idx int) {
+			defer wg.Done()
+			NoError(t, orders.Insert(bson.M{"_id": idx, "customer": "alice"}))
+		}(idx)
+	}
+	wg.Wait()
+}
+
+func TestAggregateSample(t *testing.T) {
+	db := NewDB()
+	orders := db.Collection("orders")
+	for idx := 0; idx < 20; idx++ {
+		NoError(t, orders.Insert(bson.M{"_id": idx}))
+	}
+	archive := db.Collection("archive")
+	NoError(t, archive.Insert(bson.M{"_id": 100}))
+
+	sample := func() []bson.M {
+		cursor, err := orders.Aggregate(bson.A{
+			bson.M{"$unionWith": "archive"},
+			bson.M{"$sample": bson.M{"size": 5}},
+		})
+		NoError(t, err)
+		results := []bson.M{}
+		for cursor.Next() {
+			result := bson.M{}
+			NoError(t, cursor.Decode(&result))
+			results = append(results, result)
+		}
+		return results
+	}
+
+	db.SeedRandom(42)
+	first := sample()
+	Len(t, first, 5)
+	db.SeedRandom(42)
+	Equal(t, first, sample())
+}
+
+func TestAggregateFacet(t *testing.T) {
+	products := NewDB().Collection("products")
+	NoError(t, products.Insert(
+		bson.M{"_id": 1, "category": "books", "price": 12},
+		bson.M{"_id": 2, "category": "books", "price": 30},
+		bson.M{"_id": 3, "category": "games", "price": 60},
+		bson.M{"_id": 4, "category": "music", "price": 8},
+	))
+
+	cursor, err := products.Aggregate(bson.A{
+		bson.M{"$facet": bson.M{
+			"categories": bson.A{bson.M{"$sortByCount": "$category"}, bson.M{"$limit": 1}},
+			"prices": bson.A{bson.M{"$bucket": bson.M{
+				"groupBy":    "$price",
+				"boundaries": bson.A{0, 20, 50},
+				"default":    "expensive",
+			}}},
+		}},
+	})
+	NoError(t, err)
+
+	type countT struct {
+		ID    any `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	result := struct {
+		Categories []countT `bson:"categories"`
+		Prices     []countT `bson:"prices"`
+	}{}
+	True(t, cursor.Next())
+	NoError(t, cursor.Decode(&result))
+	False(t, cursor.Next())
+	Equal(t, []countT{{ID: "books", Count: 2}}, result.Categories)
+	Equal(t, []countT{{ID: int32(0), Count: 2}, {ID: int32(20), Count: 1}, {ID: "expensive", Count: 1}}, result.Prices)
+}
+
+func TestAggregateGraphLookup(t *testing.T) {
+	db := NewDB()
+	NoError(t, db.Collection("categories").Insert(
+		bson.M{"_id": 1, "name": "books"},
+		bson.M{"_id": 2, "name": "novels", "parent": "books"},
+		bson.M{"_id": 3, "name": "thrillers", "parent": "novels"},
+	))
+	products := db.Collection("products")
+	NoError(t, products.Insert(bson.M{"_id": 10, "category": "thrillers"}))
+
+	cursor, err := products.Aggregate(bson.A{
+		bson.M{"$graphLookup": bson.M{
+			"from":             "categories",
+			"startWith":        "$category",
+			"connectFromField": "parent",
+			"connectToField":   "name",
+			"depthField":       "level",
+			"as":               "path",
+		}},
+		bson.M{"$project": bson.M{"path": "$path.name", "levels": "$path.level"}},
+	})
+	NoError(t, err)
+	True(t, cursor.Next())
+	result := bson.M{}
+	NoError(t, cursor.Decode(&result))
+	Equal(t, bson.M{"_id": int32(10), "path": bson.A{"thrillers", "novels", "books"}, "levels": bson.A{int64(0), int64(1), int64(2)}}, result)
+}
+
+func TestAggregateSetWindowFields(t *testing.T) {
+	sales := NewDB().Collection("sales")
+	NoError(t, sales.Insert(
+		bson.M{"_id": 1, "store": "north", "week": 1, "revenue": 100},
+		bson.M{"_id": 2, "store": "north", "week": 2, "revenue": 300},
+		bson.M{"_id": 3, "store": "south", "week": 1, "revenue": 50},
+		bson.M{"_id": 4, "store": "north", "week": 3, "revenue": 200},
+	))
+
+	cursor, err := sales.Aggregate(bson.A{
+		bson.M{"$setWindowFields": bson.M{
+			"partitionBy": "$store",
+			"sortBy":      bson.M{"week": 1},
+			"output": bson.M{
+				"runningTotal": bson.M{"$sum": "$revenue", "window": bson.M{"documents": bson.A{"unbounded", "current"}}},
+				"rank":         bson.M{"$rank": bson.M{}},
+			},
+		}},
+		bson.M{"$project": bson.M{"runningTotal": 1, "rank": 1}},
+	})
+	NoError(t, err)
+	results := []bson.M{}
+	for cursor.Next() {
+		result := bson.M{}
+		NoError(t, cursor.Decode(&result))
+		results = append(results, result)
+	}
+	Equal(t, []bson.M{
+		{"_id": int32(1), "runningTotal": int32(100), "rank": int32(1)},
+		{"_id": int32(2), "runningTotal": int32(400), "rank": int32(2)},
+		{"_id": int32(4), "runningTotal": int32(600), "rank": int32(3)},
+		{"_id": int32(3), "runningTotal": int32(50), "rank": int32(1)},
+	}, results)
+}
+
+func TestAggregateDensifyFill(t *testing.T) {
+	readings := NewDB().Collection("readings")
+	NoError(t, readings.Insert(
+		bson.M{"_id": 1, "hour": 0, "temperature": 10},
+		bson.M{"_id": 2, "hour": 3, "temperature": 16},
+	))
+
+	cursor, err := readings.Aggregate(bson.A{
+		bson.M{"$densify": bson.M{"field": "hour", "range": bson.M{"step": 1, "bounds": "full"}}},
+		bson.M{"$fill": bson.M{"sortBy": bson.M{"hour": 1}, "output": bson.M{"temperature": bson.M{"method": "linear"}}}},
+		bson.M{"$project": bson.M{"_id": 0}},
+	})
+	NoError(t, err)
+	results := []bson.M{}
+	for cursor.Next() {
+		result := bson.M{}
+		NoError(t, cursor.Decode(&result))
+		results = append(results, result)
+	}
+	Equal(t, []bson.M{
+		{"hour": int32(0), "temperature": int32(10)},
+		{"hour": int32(1), "temperature": 12.0},
+		{"hour": int32(2), "temperature": 14.0},
+		{"hour": int32(3), "temperature": int32(16)},
+	}, results)
+}
+
+func TestAggregateOut(t *testing.T) {
+	db := NewDB()
+	orders := db.Collection("orders")
+	NoError(t, orders.Insert(
+		bson.M{"_id": 1, "customer": "alice", "note": "coffee beans"},
+		bson.M{"_id": 2, "customer": "bob", "note": "green tea"},
+	))
+	notes := db.Collection("notes")
+	NoError(t, notes.Insert(bson.M{"_id": 3, "note": "old coffee"}))
+	_, err := notes.CreateIndex(mongo.IndexModel{Keys: bson.D{{Key: "note", Value: "text"}}})
+	NoError(t, err)
+
+	cursor, err := orders.Aggregate(bson.A{bson.M{"$project": bson.M{"note": 1}}, bson.M{"$out": "notes"}})
+	NoError(t, err)
+	False(t, cursor.Next())
+
+	results := []bson.M{}
+	NoError(t, notes.Find(&results, bson.M{"$text": bson.M{"$search": "coffee"}}))
+	Equal(t, []bson.M{{"_id": int32(1), "note": "coffee beans"}}, results)
+
+	_, err = orders.Aggregate(bson.A{bson.M{"$project": bson.M{"_id": 0}}, bson.M{"$out": "orders"}})
+	NoError(t, err)
+	results = []bson.M{}
+	NoError(t, orders.Find(&results, bson.M{}))
+	Len(t, results, 2)
+	NotNil(t, results[0]["_id"])
+}
+
+func TestAggregateMerge(t *testing.T) {
+	db := NewDB()
+	orders := db.Collection("orders")
+	NoError(t, orders.Insert(
+		bson.M{"_id": 1, "customer": "alice", "total": 10},
+		bson.M{"_id": 2, "customer": "bob", "total": 5},
+		bson.M{"_id": 3, "customer": "alice", "total": 2},
+	))
+	totals := db.Collection("totals")
+	NoError(t, totals.Insert(bson.M{"_id": "x", "customer": "alice", "total": 100, "since": 2020}))
+
+	pipeline := bson.A{
+		bson.M{"$group": bson.M{"_id": "$customer", "total": bson.M{"$sum": "$total"}}},
+		bson.M{"$project": bson.M{"_id": 0, "customer": "$_id", "total": 1}},
+		bson.M{"$merge": bson.M{"into": "totals", "on": "customer"}},
+	}
+	_, err := orders.Aggregate(pipeline)
+	ErrorIs(t, err, aggregate.ErrBadValue)
+	EqualError(t, err, "Cannot find index to verify that $merge fields will be unique (at stage 2, $merge)")
+
+	_, err = totals.CreateIndex(mongo.IndexModel{Keys: bson.D{{Key: "customer", Value: 1}}, Options: options.Index().SetUnique(true)})
+	NoError(t, err)
+	cursor, err := orders.Aggregate(pipeline)
+	NoError(t, err)
+	False(t, cursor.Next())
+
+	alice := bson.M{}
+	NoError(t, totals.FindFirst(&alice, bson.M{"customer": "alice"}))
+	Equal(t, bson.M{"_id": "x", "customer": "alice", "total": int32(12), "since": int32(2020)}, alice)
+	bob := bson.M{}
+	NoError(t, totals.FindFirst(&bob, bson.M{"customer": "bob"}))
+	Equal(t, int32(5), bob["total"])
+	NotNil(t, bob["_id"])
+
+	_, err = totals.Aggregate(bson.A{bson.M{"$merge": bson.M{"into": "totals", "whenMatched": "fail"}}})
+	ErrorIs(t, err, aggregate.ErrWriteFailed)
+}
+
+func TestAggregateText(t *testing.T) {
+	articles := newArticlesCollection(t)
+
+	cursor, err := articles.Aggregate(bson.A{
+		bson.M{"$match": bson.M{"$text": bson.M{"$search": "coffee"}}},
+		bson.M{"$count": "articles"},
+	})
+	NoError(t, err)
+	True(t, cursor.Next())
+	result := bson.M{}
+	NoError(t, cursor.Decode(&result))
+	Equal(t, bson.M{"articles": int32(2)}, result)
+
+	// The rest of the filter can use $expr
+	cursor, err = articles.Aggregate(bson.A{
+		bson.M{"$match": bson.M{"$text": bson.M{"$search": "coffee"}, "$expr": bson.M{"$eq": bson.A{"$_id", 1}}}},
+		bson.M{"$count": "articles"},
+	})
+	NoError(t, err)
+	True(t, cursor.Next())
+	NoError(t, cursor.Decode(&result))
+	Equal(t, bson.M{"articles": int32(1)}, result)
+
+	_, err = articles.Aggregate(bson.A{
+		bson.M{"$match": bson.M{"$text": bson.M{"$search": "coffee"}, "_id": bson.M{"$foo": 1}}},
+	})
+	var stageErr *aggregate.StageError
+	if ErrorAs(t, err, &stageErr) {
+		Equal(t, 0, stageErr.Index)
+	}
+	ErrorIs(t, err, match.ErrUnknownOperator)
+
+	_, err = articles.Aggregate(bson.A{
+		bson.M{"$limit": 1},
+		bson.M{"$match": bson.M{"$text": bson.M{"$search": "coffee"}}},
+	})
+	ErrorIs(t, err, aggregate.ErrBadValue)
+
+	_, err = NewDB().Collection("articles").Aggregate(bson.A{
+		bson.M{"$match": bson.M{"$text": bson.M{"$search": "coffee"}}},
+	})
+	ErrorIs(t, err, ErrTextIndexRequired)
+}
+
+func TestAggregateErrors(t *testing.T) {
+	ordersCollection := NewDB().Collection("orders")
+	NoError(t, ordersCollection.Insert(bson.M{"_id": 1}))
+
+	_, err := ordersCollection.Aggregate(bson.A{bson.M{"$match": bson.M{}}, bson.M{"$changeStream": bson.M{}}})
+	ErrorIs(t, err, aggregate.ErrNotSupported)
+	EqualError(t, err, "$changeStream is not supported by mongomock (at stage 1, $changeStream)")
+
+	_, err = ordersCollection.Aggregate(bson.A{bson.M{"$match": bson.M{"location": bson.M{"$near": bson.A{1, 2}}}}})
+	ErrorIs(t, err, aggregate.ErrBadValue)
+
+	_, err = ordersCollection.Aggregate(bson.M{"$match": bson.M{}})
+	ErrorIs(t, err, aggregate.ErrBadValue)
+}
@@ -1,6 +1,7 @@
 package mongomock
 
 import (
+	"math/rand"
 	"sync"
 )
 
@@ -10,4 +11,13 @@ type Collection struct {
 	underlayingCollection *TestConnection
 	name                  string
 	documents             []documentT
+	indexes               []*indexT
+}
+
+// randomFloat returns a random number in [0, 1) using the random number generator of the connection of the collection
+func (c *Collection) randomFloat() float64 {
+	if c.underlayingCollection == nil {
+		return rand.Float64()
+	}
+	return c.underlayingCollection.randomFloat()
 }
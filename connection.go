@@ -1,22 +1,41 @@
 package mongomock
 
 import (
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // TestConnection is the struct that implements db.Connection
 type TestConnection struct {
 	m           sync.Mutex
 	collections map[string]*Collection
+	random      *rand.Rand
 }
 
 // NewDB returns a testing database connection that is compatible with db.Connection
 func NewDB() *TestConnection {
 	return &TestConnection{
 		collections: map[string]*Collection{},
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
+// SeedRandom seeds the random number generator used by the $sample stage of aggregations and $sampleRate in filters
+// Use this within tests to make the sampled documents reproducible.
+func (c *TestConnection) SeedRandom(seed int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.random.Seed(seed)
+}
+
+// randomFloat returns a random number in [0, 1) using the seedable random number generator of the connection
+func (c *TestConnection) randomFloat() float64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.random.Float64()
+}
+
 func (c *TestConnection) Collection(name string) *Collection {
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -1,26 +1,23 @@
 package mongomock
 
-import (
-	"github.com/mjarkk/mongomock/match"
-	"go.mongodb.org/mongo-driver/bson"
-)
-
 // Count returns the number of documents in the collection of entity
-func (c *Collection) Count(filter bson.M) (uint64, error) {
+func (c *Collection) Count(filter any) (uint64, error) {
+	query, err := c.compileQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	if len(filter) == 0 {
+	if filter == nil {
 		// Take the easy route
 		return uint64(len(c.documents)), nil
 	}
 
-	var count uint64
-	for _, document := range c.documents {
-		if match.Match(document.bson, filter) {
-			count++
-		}
+	results, err := c.unsafeQuery(query)
+	if err != nil {
+		return 0, err
 	}
-
-	return count, nil
+	return uint64(len(results)), nil
 }
@@ -1,42 +1,63 @@
 package mongomock
 
 import (
-	"github.com/mjarkk/mongomock/match"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // DeleteFirst deletes the first document that matches the filter
-func (c *Collection) DeleteFirst(filter bson.M) error {
+func (c *Collection) DeleteFirst(filter any) error {
+	query, err := c.compileQuery(filter)
+	if err != nil {
+		return err
+	}
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	for idx, document := range c.documents {
-		if match.Match(document.bson, filter) {
-			c.documents = append(c.documents[:idx], c.documents[idx+1:]...)
-			return nil
-		}
+	results, err := c.unsafeQuery(query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return mongo.ErrNoDocuments
 	}
 
-	return mongo.ErrNoDocuments
+	c.unsafeDelete(results[0].idx)
+	return nil
 }
 
 // Delete deletes all documents matching the filter
-// The query used here is {"_id": {"$in": ids}}
-func (c *Collection) Delete(filter bson.M) error {
+// Returns mongo.ErrNoDocuments if no document matched the filter
+func (c *Collection) Delete(filter any) error {
+	query, err := c.compileQuery(filter)
+	if err != nil {
+		return err
+	}
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	for idx := len(c.documents) - 1; idx >= 0; idx-- {
-		document := c.documents[idx]
-		if match.Match(document.bson, filter) {
-			c.documents = append(c.documents[:idx], c.documents[idx+1:]...)
-			return nil
-		}
+	results, err := c.unsafeQuery(query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return mongo.ErrNoDocuments
 	}
 
-	return mongo.ErrNoDocuments
+	// Delete from the back so the indexes of the other results stay valid
+	for idx := len(results) - 1; idx >= 0; idx-- {
+		c.unsafeDelete(results[idx].idx)
+	}
+	return nil
+}
+
+// unsafeDelete deletes the document at idx from the collection and its indexes
+func (c *Collection) unsafeDelete(idx int) {
+	c.unsafeRemoveFromIndexes(c.documents[idx])
+	c.documents = append(c.documents[:idx], c.documents[idx+1:]...)
 }
 
 // DeleteByID deletes a document by it's ID
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -29,3 +30,15 @@ func TestDelete(t *testing.T) {
 	documentsCount, _ = usersCollection.Count(nil)
 	Equal(t, uint64(0), documentsCount)
 }
+
+func TestDeleteMultiple(t *testing.T) {
+	usersCollection := NewDB().Collection("users")
+
+	err := usersCollection.Insert(NewMockuser(), NewMockuser(), NewMockuser())
+	NoError(t, err)
+
+	err = usersCollection.Delete(bson.M{"username": "Piet"})
+	NoError(t, err)
+	documentsCount, _ := usersCollection.Count(nil)
+	Equal(t, uint64(0), documentsCount)
+}
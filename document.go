@@ -3,17 +3,23 @@ package mongomock
 import (
 	"errors"
 	"reflect"
+	"sync/atomic"
 
 	"github.com/mjarkk/mongomock/match"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 // documentT describes a document within the collection
+// The bson value keeps the field order of the document so embedded documents can be compared exactly
 type documentT struct {
-	bson  bson.M
+	// id identifies the document within indexes, every new document gets a new id
+	id    uint64
+	bson  bson.D
 	bytes []byte
 }
 
+var lastDocumentID atomic.Uint64
+
 func tryNewDocument(value any) (documentT, error) {
 	parsedValue, isNil := match.MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
 	if isNil {
@@ -24,14 +30,15 @@ func tryNewDocument(value any) (documentT, error) {
 	if err != nil {
 		return documentT{}, err
 	}
-	encodedValueMap := bson.M{}
-	err = bson.Unmarshal(encodedValue, &encodedValueMap)
+	decodedValue := bson.D{}
+	err = bson.Unmarshal(encodedValue, &decodedValue)
 	if err != nil {
 		return documentT{}, err
 	}
 
 	return documentT{
-		bson:  encodedValueMap,
+		id:    lastDocumentID.Add(1),
+		bson:  decodedValue,
 		bytes: encodedValue,
 	}, nil
 }
@@ -17,11 +17,7 @@ func (c *TestConnection) Dump(shouldPanicResults bool) {
 	for _, collection := range c.collections {
 		collection.m.Lock()
 
-		documents := []bson.M{}
-		for _, document := range collection.documents {
-			documents = append(documents, document.bson)
-		}
-		data[collection.name] = documents
+		data[collection.name] = collection.unsafeDumpDocuments()
 
 		collection.m.Unlock()
 	}
@@ -46,10 +42,7 @@ func (c *TestConnection) Dump(shouldPanicResults bool) {
 // shouldPanic controls if the output is only printed or also should panic
 func (c *Collection) Dump(shouldPanicResults bool) {
 	c.m.Lock()
-	documents := []bson.M{}
-	for _, document := range c.documents {
-		documents = append(documents, document.bson)
-	}
+	documents := c.unsafeDumpDocuments()
 	c.m.Unlock()
 
 	jsonBytes, err := json.MarshalIndent(documents, "", "    ")
@@ -64,3 +57,18 @@ func (c *Collection) Dump(shouldPanicResults bool) {
 		fmt.Println(jsonString)
 	}
 }
+
+// unsafeDumpDocuments decodes the documents of the collection into maps that can be marshalled to JSON
+// bson.D values would be marshalled as lists of key value pairs
+func (c *Collection) unsafeDumpDocuments() []bson.M {
+	documents := []bson.M{}
+	for _, document := range c.documents {
+		decodedDocument := bson.M{}
+		err := bson.Unmarshal(document.bytes, &decodedDocument)
+		if err != nil {
+			panic(err)
+		}
+		documents = append(documents, decodedDocument)
+	}
+	return documents
+}
@@ -0,0 +1,40 @@
+package mongomock
+
+import (
+	"sort"
+
+	"github.com/mjarkk/mongomock/match"
+)
+
+// ExplainNearMisses explains why the documents that came closest to matching the filter did not match
+// Documents are ranked by the number of top level clauses they matched, at most limit explanations are returned.
+// Documents that match the filter are left out.
+//
+// This is useful for test failure messages:
+//
+//	explanations, _ := collection.ExplainNearMisses(filter, 1)
+//	t.Log(explanations[0]) // field status was "draft", expected "published"
+func (c *Collection) ExplainNearMisses(filter any, limit int) ([]*match.Explanation, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	explanations := []*match.Explanation{}
+	for _, document := range c.documents {
+		explanation, err := match.Explain(document.bson, filter, match.WithRandom(c.randomFloat))
+		if err != nil {
+			return nil, err
+		}
+		if !explanation.Matched {
+			explanations = append(explanations, explanation)
+		}
+	}
+
+	sort.SliceStable(explanations, func(i, j int) bool {
+		return explanations[i].MatchedClauses() > explanations[j].MatchedClauses()
+	})
+
+	if limit >= 0 && len(explanations) > limit {
+		explanations = explanations[:limit]
+	}
+	return explanations, nil
+}
@@ -0,0 +1,31 @@
+package mongomock
+
+import (
+	"testing"
+
+	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExplainNearMisses(t *testing.T) {
+	postsCollection := NewDB().Collection("posts")
+
+	NoError(t, postsCollection.Insert(bson.M{"title": "foo", "status": "draft", "author": "bob"}))
+	NoError(t, postsCollection.Insert(bson.M{"title": "bar", "status": "archived", "author": "alice"}))
+	NoError(t, postsCollection.Insert(bson.M{"title": "baz", "status": "published", "author": "bob"}))
+
+	filter := bson.D{{Key: "status", Value: "published"}, {Key: "author", Value: "alice"}}
+	explanations, err := postsCollection.ExplainNearMisses(filter, 1)
+	NoError(t, err)
+	if Len(t, explanations, 1) {
+		Equal(t, `field status was "archived", expected "published"`, explanations[0].Clauses[0].String())
+	}
+
+	explanations, err = postsCollection.ExplainNearMisses(filter, 10)
+	NoError(t, err)
+	Len(t, explanations, 3)
+
+	explanations, err = postsCollection.ExplainNearMisses(bson.M{"status": bson.M{"$in": 1}}, 1)
+	Error(t, err)
+	Nil(t, explanations)
+}
@@ -0,0 +1,343 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Accumulator is a compiled accumulator like {$sum: "$price"} as used by $group
+type Accumulator struct {
+	argument *Expression
+	newState func() accumulatorStateT
+}
+
+// accumulatorStateT is the state of an accumulator for a single group
+type accumulatorStateT interface {
+	add(value any)
+	result() any
+}
+
+// Accumulation is the state of an accumulator for a single group
+type Accumulation struct {
+	accumulator *Accumulator
+	state       accumulatorStateT
+	variables   Variables
+}
+
+// CompileAccumulator validates and compiles an accumulator like {$sum: "$price"}
+func CompileAccumulator(accumulator any, path string) (*Accumulator, error) {
+	return CompileAccumulatorWithVariables(accumulator, path, nil)
+}
+
+// CompileAccumulatorWithVariables compiles an accumulator that can refer to user defined variables, their values are given to NewWithVariables
+func CompileAccumulatorWithVariables(accumulator any, path string, variables []string) (*Accumulator, error) {
+	document, ok := match.ToDocument(accumulator)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "The field '%s' must be an accumulator object", path)
+	}
+	if len(document) != 1 {
+		return nil, newExpressionError(path, ErrBadValue, "The field '%s' must specify one accumulator", path)
+	}
+
+	operator, value := document[0].Key, document[0].Value
+	operatorPath := joinPath(path, operator)
+	scope := newScope(variables)
+	switch operator {
+	case "$top", "$topN", "$bottom", "$bottomN":
+		return compileTopAccumulator(operator, value, operatorPath, scope)
+	case "$firstN", "$lastN", "$maxN", "$minN":
+		return compileNAccumulator(operator, value, operatorPath, scope)
+	case "$median", "$percentile":
+		return compilePercentileAccumulator(operator, value, operatorPath, scope)
+	case "$accumulator":
+		return nil, newExpressionError(operatorPath, ErrNotSupported, "%s is not supported by mongomock", operator)
+	}
+
+	newState, ok := accumulators[operator]
+	if !ok {
+		return nil, newExpressionError(operatorPath, ErrUnknownOperator, "unknown group operator '%s'", operator)
+	}
+
+	if operator == "$count" {
+		argument, ok := match.ToDocument(value)
+		if !ok || len(argument) != 0 {
+			return nil, newExpressionError(operatorPath, ErrBadValue, "$count takes no arguments, i.e. $count:{}")
+		}
+		// {$count: {}} equals {$sum: 1}
+		value = int32(1)
+	} else if _, isArray := match.ToArray(value); isArray {
+		return nil, newExpressionError(operatorPath, ErrBadValue, "The %s accumulator is a unary operator", operator)
+	}
+
+	argument, err := compile(value, operatorPath, scope)
+	if err != nil {
+		return nil, err
+	}
+	if operator == "$mergeObjects" {
+		argument = requireObject(argument, operatorPath)
+	}
+	return &Accumulator{
+		argument: &Expression{evaluate: argument},
+		newState: newState,
+	}, nil
+}
+
+// New starts a new accumulation, for example for a new group
+func (a *Accumulator) New() *Accumulation {
+	return a.NewWithVariables(nil)
+}
+
+// NewWithVariables starts a new accumulation with the values of the user defined variables
+func (a *Accumulator) NewWithVariables(variables Variables) *Accumulation {
+	return &Accumulation{accumulator: a, state: a.newState(), variables: variables}
+}
+
+// Add adds a document to the accumulation
+func (a *Accumulation) Add(document bson.D) error {
+	value, err := a.accumulator.argument.EvaluateWithVariables(document, a.variables)
+	if err != nil {
+		return err
+	}
+	a.state.add(value)
+	return nil
+}
+
+// Result returns the result of the accumulation
+func (a *Accumulation) Result() any {
+	return a.state.result()
+}
+
+// compileAccumulatorExpression compiles the expression form of an accumulator like {$sum: "$scores"} or {$max: ["$a", "$b"]}
+// A single argument that resolves to an array accumulates its elements, several arguments accumulate their values.
+func compileAccumulatorExpression(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	newState := accumulators[operator]
+	evaluators, err := compileArguments(value, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 1 {
+			if entries, isArray := match.ToArray(values[0]); isArray {
+				values = entries
+			}
+		}
+
+		state := newState()
+		for _, value := range values {
+			state.add(value)
+		}
+		return state.result(), nil
+	}, nil
+}
+
+var accumulators = map[string]func() accumulatorStateT{
+	"$sum":      func() accumulatorStateT { return &sumAccumulatorT{} },
+	"$count":    func() accumulatorStateT { return &sumAccumulatorT{} },
+	"$avg":      func() accumulatorStateT { return &avgAccumulatorT{} },
+	"$min":      func() accumulatorStateT { return &extremeAccumulatorT{direction: -1} },
+	"$max":      func() accumulatorStateT { return &extremeAccumulatorT{direction: 1} },
+	"$first":    func() accumulatorStateT { return &firstAccumulatorT{} },
+	"$last":     func() accumulatorStateT { return &lastAccumulatorT{} },
+	"$push":     func() accumulatorStateT { return &pushAccumulatorT{values: bson.A{}} },
+	"$addToSet": func() accumulatorStateT { return &addToSetAccumulatorT{values: bson.A{}} },
+
+	"$stdDevPop":    func() accumulatorStateT { return &stdDevAccumulatorT{} },
+	"$stdDevSamp":   func() accumulatorStateT { return &stdDevAccumulatorT{sample: true} },
+	"$mergeObjects": func() accumulatorStateT { return &mergeObjectsAccumulatorT{document: bson.D{}} },
+}
+
+// sumAccumulatorT sums all numbers, other values are ignored
+type sumAccumulatorT struct {
+	sum numberSumT
+}
+
+func (a *sumAccumulatorT) add(value any) { a.sum.add(value) }
+func (a *sumAccumulatorT) result() any   { return a.sum.result() }
+
+// avgAccumulatorT averages all numbers, other values are ignored
+// The result is null if there are no numbers.
+type avgAccumulatorT struct {
+	sum   numberSumT
+	count int64
+}
+
+func (a *avgAccumulatorT) add(value any) {
+	if isNumber(value) {
+		a.sum.add(value)
+		a.count++
+	}
+}
+
+func (a *avgAccumulatorT) result() any {
+	if a.count == 0 {
+		return nil
+	}
+	sum := a.sum.result()
+	if decimal, ok := sum.(primitive.Decimal128); ok && a.sum.special == nil {
+		return ratToDecimal(new(big.Rat).Quo(match.ToRat(decimal), new(big.Rat).SetInt64(a.count)))
+	}
+	return toFloat64(sum) / float64(a.count)
+}
+
+// extremeAccumulatorT keeps the smallest or largest value using MongoDB's comparison order
+// Null and missing values are ignored.
+type extremeAccumulatorT struct {
+	direction int
+	value     any
+	found     bool
+}
+
+func (a *extremeAccumulatorT) add(value any) {
+	if value == nil || value == Missing {
+		return
+	}
+	if !a.found || match.Compare(value, a.value) == a.direction {
+		a.value = value
+		a.found = true
+	}
+}
+
+func (a *extremeAccumulatorT) result() any {
+	return a.value
+}
+
+// firstAccumulatorT keeps the first value, missing values become null
+type firstAccumulatorT struct {
+	value any
+	found bool
+}
+
+func (a *firstAccumulatorT) add(value any) {
+	if a.found {
+		return
+	}
+	if value == Missing {
+		value = nil
+	}
+	a.value = value
+	a.found = true
+}
+
+func (a *firstAccumulatorT) result() any {
+	return a.value
+}
+
+// lastAccumulatorT keeps the last value, missing values become null
+type lastAccumulatorT struct {
+	value any
+}
+
+func (a *lastAccumulatorT) add(value any) {
+	if value == Missing {
+		value = nil
+	}
+	a.value = value
+}
+
+func (a *lastAccumulatorT) result() any {
+	return a.value
+}
+
+// pushAccumulatorT collects all values, missing values are left out
+type pushAccumulatorT struct {
+	values bson.A
+}
+
+func (a *pushAccumulatorT) add(value any) {
+	if value != Missing {
+		a.values = append(a.values, value)
+	}
+}
+
+func (a *pushAccumulatorT) result() any {
+	return a.values
+}
+
+// addToSetAccumulatorT collects all unique values, missing values are left out
+type addToSetAccumulatorT struct {
+	values bson.A
+}
+
+func (a *addToSetAccumulatorT) add(value any) {
+	if value == Missing {
+		return
+	}
+	for _, existing := range a.values {
+		if match.Compare(existing, value) == 0 {
+			return
+		}
+	}
+	a.values = append(a.values, value)
+}
+
+func (a *addToSetAccumulatorT) result() any {
+	return a.values
+}
+
+// stdDevAccumulatorT computes the population or sample standard deviation of all numbers, other values are ignored
+// The result is null if there are no numbers, or for the sample standard deviation if there is only one.
+type stdDevAccumulatorT struct {
+	sample bool
+	count  int64
+	mean   float64
+	// m2 is the sum of the squared differences from the mean, updated using Welford's algorithm
+	m2 float64
+}
+
+func (a *stdDevAccumulatorT) add(value any) {
+	if !isNumber(value) {
+		return
+	}
+	number := toFloat64(value)
+	a.count++
+	delta := number - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (number - a.mean)
+}
+
+func (a *stdDevAccumulatorT) result() any {
+	if a.count == 0 || a.sample && a.count == 1 {
+		return nil
+	}
+	if a.sample {
+		return math.Sqrt(a.m2 / float64(a.count-1))
+	}
+	return math.Sqrt(a.m2 / float64(a.count))
+}
+
+// requireObject wraps the argument of $mergeObjects so values other than documents, null and missing are an error
+func requireObject(argument evaluatorT, path string) evaluatorT {
+	return func(ctx *contextT) (any, error) {
+		value, err := argument(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(bson.D); !ok && !isNullish(value) {
+			return nil, newExpressionError(path, ErrBadValue, "$mergeObjects requires object inputs, but input %v is of type %s", value, TypeName(value))
+		}
+		return value, nil
+	}
+}
+
+// mergeObjectsAccumulatorT merges all documents, later documents overwrite the fields of earlier ones
+// Null and missing values are ignored.
+type mergeObjectsAccumulatorT struct {
+	document bson.D
+}
+
+func (a *mergeObjectsAccumulatorT) add(value any) {
+	a.document, _ = mergeObjects(a.document, value, "")
+}
+
+func (a *mergeObjectsAccumulatorT) result() any {
+	return a.document
+}
@@ -0,0 +1,431 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileArithmetic compiles arithmetic operators like {$add: ["$price", "$tax"]}
+// Like MongoDB the result is null if one of the arguments is null or missing.
+func compileArithmetic(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	var evaluators []evaluatorT
+	var err error
+	var operation func(values []any) (any, error)
+
+	switch operator {
+	case "$add":
+		evaluators, err = compileArguments(value, path, scope)
+		operation = func(values []any) (any, error) { return add(values, path) }
+	case "$multiply":
+		evaluators, err = compileArguments(value, path, scope)
+		operation = func(values []any) (any, error) { return multiply(values, path) }
+	case "$subtract":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+		operation = func(values []any) (any, error) { return subtract(values[0], values[1], path) }
+	case "$divide":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+		operation = func(values []any) (any, error) { return divide(values[0], values[1], path) }
+	case "$mod":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+		operation = func(values []any) (any, error) { return mod(values[0], values[1], path) }
+	case "$pow":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+		operation = func(values []any) (any, error) { return pow(values[0], values[1], path) }
+	case "$log":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+		operation = func(values []any) (any, error) { return logBase(values[0], values[1], path) }
+	case "$trunc", "$round":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 1, 2)
+		operation = func(values []any) (any, error) {
+			var places any = int32(0)
+			if len(values) == 2 {
+				places = values[1]
+			}
+			return round(operator, values[0], places, path)
+		}
+	default:
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 1, 1)
+		operation = func(values []any) (any, error) { return unaryArithmetic(operator, values[0], path) }
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+		if anyNullish(values) {
+			return nil, nil
+		}
+		return operation(values)
+	}, nil
+}
+
+// add adds numbers, one of the values can be a date to which the sum is added in milliseconds
+func add(values []any, path string) (any, error) {
+	var sum numberSumT
+	var date *primitive.DateTime
+	for _, value := range values {
+		if dateValue, ok := value.(primitive.DateTime); ok {
+			if date != nil {
+				return nil, newExpressionError(path, ErrBadValue, "only one date allowed in an $add expression")
+			}
+			date = &dateValue
+			continue
+		}
+		if !isNumber(value) {
+			return nil, newExpressionError(path, ErrBadValue, "$add only supports numeric or date types, not %s", TypeName(value))
+		}
+		sum.add(value)
+	}
+
+	if date != nil {
+		return addMilliseconds(*date, sum.result()), nil
+	}
+	return sum.result(), nil
+}
+
+// addMilliseconds adds a number of milliseconds to a date, fractions of milliseconds are rounded
+func addMilliseconds(date primitive.DateTime, milliseconds any) primitive.DateTime {
+	if kind, _ := numberKind(milliseconds); kind <= kindInt64 {
+		return date + primitive.DateTime(toInt64(milliseconds))
+	}
+	return date + primitive.DateTime(math.Round(toFloat64(milliseconds)))
+}
+
+func multiply(values []any, path string) (any, error) {
+	kind, ok := widestKind(values...)
+	if !ok {
+		for _, value := range values {
+			if !isNumber(value) {
+				return nil, newExpressionError(path, ErrBadValue, "$multiply only supports numeric types, not %s", TypeName(value))
+			}
+		}
+	}
+
+	switch kind {
+	case kindDecimal:
+		return decimalOperation(values, func(rats []*big.Rat) *big.Rat {
+			product := big.NewRat(1, 1)
+			for _, rat := range rats {
+				product.Mul(product, rat)
+			}
+			return product
+		}, multiplyFloats), nil
+	case kindDouble:
+		return multiplyFloats(values), nil
+	}
+
+	product := int64(1)
+	for _, value := range values {
+		number := toInt64(value)
+		result := product * number
+		if product != 0 && (result/product != number || product == -1 && number == math.MinInt64 || number == -1 && product == math.MinInt64) {
+			// Like MongoDB integer overflows result in a double
+			return multiplyFloats(values), nil
+		}
+		product = result
+	}
+	return intResult(product, kind), nil
+}
+
+func multiplyFloats(values []any) float64 {
+	product := 1.0
+	for _, value := range values {
+		product *= toFloat64(value)
+	}
+	return product
+}
+
+// decimalOperation runs an operation on numbers of which at least one is a decimal
+// NaN and infinite values can't be represented as rational numbers, for those the float operation is used.
+func decimalOperation(values []any, ratOperation func(rats []*big.Rat) *big.Rat, floatOperation func(values []any) float64) primitive.Decimal128 {
+	rats := make([]*big.Rat, len(values))
+	for idx, value := range values {
+		if isSpecial(value) {
+			return toDecimal(floatOperation(values))
+		}
+		rats[idx] = match.ToRat(toDecimal(value))
+	}
+	return ratToDecimal(ratOperation(rats))
+}
+
+func subtract(a any, b any, path string) (any, error) {
+	aDate, aIsDate := a.(primitive.DateTime)
+	bDate, bIsDate := b.(primitive.DateTime)
+	switch {
+	case aIsDate && bIsDate:
+		return int64(aDate - bDate), nil
+	case aIsDate && isNumber(b):
+		return addMilliseconds(aDate, negate(b)), nil
+	case bIsDate:
+		return nil, newExpressionError(path, ErrBadValue, "can't $subtract %s from %s", TypeName(b), TypeName(a))
+	}
+
+	kind, ok := widestKind(a, b)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "can't $subtract %s from %s", TypeName(b), TypeName(a))
+	}
+	switch kind {
+	case kindDecimal:
+		return decimalOperation([]any{a, b}, func(rats []*big.Rat) *big.Rat {
+			return new(big.Rat).Sub(rats[0], rats[1])
+		}, subtractFloats), nil
+	case kindDouble:
+		return subtractFloats([]any{a, b}), nil
+	}
+
+	aInt, bInt := toInt64(a), toInt64(b)
+	difference := aInt - bInt
+	if (bInt > 0 && difference > aInt) || (bInt < 0 && difference < aInt) {
+		return subtractFloats([]any{a, b}), nil
+	}
+	return intResult(difference, kind), nil
+}
+
+func subtractFloats(values []any) float64 {
+	return toFloat64(values[0]) - toFloat64(values[1])
+}
+
+// negate negates a number, the smallest int64 becomes a double
+func negate(value any) any {
+	switch number := value.(type) {
+	case int32:
+		return -int64(number)
+	case int64:
+		if number == math.MinInt64 {
+			return -float64(number)
+		}
+		return -number
+	case float64:
+		return -number
+	case primitive.Decimal128:
+		if isSpecial(number) {
+			return toDecimal(-toFloat64(number))
+		}
+		return ratToDecimal(new(big.Rat).Neg(match.ToRat(number)))
+	}
+	return value
+}
+
+func divide(a any, b any, path string) (any, error) {
+	kind, ok := widestKind(a, b)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$divide only supports numeric types, not %s and %s", TypeName(a), TypeName(b))
+	}
+	if toFloat64(b) == 0 {
+		return nil, newExpressionError(path, ErrBadValue, "can't $divide by zero")
+	}
+
+	if kind == kindDecimal {
+		return decimalOperation([]any{a, b}, func(rats []*big.Rat) *big.Rat {
+			return new(big.Rat).Quo(rats[0], rats[1])
+		}, divideFloats), nil
+	}
+	return divideFloats([]any{a, b}), nil
+}
+
+func divideFloats(values []any) float64 {
+	return toFloat64(values[0]) / toFloat64(values[1])
+}
+
+// mod returns the remainder of a divided by b, like MongoDB the result has the sign of a
+func mod(a any, b any, path string) (any, error) {
+	kind, ok := widestKind(a, b)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$mod only supports numeric types, not %s and %s", TypeName(a), TypeName(b))
+	}
+	if kind <= kindInt64 && toInt64(b) == 0 {
+		return nil, newExpressionError(path, ErrBadValue, "can't $mod by zero")
+	}
+
+	switch kind {
+	case kindDecimal:
+		return decimalOperation([]any{a, b}, func(rats []*big.Rat) *big.Rat {
+			quotient := new(big.Rat).Quo(rats[0], rats[1])
+			truncated := roundRat(quotient, 0, true)
+			return new(big.Rat).Sub(rats[0], truncated.Mul(truncated, rats[1]))
+		}, modFloats), nil
+	case kindDouble:
+		return modFloats([]any{a, b}), nil
+	}
+	return intResult(toInt64(a)%toInt64(b), kind), nil
+}
+
+func modFloats(values []any) float64 {
+	return math.Mod(toFloat64(values[0]), toFloat64(values[1]))
+}
+
+func pow(base any, exponent any, path string) (any, error) {
+	kind, ok := widestKind(base, exponent)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$pow only supports numeric types, not %s and %s", TypeName(base), TypeName(exponent))
+	}
+	if toFloat64(base) == 0 && toFloat64(exponent) < 0 {
+		return nil, newExpressionError(path, ErrBadValue, "$pow cannot take a base of 0 and a negative exponent")
+	}
+
+	powFloats := func(values []any) float64 {
+		return math.Pow(toFloat64(values[0]), toFloat64(values[1]))
+	}
+	switch kind {
+	case kindDecimal:
+		return toDecimal(powFloats([]any{base, exponent})), nil
+	case kindDouble:
+		return powFloats([]any{base, exponent}), nil
+	}
+
+	baseInt, exponentInt := toInt64(base), toInt64(exponent)
+	switch {
+	case baseInt == 1:
+		return intResult(1, kind), nil
+	case baseInt == -1:
+		if exponentInt%2 == 0 {
+			return intResult(1, kind), nil
+		}
+		return intResult(-1, kind), nil
+	case exponentInt < 0:
+		return powFloats([]any{base, exponent}), nil
+	}
+
+	result := big.NewInt(1).Exp(big.NewInt(baseInt), big.NewInt(exponentInt), nil)
+	if !result.IsInt64() {
+		return powFloats([]any{base, exponent}), nil
+	}
+	return intResult(result.Int64(), kind), nil
+}
+
+func logBase(number any, base any, path string) (any, error) {
+	kind, ok := widestKind(number, base)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$log's argument must be numeric, not %s and %s", TypeName(number), TypeName(base))
+	}
+	numberFloat, baseFloat := toFloat64(number), toFloat64(base)
+	if !(numberFloat > 0) {
+		return nil, newExpressionError(path, ErrBadValue, "$log's argument must be a positive number, but is %v", numberFloat)
+	}
+	if !(baseFloat > 0) || baseFloat == 1 {
+		return nil, newExpressionError(path, ErrBadValue, "$log's base must be a positive number not equal to 1, but is %v", baseFloat)
+	}
+
+	result := math.Log(numberFloat) / math.Log(baseFloat)
+	if kind == kindDecimal {
+		return toDecimal(result), nil
+	}
+	return result, nil
+}
+
+// round rounds or truncates a number to a number of decimal places, places can be negative to round to tens, hundreds, etc.
+func round(operator string, value any, places any, path string) (any, error) {
+	kind, ok := numberKind(value)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "%s only supports numeric types, not %s", operator, TypeName(value))
+	}
+	placesInt, ok := wholeNumber(places)
+	if !ok || placesInt < -20 || placesInt > 100 {
+		return nil, newExpressionError(path, ErrBadValue, "cannot apply %s with precision value %v value must be in [-20, 100]", operator, places)
+	}
+	truncate := operator == "$trunc"
+
+	if isSpecial(value) || kind <= kindInt64 && placesInt >= 0 {
+		return value, nil
+	}
+
+	rounded := roundRat(match.ToRat(value), placesInt, truncate)
+	switch kind {
+	case kindDecimal:
+		return ratToDecimal(rounded), nil
+	case kindDouble:
+		result, _ := rounded.Float64()
+		return result, nil
+	}
+	return intResult(new(big.Int).Quo(rounded.Num(), rounded.Denom()).Int64(), kind), nil
+}
+
+// wholeNumber converts a number without a fraction like 5 or 5.0 into an int64
+func wholeNumber(value any) (int64, bool) {
+	switch number := value.(type) {
+	case int32, int64:
+		return toInt64(number), true
+	case float64, primitive.Decimal128:
+		float := toFloat64(number)
+		if float != math.Trunc(float) || float < math.MinInt64 || float >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(float), true
+	}
+	return 0, false
+}
+
+// unaryArithmetic runs arithmetic operators that take a single number like $abs and $sqrt
+func unaryArithmetic(operator string, value any, path string) (any, error) {
+	kind, ok := numberKind(value)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "%s only supports numeric types, not %s", operator, TypeName(value))
+	}
+	float := toFloat64(value)
+
+	var result float64
+	switch operator {
+	case "$abs":
+		switch number := value.(type) {
+		case int32:
+			if number == math.MinInt32 {
+				return -int64(number), nil
+			}
+			return intResult(absInt64(int64(number)), kind), nil
+		case int64:
+			if number == math.MinInt64 {
+				return nil, newExpressionError(path, ErrBadValue, "can't take $abs of long long min")
+			}
+			return absInt64(number), nil
+		case primitive.Decimal128:
+			if !isSpecial(number) {
+				return ratToDecimal(new(big.Rat).Abs(match.ToRat(number))), nil
+			}
+		}
+		result = math.Abs(float)
+	case "$ceil", "$floor":
+		if kind <= kindInt64 {
+			return value, nil
+		}
+		if kind == kindDecimal && !isSpecial(value) {
+			floored := floorRat(match.ToRat(value.(primitive.Decimal128)))
+			if operator == "$ceil" && floored.Cmp(match.ToRat(value.(primitive.Decimal128))) != 0 {
+				floored.Add(floored, big.NewRat(1, 1))
+			}
+			return ratToDecimal(floored), nil
+		}
+		if operator == "$ceil" {
+			result = math.Ceil(float)
+		} else {
+			result = math.Floor(float)
+		}
+	case "$exp":
+		result = math.Exp(float)
+	case "$ln", "$log10":
+		if !(float > 0) && !math.IsNaN(float) {
+			return nil, newExpressionError(path, ErrBadValue, "%s's argument must be a positive number, but is %v", operator, float)
+		}
+		if operator == "$ln" {
+			result = math.Log(float)
+		} else {
+			result = math.Log10(float)
+		}
+	case "$sqrt":
+		if float < 0 {
+			return nil, newExpressionError(path, ErrBadValue, "$sqrt's argument must be greater than or equal to 0")
+		}
+		result = math.Sqrt(float)
+	}
+
+	if kind == kindDecimal {
+		return toDecimal(result), nil
+	}
+	return result, nil
+}
@@ -0,0 +1,862 @@
+package expr
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// compileArrayOperator compiles array and object operators that take an array of arguments like {$arrayElemAt: ["$items", 0]}
+func compileArrayOperator(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	var evaluators []evaluatorT
+	var err error
+	switch operator {
+	case "$concatArrays", "$mergeObjects":
+		evaluators, err = compileArguments(value, path, scope)
+	case "$first", "$last", "$isArray", "$reverseArray", "$size", "$arrayToObject", "$objectToArray":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 1, 1)
+	case "$arrayElemAt", "$in":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+	case "$indexOfArray":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 4)
+	case "$range", "$slice":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 3)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operator {
+		case "$arrayElemAt":
+			return arrayElemAt(values[0], values[1], path)
+		case "$first", "$last":
+			if isNullish(values[0]) {
+				return nil, nil
+			}
+			entries, ok := values[0].(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "%s's argument must be an array, but is %s", operator, TypeName(values[0]))
+			}
+			if len(entries) == 0 {
+				return Missing, nil
+			}
+			if operator == "$first" {
+				return entries[0], nil
+			}
+			return entries[len(entries)-1], nil
+		case "$concatArrays":
+			result := bson.A{}
+			for _, value := range values {
+				if isNullish(value) {
+					return nil, nil
+				}
+				entries, ok := value.(bson.A)
+				if !ok {
+					return nil, newExpressionError(path, ErrBadValue, "$concatArrays only supports arrays, not %s", TypeName(value))
+				}
+				result = append(result, entries...)
+			}
+			return result, nil
+		case "$in":
+			entries, ok := values[1].(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "$in requires an array as a second argument, found: %s", TypeName(values[1]))
+			}
+			return containsValue(entries, values[0]), nil
+		case "$indexOfArray":
+			return indexOfArray(values, path)
+		case "$isArray":
+			_, ok := values[0].(bson.A)
+			return ok, nil
+		case "$range":
+			return arrayRange(values, path)
+		case "$reverseArray":
+			if isNullish(values[0]) {
+				return nil, nil
+			}
+			entries, ok := values[0].(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "The argument to $reverseArray must be an array, but was of type: %s", TypeName(values[0]))
+			}
+			result := make(bson.A, len(entries))
+			for idx, entry := range entries {
+				result[len(entries)-1-idx] = entry
+			}
+			return result, nil
+		case "$size":
+			entries, ok := values[0].(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "The argument to $size must be an array. Type of argument: %s", TypeName(values[0]))
+			}
+			return int32(len(entries)), nil
+		case "$slice":
+			return slice(values, path)
+		case "$arrayToObject":
+			return arrayToObject(values[0], path)
+		case "$objectToArray":
+			if isNullish(values[0]) {
+				return nil, nil
+			}
+			document, ok := values[0].(bson.D)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "$objectToArray requires a document input, found: %s", TypeName(values[0]))
+			}
+			result := make(bson.A, len(document))
+			for idx, entry := range document {
+				result[idx] = bson.D{{Key: "k", Value: entry.Key}, {Key: "v", Value: entry.Value}}
+			}
+			return result, nil
+		default:
+			result := bson.D{}
+			for _, value := range values {
+				result, err = mergeObjects(result, value, path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return result, nil
+		}
+	}, nil
+}
+
+// int32Argument converts an argument that has to be a whole number within the range of a 32-bit integer
+func int32Argument(value any) (int64, bool) {
+	number, ok := wholeNumber(value)
+	if !ok || number < math.MinInt32 || number > math.MaxInt32 {
+		return 0, false
+	}
+	return number, true
+}
+
+func arrayElemAt(array any, index any, path string) (any, error) {
+	if isNullish(array) || isNullish(index) {
+		return nil, nil
+	}
+	entries, ok := array.(bson.A)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$arrayElemAt's first argument must be an array, but is %s", TypeName(array))
+	}
+	if !isNumber(index) {
+		return nil, newExpressionError(path, ErrBadValue, "$arrayElemAt's second argument must be a numeric value, but is %s", TypeName(index))
+	}
+	idx, ok := int32Argument(index)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$arrayElemAt's second argument must be representable as a 32-bit integer: %v", index)
+	}
+
+	if idx < 0 {
+		idx += int64(len(entries))
+	}
+	if idx < 0 || idx >= int64(len(entries)) {
+		return Missing, nil
+	}
+	return entries[idx], nil
+}
+
+func indexOfArray(values []any, path string) (any, error) {
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	entries, ok := values[0].(bson.A)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$indexOfArray requires an array as a first argument, found: %s", TypeName(values[0]))
+	}
+	start, end, err := indexRange("$indexOfArray", values[2:], len(entries), path)
+	if err != nil {
+		return nil, err
+	}
+	for idx := start; idx < end; idx++ {
+		if compareValues(entries[idx], values[1]) == 0 {
+			return int32(idx), nil
+		}
+	}
+	return int32(-1), nil
+}
+
+func arrayRange(values []any, path string) (any, error) {
+	names := []string{"starting value", "ending value", "step value"}
+	numbers := []int64{0, 0, 1}
+	for idx, value := range values {
+		if !isNumber(value) {
+			return nil, newExpressionError(path, ErrBadValue, "$range requires a numeric %s, found value of type: %s", names[idx], TypeName(value))
+		}
+		number, ok := int32Argument(value)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$range requires a %s that can be represented as a 32-bit integer, found value: %v", names[idx], value)
+		}
+		numbers[idx] = number
+	}
+	start, end, step := numbers[0], numbers[1], numbers[2]
+	if step == 0 {
+		return nil, newExpressionError(path, ErrBadValue, "$range requires a non-zero step value")
+	}
+
+	result := bson.A{}
+	for number := start; step > 0 && number < end || step < 0 && number > end; number += step {
+		result = append(result, int32(number))
+	}
+	return result, nil
+}
+
+// slice implements {$slice: [array, n]} and {$slice: [array, position, n]}
+func slice(values []any, path string) (any, error) {
+	if anyNullish(values) {
+		return nil, nil
+	}
+	entries, ok := values[0].(bson.A)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "First argument to $slice must be an array, but is of type: %s", TypeName(values[0]))
+	}
+	ordinals := []string{"", "Second", "Third"}
+	numbers := make([]int64, len(values))
+	for idx := 1; idx < len(values); idx++ {
+		if !isNumber(values[idx]) {
+			return nil, newExpressionError(path, ErrBadValue, "%s argument to $slice must be a numeric value, but was of type: %s", ordinals[idx], TypeName(values[idx]))
+		}
+		number, ok := int32Argument(values[idx])
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "%s argument to $slice can't be represented as a 32-bit integer: %v", ordinals[idx], values[idx])
+		}
+		numbers[idx] = number
+	}
+
+	length := int64(len(entries))
+	var start, end int64
+	if len(values) == 2 {
+		count := numbers[1]
+		if count >= 0 {
+			start, end = 0, minInt64(count, length)
+		} else {
+			start, end = length+count, length
+			if start < 0 {
+				start = 0
+			}
+		}
+	} else {
+		position, count := numbers[1], numbers[2]
+		if count <= 0 {
+			return nil, newExpressionError(path, ErrBadValue, "Third argument to $slice must be positive: %d", count)
+		}
+		start = position
+		if position < 0 {
+			start = length + position
+			if start < 0 {
+				start = 0
+			}
+		}
+		start = minInt64(start, length)
+		end = minInt64(start+count, length)
+	}
+
+	result := make(bson.A, end-start)
+	copy(result, entries[start:end])
+	return result, nil
+}
+
+// arrayToObject converts [["a", 1]] or [{k: "a", v: 1}] into {a: 1}
+// Like MongoDB a key that occurs multiple times gets the last value.
+func arrayToObject(value any, path string) (any, error) {
+	if isNullish(value) {
+		return nil, nil
+	}
+	entries, ok := value.(bson.A)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires an array input, found: %s", TypeName(value))
+	}
+
+	result := bson.D{}
+	var usesPairs bool
+	for idx, entry := range entries {
+		var key, keyValue any
+		switch typedEntry := entry.(type) {
+		case bson.A:
+			if idx > 0 && !usesPairs {
+				return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires a consistent input format. Expected an object with keys 'k' and 'v' but found an array")
+			}
+			usesPairs = true
+			if len(typedEntry) != 2 {
+				return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires an array of size 2 arrays,found array of size: %d", len(typedEntry))
+			}
+			key, keyValue = typedEntry[0], typedEntry[1]
+		case bson.D:
+			if idx > 0 && usesPairs {
+				return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires a consistent input format. Expected an array of size 2 but found an object")
+			}
+			if len(typedEntry) != 2 {
+				return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires an object keys of 'k' and 'v'. Found incorrect number of keys:%d", len(typedEntry))
+			}
+			key, keyValue = LookupFieldPath(typedEntry, []string{"k"}), LookupFieldPath(typedEntry, []string{"v"})
+			if key == Missing || keyValue == Missing {
+				return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires an object with keys 'k' and 'v'. Missing either or both keys from: %v", typedEntry)
+			}
+		default:
+			return nil, newExpressionError(path, ErrBadValue, "Unrecognised input type format for $arrayToObject: %s", TypeName(entry))
+		}
+
+		keyText, ok := key.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$arrayToObject requires an array of key-value pairs, where the key must be of type string. Found key type: %s", TypeName(key))
+		}
+		if strings.Contains(keyText, "\x00") {
+			return nil, newExpressionError(path, ErrBadValue, "Key field cannot contain an embedded null byte")
+		}
+		result = setKey(result, keyText, keyValue)
+	}
+	return result, nil
+}
+
+// setKey sets a key within a document, replacing the value if the key already exists
+func setKey(document bson.D, key string, value any) bson.D {
+	for idx, entry := range document {
+		if entry.Key == key {
+			document[idx].Value = value
+			return document
+		}
+	}
+	return append(document, bson.E{Key: key, Value: value})
+}
+
+// mergeObjects merges the fields of value into the result, nullish values are ignored
+func mergeObjects(result bson.D, value any, path string) (bson.D, error) {
+	if isNullish(value) {
+		return result, nil
+	}
+	document, ok := value.(bson.D)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$mergeObjects requires object inputs, but input %v is of type %s", value, TypeName(value))
+	}
+	for _, entry := range document {
+		result = setKey(result, entry.Key, entry.Value)
+	}
+	return result, nil
+}
+
+// containsValue returns true if one of the entries is equal to the value
+func containsValue(entries bson.A, value any) bool {
+	for _, entry := range entries {
+		if compareValues(entry, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compileFilter compiles {$filter: {input: "$items", as: "item", cond: {$gte: ["$$item.price", 100]}, limit: 2}}
+func compileFilter(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$filter", value, path, []string{"input", "cond"}, []string{"as", "limit"})
+	if err != nil {
+		return nil, err
+	}
+	as, err := parseAs("$filter", arguments, path)
+	if err != nil {
+		return nil, err
+	}
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := compile(arguments["cond"], joinPath(path, "cond"), scope.with(as))
+	if err != nil {
+		return nil, err
+	}
+	var limit evaluatorT
+	if limitValue, ok := arguments["limit"]; ok {
+		limit, err = compile(limitValue, joinPath(path, "limit"), scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx *contextT) (any, error) {
+		inputValue, err := input(ctx)
+		if err != nil {
+			return nil, err
+		}
+		maxResults := int64(-1)
+		if limit != nil {
+			limitValue, err := limit(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !isNullish(limitValue) {
+				number, ok := int32Argument(limitValue)
+				if !ok {
+					return nil, newExpressionError(path, ErrBadValue, "$filter: limit must be represented as a 32-bit integral value: %v", limitValue)
+				}
+				if number < 1 {
+					return nil, newExpressionError(path, ErrBadValue, "$filter: limit must be greater than 0: %d", number)
+				}
+				maxResults = number
+			}
+		}
+
+		if isNullish(inputValue) {
+			return nil, nil
+		}
+		entries, ok := inputValue.(bson.A)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "input to $filter must be an array not %s", TypeName(inputValue))
+		}
+
+		result := bson.A{}
+		for _, entry := range entries {
+			if maxResults >= 0 && int64(len(result)) >= maxResults {
+				break
+			}
+			keep, err := cond(ctx.with(as, entry))
+			if err != nil {
+				return nil, err
+			}
+			if IsTrue(keep) {
+				result = append(result, entry)
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// parseAs parses the name of the variable of operators like $filter and $map, it defaults to "this"
+func parseAs(operator string, arguments map[string]any, path string) (string, error) {
+	asValue, ok := arguments["as"]
+	if !ok {
+		return "this", nil
+	}
+	as, ok := asValue.(string)
+	if !ok {
+		return "", newExpressionError(path, ErrBadValue, "%s: 'as' must be a string", operator)
+	}
+	err := validateVariableName(as, path)
+	if err != nil {
+		return "", err
+	}
+	return as, nil
+}
+
+// compileMap compiles {$map: {input: "$items", as: "item", in: {$multiply: ["$$item.price", 2]}}}
+func compileMap(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$map", value, path, []string{"input", "in"}, []string{"as"})
+	if err != nil {
+		return nil, err
+	}
+	as, err := parseAs("$map", arguments, path)
+	if err != nil {
+		return nil, err
+	}
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+	in, err := compile(arguments["in"], joinPath(path, "in"), scope.with(as))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		inputValue, err := input(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(inputValue) {
+			return nil, nil
+		}
+		entries, ok := inputValue.(bson.A)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "input to $map must be an array not %s", TypeName(inputValue))
+		}
+
+		result := make(bson.A, len(entries))
+		for idx, entry := range entries {
+			value, err := in(ctx.with(as, entry))
+			if err != nil {
+				return nil, err
+			}
+			if value == Missing {
+				value = nil
+			}
+			result[idx] = value
+		}
+		return result, nil
+	}, nil
+}
+
+// compileReduce compiles {$reduce: {input: "$items", initialValue: 0, in: {$add: ["$$value", "$$this.qty"]}}}
+func compileReduce(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$reduce", value, path, []string{"input", "initialValue", "in"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	evaluators, err := compileNamedArguments(map[string]any{
+		"input":        arguments["input"],
+		"initialValue": arguments["initialValue"],
+	}, path, scope)
+	if err != nil {
+		return nil, err
+	}
+	in, err := compile(arguments["in"], joinPath(path, "in"), scope.with("value", "this"))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		inputValue, err := evaluators["input"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(inputValue) {
+			return nil, nil
+		}
+		entries, ok := inputValue.(bson.A)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$reduce requires that 'input' be an array, found: %s", TypeName(inputValue))
+		}
+
+		result, err := evaluators["initialValue"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			result, err = in(ctx.with("value", result).with("this", entry))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// compileZip compiles {$zip: {inputs: ["$a", "$b"], useLongestLength: true, defaults: [0, 0]}}
+func compileZip(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$zip", value, path, []string{"inputs"}, []string{"useLongestLength", "defaults"})
+	if err != nil {
+		return nil, err
+	}
+	inputValues, ok := match.ToArray(arguments["inputs"])
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "inputs must be an array of expressions, found %s", TypeName(Normalize(arguments["inputs"])))
+	}
+	inputs, err := compileArguments(inputValues, joinPath(path, "inputs"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	useLongestLength := false
+	if useLongestLengthValue, ok := arguments["useLongestLength"]; ok {
+		useLongestLength, ok = useLongestLengthValue.(bool)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "useLongestLength must be a bool, found %s", TypeName(Normalize(useLongestLengthValue)))
+		}
+	}
+	var defaults []evaluatorT
+	if defaultsValue, ok := arguments["defaults"]; ok {
+		if !useLongestLength {
+			return nil, newExpressionError(path, ErrBadValue, "cannot specify defaults unless useLongestLength is true")
+		}
+		defaultValues, ok := match.ToArray(defaultsValue)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "defaults must be an array of expressions, found %s", TypeName(Normalize(defaultsValue)))
+		}
+		if len(defaultValues) != len(inputs) {
+			return nil, newExpressionError(path, ErrBadValue, "defaults and inputs must have the same length")
+		}
+		defaults, err = compileArguments(defaultValues, joinPath(path, "defaults"), scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, inputs)
+		if err != nil {
+			return nil, err
+		}
+		defaultValues := make([]any, len(inputs))
+		if defaults != nil {
+			defaultValues, err = evaluateAll(ctx, defaults)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		arrays := make([]bson.A, len(values))
+		length := -1
+		for idx, value := range values {
+			if isNullish(value) {
+				return nil, nil
+			}
+			entries, ok := value.(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "$zip found a non-array expression in input: %v", value)
+			}
+			arrays[idx] = entries
+			if length < 0 || useLongestLength && len(entries) > length || !useLongestLength && len(entries) < length {
+				length = len(entries)
+			}
+		}
+
+		result := bson.A{}
+		for idx := 0; idx < length; idx++ {
+			row := make(bson.A, len(arrays))
+			for arrayIdx, entries := range arrays {
+				if idx < len(entries) {
+					row[arrayIdx] = entries[idx]
+				} else {
+					row[arrayIdx] = defaultValues[arrayIdx]
+				}
+			}
+			result = append(result, row)
+		}
+		return result, nil
+	}, nil
+}
+
+// compileSortArray compiles {$sortArray: {input: "$items", sortBy: {price: -1}}} and {$sortArray: {input: "$scores", sortBy: 1}}
+func compileSortArray(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$sortArray", value, path, []string{"input", "sortBy"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var sortKeys []sortKeyT
+	sortBy := Normalize(arguments["sortBy"])
+	if document, ok := sortBy.(bson.D); ok && len(document) > 0 {
+		for _, entry := range document {
+			direction, ok := wholeNumber(entry.Value)
+			if !ok || direction != 1 && direction != -1 {
+				return nil, newExpressionError(path, ErrBadValue, "$sortArray sort direction of %s must be 1 or -1", entry.Key)
+			}
+			sortKeys = append(sortKeys, sortKeyT{key: entry.Key, direction: int(direction)})
+		}
+	} else {
+		direction, ok := wholeNumber(sortBy)
+		if !ok || direction != 1 && direction != -1 {
+			return nil, newExpressionError(path, ErrBadValue, "$sortArray requires sortBy to be either 1, -1 or a non-empty document")
+		}
+		sortKeys = []sortKeyT{{direction: int(direction)}}
+	}
+
+	return func(ctx *contextT) (any, error) {
+		inputValue, err := input(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(inputValue) {
+			return nil, nil
+		}
+		entries, ok := inputValue.(bson.A)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "The input argument to $sortArray must be an array, but was of type: %s", TypeName(inputValue))
+		}
+
+		result := make(bson.A, len(entries))
+		copy(result, entries)
+		sort.SliceStable(result, func(i, j int) bool {
+			for _, sortKey := range sortKeys {
+				a, b := result[i], result[j]
+				if sortKey.key != "" {
+					a = match.SortValue(a, sortKey.key, sortKey.direction < 0)
+					b = match.SortValue(b, sortKey.key, sortKey.direction < 0)
+				}
+				comparison := match.Compare(a, b)
+				if comparison != 0 {
+					return comparison == -sortKey.direction
+				}
+			}
+			return false
+		})
+		return result, nil
+	}, nil
+}
+
+// compileGetField compiles {$getField: {field: "price.usd", input: "$$CURRENT"}} and the short form {$getField: "price.usd"}
+// Unlike field paths the field name is used as is, so it can contain dots and start with a $.
+func compileGetField(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments := map[string]any{"field": value, "input": "$$CURRENT"}
+	if _, isString := value.(string); !isString {
+		var err error
+		arguments, err = parseNamedArguments("$getField", value, path, []string{"field"}, []string{"input"})
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := arguments["input"]; !ok {
+			arguments["input"] = "$$CURRENT"
+		}
+	}
+
+	field, ok := arguments["field"].(string)
+	if document, isDocument := match.ToDocument(arguments["field"]); isDocument && len(document) == 1 && document[0].Key == "$literal" {
+		field, ok = document[0].Value.(string)
+	} else if strings.HasPrefix(field, "$") {
+		ok = false
+	}
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$getField requires 'field' to evaluate to a constant, but got a non-constant argument")
+	}
+
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		inputValue, err := input(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if inputValue == Missing {
+			return Missing, nil
+		}
+		if isNullish(inputValue) {
+			return nil, nil
+		}
+		document, ok := inputValue.(bson.D)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$getField requires 'input' to evaluate to type Object, but got %s", TypeName(inputValue))
+		}
+		for _, entry := range document {
+			if entry.Key == field {
+				return entry.Value, nil
+			}
+		}
+		return Missing, nil
+	}, nil
+}
+
+// compileSet compiles the set operators like {$setUnion: ["$a", "$b"]}
+// Arrays are seen as sets, so duplicates are removed from the results.
+func compileSet(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	var evaluators []evaluatorT
+	var err error
+	switch operator {
+	case "$setIntersection", "$setUnion":
+		evaluators, err = compileArguments(value, path, scope)
+	case "$setEquals":
+		evaluators, err = compileArguments(value, path, scope)
+		if err == nil && len(evaluators) < 2 {
+			return nil, newExpressionError(path, ErrBadValue, "$setEquals needs at least two arguments had: %d", len(evaluators))
+		}
+	case "$setDifference", "$setIsSubset":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+	case "$anyElementTrue", "$allElementsTrue":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 1, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operator {
+		case "$anyElementTrue", "$allElementsTrue":
+			entries, ok := values[0].(bson.A)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "%s's argument must be an array, but is %s", operator, TypeName(values[0]))
+			}
+			// $anyElementTrue is false unless one of the values is true, $allElementsTrue is true unless one of the values is false
+			stopOn := operator == "$anyElementTrue"
+			for _, entry := range entries {
+				if IsTrue(entry) == stopOn {
+					return stopOn, nil
+				}
+			}
+			return !stopOn, nil
+		case "$setIntersection", "$setUnion", "$setDifference":
+			if anyNullish(values) {
+				return nil, nil
+			}
+		}
+
+		sets := make([]bson.A, len(values))
+		for idx, value := range values {
+			entries, ok := value.(bson.A)
+			if !ok {
+				if len(values) == 2 && (operator == "$setDifference" || operator == "$setIsSubset") {
+					ordinal := "First"
+					if idx == 1 {
+						ordinal = "Second"
+					}
+					return nil, newExpressionError(path, ErrBadValue, "both operands of %s must be arrays. %s argument is of type: %s", operator, ordinal, TypeName(value))
+				}
+				return nil, newExpressionError(path, ErrBadValue, "All operands of %s must be arrays. One argument is of type: %s", operator, TypeName(value))
+			}
+			sets[idx] = uniqueValues(entries)
+		}
+
+		switch operator {
+		case "$setUnion":
+			result := bson.A{}
+			for _, set := range sets {
+				result = append(result, set...)
+			}
+			return uniqueValues(result), nil
+		case "$setIntersection":
+			if len(sets) == 0 {
+				return bson.A{}, nil
+			}
+			result := bson.A{}
+			for _, entry := range sets[0] {
+				inAll := true
+				for _, set := range sets[1:] {
+					inAll = inAll && containsValue(set, entry)
+				}
+				if inAll {
+					result = append(result, entry)
+				}
+			}
+			return result, nil
+		case "$setDifference":
+			result := bson.A{}
+			for _, entry := range sets[0] {
+				if !containsValue(sets[1], entry) {
+					result = append(result, entry)
+				}
+			}
+			return result, nil
+		case "$setIsSubset":
+			return isSubset(sets[0], sets[1]), nil
+		default:
+			for _, set := range sets[1:] {
+				if !isSubset(sets[0], set) || !isSubset(set, sets[0]) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+	}, nil
+}
+
+// uniqueValues removes duplicate values, keeping the first occurrence
+func uniqueValues(entries bson.A) bson.A {
+	result := bson.A{}
+	for _, entry := range entries {
+		if !containsValue(result, entry) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func isSubset(subset bson.A, set bson.A) bool {
+	for _, entry := range subset {
+		if !containsValue(set, entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,395 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// convertTypeCodes are the numeric bson type codes that can be used as the to argument of $convert
+var convertTypeCodes = map[int64]string{
+	1:  "double",
+	2:  "string",
+	7:  "objectId",
+	8:  "bool",
+	9:  "date",
+	16: "int",
+	18: "long",
+	19: "decimal",
+}
+
+// toOperatorTypes are the types the $to operators like $toInt convert to
+var toOperatorTypes = map[string]string{
+	"$toBool":     "bool",
+	"$toDate":     "date",
+	"$toDecimal":  "decimal",
+	"$toDouble":   "double",
+	"$toInt":      "int",
+	"$toLong":     "long",
+	"$toObjectId": "objectId",
+	"$toString":   "string",
+}
+
+// compileConvert compiles {$convert: {input: "$price", to: "decimal", onError: 0, onNull: 0}}
+func compileConvert(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$convert", value, path, []string{"input", "to"}, []string{"onError", "onNull"})
+	if err != nil {
+		return nil, err
+	}
+	evaluators, err := compileNamedArguments(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		input, err := evaluators["input"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		to, err := evaluators["to"](ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNullish(to) {
+			return nil, nil
+		}
+		typeName, err := parseConvertType(to, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNullish(input) {
+			if evaluators["onNull"] != nil {
+				return evaluators["onNull"](ctx)
+			}
+			return nil, nil
+		}
+
+		result, err := convertValue(input, typeName, path)
+		if err != nil && evaluators["onError"] != nil {
+			return evaluators["onError"](ctx)
+		}
+		return result, err
+	}, nil
+}
+
+// parseConvertType parses the to argument of $convert, a type name like "int" or a numeric type code like 16
+func parseConvertType(to any, path string) (string, error) {
+	if name, ok := to.(string); ok {
+		for _, knownName := range convertTypeCodes {
+			if name == knownName {
+				return name, nil
+			}
+		}
+		return "", newExpressionError(path, ErrBadValue, "Unknown type name: %s", name)
+	}
+
+	code, ok := wholeNumber(to)
+	if !ok {
+		return "", newExpressionError(path, ErrBadValue, "$convert's 'to' argument must be a string or number, but is %s", TypeName(to))
+	}
+	name, ok := convertTypeCodes[code]
+	if !ok {
+		return "", newExpressionError(path, ErrBadValue, "In $convert, numeric 'to' argument is not a valid type: %d", code)
+	}
+	return name, nil
+}
+
+// compileTo compiles the shorthands of $convert like {$toInt: "$qty"}
+func compileTo(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	evaluators, err := compileFixedArguments(operator, value, path, scope, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	to := toOperatorTypes[operator]
+
+	return func(ctx *contextT) (any, error) {
+		value, err := evaluators[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(value) {
+			return nil, nil
+		}
+		return convertValue(value, to, path)
+	}, nil
+}
+
+// compileType compiles {$type: "$value"} and {$isNumber: "$value"}
+func compileType(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	evaluators, err := compileFixedArguments(operator, value, path, scope, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		value, err := evaluators[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if operator == "$isNumber" {
+			return isNumber(value), nil
+		}
+		return TypeName(value), nil
+	}, nil
+}
+
+// convertValue converts a value that is not nullish into one of the types supported by $convert
+func convertValue(value any, to string, path string) (any, error) {
+	unsupported := func() error {
+		return newExpressionError(path, ErrBadValue, "Unsupported conversion from %s to %s in $convert with no onError value", TypeName(value), to)
+	}
+	overflow := func() error {
+		return newExpressionError(path, ErrBadValue, "Conversion would overflow target type in $convert with no onError value: %v", value)
+	}
+	parseError := func(kind string) error {
+		return newExpressionError(path, ErrBadValue, "Failed to parse %s '%v' in $convert with no onError value", kind, value)
+	}
+
+	switch to {
+	case "bool":
+		switch typedValue := value.(type) {
+		case bool:
+			return typedValue, nil
+		case int32, int64, float64, primitive.Decimal128:
+			return IsTrue(typedValue), nil
+		}
+		return true, nil
+
+	case "string":
+		text, ok := toStringValue(value)
+		if !ok {
+			return nil, unsupported()
+		}
+		return text, nil
+
+	case "double":
+		switch typedValue := value.(type) {
+		case bool:
+			if typedValue {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		case int32, int64, float64:
+			return toFloat64(typedValue), nil
+		case primitive.Decimal128:
+			result := toFloat64(typedValue)
+			if math.IsInf(result, 0) && typedValue.IsInf() == 0 {
+				return nil, overflow()
+			}
+			return result, nil
+		case string:
+			result, err := parseFloatString(typedValue)
+			if err != nil {
+				return nil, parseError("number")
+			}
+			return result, nil
+		case primitive.DateTime:
+			return float64(typedValue), nil
+		}
+		return nil, unsupported()
+
+	case "int", "long":
+		minimum, maximum := float64(math.MinInt64), float64(math.MaxInt64)
+		if to == "int" {
+			minimum, maximum = math.MinInt32, math.MaxInt32
+		}
+		var result int64
+		switch typedValue := value.(type) {
+		case bool:
+			if typedValue {
+				result = 1
+			}
+		case int32, int64:
+			result = toInt64(typedValue)
+			if float64(result) < minimum || float64(result) > maximum {
+				return nil, overflow()
+			}
+		case float64, primitive.Decimal128:
+			if isSpecial(typedValue) {
+				return nil, newExpressionError(path, ErrBadValue, "Attempt to convert NaN or infinity value to integer type in $convert with no onError value: %v", typedValue)
+			}
+			number := math.Trunc(toFloat64(typedValue))
+			// The maximum of a long can't be represented as a double, a double equal to it is already out of range
+			if number < minimum || number >= maximum && to == "long" || number > maximum {
+				return nil, overflow()
+			}
+			result = int64(number)
+		case string:
+			bits := 64
+			if to == "int" {
+				bits = 32
+			}
+			number, err := strconv.ParseInt(typedValue, 10, bits)
+			if err != nil {
+				return nil, parseError("number")
+			}
+			result = number
+		case primitive.DateTime:
+			if to == "int" {
+				return nil, unsupported()
+			}
+			result = int64(typedValue)
+		default:
+			return nil, unsupported()
+		}
+		if to == "int" {
+			return int32(result), nil
+		}
+		return result, nil
+
+	case "decimal":
+		switch typedValue := value.(type) {
+		case bool:
+			if typedValue {
+				return toDecimal(int32(1)), nil
+			}
+			return toDecimal(int32(0)), nil
+		case int32, int64, float64, primitive.Decimal128:
+			return toDecimal(typedValue), nil
+		case string:
+			result, err := primitive.ParseDecimal128(typedValue)
+			if err != nil {
+				return nil, parseError("number")
+			}
+			return result, nil
+		case primitive.DateTime:
+			return toDecimal(int64(typedValue)), nil
+		}
+		return nil, unsupported()
+
+	case "objectId":
+		switch typedValue := value.(type) {
+		case primitive.ObjectID:
+			return typedValue, nil
+		case string:
+			result, err := primitive.ObjectIDFromHex(typedValue)
+			if err != nil {
+				return nil, parseError("objectId")
+			}
+			return result, nil
+		}
+		return nil, unsupported()
+
+	default:
+		switch typedValue := value.(type) {
+		case primitive.DateTime:
+			return typedValue, nil
+		case int64:
+			return primitive.DateTime(typedValue), nil
+		case float64, primitive.Decimal128:
+			if isSpecial(typedValue) {
+				return nil, unsupported()
+			}
+			number := math.Trunc(toFloat64(typedValue))
+			if number < math.MinInt64 || number >= math.MaxInt64 {
+				return nil, overflow()
+			}
+			return primitive.DateTime(int64(number)), nil
+		case primitive.ObjectID:
+			return primitive.NewDateTimeFromTime(typedValue.Timestamp()), nil
+		case primitive.Timestamp:
+			return primitive.NewDateTimeFromTime(time.Unix(int64(typedValue.T), 0)), nil
+		case string:
+			result, ok := parseDateString(typedValue)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "Error parsing date string '%s' in $convert with no onError value", typedValue)
+			}
+			return result, nil
+		}
+		return nil, unsupported()
+	}
+}
+
+// parseFloatString parses a string into a double like MongoDB, only decimal notation and the special values are accepted
+func parseFloatString(text string) (float64, error) {
+	switch text {
+	case "NaN", "-NaN":
+		return math.NaN(), nil
+	case "Infinity", "inf", "+Infinity":
+		return math.Inf(1), nil
+	case "-Infinity", "-inf":
+		return math.Inf(-1), nil
+	}
+	if strings.ContainsAny(text, "xXpP_") {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// dateLayouts are the date formats $toDate accepts
+var dateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseDateString parses a date like "2021-03-20T10:30:00Z", dates without a timezone are UTC
+func parseDateString(text string) (primitive.DateTime, bool) {
+	for _, layout := range dateLayouts {
+		parsed, err := time.Parse(layout, text)
+		if err == nil {
+			return primitive.NewDateTimeFromTime(parsed), true
+		}
+	}
+	return 0, false
+}
+
+// toStringValue converts a value into a string like $toString
+// Returns false for values that can't be converted like arrays and documents.
+func toStringValue(value any) (string, bool) {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue, true
+	case primitive.Symbol:
+		return string(typedValue), true
+	case bool:
+		return strconv.FormatBool(typedValue), true
+	case int32:
+		return strconv.FormatInt(int64(typedValue), 10), true
+	case int64:
+		return strconv.FormatInt(typedValue, 10), true
+	case float64:
+		return formatDouble(typedValue), true
+	case primitive.Decimal128:
+		return typedValue.String(), true
+	case primitive.ObjectID:
+		return typedValue.Hex(), true
+	case primitive.DateTime:
+		return typedValue.Time().UTC().Format("2006-01-02T15:04:05.000Z"), true
+	case primitive.Timestamp:
+		return fmt.Sprintf("Timestamp(%d, %d)", typedValue.T, typedValue.I), true
+	}
+	return "", false
+}
+
+// formatDouble formats a double like MongoDB, whole numbers have no decimal point and very large or small numbers use exponents
+func formatDouble(number float64) string {
+	switch {
+	case math.IsNaN(number):
+		return "NaN"
+	case math.IsInf(number, 1):
+		return "Infinity"
+	case math.IsInf(number, -1):
+		return "-Infinity"
+	}
+	abs := math.Abs(number)
+	if abs != 0 && (abs < 1e-4 || abs >= 1e21) {
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+	if abs >= 1e15 && abs == math.Trunc(abs) {
+		return new(big.Float).SetFloat64(number).Text('f', 0)
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
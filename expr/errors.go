@@ -0,0 +1,45 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownOperator is returned if an expression contains an operator that does not exist
+	ErrUnknownOperator = errors.New("unknown operator")
+	// ErrBadValue is returned if an expression is invalid or can't be evaluated, like {$add: ["a", 1]}
+	ErrBadValue = errors.New("bad value")
+	// ErrNotSupported is returned for valid MongoDB operators that are not supported by mongomock
+	ErrNotSupported = errors.New("operator not supported")
+)
+
+// ExpressionError describes why an expression is invalid or could not be evaluated
+// It wraps one of ErrUnknownOperator, ErrBadValue or ErrNotSupported
+type ExpressionError struct {
+	// Path is the path of the offending expression, like "total.$add"
+	Path string
+	// Message is the error message MongoDB would have returned
+	Message string
+	// Err is the kind of error
+	Err error
+}
+
+func (e *ExpressionError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (at %s)", e.Message, e.Path)
+}
+
+func (e *ExpressionError) Unwrap() error {
+	return e.Err
+}
+
+func newExpressionError(path string, err error, format string, args ...any) *ExpressionError {
+	return &ExpressionError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+		Err:     err,
+	}
+}
@@ -0,0 +1,393 @@
+// Package expr evaluates MongoDB aggregation expressions like {$add: ["$price", "$tax"]} against documents
+package expr
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// missingT is the type of the missing value
+type missingT struct{}
+
+// Missing is the result of an expression that refers to a field that does not exist
+// Fields set to Missing are left out of documents, unlike fields set to null.
+var Missing = missingT{}
+
+// Expression is a compiled aggregation expression
+type Expression struct {
+	evaluate evaluatorT
+}
+
+// Variables are the values of user defined variables like the let option of an aggregation, referred to as "$$name"
+// The NOW system variable can be set as well so it's the same for all documents, otherwise the current time is used.
+type Variables map[string]any
+
+// contextT contains the values an expression is evaluated against
+type contextT struct {
+	root      any
+	current   any
+	locals    *variableT
+	variables Variables
+}
+
+// variableT is a variable defined within the expression by operators like $let and $map
+type variableT struct {
+	name  string
+	value any
+	next  *variableT
+}
+
+// with returns a copy of the context with a variable set
+// Like MongoDB setting CURRENT changes the document field paths refer to.
+func (c *contextT) with(name string, value any) *contextT {
+	result := *c
+	if name == "CURRENT" {
+		result.current = value
+	} else {
+		result.locals = &variableT{name: name, value: value, next: c.locals}
+	}
+	return &result
+}
+
+func (c *contextT) variable(name string) any {
+	for variable := c.locals; variable != nil; variable = variable.next {
+		if variable.name == name {
+			return variable.value
+		}
+	}
+	value, ok := c.variables[name]
+	if !ok {
+		return Missing
+	}
+	return value
+}
+
+// scopeT contains the names of the user defined variables that can be used at a position within an expression
+type scopeT map[string]bool
+
+func newScope(names []string) scopeT {
+	return scopeT{}.with(names...)
+}
+
+// with returns a copy of the scope with the variables added
+func (s scopeT) with(names ...string) scopeT {
+	result := make(scopeT, len(s)+len(names))
+	for name := range s {
+		result[name] = true
+	}
+	for _, name := range names {
+		result[name] = true
+	}
+	return result
+}
+
+// evaluatorT evaluates a compiled expression
+type evaluatorT func(ctx *contextT) (any, error)
+
+// Compile validates an expression and compiles it
+//
+// Expressions can be field paths like "$price", literal values, objects like {total: "$price"}, arrays of expressions and operators like {$add: ["$price", "$tax"]}.
+// Documents within the expression can be any document like value, so bson.D, bson.M, maps and structs.
+func Compile(expression any) (*Expression, error) {
+	return CompileWithVariables(expression, nil)
+}
+
+// CompileWithVariables compiles an expression that can refer to user defined variables, their values are given to EvaluateWithVariables
+func CompileWithVariables(expression any, variables []string) (*Expression, error) {
+	evaluate, err := compile(expression, "", newScope(variables))
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{evaluate: evaluate}, nil
+}
+
+// Evaluate evaluates the expression against a document
+// Returns Missing if the expression refers to a field that does not exist.
+func (e *Expression) Evaluate(document bson.D) (any, error) {
+	return e.EvaluateWithVariables(document, nil)
+}
+
+// EvaluateWithVariables evaluates the expression against a document with the values of the user defined variables
+func (e *Expression) EvaluateWithVariables(document bson.D, variables Variables) (any, error) {
+	return e.evaluate(&contextT{root: document, current: document, variables: variables})
+}
+
+func compile(expression any, path string, scope scopeT) (evaluatorT, error) {
+	if expressionString, ok := expression.(string); ok && strings.HasPrefix(expressionString, "$") {
+		return compileFieldPath(expressionString, path, scope)
+	}
+
+	if document, ok := match.ToDocument(expression); ok {
+		if len(document) > 0 && strings.HasPrefix(document[0].Key, "$") {
+			return compileOperator(document, path, scope)
+		}
+		return compileObject(document, path, scope)
+	}
+
+	if entries, ok := match.ToArray(expression); ok {
+		return compileArray(entries, path, scope)
+	}
+
+	return constant(Normalize(expression)), nil
+}
+
+// compileObject compiles an object expression like {total: "$price", currency: "EUR"}
+// Fields that evaluate to Missing are left out of the result.
+func compileObject(document bson.D, path string, scope scopeT) (evaluatorT, error) {
+	keys := make([]string, len(document))
+	evaluators := make([]evaluatorT, len(document))
+	for idx, entry := range document {
+		keyPath := joinPath(path, entry.Key)
+		if strings.HasPrefix(entry.Key, "$") {
+			return nil, newExpressionError(keyPath, ErrBadValue, "FieldPath field names may not start with '$'")
+		}
+		if strings.Contains(entry.Key, ".") {
+			return nil, newExpressionError(keyPath, ErrBadValue, "FieldPath field names may not contain '.'")
+		}
+
+		evaluator, err := compile(entry.Value, keyPath, scope)
+		if err != nil {
+			return nil, err
+		}
+		keys[idx] = entry.Key
+		evaluators[idx] = evaluator
+	}
+
+	return func(ctx *contextT) (any, error) {
+		result := make(bson.D, 0, len(evaluators))
+		for idx, evaluator := range evaluators {
+			value, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if value != Missing {
+				result = append(result, bson.E{Key: keys[idx], Value: value})
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// compileArray compiles an array of expressions like ["$price", "$tax"]
+// Like MongoDB entries that evaluate to Missing become null.
+func compileArray(entries []any, path string, scope scopeT) (evaluatorT, error) {
+	evaluators := make([]evaluatorT, len(entries))
+	for idx, entry := range entries {
+		evaluator, err := compile(entry, joinPath(path, strconv.Itoa(idx)), scope)
+		if err != nil {
+			return nil, err
+		}
+		evaluators[idx] = evaluator
+	}
+
+	return func(ctx *contextT) (any, error) {
+		result := make(bson.A, len(evaluators))
+		for idx, evaluator := range evaluators {
+			value, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if value == Missing {
+				value = nil
+			}
+			result[idx] = value
+		}
+		return result, nil
+	}, nil
+}
+
+// compileFieldPath compiles a field path like "$items.price" or a variable like "$$item.price"
+func compileFieldPath(fieldPath string, path string, scope scopeT) (evaluatorT, error) {
+	if strings.HasPrefix(fieldPath, "$$") {
+		return compileVariable(fieldPath[2:], path, scope)
+	}
+
+	parts, err := parseFieldPath(fieldPath[1:], path)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *contextT) (any, error) {
+		return LookupFieldPath(ctx.current, parts), nil
+	}, nil
+}
+
+// compileVariable compiles a variable without the leading $$ like "ROOT" or "item.price"
+func compileVariable(variable string, path string, scope scopeT) (evaluatorT, error) {
+	name, fieldPath, hasFieldPath := strings.Cut(variable, ".")
+	var parts []string
+	if hasFieldPath {
+		var err error
+		parts, err = parseFieldPath(fieldPath, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lookup func(ctx *contextT) any
+	switch name {
+	case "ROOT":
+		lookup = func(ctx *contextT) any { return ctx.root }
+	case "CURRENT":
+		lookup = func(ctx *contextT) any { return ctx.current }
+	case "REMOVE":
+		lookup = func(ctx *contextT) any { return Missing }
+	case "NOW":
+		lookup = func(ctx *contextT) any {
+			if now, ok := ctx.variables["NOW"]; ok {
+				return now
+			}
+			return primitive.NewDateTimeFromTime(time.Now())
+		}
+	case "CLUSTER_TIME", "DESCEND", "PRUNE", "KEEP", "SEARCH_META", "USER_ROLES":
+		return nil, newExpressionError(path, ErrNotSupported, "the $$%s variable is not supported by mongomock", name)
+	default:
+		if !scope[name] {
+			err := validateVariableName(name, path)
+			if err != nil {
+				return nil, err
+			}
+			return nil, newExpressionError(path, ErrBadValue, "Use of undefined variable: %s", name)
+		}
+		lookup = func(ctx *contextT) any { return ctx.variable(name) }
+	}
+
+	return func(ctx *contextT) (any, error) {
+		return LookupFieldPath(lookup(ctx), parts), nil
+	}, nil
+}
+
+// ValidateVariableName validates the name of a user defined variable
+// Like MongoDB names have to start with a lowercase letter or a non ASCII character and may only contain letters, digits and underscores.
+func ValidateVariableName(name string) error {
+	return validateVariableName(name, "")
+}
+
+func validateVariableName(name string, path string) error {
+	if name == "" {
+		return newExpressionError(path, ErrBadValue, "empty variable names are not allowed")
+	}
+	for idx, char := range name {
+		if idx == 0 && !(char >= 'a' && char <= 'z' || char > unicode.MaxASCII) {
+			return newExpressionError(path, ErrBadValue, "'%s' starts with an invalid character for a user variable name", name)
+		}
+		isLetter := char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z'
+		if !(isLetter || char >= '0' && char <= '9' || char == '_' || char > unicode.MaxASCII) {
+			return newExpressionError(path, ErrBadValue, "'%s' contains an invalid character for a variable name: '%c'", name, char)
+		}
+	}
+	return nil
+}
+
+// parseFieldPath splits a field path without the leading $ into its parts
+func parseFieldPath(fieldPath string, path string) ([]string, error) {
+	if fieldPath == "" {
+		return nil, newExpressionError(path, ErrBadValue, "'$' by itself is not a valid FieldPath")
+	}
+
+	parts := strings.Split(fieldPath, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, newExpressionError(path, ErrBadValue, "FieldPath must not contain empty field names")
+		}
+		if strings.HasPrefix(part, "$") {
+			return nil, newExpressionError(path, ErrBadValue, "FieldPath field names may not start with '$'")
+		}
+	}
+	return parts, nil
+}
+
+// LookupFieldPath looks up a field path like ["items", "price"] within a value
+// Like MongoDB arrays are walked through, so the path resolves to an array of the prices of all items.
+// Unlike filters numeric path parts do not refer to array indexes.
+// Returns Missing if the path does not exist.
+func LookupFieldPath(value any, path []string) any {
+	if len(path) == 0 {
+		return value
+	}
+
+	if entries, ok := value.(bson.A); ok {
+		results := bson.A{}
+		for _, entry := range entries {
+			switch entry.(type) {
+			case bson.D, bson.A:
+				result := LookupFieldPath(entry, path)
+				if result != Missing {
+					results = append(results, result)
+				}
+			}
+		}
+		return results
+	}
+
+	document, ok := value.(bson.D)
+	if !ok {
+		return Missing
+	}
+	for _, entry := range document {
+		if entry.Key == path[0] {
+			return LookupFieldPath(entry.Value, path[1:])
+		}
+	}
+	return Missing
+}
+
+func constant(value any) evaluatorT {
+	return func(ctx *contextT) (any, error) {
+		return value, nil
+	}
+}
+
+// Normalize converts a value into the value it would be after encoding and decoding it as bson
+// Documents become bson.D, arrays bson.A and numbers int32, int64 or float64, this is the form expressions work with.
+func Normalize(value any) any {
+	switch typedValue := value.(type) {
+	case nil, string, bool, int32, int64, float64,
+		primitive.ObjectID, primitive.DateTime, primitive.Decimal128, primitive.Timestamp, primitive.Regex:
+		return value
+	case bson.D:
+		result := make(bson.D, len(typedValue))
+		for idx, entry := range typedValue {
+			result[idx] = bson.E{Key: entry.Key, Value: Normalize(entry.Value)}
+		}
+		return result
+	case bson.A:
+		result := make(bson.A, len(typedValue))
+		for idx, entry := range typedValue {
+			result[idx] = Normalize(entry)
+		}
+		return result
+	case missingT:
+		return value
+	}
+
+	if document, ok := match.ToDocument(value); ok {
+		return Normalize(document)
+	}
+	if entries, ok := match.ToArray(value); ok {
+		return Normalize(bson.A(entries))
+	}
+
+	encoded, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return value
+	}
+	decoded := bson.D{}
+	err = bson.Unmarshal(encoded, &decoded)
+	if err != nil || len(decoded) == 0 {
+		return value
+	}
+	return decoded[0].Value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,472 @@
+package expr
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func mustParseDecimal128(value string) primitive.Decimal128 {
+	decimal, err := primitive.ParseDecimal128(value)
+	if err != nil {
+		panic(err)
+	}
+	return decimal
+}
+
+func TestEvaluate(t *testing.T) {
+	document := bson.D{
+		{Key: "name", Value: "pear"},
+		{Key: "price", Value: 2.5},
+		{Key: "supplier", Value: bson.D{{Key: "city", Value: "Utrecht"}}},
+		{Key: "items", Value: bson.A{
+			bson.D{{Key: "price", Value: int32(1)}},
+			bson.D{{Key: "name", Value: "no price"}},
+			int32(3),
+			bson.A{bson.D{{Key: "price", Value: int32(2)}}},
+		}},
+	}
+
+	cases := []struct {
+		Name       string
+		Expression any
+		Expected   any
+	}{
+		{"constant", "pear", "pear"},
+		{"go number", 5, int32(5)},
+		{"field path", "$name", "pear"},
+		{"embedded field path", "$supplier.city", "Utrecht"},
+		{"missing field", "$nothing", Missing},
+		{"missing embedded field", "$name.city", Missing},
+		{"field path through arrays", "$items.price", bson.A{int32(1), bson.A{int32(2)}}},
+		{"numeric path parts are no indexes", "$items.0", bson.A{bson.A{}}},
+		{"object", bson.M{"city": "$supplier.city"}, bson.D{{Key: "city", Value: "Utrecht"}}},
+		{"object without missing fields", bson.D{{Key: "a", Value: "$nothing"}, {Key: "b", Value: true}}, bson.D{{Key: "b", Value: true}}},
+		{"array", bson.A{"$name", "$nothing", 1.5}, bson.A{"pear", nil, 1.5}},
+		{"$literal", bson.M{"$literal": "$name"}, "$name"},
+		{"$literal document", bson.M{"$literal": bson.M{"$add": 1}}, bson.D{{Key: "$add", Value: int32(1)}}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			expression, err := Compile(testCase.Expression)
+			NoError(t, err)
+			result, err := expression.Evaluate(document)
+			NoError(t, err)
+			Equal(t, testCase.Expected, result)
+		})
+	}
+}
+
+func TestOperators(t *testing.T) {
+	document := bson.D{
+		{Key: "name", Value: "Pear"},
+		{Key: "qty", Value: int32(4)},
+		{Key: "price", Value: 2.5},
+		{Key: "null", Value: nil},
+		{Key: "tags", Value: bson.A{"fruit", "green", "fruit"}},
+		{Key: "items", Value: bson.A{
+			bson.D{{Key: "sku", Value: "a"}, {Key: "price", Value: int32(3)}},
+			bson.D{{Key: "sku", Value: "b"}, {Key: "price", Value: int32(1)}},
+		}},
+		{Key: "date", Value: primitive.NewDateTimeFromTime(time.Date(2021, 3, 20, 10, 30, 0, 0, time.UTC))},
+	}
+
+	cases := []struct {
+		Name       string
+		Expression any
+		Expected   any
+	}{
+		{"$$ROOT", bson.M{"$getField": bson.M{"field": "qty", "input": "$$ROOT"}}, int32(4)},
+		{"$$CURRENT field path", "$$CURRENT.qty", int32(4)},
+		{"$$REMOVE", bson.D{{Key: "a", Value: "$$REMOVE"}, {Key: "b", Value: 1}}, bson.D{{Key: "b", Value: int32(1)}}},
+		{"$let", bson.M{"$let": bson.M{"vars": bson.M{"total": bson.M{"$multiply": bson.A{"$qty", "$price"}}}, "in": bson.M{"$add": bson.A{"$$total", 1}}}}, 11.0},
+		{"$let rebinding CURRENT", bson.M{"$let": bson.M{"vars": bson.M{"CURRENT": bson.M{"qty": 7}}, "in": "$qty"}}, int32(7)},
+
+		{"$add", bson.M{"$add": bson.A{"$qty", 1}}, int32(5)},
+		{"$add widens", bson.M{"$add": bson.A{"$qty", int64(1), "$price"}}, 7.5},
+		{"$add int32 overflow", bson.M{"$add": bson.A{int32(math.MaxInt32), int32(1)}}, int64(math.MaxInt32 + 1)},
+		{"$add null", bson.M{"$add": bson.A{"$qty", "$null"}}, nil},
+		{"$add missing", bson.M{"$add": bson.A{"$qty", "$nothing"}}, nil},
+		{"$add date", bson.M{"$add": bson.A{"$date", 1000}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 20, 10, 30, 1, 0, time.UTC))},
+		{"$subtract dates", bson.M{"$subtract": bson.A{"$date", "$date"}}, int64(0)},
+		{"$multiply", bson.M{"$multiply": bson.A{"$qty", "$qty"}}, int32(16)},
+		{"$divide", bson.M{"$divide": bson.A{"$qty", 8}}, 0.5},
+		{"$mod", bson.M{"$mod": bson.A{"$qty", 3}}, int32(1)},
+		{"$pow", bson.M{"$pow": bson.A{2, 10}}, int32(1024)},
+		{"$round", bson.M{"$round": bson.A{2.5, 0}}, 2.0},
+		{"$round decimal places", bson.M{"$round": bson.A{1.255, 1}}, 1.3},
+		{"$trunc", bson.M{"$trunc": bson.A{-2.7, 0}}, -2.0},
+		{"$abs", bson.M{"$abs": int32(-3)}, int32(3)},
+		{"$sqrt", bson.M{"$sqrt": 16}, 4.0},
+		{"$add decimal", bson.M{"$add": bson.A{mustParseDecimal128("0.1"), 0.2}}, mustParseDecimal128("0.3")},
+
+		{"$eq", bson.M{"$eq": bson.A{"$qty", 4.0}}, true},
+		{"$gt missing and null", bson.M{"$gt": bson.A{"$null", "$nothing"}}, true},
+		{"$cmp", bson.M{"$cmp": bson.A{"$name", "Apple"}}, int32(1)},
+		{"$and", bson.M{"$and": bson.A{1, "$name", bson.A{}}}, true},
+		{"$and with zero", bson.M{"$and": bson.A{1, 0}}, false},
+		{"$or", bson.M{"$or": bson.A{"$null", "$nothing", false}}, false},
+		{"$not", bson.M{"$not": bson.A{"$null"}}, true},
+		{"$cond", bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$qty", 4}}, "many", "few"}}, "many"},
+		{"$cond object", bson.M{"$cond": bson.M{"if": "$null", "then": "yes", "else": "no"}}, "no"},
+		{"$switch", bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": bson.M{"$lt": bson.A{"$qty", 2}}, "then": "low"},
+				bson.M{"case": bson.M{"$lt": bson.A{"$qty", 10}}, "then": "medium"},
+			},
+			"default": "high",
+		}}, "medium"},
+		{"$ifNull", bson.M{"$ifNull": bson.A{"$nothing", "$null", "default"}}, "default"},
+
+		{"$concat", bson.M{"$concat": bson.A{"$name", " ", "tree"}}, "Pear tree"},
+		{"$concat null", bson.M{"$concat": bson.A{"$name", "$null"}}, nil},
+		{"$toUpper", bson.M{"$toUpper": "$name"}, "PEAR"},
+		{"$toLower null", bson.M{"$toLower": "$null"}, ""},
+		{"$substrCP", bson.M{"$substrCP": bson.A{"héllo", 1, 3}}, "éll"},
+		{"$substrBytes", bson.M{"$substrBytes": bson.A{"$name", 1, -1}}, "ear"},
+		{"$strLenCP", bson.M{"$strLenCP": "héllo"}, int32(5)},
+		{"$strLenBytes", bson.M{"$strLenBytes": "héllo"}, int32(6)},
+		{"$split", bson.M{"$split": bson.A{"a-b-c", "-"}}, bson.A{"a", "b", "c"}},
+		{"$indexOfCP", bson.M{"$indexOfCP": bson.A{"héllo", "l"}}, int32(2)},
+		{"$indexOfBytes", bson.M{"$indexOfBytes": bson.A{"héllo", "l"}}, int32(3)},
+		{"$indexOfBytes not found", bson.M{"$indexOfBytes": bson.A{"hello", "l", 4}}, int32(-1)},
+		{"$strcasecmp", bson.M{"$strcasecmp": bson.A{"$name", "PEAR"}}, int32(0)},
+		{"$trim", bson.M{"$trim": bson.M{"input": "  pear\n"}}, "pear"},
+		{"$ltrim chars", bson.M{"$ltrim": bson.M{"input": "--pear--", "chars": "-"}}, "pear--"},
+		{"$replaceAll", bson.M{"$replaceAll": bson.M{"input": "a.b.c", "find": ".", "replacement": "/"}}, "a/b/c"},
+		{"$regexMatch", bson.M{"$regexMatch": bson.M{"input": "$name", "regex": "^p", "options": "i"}}, true},
+		{"$regexFind", bson.M{"$regexFind": bson.M{"input": "héllo", "regex": primitive.Regex{Pattern: "l(o)?"}}}, bson.D{
+			{Key: "match", Value: "l"},
+			{Key: "idx", Value: int32(2)},
+			{Key: "captures", Value: bson.A{nil}},
+		}},
+		{"$regexFindAll", bson.M{"$regexFindAll": bson.M{"input": "a1b22", "regex": "[0-9]+"}}, bson.A{
+			bson.D{{Key: "match", Value: "1"}, {Key: "idx", Value: int32(1)}, {Key: "captures", Value: bson.A{}}},
+			bson.D{{Key: "match", Value: "22"}, {Key: "idx", Value: int32(3)}, {Key: "captures", Value: bson.A{}}},
+		}},
+
+		{"$arrayElemAt", bson.M{"$arrayElemAt": bson.A{"$tags", -1}}, "fruit"},
+		{"$arrayElemAt out of range", bson.D{{Key: "a", Value: bson.M{"$arrayElemAt": bson.A{"$tags", 5}}}}, bson.D{}},
+		{"$first", bson.M{"$first": "$items.sku"}, "a"},
+		{"$last", bson.M{"$last": "$tags"}, "fruit"},
+		{"$concatArrays", bson.M{"$concatArrays": bson.A{bson.A{1}, bson.A{2, 3}}}, bson.A{int32(1), int32(2), int32(3)}},
+		{"$in", bson.M{"$in": bson.A{"green", "$tags"}}, true},
+		{"$indexOfArray", bson.M{"$indexOfArray": bson.A{"$tags", "fruit", 1}}, int32(2)},
+		{"$isArray", bson.M{"$isArray": bson.A{"$tags"}}, true},
+		{"$range", bson.M{"$range": bson.A{0, 10, 4}}, bson.A{int32(0), int32(4), int32(8)}},
+		{"$reverseArray", bson.M{"$reverseArray": bson.A{bson.A{1, 2}}}, bson.A{int32(2), int32(1)}},
+		{"$size", bson.M{"$size": "$tags"}, int32(3)},
+		{"$slice", bson.M{"$slice": bson.A{"$tags", -2}}, bson.A{"green", "fruit"}},
+		{"$slice position", bson.M{"$slice": bson.A{"$tags", 1, 1}}, bson.A{"green"}},
+		{"$arrayToObject", bson.M{"$arrayToObject": bson.A{bson.A{bson.A{"a", 1}, bson.A{"b", 2}, bson.A{"a", 3}}}}, bson.D{{Key: "a", Value: int32(3)}, {Key: "b", Value: int32(2)}}},
+		{"$objectToArray", bson.M{"$objectToArray": bson.M{"a": 1}}, bson.A{bson.D{{Key: "k", Value: "a"}, {Key: "v", Value: int32(1)}}}},
+		{"$mergeObjects", bson.M{"$mergeObjects": bson.A{bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}, "$null", bson.M{"a": 2}}}, bson.D{{Key: "a", Value: int32(2)}, {Key: "b", Value: int32(1)}}},
+		{"$filter", bson.M{"$filter": bson.M{"input": "$items", "as": "item", "cond": bson.M{"$gt": bson.A{"$$item.price", 2}}}}, bson.A{
+			bson.D{{Key: "sku", Value: "a"}, {Key: "price", Value: int32(3)}},
+		}},
+		{"$filter limit", bson.M{"$filter": bson.M{"input": "$tags", "cond": true, "limit": 1}}, bson.A{"fruit"}},
+		{"$filter null", bson.M{"$filter": bson.M{"input": "$nothing", "cond": true}}, nil},
+		{"$map", bson.M{"$map": bson.M{"input": "$items", "in": bson.M{"$multiply": bson.A{"$$this.price", "$qty"}}}}, bson.A{int32(12), int32(4)}},
+		{"$reduce", bson.M{"$reduce": bson.M{"input": "$items", "initialValue": 0, "in": bson.M{"$add": bson.A{"$$value", "$$this.price"}}}}, int32(4)},
+		{"$zip", bson.M{"$zip": bson.M{"inputs": bson.A{bson.A{1, 2}, bson.A{"a"}}}}, bson.A{bson.A{int32(1), "a"}}},
+		{"$zip longest", bson.M{"$zip": bson.M{"inputs": bson.A{bson.A{1, 2}, bson.A{"a"}}, "useLongestLength": true, "defaults": bson.A{0, "z"}}}, bson.A{
+			bson.A{int32(1), "a"},
+			bson.A{int32(2), "z"},
+		}},
+		{"$sortArray", bson.M{"$sortArray": bson.M{"input": "$items", "sortBy": bson.M{"price": 1}}}, bson.A{
+			bson.D{{Key: "sku", Value: "b"}, {Key: "price", Value: int32(1)}},
+			bson.D{{Key: "sku", Value: "a"}, {Key: "price", Value: int32(3)}},
+		}},
+		{"$sortArray values", bson.M{"$sortArray": bson.M{"input": bson.A{2, 3, 1}, "sortBy": -1}}, bson.A{int32(3), int32(2), int32(1)}},
+		{"$getField", bson.M{"$getField": "name"}, "Pear"},
+		{"$getField dotted name", bson.M{"$getField": bson.M{"field": "a.b", "input": bson.M{"$literal": bson.M{"a.b": 1}}}}, int32(1)},
+
+		{"$setUnion", bson.M{"$setUnion": bson.A{"$tags", bson.A{"ripe"}}}, bson.A{"fruit", "green", "ripe"}},
+		{"$setIntersection", bson.M{"$setIntersection": bson.A{"$tags", bson.A{"green", "ripe"}}}, bson.A{"green"}},
+		{"$setDifference", bson.M{"$setDifference": bson.A{"$tags", bson.A{"green"}}}, bson.A{"fruit"}},
+		{"$setEquals", bson.M{"$setEquals": bson.A{"$tags", bson.A{"green", "fruit"}}}, true},
+		{"$setIsSubset", bson.M{"$setIsSubset": bson.A{bson.A{"green"}, "$tags"}}, true},
+		{"$anyElementTrue", bson.M{"$anyElementTrue": bson.A{bson.A{0, nil, 1}}}, true},
+		{"$allElementsTrue", bson.M{"$allElementsTrue": bson.A{bson.A{1, false}}}, false},
+
+		{"$toString", bson.M{"$toString": "$price"}, "2.5"},
+		{"$toString date", bson.M{"$toString": "$date"}, "2021-03-20T10:30:00.000Z"},
+		{"$toInt", bson.M{"$toInt": "42"}, int32(42)},
+		{"$toInt truncates", bson.M{"$toInt": "$price"}, int32(2)},
+		{"$toLong date", bson.M{"$toLong": "$date"}, int64(1616236200000)},
+		{"$toDouble", bson.M{"$toDouble": true}, 1.0},
+		{"$toDecimal", bson.M{"$toDecimal": "$price"}, mustParseDecimal128("2.5")},
+		{"$toBool", bson.M{"$toBool": "$qty"}, true},
+		{"$toDate", bson.M{"$toDate": "2021-03-20T10:30:00Z"}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 20, 10, 30, 0, 0, time.UTC))},
+		{"$toObjectId", bson.M{"$toObjectId": "5ab9cbfa31c2ab715d42129e"}, mustObjectID("5ab9cbfa31c2ab715d42129e")},
+		{"$toInt null", bson.M{"$toInt": "$nothing"}, nil},
+		{"$convert", bson.M{"$convert": bson.M{"input": "$name", "to": "int", "onError": -1}}, int32(-1)},
+		{"$convert onNull", bson.M{"$convert": bson.M{"input": "$null", "to": 16, "onNull": 0}}, int32(0)},
+		{"$type", bson.M{"$type": "$nothing"}, "missing"},
+		{"$type array", bson.M{"$type": bson.A{"$tags"}}, "array"},
+		{"$isNumber", bson.M{"$isNumber": "$price"}, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			expression, err := Compile(testCase.Expression)
+			NoError(t, err)
+			result, err := expression.Evaluate(document)
+			NoError(t, err)
+			Equal(t, testCase.Expected, result)
+		})
+	}
+}
+
+func mustObjectID(hex string) primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	document := bson.D{{Key: "name", Value: "pear"}, {Key: "qty", Value: int32(0)}}
+
+	cases := []struct {
+		Name       string
+		Expression any
+		Message    string
+	}{
+		{"$add string", bson.M{"$add": bson.A{"$name", 1}}, "$add only supports numeric or date types, not string (at $add)"},
+		{"$divide by zero", bson.M{"$divide": bson.A{1, "$qty"}}, "can't $divide by zero (at $divide)"},
+		{"$concat number", bson.M{"$concat": bson.A{"$name", 1}}, "$concat only supports strings, not int (at $concat)"},
+		{"$size of missing", bson.M{"$size": "$tags"}, "The argument to $size must be an array. Type of argument: missing (at $size)"},
+		{"$switch without match", bson.M{"$switch": bson.M{"branches": bson.A{bson.M{"case": false, "then": 1}}}}, "$switch could not find a matching branch for an input, and no default was specified. (at $switch)"},
+		{"$toInt string", bson.M{"$toInt": "$name"}, "Failed to parse number 'pear' in $convert with no onError value (at $toInt)"},
+		{"$toObjectId number", bson.M{"$toObjectId": "$qty"}, "Unsupported conversion from int to objectId in $convert with no onError value (at $toObjectId)"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			expression, err := Compile(testCase.Expression)
+			NoError(t, err)
+			_, err = expression.Evaluate(document)
+			EqualError(t, err, testCase.Message)
+			ErrorIs(t, err, ErrBadValue)
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	expression, err := CompileWithVariables(bson.M{"$multiply": bson.A{"$qty", "$$factor"}}, []string{"factor"})
+	NoError(t, err)
+	result, err := expression.EvaluateWithVariables(bson.D{{Key: "qty", Value: int32(2)}}, Variables{"factor": int32(3)})
+	NoError(t, err)
+	Equal(t, int32(6), result)
+
+	now := primitive.NewDateTimeFromTime(time.Date(2021, 3, 20, 0, 0, 0, 0, time.UTC))
+	expression, err = Compile("$$NOW")
+	NoError(t, err)
+	result, err = expression.EvaluateWithVariables(bson.D{}, Variables{"NOW": now})
+	NoError(t, err)
+	Equal(t, now, result)
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Expression any
+		Err        error
+		Message    string
+	}{
+		{"unknown operator", bson.M{"a": bson.M{"$foo": 1}}, ErrUnknownOperator, "Unrecognized expression '$foo' (at a.$foo)"},
+		{"operator with other fields", bson.D{{Key: "$literal", Value: 1}, {Key: "a", Value: 1}}, ErrBadValue, "an expression specification must contain exactly one field, the name of the expression. Found 2 fields"},
+		{"field with a dot", bson.M{"a.b": 1}, ErrBadValue, "FieldPath field names may not contain '.' (at a.b)"},
+		{"only a dollar", "$", ErrBadValue, "'$' by itself is not a valid FieldPath"},
+		{"empty field name", "$a..b", ErrBadValue, "FieldPath must not contain empty field names"},
+		{"undefined variable", "$$total", ErrBadValue, "Use of undefined variable: total"},
+		{"invalid variable name", "$$Total", ErrBadValue, "'Total' starts with an invalid character for a user variable name"},
+		{"unsupported variable", "$$CLUSTER_TIME", ErrNotSupported, "the $$CLUSTER_TIME variable is not supported by mongomock"},
+		{"unsupported operator", bson.M{"$rand": bson.M{}}, ErrNotSupported, "$rand is not supported by mongomock (at $rand)"},
+		{"wrong argument count", bson.M{"$eq": bson.A{1}}, ErrBadValue, "Expression $eq takes exactly 2 arguments. 1 were passed in. (at $eq)"},
+		{"unknown named argument", bson.M{"$filter": bson.M{"input": "$a", "cond": true, "where": 1}}, ErrBadValue, "Unrecognized parameter to $filter: where (at $filter)"},
+		{"missing named argument", bson.M{"$map": bson.M{"input": "$a"}}, ErrBadValue, "Missing 'in' parameter to $map (at $map)"},
+		{"variable out of scope", bson.M{"$add": bson.A{bson.M{"$let": bson.M{"vars": bson.M{"a": 1}, "in": "$$a"}}, "$$a"}}, ErrBadValue, "Use of undefined variable: a (at $add.1)"},
+		{"$switch without branches", bson.M{"$switch": bson.M{"branches": bson.A{}}}, ErrBadValue, "$switch requires at least one branch (at $switch)"},
+		{"$zip defaults without longest length", bson.M{"$zip": bson.M{"inputs": bson.A{"$a"}, "defaults": bson.A{1}}}, ErrBadValue, "cannot specify defaults unless useLongestLength is true (at $zip)"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := Compile(testCase.Expression)
+			EqualError(t, err, testCase.Message)
+			ErrorIs(t, err, testCase.Err)
+		})
+	}
+}
+
+func TestAccumulators(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Accumulator any
+		Values      []any
+		Expected    any
+	}{
+		{"$sum int32", bson.M{"$sum": "$v"}, []any{int32(1), int32(2)}, int32(3)},
+		{"$sum ignores other values", bson.M{"$sum": "$v"}, []any{int32(1), "2", nil, Missing, true}, int32(1)},
+		{"$sum without values", bson.M{"$sum": "$v"}, []any{}, int32(0)},
+		{"$sum int32 overflow", bson.M{"$sum": "$v"}, []any{int32(math.MaxInt32), int32(1)}, int64(math.MaxInt32 + 1)},
+		{"$sum int64", bson.M{"$sum": "$v"}, []any{int32(1), int64(2)}, int64(3)},
+		{"$sum int64 overflow", bson.M{"$sum": "$v"}, []any{int64(math.MaxInt64), int64(1)}, float64(math.MaxInt64) + 1},
+		{"$sum double", bson.M{"$sum": "$v"}, []any{int32(1), 0.5}, 1.5},
+		{"$sum decimal", bson.M{"$sum": "$v"}, []any{0.1, mustParseDecimal128("0.2"), int32(1)}, mustParseDecimal128("1.3")},
+		{"$sum NaN", bson.M{"$sum": "$v"}, []any{int32(1), math.NaN()}, math.NaN()},
+		{"$sum constant", bson.M{"$sum": 1}, []any{"a", "b"}, int32(2)},
+		{"$count", bson.M{"$count": bson.M{}}, []any{"a", "b", Missing}, int32(3)},
+		{"$avg", bson.M{"$avg": "$v"}, []any{int32(1), int32(2), "a"}, 1.5},
+		{"$avg without numbers", bson.M{"$avg": "$v"}, []any{"a"}, nil},
+		{"$avg decimal", bson.M{"$avg": "$v"}, []any{mustParseDecimal128("1"), int32(2)}, mustParseDecimal128("1.5")},
+		{"$min", bson.M{"$min": "$v"}, []any{"a", int32(3), nil, 2.5}, 2.5},
+		{"$max", bson.M{"$max": "$v"}, []any{"a", int32(3), nil, Missing}, "a"},
+		{"$max without values", bson.M{"$max": "$v"}, []any{nil, Missing}, nil},
+		{"$first", bson.M{"$first": "$v"}, []any{Missing, int32(2)}, nil},
+		{"$last", bson.M{"$last": "$v"}, []any{int32(1), "b"}, "b"},
+		{"$push", bson.M{"$push": "$v"}, []any{int32(1), Missing, nil, int32(1)}, bson.A{int32(1), nil, int32(1)}},
+		{"$addToSet", bson.M{"$addToSet": "$v"}, []any{int32(1), 1.0, "a", Missing}, bson.A{int32(1), "a"}},
+		{"$stdDevPop", bson.M{"$stdDevPop": "$v"}, []any{int32(2), int32(4), int32(4), int32(4), int64(5), 5.0, int32(7), int32(9), "a"}, 2.0},
+		{"$stdDevSamp", bson.M{"$stdDevSamp": "$v"}, []any{int32(1), int32(3)}, math.Sqrt(2)},
+		{"$stdDevSamp single value", bson.M{"$stdDevSamp": "$v"}, []any{int32(1), nil}, nil},
+		{"$mergeObjects", bson.M{"$mergeObjects": "$v"}, []any{bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}}, nil, Missing, bson.D{{Key: "a", Value: int32(2)}}}, bson.D{{Key: "a", Value: int32(2)}, {Key: "b", Value: int32(1)}}},
+		{"$top", bson.M{"$top": bson.M{"sortBy": bson.M{"v": 1}, "output": "$v"}}, []any{int32(3), int32(1), int32(2)}, int32(1)},
+		{"$bottom", bson.M{"$bottom": bson.M{"sortBy": bson.M{"v": 1}, "output": bson.A{"$v"}}}, []any{int32(3), int32(1), int32(2)}, bson.A{int32(3)}},
+		{"$topN", bson.M{"$topN": bson.M{"n": 2, "sortBy": bson.M{"v": -1}, "output": "$v"}}, []any{int32(3), int32(1), int32(2)}, bson.A{int32(3), int32(2)}},
+		{"$topN missing output", bson.M{"$topN": bson.M{"n": 2, "sortBy": bson.M{"v": 1}, "output": "$v"}}, []any{int32(3), Missing}, bson.A{nil, int32(3)}},
+		{"$bottomN", bson.M{"$bottomN": bson.M{"n": 2, "sortBy": bson.M{"v": -1}, "output": "$v"}}, []any{int32(3), int32(1), int32(2)}, bson.A{int32(2), int32(1)}},
+		{"$firstN", bson.M{"$firstN": bson.M{"input": "$v", "n": 2}}, []any{Missing, int32(1), int32(2)}, bson.A{nil, int32(1)}},
+		{"$lastN", bson.M{"$lastN": bson.M{"input": "$v", "n": 2}}, []any{int32(1), int32(2), Missing}, bson.A{int32(2), nil}},
+		{"$lastN without values", bson.M{"$lastN": bson.M{"input": "$v", "n": 2}}, []any{}, bson.A{}},
+		{"$maxN", bson.M{"$maxN": bson.M{"input": "$v", "n": 2}}, []any{int32(1), nil, int32(3), int32(2)}, bson.A{int32(3), int32(2)}},
+		{"$minN", bson.M{"$minN": bson.M{"input": "$v", "n": 5}}, []any{int32(3), nil, int32(1)}, bson.A{int32(1), int32(3)}},
+		{"$median", bson.M{"$median": bson.M{"input": "$v", "method": "approximate"}}, []any{int32(4), int32(1), int32(3), int32(2), "a"}, 2.0},
+		{"$median continuous", bson.M{"$median": bson.M{"input": "$v", "method": "continuous"}}, []any{int32(4), int32(1), int32(3), int32(2)}, 2.5},
+		{"$median without numbers", bson.M{"$median": bson.M{"input": "$v", "method": "approximate"}}, []any{"a"}, nil},
+		{"$percentile", bson.M{"$percentile": bson.M{"input": "$v", "p": bson.A{0, 0.5, 1}, "method": "approximate"}}, []any{int32(3), int32(1), int32(2)}, bson.A{1.0, 2.0, 3.0}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			accumulator, err := CompileAccumulator(testCase.Accumulator, "total")
+			NoError(t, err)
+
+			accumulation := accumulator.New()
+			for _, value := range testCase.Values {
+				document := bson.D{}
+				if value != Missing {
+					document = bson.D{{Key: "v", Value: value}}
+				}
+				NoError(t, accumulation.Add(document))
+			}
+
+			result := accumulation.Result()
+			if number, ok := testCase.Expected.(float64); ok && math.IsNaN(number) {
+				True(t, math.IsNaN(result.(float64)))
+				return
+			}
+			Equal(t, testCase.Expected, result)
+		})
+	}
+}
+
+func TestAccumulatorExpressions(t *testing.T) {
+	document := bson.D{
+		{Key: "scores", Value: bson.A{int32(4), int32(2), "a", nil, int32(6)}},
+		{Key: "a", Value: int32(3)},
+		{Key: "b", Value: 1.5},
+		{Key: "empty", Value: bson.A{}},
+	}
+
+	cases := []struct {
+		Name       string
+		Expression any
+		Expected   any
+	}{
+		{"$sum array", bson.M{"$sum": "$scores"}, int32(12)},
+		{"$sum arguments", bson.M{"$sum": bson.A{"$a", "$b", "$nothing"}}, 4.5},
+		{"$sum single value", bson.M{"$sum": "$a"}, int32(3)},
+		{"$sum non number", bson.M{"$sum": "$nothing"}, int32(0)},
+		{"$sum arrays within arguments", bson.M{"$sum": bson.A{"$scores", "$a"}}, int32(3)},
+		{"$avg array", bson.M{"$avg": "$scores"}, 4.0},
+		{"$avg arguments", bson.M{"$avg": bson.A{"$a", "$b"}}, 2.25},
+		{"$avg empty array", bson.M{"$avg": "$empty"}, nil},
+		{"$min array", bson.M{"$min": "$scores"}, int32(2)},
+		{"$min arguments", bson.M{"$min": bson.A{"$a", "$b", nil}}, 1.5},
+		{"$max array", bson.M{"$max": "$scores"}, "a"},
+		{"$max missing", bson.M{"$max": "$nothing"}, nil},
+		{"$stdDevPop", bson.M{"$stdDevPop": bson.A{int32(2), int32(4), int32(4), int32(4), int32(5), int32(5), int32(7), int32(9)}}, 2.0},
+		{"$stdDevSamp", bson.M{"$stdDevSamp": bson.A{"$a", int32(1)}}, math.Sqrt(2)},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			expression, err := Compile(testCase.Expression)
+			NoError(t, err)
+			result, err := expression.Evaluate(document)
+			NoError(t, err)
+			Equal(t, testCase.Expected, result)
+		})
+	}
+}
+
+func TestCompileAccumulatorErrors(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Accumulator any
+		Err         error
+		Message     string
+	}{
+		{"not an object", 1, ErrBadValue, "The field 'total' must be an accumulator object (at total)"},
+		{"two accumulators", bson.D{{Key: "$sum", Value: 1}, {Key: "$avg", Value: 1}}, ErrBadValue, "The field 'total' must specify one accumulator (at total)"},
+		{"unknown accumulator", bson.M{"$foo": 1}, ErrUnknownOperator, "unknown group operator '$foo' (at total.$foo)"},
+		{"array argument", bson.M{"$sum": bson.A{1, 2}}, ErrBadValue, "The $sum accumulator is a unary operator (at total.$sum)"},
+		{"$count with argument", bson.M{"$count": 1}, ErrBadValue, "$count takes no arguments, i.e. $count:{} (at total.$count)"},
+		{"$topN without n", bson.M{"$topN": bson.M{"sortBy": bson.M{"a": 1}, "output": "$a"}}, ErrBadValue, "Missing 'n' parameter to $topN (at total.$topN)"},
+		{"$top with n", bson.M{"$top": bson.M{"n": 1, "sortBy": bson.M{"a": 1}, "output": "$a"}}, ErrBadValue, "Unrecognized parameter to $top: n (at total.$top)"},
+		{"$bottom invalid sortBy", bson.M{"$bottom": bson.M{"sortBy": bson.M{"a": 2}, "output": "$a"}}, ErrBadValue, "$bottom sort key ordering must be 1 (for ascending) or -1 (for descending) (at total.$bottom)"},
+		{"$median invalid method", bson.M{"$median": bson.M{"input": "$a", "method": "exact"}}, ErrBadValue, "$median 'method' must be one of 'approximate', 'discrete' or 'continuous' (at total.$median)"},
+		{"$percentile p out of range", bson.M{"$percentile": bson.M{"input": "$a", "p": bson.A{1.5}, "method": "approximate"}}, ErrBadValue, "'p' must be an array of numeric values from [0.0, 1.0] range, but found 1.5 (at total.$percentile)"},
+		{"$accumulator", bson.M{"$accumulator": bson.M{}}, ErrNotSupported, "$accumulator is not supported by mongomock (at total.$accumulator)"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := CompileAccumulator(testCase.Accumulator, "total")
+			EqualError(t, err, testCase.Message)
+			ErrorIs(t, err, testCase.Err)
+		})
+	}
+}
+
+func TestAccumulationErrors(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Accumulator any
+		Value       any
+		Message     string
+	}{
+		{"$firstN with n of 0", bson.M{"$firstN": bson.M{"input": "$v", "n": 0}}, int32(1), "'n' must be greater than 0, found 0 (at total.$firstN)"},
+		{"$topN with string n", bson.M{"$topN": bson.M{"n": "$v", "sortBy": bson.M{"v": 1}, "output": "$v"}}, "a", "Value for 'n' must be of integral type, but found string (at total.$topN)"},
+		{"$mergeObjects with number", bson.M{"$mergeObjects": "$v"}, int32(1), "$mergeObjects requires object inputs, but input 1 is of type int (at total.$mergeObjects)"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			accumulator, err := CompileAccumulator(testCase.Accumulator, "total")
+			NoError(t, err)
+			err = accumulator.New().Add(bson.D{{Key: "v", Value: testCase.Value}})
+			EqualError(t, err, testCase.Message)
+			ErrorIs(t, err, ErrBadValue)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package expr
+
+import (
+	"github.com/mjarkk/mongomock/match"
+)
+
+// compareValues compares two values like MongoDB's aggregation comparison operators
+// Unlike filters missing values are smaller than null.
+func compareValues(a any, b any) int {
+	aMissing, bMissing := a == Missing, b == Missing
+	switch {
+	case aMissing && bMissing:
+		return 0
+	case aMissing:
+		return -1
+	case bMissing:
+		return 1
+	}
+	return match.Compare(a, b)
+}
+
+// compileComparison compiles comparison operators like {$gt: ["$qty", 250]}
+func compileComparison(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	evaluators, err := compileFixedArguments(operator, value, path, scope, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+
+		result := compareValues(values[0], values[1])
+		switch operator {
+		case "$cmp":
+			return int32(result), nil
+		case "$eq":
+			return result == 0, nil
+		case "$ne":
+			return result != 0, nil
+		case "$gt":
+			return result > 0, nil
+		case "$gte":
+			return result >= 0, nil
+		case "$lt":
+			return result < 0, nil
+		default:
+			return result <= 0, nil
+		}
+	}, nil
+}
+
+// compileBoolean compiles {$and: [...]}, {$or: [...]} and {$not: [...]}
+// $and and $or stop evaluating their arguments as soon as the result is known.
+func compileBoolean(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	if operator == "$not" {
+		evaluators, err := compileFixedArguments(operator, value, path, scope, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *contextT) (any, error) {
+			value, err := evaluators[0](ctx)
+			if err != nil {
+				return nil, err
+			}
+			return !IsTrue(value), nil
+		}, nil
+	}
+
+	evaluators, err := compileArguments(value, path, scope)
+	if err != nil {
+		return nil, err
+	}
+	// $and is true unless one of the values is false, $or is false unless one of the values is true
+	stopOn := operator == "$or"
+	return func(ctx *contextT) (any, error) {
+		for _, evaluator := range evaluators {
+			value, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if IsTrue(value) == stopOn {
+				return stopOn, nil
+			}
+		}
+		return !stopOn, nil
+	}, nil
+}
+
+// compileCond compiles {$cond: [if, then, else]} and {$cond: {if: ..., then: ..., else: ...}}
+func compileCond(value any, path string, scope scopeT) (evaluatorT, error) {
+	var evaluators []evaluatorT
+	if _, isArray := match.ToArray(value); isArray {
+		var err error
+		evaluators, err = compileFixedArguments("$cond", value, path, scope, 3, 3)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		arguments, err := parseNamedArguments("$cond", value, path, []string{"if", "then", "else"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		named, err := compileNamedArguments(arguments, path, scope)
+		if err != nil {
+			return nil, err
+		}
+		evaluators = []evaluatorT{named["if"], named["then"], named["else"]}
+	}
+
+	return func(ctx *contextT) (any, error) {
+		condition, err := evaluators[0](ctx)
+		if err != nil {
+			return nil, err
+		}
+		if IsTrue(condition) {
+			return evaluators[1](ctx)
+		}
+		return evaluators[2](ctx)
+	}, nil
+}
+
+// compileSwitch compiles {$switch: {branches: [{case: ..., then: ...}], default: ...}}
+func compileSwitch(value any, path string, scope scopeT) (evaluatorT, error) {
+	document, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$switch requires an object as an argument, found: %s", TypeName(Normalize(value)))
+	}
+	arguments := map[string]any{}
+	for _, entry := range document {
+		if entry.Key != "branches" && entry.Key != "default" {
+			return nil, newExpressionError(path, ErrBadValue, "$switch found an unknown argument: %s", entry.Key)
+		}
+		arguments[entry.Key] = entry.Value
+	}
+	branches, ok := match.ToArray(arguments["branches"])
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$switch expected an array for 'branches', found: %s", TypeName(Normalize(arguments["branches"])))
+	}
+	if len(branches) == 0 {
+		return nil, newExpressionError(path, ErrBadValue, "$switch requires at least one branch")
+	}
+
+	cases := make([]evaluatorT, len(branches))
+	thens := make([]evaluatorT, len(branches))
+	for idx, branch := range branches {
+		branchDocument, ok := match.ToDocument(branch)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$switch expected each branch to be an object, found: %s", TypeName(Normalize(branch)))
+		}
+		branchArguments := map[string]any{}
+		for _, entry := range branchDocument {
+			if entry.Key != "case" && entry.Key != "then" {
+				return nil, newExpressionError(path, ErrBadValue, "$switch found an unknown argument to a branch: %s", entry.Key)
+			}
+			branchArguments[entry.Key] = entry.Value
+		}
+		for _, name := range []string{"case", "then"} {
+			if _, ok := branchArguments[name]; !ok {
+				return nil, newExpressionError(path, ErrBadValue, "$switch requires each branch have a '%s' expression", name)
+			}
+		}
+
+		named, err := compileNamedArguments(branchArguments, joinPath(path, "branches"), scope)
+		if err != nil {
+			return nil, err
+		}
+		cases[idx], thens[idx] = named["case"], named["then"]
+	}
+
+	var defaultEvaluator evaluatorT
+	if defaultValue, ok := arguments["default"]; ok {
+		var err error
+		defaultEvaluator, err = compile(defaultValue, joinPath(path, "default"), scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx *contextT) (any, error) {
+		for idx, evaluator := range cases {
+			condition, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if IsTrue(condition) {
+				return thens[idx](ctx)
+			}
+		}
+		if defaultEvaluator == nil {
+			return nil, newExpressionError(path, ErrBadValue, "$switch could not find a matching branch for an input, and no default was specified.")
+		}
+		return defaultEvaluator(ctx)
+	}, nil
+}
+
+// compileIfNull compiles {$ifNull: ["$a", "$b", "default"]}, it returns the first value that is not null or missing
+// Like MongoDB the last argument is returned as is, even if it's null.
+func compileIfNull(value any, path string, scope scopeT) (evaluatorT, error) {
+	evaluators, err := compileArguments(value, path, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(evaluators) < 2 {
+		return nil, newExpressionError(path, ErrBadValue, "$ifNull needs at least two arguments, had: %d", len(evaluators))
+	}
+
+	return func(ctx *contextT) (any, error) {
+		for idx, evaluator := range evaluators {
+			value, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !isNullish(value) || idx == len(evaluators)-1 {
+				return value, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
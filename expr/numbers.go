@@ -0,0 +1,291 @@
+package expr
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// numberKindT is the bson type of a number, ordered from narrowest to widest
+type numberKindT int
+
+const (
+	kindInt32 numberKindT = iota
+	kindInt64
+	kindDouble
+	kindDecimal
+)
+
+// numberKind returns the kind of a number and false if the value is not a number
+func numberKind(value any) (numberKindT, bool) {
+	switch value.(type) {
+	case int32:
+		return kindInt32, true
+	case int64:
+		return kindInt64, true
+	case float64:
+		return kindDouble, true
+	case primitive.Decimal128:
+		return kindDecimal, true
+	}
+	return 0, false
+}
+
+// isNumber returns true for int32, int64, double and decimal values
+func isNumber(value any) bool {
+	_, ok := numberKind(value)
+	return ok
+}
+
+// toInt64 converts an int32 or int64 into an int64
+func toInt64(value any) int64 {
+	switch number := value.(type) {
+	case int32:
+		return int64(number)
+	case int64:
+		return number
+	}
+	return 0
+}
+
+// toFloat64 converts a number into a float64
+func toFloat64(value any) float64 {
+	switch number := value.(type) {
+	case int32:
+		return float64(number)
+	case int64:
+		return float64(number)
+	case float64:
+		return number
+	case primitive.Decimal128:
+		if number.IsNaN() {
+			return math.NaN()
+		}
+		if inf := number.IsInf(); inf != 0 {
+			return math.Inf(inf)
+		}
+		result, _ := match.ToRat(number).Float64()
+		return result
+	}
+	return 0
+}
+
+// ratToDecimal converts a rational number into a decimal with up to 34 significant digits
+func ratToDecimal(rat *big.Rat) primitive.Decimal128 {
+	text := new(big.Float).SetPrec(256).SetRat(rat).Text('g', 34)
+	decimal, err := primitive.ParseDecimal128(text)
+	if err != nil {
+		return primitive.NewDecimal128(0, 0)
+	}
+	return decimal
+}
+
+// toDecimal converts a number into a decimal
+func toDecimal(value any) primitive.Decimal128 {
+	switch number := value.(type) {
+	case primitive.Decimal128:
+		return number
+	case float64:
+		switch {
+		case math.IsNaN(number):
+			decimal, _ := primitive.ParseDecimal128("NaN")
+			return decimal
+		case math.IsInf(number, 1):
+			decimal, _ := primitive.ParseDecimal128("Infinity")
+			return decimal
+		case math.IsInf(number, -1):
+			decimal, _ := primitive.ParseDecimal128("-Infinity")
+			return decimal
+		}
+		// Like MongoDB doubles are converted using their shortest representation with 15 digits
+		decimal, err := primitive.ParseDecimal128(big.NewFloat(number).Text('g', 15))
+		if err == nil {
+			return decimal
+		}
+	}
+	return ratToDecimal(match.ToRat(value))
+}
+
+// numberSumT sums numbers like MongoDB does
+// The result has the widest type of the summed numbers, int32 sums that overflow become int64 and int64 sums that overflow become doubles.
+type numberSumT struct {
+	kind    numberKindT
+	integer int64
+	double  float64
+	decimal *big.Rat
+	// special is set to NaN or Infinity if one of the doubles or decimals is one
+	special *float64
+}
+
+func (s *numberSumT) add(value any) {
+	kind, ok := numberKind(value)
+	if !ok {
+		return
+	}
+
+	if kind == kindDouble || kind == kindDecimal {
+		float := toFloat64(value)
+		if math.IsNaN(float) || math.IsInf(float, 0) {
+			if s.special == nil {
+				s.special = &float
+			} else {
+				sum := *s.special + float
+				s.special = &sum
+			}
+			s.widen(kind)
+			return
+		}
+	}
+
+	switch kind {
+	case kindInt32, kindInt64:
+		number := toInt64(value)
+		if s.kind <= kindInt64 {
+			sum := s.integer + number
+			overflows := (number > 0 && sum < s.integer) || (number < 0 && sum > s.integer)
+			if !overflows {
+				s.integer = sum
+				if kind > s.kind {
+					s.kind = kind
+				}
+				if s.kind == kindInt32 && (sum > math.MaxInt32 || sum < math.MinInt32) {
+					s.kind = kindInt64
+				}
+				return
+			}
+			s.widen(kindDouble)
+		}
+		s.addWide(value)
+	default:
+		s.widen(kind)
+		s.addWide(value)
+	}
+}
+
+// widen converts the sum into a wider kind
+func (s *numberSumT) widen(kind numberKindT) {
+	if kind <= s.kind {
+		return
+	}
+	if s.kind <= kindInt64 {
+		s.double = float64(s.integer)
+		s.decimal = new(big.Rat).SetInt64(s.integer)
+		s.integer = 0
+	}
+	s.kind = kind
+}
+
+func (s *numberSumT) addWide(value any) {
+	s.double += toFloat64(value)
+	// Doubles are added to decimals using their 15 digit decimal representation, like MongoDB does
+	s.decimal.Add(s.decimal, match.ToRat(toDecimal(value)))
+}
+
+func (s *numberSumT) result() any {
+	if s.special != nil {
+		if s.kind == kindDecimal {
+			return toDecimal(*s.special)
+		}
+		return *s.special
+	}
+
+	switch s.kind {
+	case kindInt32:
+		return int32(s.integer)
+	case kindInt64:
+		return s.integer
+	case kindDouble:
+		return s.double
+	default:
+		return ratToDecimal(s.decimal)
+	}
+}
+
+// widestKind returns the widest kind of the numbers and false if one of the values is not a number
+func widestKind(values ...any) (numberKindT, bool) {
+	widest := kindInt32
+	for _, value := range values {
+		kind, ok := numberKind(value)
+		if !ok {
+			return 0, false
+		}
+		if kind > widest {
+			widest = kind
+		}
+	}
+	return widest, true
+}
+
+// intResult returns the result of an integer operation as an int32 if kind is kindInt32 and the result fits
+func intResult(result int64, kind numberKindT) any {
+	if kind == kindInt32 && result >= math.MinInt32 && result <= math.MaxInt32 {
+		return int32(result)
+	}
+	return result
+}
+
+// isNaN returns true for double and decimal NaN values
+func isNaN(value any) bool {
+	switch number := value.(type) {
+	case float64:
+		return math.IsNaN(number)
+	case primitive.Decimal128:
+		return number.IsNaN()
+	}
+	return false
+}
+
+// isSpecial returns true for NaN and infinite double and decimal values, these can't be converted into a big.Rat
+func isSpecial(value any) bool {
+	float := toFloat64(value)
+	return math.IsNaN(float) || math.IsInf(float, 0)
+}
+
+// floorRat rounds a rational number down to an integer
+func floorRat(rat *big.Rat) *big.Rat {
+	quotient := new(big.Int).Div(rat.Num(), rat.Denom())
+	return new(big.Rat).SetInt(quotient)
+}
+
+// roundRat rounds a rational number to a number of decimal places, a negative number of places rounds to tens, hundreds, etc.
+// Like MongoDB's $round halves are rounded to the nearest even number, truncate rounds towards zero instead.
+func roundRat(rat *big.Rat, places int64, truncate bool) *big.Rat {
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(absInt64(places)), nil))
+	scaled := new(big.Rat).Set(rat)
+	if places >= 0 {
+		scaled.Mul(scaled, scale)
+	} else {
+		scaled.Quo(scaled, scale)
+	}
+
+	rounded := floorRat(scaled)
+	fraction := new(big.Rat).Sub(scaled, rounded)
+	if truncate {
+		if scaled.Sign() < 0 && fraction.Sign() != 0 {
+			rounded.Add(rounded, big.NewRat(1, 1))
+		}
+	} else {
+		switch fraction.Cmp(big.NewRat(1, 2)) {
+		case 1:
+			rounded.Add(rounded, big.NewRat(1, 1))
+		case 0:
+			if new(big.Int).Rem(rounded.Num(), big.NewInt(2)).Sign() != 0 {
+				rounded.Add(rounded, big.NewRat(1, 1))
+			}
+		}
+	}
+
+	if places >= 0 {
+		return rounded.Quo(rounded, scale)
+	}
+	return rounded.Mul(rounded, scale)
+}
+
+func absInt64(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,360 @@
+package expr
+
+import (
+	"strconv"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileOperator compiles an operator expression like {$add: [1, 2]}
+func compileOperator(document bson.D, path string, scope scopeT) (evaluatorT, error) {
+	if len(document) != 1 {
+		return nil, newExpressionError(path, ErrBadValue, "an expression specification must contain exactly one field, the name of the expression. Found %d fields", len(document))
+	}
+
+	operator, value := document[0].Key, document[0].Value
+	operatorPath := joinPath(path, operator)
+	switch operator {
+	case "$literal":
+		return constant(Normalize(value)), nil
+	case "$let":
+		return compileLet(value, operatorPath, scope)
+
+	case "$add", "$subtract", "$multiply", "$divide", "$mod", "$abs", "$ceil", "$floor", "$trunc", "$round",
+		"$exp", "$ln", "$log", "$log10", "$pow", "$sqrt":
+		return compileArithmetic(operator, value, operatorPath, scope)
+	case "$sum", "$avg", "$min", "$max", "$stdDevPop", "$stdDevSamp":
+		return compileAccumulatorExpression(operator, value, operatorPath, scope)
+
+	case "$cmp", "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		return compileComparison(operator, value, operatorPath, scope)
+	case "$and", "$or", "$not":
+		return compileBoolean(operator, value, operatorPath, scope)
+	case "$cond":
+		return compileCond(value, operatorPath, scope)
+	case "$switch":
+		return compileSwitch(value, operatorPath, scope)
+	case "$ifNull":
+		return compileIfNull(value, operatorPath, scope)
+
+	case "$concat", "$substr", "$substrBytes", "$substrCP", "$toLower", "$toUpper", "$strLenBytes", "$strLenCP",
+		"$split", "$indexOfBytes", "$indexOfCP", "$strcasecmp":
+		return compileString(operator, value, operatorPath, scope)
+	case "$trim", "$ltrim", "$rtrim":
+		return compileTrim(operator, value, operatorPath, scope)
+	case "$replaceOne", "$replaceAll":
+		return compileReplace(operator, value, operatorPath, scope)
+	case "$regexMatch", "$regexFind", "$regexFindAll":
+		return compileRegex(operator, value, operatorPath, scope)
+
+	case "$arrayElemAt", "$first", "$last", "$concatArrays", "$in", "$indexOfArray", "$isArray", "$range",
+		"$reverseArray", "$size", "$slice", "$arrayToObject", "$objectToArray", "$mergeObjects":
+		return compileArrayOperator(operator, value, operatorPath, scope)
+	case "$filter":
+		return compileFilter(value, operatorPath, scope)
+	case "$map":
+		return compileMap(value, operatorPath, scope)
+	case "$reduce":
+		return compileReduce(value, operatorPath, scope)
+	case "$zip":
+		return compileZip(value, operatorPath, scope)
+	case "$sortArray":
+		return compileSortArray(value, operatorPath, scope)
+	case "$getField":
+		return compileGetField(value, operatorPath, scope)
+	case "$setEquals", "$setIntersection", "$setUnion", "$setDifference", "$setIsSubset", "$anyElementTrue", "$allElementsTrue":
+		return compileSet(operator, value, operatorPath, scope)
+
+	case "$convert":
+		return compileConvert(value, operatorPath, scope)
+	case "$toBool", "$toDate", "$toDecimal", "$toDouble", "$toInt", "$toLong", "$toObjectId", "$toString":
+		return compileTo(operator, value, operatorPath, scope)
+	case "$type", "$isNumber":
+		return compileType(operator, value, operatorPath, scope)
+	}
+
+	if unsupportedOperators[operator] {
+		return nil, newExpressionError(operatorPath, ErrNotSupported, "%s is not supported by mongomock", operator)
+	}
+	return nil, newExpressionError(operatorPath, ErrUnknownOperator, "Unrecognized expression '%s'", operator)
+}
+
+// unsupportedOperators are valid MongoDB expression operators that mongomock does not support
+var unsupportedOperators = map[string]bool{
+	"$accumulator":      true,
+	"$acos":             true,
+	"$acosh":            true,
+	"$asin":             true,
+	"$asinh":            true,
+	"$atan":             true,
+	"$atan2":            true,
+	"$atanh":            true,
+	"$binarySize":       true,
+	"$bitAnd":           true,
+	"$bitNot":           true,
+	"$bitOr":            true,
+	"$bitXor":           true,
+	"$bsonSize":         true,
+	"$cos":              true,
+	"$cosh":             true,
+	"$dateAdd":          true,
+	"$dateDiff":         true,
+	"$dateFromParts":    true,
+	"$dateFromString":   true,
+	"$dateSubtract":     true,
+	"$dateToParts":      true,
+	"$dateToString":     true,
+	"$dateTrunc":        true,
+	"$dayOfMonth":       true,
+	"$dayOfWeek":        true,
+	"$dayOfYear":        true,
+	"$degreesToRadians": true,
+	"$function":         true,
+	"$hour":             true,
+	"$isoDayOfWeek":     true,
+	"$isoWeek":          true,
+	"$isoWeekYear":      true,
+	"$meta":             true,
+	"$millisecond":      true,
+	"$minute":           true,
+	"$month":            true,
+	"$radiansToDegrees": true,
+	"$rand":             true,
+	"$sampleRate":       true,
+	"$second":           true,
+	"$setField":         true,
+	"$sin":              true,
+	"$sinh":             true,
+	"$tan":              true,
+	"$tanh":             true,
+	"$toHashedIndexKey": true,
+	"$tsIncrement":      true,
+	"$tsSecond":         true,
+	"$unsetField":       true,
+	"$week":             true,
+	"$year":             true,
+}
+
+// compileLet compiles {$let: {vars: {total: {$add: ["$price", "$tax"]}}, in: {$multiply: ["$$total", "$qty"]}}}
+// The variables are evaluated in the scope of $let itself, so they can't refer to each other.
+func compileLet(value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments("$let", value, path, []string{"vars", "in"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	vars, ok := match.ToDocument(arguments["vars"])
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "invalid parameter: expected an object (vars)")
+	}
+
+	names := make([]string, len(vars))
+	evaluators := make([]evaluatorT, len(vars))
+	for idx, entry := range vars {
+		if entry.Key != "CURRENT" {
+			err = validateVariableName(entry.Key, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		names[idx] = entry.Key
+		evaluators[idx], err = compile(entry.Value, joinPath(path, "vars."+entry.Key), scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	in, err := compile(arguments["in"], joinPath(path, "in"), scope.with(names...))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		innerCtx := ctx
+		for idx, evaluator := range evaluators {
+			value, err := evaluator(ctx)
+			if err != nil {
+				return nil, err
+			}
+			innerCtx = innerCtx.with(names[idx], value)
+		}
+		return in(innerCtx)
+	}, nil
+}
+
+// compileArguments compiles the arguments of an operator like {$add: [1, "$price"]}
+// Like MongoDB a value that is not an array is a single argument.
+func compileArguments(value any, path string, scope scopeT) ([]evaluatorT, error) {
+	entries, ok := match.ToArray(value)
+	if !ok {
+		entries = []any{value}
+	}
+
+	evaluators := make([]evaluatorT, len(entries))
+	for idx, entry := range entries {
+		var err error
+		evaluators[idx], err = compile(entry, joinPath(path, strconv.Itoa(idx)), scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return evaluators, nil
+}
+
+// compileFixedArguments compiles the arguments of an operator that takes between min and max arguments
+func compileFixedArguments(operator string, value any, path string, scope scopeT, min int, max int) ([]evaluatorT, error) {
+	evaluators, err := compileArguments(value, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(evaluators)
+	switch {
+	case min == max && count != min:
+		return nil, newExpressionError(path, ErrBadValue, "Expression %s takes exactly %d arguments. %d were passed in.", operator, min, count)
+	case count < min:
+		return nil, newExpressionError(path, ErrBadValue, "Expression %s takes at least %d arguments, and at most %d, but %d were passed in.", operator, min, max, count)
+	case max >= 0 && count > max:
+		return nil, newExpressionError(path, ErrBadValue, "Expression %s takes at least %d arguments, and at most %d, but %d were passed in.", operator, min, max, count)
+	}
+	return evaluators, nil
+}
+
+// parseNamedArguments parses the object argument of operators like {$filter: {input: "$items", cond: true}}
+func parseNamedArguments(operator string, value any, path string, required []string, optional []string) (map[string]any, error) {
+	document, ok := match.ToDocument(value)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "%s only supports an object as its argument", operator)
+	}
+
+	known := map[string]bool{}
+	for _, name := range append(append([]string{}, required...), optional...) {
+		known[name] = true
+	}
+
+	arguments := map[string]any{}
+	for _, entry := range document {
+		if !known[entry.Key] {
+			return nil, newExpressionError(path, ErrBadValue, "Unrecognized parameter to %s: %s", operator, entry.Key)
+		}
+		arguments[entry.Key] = entry.Value
+	}
+	for _, name := range required {
+		if _, ok := arguments[name]; !ok {
+			return nil, newExpressionError(path, ErrBadValue, "Missing '%s' parameter to %s", name, operator)
+		}
+	}
+	return arguments, nil
+}
+
+// compileNamedArguments compiles the arguments parsed by parseNamedArguments, arguments that are not set are nil
+func compileNamedArguments(arguments map[string]any, path string, scope scopeT) (map[string]evaluatorT, error) {
+	evaluators := map[string]evaluatorT{}
+	for name, argument := range arguments {
+		evaluator, err := compile(argument, joinPath(path, name), scope)
+		if err != nil {
+			return nil, err
+		}
+		evaluators[name] = evaluator
+	}
+	return evaluators, nil
+}
+
+// evaluateAll evaluates all evaluators
+func evaluateAll(ctx *contextT, evaluators []evaluatorT) ([]any, error) {
+	values := make([]any, len(evaluators))
+	for idx, evaluator := range evaluators {
+		var err error
+		values[idx], err = evaluator(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// isNullish returns true for values that make most operators return null, null, undefined and missing values
+func isNullish(value any) bool {
+	switch value.(type) {
+	case nil, missingT, primitive.Undefined:
+		return true
+	}
+	return false
+}
+
+// anyNullish returns true if one of the values is nullish
+func anyNullish(values []any) bool {
+	for _, value := range values {
+		if isNullish(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrue returns the boolean value of an expression result
+// Like MongoDB false, null, undefined, missing and zero are false, all other values including empty arrays are true.
+func IsTrue(value any) bool {
+	if isNullish(value) {
+		return false
+	}
+	switch typedValue := value.(type) {
+	case bool:
+		return typedValue
+	case int32, int64, float64, primitive.Decimal128:
+		return toFloat64(typedValue) != 0 || isNaN(typedValue)
+	}
+	return true
+}
+
+// TypeName returns the MongoDB alias of the type of a value like "string" or "objectId"
+func TypeName(value any) string {
+	switch value.(type) {
+	case missingT:
+		return "missing"
+	case nil:
+		return "null"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.D:
+		return "object"
+	case bson.A:
+		return "array"
+	case primitive.Binary:
+		return "binData"
+	case primitive.Undefined:
+		return "undefined"
+	case primitive.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case primitive.DateTime:
+		return "date"
+	case primitive.Regex:
+		return "regex"
+	case primitive.DBPointer:
+		return "dbPointer"
+	case primitive.JavaScript:
+		return "javascript"
+	case primitive.Symbol:
+		return "symbol"
+	case primitive.CodeWithScope:
+		return "javascriptWithScope"
+	case int32:
+		return "int"
+	case primitive.Timestamp:
+		return "timestamp"
+	case int64:
+		return "long"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	}
+	return "unknown"
+}
@@ -0,0 +1,359 @@
+package expr
+
+import (
+	"math"
+	"sort"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// rankedValueT is the argument of the accumulators that keep n values like $topN and $maxN for a single document
+type rankedValueT struct {
+	n          int64
+	sortValues []any
+	output     any
+}
+
+// sortKeyT is a field of the sortBy argument of $top and $bottom
+type sortKeyT struct {
+	key       string
+	direction int
+}
+
+// compileTopAccumulator compiles {$topN: {n: 3, sortBy: {score: -1}, output: "$name"}}, $top, $bottom and $bottomN
+func compileTopAccumulator(operator string, value any, path string, scope scopeT) (*Accumulator, error) {
+	isN := operator == "$topN" || operator == "$bottomN"
+	required := []string{"sortBy", "output"}
+	if isN {
+		required = append(required, "n")
+	}
+	arguments, err := parseNamedArguments(operator, value, path, required, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sortBy, ok := match.ToDocument(arguments["sortBy"])
+	if !ok || len(sortBy) == 0 {
+		return nil, newExpressionError(path, ErrBadValue, "%s requires 'sortBy' to be a non-empty object", operator)
+	}
+	sortKeys := make([]sortKeyT, len(sortBy))
+	for idx, entry := range sortBy {
+		direction, ok := wholeNumber(Normalize(entry.Value))
+		if !ok || direction != 1 && direction != -1 {
+			return nil, newExpressionError(path, ErrBadValue, "%s sort key ordering must be 1 (for ascending) or -1 (for descending)", operator)
+		}
+		sortKeys[idx] = sortKeyT{key: entry.Key, direction: int(direction)}
+	}
+
+	output, err := compile(arguments["output"], joinPath(path, "output"), scope)
+	if err != nil {
+		return nil, err
+	}
+	n, err := compileN(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	argument := func(ctx *contextT) (any, error) {
+		count, err := n(ctx)
+		if err != nil {
+			return nil, err
+		}
+		outputValue, err := output(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if outputValue == Missing {
+			outputValue = nil
+		}
+		sortValues := make([]any, len(sortKeys))
+		for idx, sortKey := range sortKeys {
+			sortValues[idx] = match.SortValue(ctx.current, sortKey.key, sortKey.direction < 0)
+		}
+		return rankedValueT{n: count, sortValues: sortValues, output: outputValue}, nil
+	}
+
+	bottom := operator == "$bottom" || operator == "$bottomN"
+	return &Accumulator{
+		argument: &Expression{evaluate: argument},
+		newState: func() accumulatorStateT {
+			return &topAccumulatorT{sortKeys: sortKeys, bottom: bottom, single: !isN}
+		},
+	}, nil
+}
+
+// compileN compiles the n argument of accumulators like $topN, accumulators without n get a constant 1
+// Like MongoDB n can depend on the fields of the group _id, it's evaluated against the first document of a group.
+func compileN(arguments map[string]any, path string, scope scopeT) (func(ctx *contextT) (int64, error), error) {
+	nValue, ok := arguments["n"]
+	if !ok {
+		return func(ctx *contextT) (int64, error) { return 1, nil }, nil
+	}
+	evaluator, err := compile(nValue, joinPath(path, "n"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (int64, error) {
+		value, err := evaluator(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n, ok := wholeNumber(value)
+		if !ok {
+			return 0, newExpressionError(path, ErrBadValue, "Value for 'n' must be of integral type, but found %v", TypeName(value))
+		}
+		if n <= 0 {
+			return 0, newExpressionError(path, ErrBadValue, "'n' must be greater than 0, found %d", n)
+		}
+		return n, nil
+	}, nil
+}
+
+// topAccumulatorT keeps the first or last values in the order of sortBy
+// Documents with equal sort values keep the order they were added in.
+type topAccumulatorT struct {
+	sortKeys []sortKeyT
+	bottom   bool
+	single   bool
+	n        int64
+	values   []rankedValueT
+}
+
+func (a *topAccumulatorT) add(value any) {
+	ranked := value.(rankedValueT)
+	if len(a.values) == 0 {
+		a.n = ranked.n
+	}
+	a.values = append(a.values, ranked)
+}
+
+func (a *topAccumulatorT) result() any {
+	values := make([]rankedValueT, len(a.values))
+	copy(values, a.values)
+	sort.SliceStable(values, func(i, j int) bool {
+		for idx, sortKey := range a.sortKeys {
+			result := match.Compare(values[i].sortValues[idx], values[j].sortValues[idx])
+			if result != 0 {
+				return result == -sortKey.direction
+			}
+		}
+		return false
+	})
+
+	if int64(len(values)) > a.n {
+		if a.bottom {
+			values = values[int64(len(values))-a.n:]
+		} else {
+			values = values[:a.n]
+		}
+	}
+	if a.single {
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0].output
+	}
+
+	results := make(bson.A, len(values))
+	for idx, value := range values {
+		results[idx] = value.output
+	}
+	return results
+}
+
+// compileNAccumulator compiles {$firstN: {input: "$name", n: 3}}, $lastN, $maxN and $minN
+func compileNAccumulator(operator string, value any, path string, scope scopeT) (*Accumulator, error) {
+	arguments, err := parseNamedArguments(operator, value, path, []string{"input", "n"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+	n, err := compileN(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	argument := func(ctx *contextT) (any, error) {
+		count, err := n(ctx)
+		if err != nil {
+			return nil, err
+		}
+		inputValue, err := input(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return rankedValueT{n: count, output: inputValue}, nil
+	}
+
+	return &Accumulator{
+		argument: &Expression{evaluate: argument},
+		newState: func() accumulatorStateT {
+			return &nAccumulatorT{operator: operator}
+		},
+	}, nil
+}
+
+// nAccumulatorT keeps the first, last, largest or smallest n values
+// $firstN and $lastN keep null and missing values as null, $maxN and $minN ignore them.
+type nAccumulatorT struct {
+	operator string
+	n        int64
+	values   bson.A
+	found    bool
+}
+
+func (a *nAccumulatorT) add(value any) {
+	ranked := value.(rankedValueT)
+	if !a.found {
+		a.n = ranked.n
+		a.found = true
+	}
+
+	output := ranked.output
+	switch a.operator {
+	case "$firstN":
+		if int64(len(a.values)) < a.n {
+			a.values = append(a.values, nullIfMissing(output))
+		}
+	case "$lastN":
+		a.values = append(a.values, nullIfMissing(output))
+		if int64(len(a.values)) > a.n {
+			a.values = a.values[1:]
+		}
+	default:
+		if isNullish(output) {
+			return
+		}
+		a.values = append(a.values, output)
+	}
+}
+
+func (a *nAccumulatorT) result() any {
+	if a.operator != "$maxN" && a.operator != "$minN" {
+		if a.values == nil {
+			return bson.A{}
+		}
+		return a.values
+	}
+
+	direction := 1
+	if a.operator == "$maxN" {
+		direction = -1
+	}
+	values := make(bson.A, len(a.values))
+	copy(values, a.values)
+	sort.SliceStable(values, func(i, j int) bool {
+		return match.Compare(values[i], values[j]) == -direction
+	})
+	if int64(len(values)) > a.n {
+		values = values[:a.n]
+	}
+	return values
+}
+
+func nullIfMissing(value any) any {
+	if value == Missing {
+		return nil
+	}
+	return value
+}
+
+// compilePercentileAccumulator compiles {$percentile: {input: "$score", p: [0.5, 0.9], method: "approximate"}} and $median
+func compilePercentileAccumulator(operator string, value any, path string, scope scopeT) (*Accumulator, error) {
+	required := []string{"input", "method"}
+	if operator == "$percentile" {
+		required = append(required, "p")
+	}
+	arguments, err := parseNamedArguments(operator, value, path, required, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	method, ok := arguments["method"].(string)
+	if !ok || method != "approximate" && method != "discrete" && method != "continuous" {
+		return nil, newExpressionError(path, ErrBadValue, "%s 'method' must be one of 'approximate', 'discrete' or 'continuous'", operator)
+	}
+
+	percentiles := []float64{0.5}
+	if operator == "$percentile" {
+		pValues, ok := match.ToArray(arguments["p"])
+		if !ok || len(pValues) == 0 {
+			return nil, newExpressionError(path, ErrBadValue, "'p' must be an array of numeric values from [0.0, 1.0] range, but found %v", arguments["p"])
+		}
+		percentiles = make([]float64, len(pValues))
+		for idx, pValue := range pValues {
+			p := Normalize(pValue)
+			if !isNumber(p) || toFloat64(p) < 0 || toFloat64(p) > 1 || isNaN(p) {
+				return nil, newExpressionError(path, ErrBadValue, "'p' must be an array of numeric values from [0.0, 1.0] range, but found %v", pValue)
+			}
+			percentiles[idx] = toFloat64(p)
+		}
+	}
+
+	input, err := compile(arguments["input"], joinPath(path, "input"), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Accumulator{
+		argument: &Expression{evaluate: input},
+		newState: func() accumulatorStateT {
+			return &percentileAccumulatorT{
+				percentiles: percentiles,
+				continuous:  method == "continuous",
+				single:      operator == "$median",
+			}
+		},
+	}, nil
+}
+
+// percentileAccumulatorT computes percentiles of all numbers, other values are ignored
+// The approximate method gives the exact discrete percentile, as mongomock has no need to save memory.
+type percentileAccumulatorT struct {
+	percentiles []float64
+	continuous  bool
+	single      bool
+	values      []float64
+}
+
+func (a *percentileAccumulatorT) add(value any) {
+	if isNumber(value) && !isNaN(value) {
+		a.values = append(a.values, toFloat64(value))
+	}
+}
+
+func (a *percentileAccumulatorT) result() any {
+	sort.Float64s(a.values)
+	results := make(bson.A, len(a.percentiles))
+	for idx, p := range a.percentiles {
+		results[idx] = a.percentile(p)
+	}
+	if a.single {
+		return results[0]
+	}
+	return results
+}
+
+func (a *percentileAccumulatorT) percentile(p float64) any {
+	count := len(a.values)
+	if count == 0 {
+		return nil
+	}
+
+	if a.continuous {
+		rank := p * float64(count-1)
+		lower, upper := int(math.Floor(rank)), int(math.Ceil(rank))
+		return a.values[lower] + (rank-float64(lower))*(a.values[upper]-a.values[lower])
+	}
+
+	idx := int(math.Ceil(p*float64(count))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return a.values[idx]
+}
@@ -0,0 +1,499 @@
+package expr
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileString compiles string operators that take an array of arguments like {$concat: ["$first", " ", "$last"]}
+func compileString(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	var evaluators []evaluatorT
+	var err error
+	switch operator {
+	case "$concat":
+		evaluators, err = compileArguments(value, path, scope)
+	case "$toLower", "$toUpper", "$strLenBytes", "$strLenCP":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 1, 1)
+	case "$substr", "$substrBytes", "$substrCP":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 3, 3)
+	case "$split", "$strcasecmp":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 2)
+	case "$indexOfBytes", "$indexOfCP":
+		evaluators, err = compileFixedArguments(operator, value, path, scope, 2, 4)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		values, err := evaluateAll(ctx, evaluators)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operator {
+		case "$concat":
+			return concat(values, path)
+		case "$toLower", "$toUpper":
+			text, err := stringArgument(operator, values[0], path)
+			if err != nil {
+				return nil, err
+			}
+			if operator == "$toLower" {
+				return strings.ToLower(text), nil
+			}
+			return strings.ToUpper(text), nil
+		case "$strLenBytes", "$strLenCP":
+			text, ok := values[0].(string)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "%s requires a string argument, found: %s", operator, TypeName(values[0]))
+			}
+			if operator == "$strLenBytes" {
+				return int32(len(text)), nil
+			}
+			return int32(utf8.RuneCountInString(text)), nil
+		case "$substr", "$substrBytes":
+			return substrBytes(values, path)
+		case "$substrCP":
+			return substrCP(values, path)
+		case "$split":
+			return split(values[0], values[1], path)
+		case "$strcasecmp":
+			a, err := stringArgument(operator, values[0], path)
+			if err != nil {
+				return nil, err
+			}
+			b, err := stringArgument(operator, values[1], path)
+			if err != nil {
+				return nil, err
+			}
+			return int32(strings.Compare(strings.ToUpper(a), strings.ToUpper(b))), nil
+		default:
+			return indexOf(operator, values, path)
+		}
+	}, nil
+}
+
+// stringArgument converts the argument of operators like $toLower into a string
+// Like MongoDB null and missing values become an empty string and numbers and dates are converted.
+func stringArgument(operator string, value any, path string) (string, error) {
+	if isNullish(value) {
+		return "", nil
+	}
+	switch value.(type) {
+	case string, primitive.Symbol, int32, int64, float64, primitive.Decimal128, primitive.DateTime, primitive.Timestamp:
+		text, _ := toStringValue(value)
+		return text, nil
+	}
+	return "", newExpressionError(path, ErrBadValue, "%s: can't convert from BSON type %s to String", operator, TypeName(value))
+}
+
+func concat(values []any, path string) (any, error) {
+	builder := strings.Builder{}
+	for _, value := range values {
+		if isNullish(value) {
+			return nil, nil
+		}
+		text, ok := value.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "$concat only supports strings, not %s", TypeName(value))
+		}
+		builder.WriteString(text)
+	}
+	return builder.String(), nil
+}
+
+func substrBytes(values []any, path string) (any, error) {
+	text, err := stringArgument("$substrBytes", values[0], path)
+	if err != nil {
+		return nil, err
+	}
+	if !isNumber(values[1]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrBytes: starting index must be a numeric type (is BSON type %s)", TypeName(values[1]))
+	}
+	if !isNumber(values[2]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrBytes: length must be a numeric type (is BSON type %s)", TypeName(values[2]))
+	}
+
+	start := int64(toFloat64(values[1]))
+	length := int64(toFloat64(values[2]))
+	if start < 0 || start >= int64(len(text)) {
+		return "", nil
+	}
+	end := int64(len(text))
+	if length >= 0 && start+length < end {
+		end = start + length
+	}
+
+	if !utf8.RuneStart(text[start]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrBytes:  Invalid range, starting index is a UTF-8 continuation byte.")
+	}
+	if end < int64(len(text)) && !utf8.RuneStart(text[end]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrBytes:  Invalid range, ending index is in the middle of a UTF-8 character.")
+	}
+	return text[start:end], nil
+}
+
+func substrCP(values []any, path string) (any, error) {
+	text, err := stringArgument("$substrCP", values[0], path)
+	if err != nil {
+		return nil, err
+	}
+	start, ok := wholeNumber(values[1])
+	if !isNumber(values[1]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrCP: starting index must be a numeric type (is BSON type %s)", TypeName(values[1]))
+	}
+	if !ok || start < 0 {
+		return nil, newExpressionError(path, ErrBadValue, "$substrCP: starting index must be non-negative integer")
+	}
+	length, ok := wholeNumber(values[2])
+	if !isNumber(values[2]) {
+		return nil, newExpressionError(path, ErrBadValue, "$substrCP: length must be a numeric type (is BSON type %s)", TypeName(values[2]))
+	}
+	if !ok || length < 0 {
+		return nil, newExpressionError(path, ErrBadValue, "$substrCP: length must be a nonnegative integer.")
+	}
+
+	runes := []rune(text)
+	if start >= int64(len(runes)) {
+		return "", nil
+	}
+	end := int64(len(runes))
+	if start+length < end {
+		end = start + length
+	}
+	return string(runes[start:end]), nil
+}
+
+func split(value any, separator any, path string) (any, error) {
+	if isNullish(value) {
+		return nil, nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$split requires an expression that evaluates to a string as a first argument, found: %s", TypeName(value))
+	}
+	separatorText, ok := separator.(string)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "$split requires an expression that evaluates to a string as a second argument, found: %s", TypeName(separator))
+	}
+	if separatorText == "" {
+		return nil, newExpressionError(path, ErrBadValue, "$split requires a non-empty separator")
+	}
+
+	parts := strings.Split(text, separatorText)
+	result := make(bson.A, len(parts))
+	for idx, part := range parts {
+		result[idx] = part
+	}
+	return result, nil
+}
+
+// indexOf returns the index of a substring like {$indexOfCP: ["$text", "needle", start, end]} or -1 if it's not found
+func indexOf(operator string, values []any, path string) (any, error) {
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+	text, ok := values[0].(string)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "%s requires a string as the first argument, found: %s", operator, TypeName(values[0]))
+	}
+	search, ok := values[1].(string)
+	if !ok {
+		return nil, newExpressionError(path, ErrBadValue, "%s requires a string as the second argument, found: %s", operator, TypeName(values[1]))
+	}
+
+	if operator == "$indexOfCP" {
+		runes := []rune(text)
+		start, end, err := indexRange(operator, values[2:], len(runes), path)
+		if err != nil {
+			return nil, err
+		}
+		if start > end {
+			return int32(-1), nil
+		}
+		found := strings.Index(string(runes[start:end]), search)
+		if found < 0 {
+			return int32(-1), nil
+		}
+		return int32(start + utf8.RuneCountInString(string(runes[start:end])[:found])), nil
+	}
+
+	start, end, err := indexRange(operator, values[2:], len(text), path)
+	if err != nil {
+		return nil, err
+	}
+	if start > end {
+		return int32(-1), nil
+	}
+	found := strings.Index(text[start:end], search)
+	if found < 0 {
+		return int32(-1), nil
+	}
+	return int32(start + found), nil
+}
+
+// indexRange parses the optional start and end arguments of operators like $indexOfCP and $indexOfArray
+func indexRange(operator string, values []any, length int, path string) (int, int, error) {
+	start, end := 0, length
+	for idx, value := range values {
+		number, ok := wholeNumber(value)
+		name := "starting"
+		if idx == 1 {
+			name = "ending"
+		}
+		if !ok {
+			return 0, 0, newExpressionError(path, ErrBadValue, "%s requires an integral %s index, found a value of type: %s", operator, name, TypeName(value))
+		}
+		if number < 0 {
+			return 0, 0, newExpressionError(path, ErrBadValue, "%s requires a nonnegative %s index, found: %d", operator, name, number)
+		}
+		if idx == 0 {
+			start = int(minInt64(number, int64(length)+1))
+		} else {
+			end = int(minInt64(number, int64(length)))
+		}
+	}
+	return start, end, nil
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// defaultTrimCharacters are the whitespace characters removed by $trim if no chars are given
+const defaultTrimCharacters = "\x00 \t\n\v\f\r\u00a0\u1680\u2000\u2001\u2002\u2003\u2004\u2005\u2006\u2007\u2008\u2009\u200a\u2028\u2029\u202f\u205f\u3000"
+
+// compileTrim compiles {$trim: {input: "$name", chars: " -"}}, $ltrim and $rtrim
+func compileTrim(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments(operator, value, path, []string{"input"}, []string{"chars"})
+	if err != nil {
+		return nil, err
+	}
+	evaluators, err := compileNamedArguments(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		input, err := evaluators["input"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		chars := any(defaultTrimCharacters)
+		if evaluators["chars"] != nil {
+			chars, err = evaluators["chars"](ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if isNullish(input) || isNullish(chars) {
+			return nil, nil
+		}
+
+		text, ok := input.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "%s requires its input to be a string, got %v (of type %s) instead.", operator, input, TypeName(input))
+		}
+		charsText, ok := chars.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "%s requires 'chars' to be a string, got %v (of type %s) instead.", operator, chars, TypeName(chars))
+		}
+
+		switch operator {
+		case "$ltrim":
+			return strings.TrimLeft(text, charsText), nil
+		case "$rtrim":
+			return strings.TrimRight(text, charsText), nil
+		default:
+			return strings.Trim(text, charsText), nil
+		}
+	}, nil
+}
+
+// compileReplace compiles {$replaceOne: {input: "$name", find: "a", replacement: "b"}} and $replaceAll
+func compileReplace(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	names := []string{"input", "find", "replacement"}
+	arguments, err := parseNamedArguments(operator, value, path, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	evaluators, err := compileNamedArguments(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		texts := make([]string, len(names))
+		isNull := false
+		for idx, name := range names {
+			value, err := evaluators[name](ctx)
+			if err != nil {
+				return nil, err
+			}
+			if isNullish(value) {
+				isNull = true
+				continue
+			}
+			text, ok := value.(string)
+			if !ok {
+				return nil, newExpressionError(path, ErrBadValue, "%s requires that '%s' be a string, found: %v", operator, name, value)
+			}
+			texts[idx] = text
+		}
+		if isNull {
+			return nil, nil
+		}
+
+		if operator == "$replaceOne" {
+			return strings.Replace(texts[0], texts[1], texts[2], 1), nil
+		}
+		return strings.ReplaceAll(texts[0], texts[1], texts[2]), nil
+	}, nil
+}
+
+// regexCache contains compiled regular expressions by their Go pattern
+var regexCache = sync.Map{}
+
+// compileRegex compiles {$regexMatch: {input: "$name", regex: /^a/, options: "i"}}, $regexFind and $regexFindAll
+func compileRegex(operator string, value any, path string, scope scopeT) (evaluatorT, error) {
+	arguments, err := parseNamedArguments(operator, value, path, []string{"input", "regex"}, []string{"options"})
+	if err != nil {
+		return nil, err
+	}
+	evaluators, err := compileNamedArguments(arguments, path, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx *contextT) (any, error) {
+		input, err := evaluators["input"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		regexValue, err := evaluators["regex"](ctx)
+		if err != nil {
+			return nil, err
+		}
+		var options any = Missing
+		if evaluators["options"] != nil {
+			options, err = evaluators["options"](ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if isNullish(input) || isNullish(regexValue) {
+			switch operator {
+			case "$regexMatch":
+				return false, nil
+			case "$regexFind":
+				return nil, nil
+			default:
+				return bson.A{}, nil
+			}
+		}
+		text, ok := input.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "%s needs 'input' to be of type string", operator)
+		}
+		regex, err := parseRegexArguments(operator, regexValue, options, path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operator {
+		case "$regexMatch":
+			return regex.MatchString(text), nil
+		case "$regexFind":
+			found := regex.FindStringSubmatchIndex(text)
+			if found == nil {
+				return nil, nil
+			}
+			return regexResult(text, found), nil
+		default:
+			results := bson.A{}
+			for _, found := range regex.FindAllStringSubmatchIndex(text, -1) {
+				results = append(results, regexResult(text, found))
+			}
+			return results, nil
+		}
+	}, nil
+}
+
+// parseRegexArguments compiles the regex and options arguments of the regex operators into a Go regular expression
+func parseRegexArguments(operator string, regexValue any, options any, path string) (*regexp.Regexp, error) {
+	var pattern, flags string
+	switch typedRegex := regexValue.(type) {
+	case primitive.Regex:
+		pattern, flags = typedRegex.Pattern, typedRegex.Options
+		if !isNullish(options) && flags != "" {
+			return nil, newExpressionError(path, ErrBadValue, "%s: regex option(s) specified in both 'regex' and 'option' fields", operator)
+		}
+	case string:
+		pattern = typedRegex
+	default:
+		return nil, newExpressionError(path, ErrBadValue, "%s needs 'regex' to be of type string or regex", operator)
+	}
+	if !isNullish(options) {
+		optionsText, ok := options.(string)
+		if !ok {
+			return nil, newExpressionError(path, ErrBadValue, "%s needs 'options' to be of type string", operator)
+		}
+		flags = optionsText
+	}
+
+	goFlags := ""
+	for _, flag := range flags {
+		switch flag {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(goFlags, flag) {
+				goFlags += string(flag)
+			}
+		case 'x':
+			return nil, newExpressionError(path, ErrNotSupported, "regex option %c is not supported by mongomock", flag)
+		default:
+			return nil, newExpressionError(path, ErrBadValue, "%s invalid flag in regex options: %c", operator, flag)
+		}
+	}
+	if goFlags != "" {
+		pattern = "(?" + goFlags + ")" + pattern
+	}
+
+	cached, ok := regexCache.Load(pattern)
+	if ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newExpressionError(path, ErrBadValue, "%s: Invalid regular expression: %s", operator, err.Error())
+	}
+	regexCache.Store(pattern, regex)
+	return regex, nil
+}
+
+// regexResult converts a match of a regular expression into the {match, idx, captures} document of $regexFind
+// Like MongoDB idx is in code points and captures that did not match are null.
+func regexResult(text string, found []int) bson.D {
+	captures := bson.A{}
+	for idx := 2; idx < len(found); idx += 2 {
+		if found[idx] < 0 {
+			captures = append(captures, nil)
+		} else {
+			captures = append(captures, text[found[idx]:found[idx+1]])
+		}
+	}
+	return bson.D{
+		{Key: "match", Value: text[found[0]:found[1]]},
+		{Key: "idx", Value: int32(utf8.RuneCountInString(text[:found[0]]))},
+		{Key: "captures", Value: captures},
+	}
+}
@@ -3,43 +3,48 @@ package mongomock
 import (
 	"errors"
 	"reflect"
+	"sort"
 
-	"github.com/mjarkk/mongomock/match"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // FindFirst finds the first document in the collection matching the filter and places it into placeInto
 // The result can be filtered using filters
 // The filters should work equal to MongoDB filters (https://docs.mongodb.com/manual/tutorial/query-documents/)
 // tough this might miss features compared to mongoDB's filters
-func (c *Collection) FindFirst(placeInto any, filter bson.M) error {
+//
+// The sort, skip and projection options are supported, including {$meta: "textScore"}
+func (c *Collection) FindFirst(placeInto any, filter any, opts ...*options.FindOneOptions) error {
 	placeIntoReflection := reflect.ValueOf(placeInto)
 	if placeIntoReflection.Kind() != reflect.Ptr {
 		return errors.New("placeInto should be a pointer")
 	}
 
-	c.m.Lock()
-	defer c.m.Unlock()
+	findOptions, err := parseFindOneOptions(opts)
+	if err != nil {
+		return err
+	}
 
-	for _, document := range c.documents {
-		if match.Match(document.bson, filter) {
-			err := bson.Unmarshal(document.bytes, placeInto)
-			return err
-		}
+	results, err := c.find(filter, findOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return mongo.ErrNoDocuments
 	}
 
-	return mongo.ErrNoDocuments
+	return bson.Unmarshal(results[0].document.bytes, placeInto)
 }
 
 // Find finds documents in the collection of the base
 // The results can be filtered using filters
 // The filters should work equal to MongoDB filters (https://docs.mongodb.com/manual/tutorial/query-documents/)
 // tough this might miss features compared to mongoDB's filters
-func (c *Collection) Find(results any, filter bson.M) error {
-	c.m.Lock()
-	defer c.m.Unlock()
-
+//
+// The sort, skip, limit and projection options are supported, including {$meta: "textScore"}
+func (c *Collection) Find(results any, filter any, opts ...*options.FindOptions) error {
 	resultRefl := reflect.ValueOf(results)
 	if resultRefl.Kind() != reflect.Ptr {
 		return errors.New("requires pointer to slice as results argument")
@@ -50,19 +55,25 @@ func (c *Collection) Find(results any, filter bson.M) error {
 		return errors.New("requires pointer to slice as results argument")
 	}
 
+	findOptions, err := parseFindOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	foundResults, err := c.find(filter, findOptions)
+	if err != nil {
+		return err
+	}
+
 	resultsSliceContentType := resultRefl.Type().Elem()
 	resultIsSliceOfPtrs := resultsSliceContentType.Kind() == reflect.Ptr
 	if resultIsSliceOfPtrs {
 		resultsSliceContentType = resultsSliceContentType.Elem()
 	}
 
-	for _, document := range c.documents {
-		if !match.Match(document.bson, filter) {
-			continue
-		}
-
+	for _, result := range foundResults {
 		newDocument := reflect.New(resultsSliceContentType)
-		err := bson.Unmarshal(document.bytes, newDocument.Interface())
+		err := bson.Unmarshal(result.document.bytes, newDocument.Interface())
 		if err != nil {
 			return err
 		}
@@ -79,12 +90,39 @@ func (c *Collection) Find(results any, filter bson.M) error {
 	return nil
 }
 
+// find returns the documents matching the filter with the find options applied
+func (c *Collection) find(filter any, findOptions findOptionsT) ([]resultT, error) {
+	query, err := c.compileQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	results, err := c.unsafeQuery(query)
+	c.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if query.matcher.HasNear() {
+		// Like MongoDB the results of $near and $nearSphere are sorted by distance
+		distances := make(map[uint64]float64, len(results))
+		for _, result := range results {
+			distances[result.document.id], _ = query.matcher.NearDistance(result.document.bson)
+		}
+		sort.SliceStable(results, func(i, j int) bool {
+			return distances[results[i].document.id] < distances[results[j].document.id]
+		})
+	}
+
+	return findOptions.apply(results, query.text != nil)
+}
+
 // Cursor is a cursor for the testingdb implementing the db.Cursor
 type Cursor struct {
 	// should be set initially
-	collection *Collection
-	idx        int
-	filter     bson.M
+	results []resultT
+	idx     int
 	// set after init
 	document documentT
 }
@@ -93,19 +131,13 @@ type Cursor struct {
 // returns true if there is a next item
 // returns false if there is no next item
 func (c *Cursor) Next() bool {
-	c.collection.m.Lock()
-	defer c.collection.m.Unlock()
-
-	for c.idx < len(c.collection.documents) {
-		c.document = c.collection.documents[c.idx]
-		c.idx++
-		if !match.Match(c.document.bson, c.filter) {
-			continue
-		}
-		return true
+	if c.idx >= len(c.results) {
+		return false
 	}
 
-	return false
+	c.document = c.results[c.idx].document
+	c.idx++
+	return true
 }
 
 // Decode decodes the current item within the cursor into e
@@ -119,15 +151,20 @@ func (c *Cursor) Decode(e any) error {
 }
 
 // FindCursor finds documents in the collection of the base
-func (c *Collection) FindCursor(filter bson.M) (*Cursor, error) {
+// The documents are looked up when the cursor is created, so the cursor is a snapshot of the collection at that moment.
+// Documents inserted, changed or deleted afterwards are not seen by Next, this is required to sort the results.
+//
+// The sort, skip, limit and projection options are supported, including {$meta: "textScore"}
+func (c *Collection) FindCursor(filter any, opts ...*options.FindOptions) (*Cursor, error) {
+	findOptions, err := parseFindOptions(opts)
+	if err != nil {
+		return nil, err
+	}
 
-	c.m.Lock()
-	cursor := &Cursor{
-		collection: c,
-		idx:        0,
-		filter:     filter,
+	results, err := c.find(filter, findOptions)
+	if err != nil {
+		return nil, err
 	}
-	c.m.Unlock()
 
-	return cursor, nil
+	return &Cursor{results: results}, nil
 }
@@ -0,0 +1,219 @@
+package mongomock
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mjarkk/mongomock/aggregate"
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errNoTextScore is returned if the text score is used without a $text query
+var errNoTextScore = errors.New("query requires text score metadata, but it is not available")
+
+// findOptionsT contains the options of a find query supported by mongomock
+type findOptionsT struct {
+	sort       bson.D
+	projection bson.D
+	skip       int64
+	limit      int64
+}
+
+func parseFindOptions(opts []*options.FindOptions) (findOptionsT, error) {
+	merged := options.MergeFindOptions(opts...)
+
+	result := findOptionsT{}
+	if merged.Skip != nil {
+		result.skip = *merged.Skip
+	}
+	if merged.Limit != nil {
+		// A negative limit means a single batch, which equals a positive limit for mongomock
+		result.limit = *merged.Limit
+		if result.limit < 0 {
+			result.limit = -result.limit
+		}
+	}
+	return result, result.parseDocuments(merged.Sort, merged.Projection)
+}
+
+func parseFindOneOptions(opts []*options.FindOneOptions) (findOptionsT, error) {
+	merged := options.MergeFindOneOptions(opts...)
+
+	result := findOptionsT{limit: 1}
+	if merged.Skip != nil {
+		result.skip = *merged.Skip
+	}
+	return result, result.parseDocuments(merged.Sort, merged.Projection)
+}
+
+func (o *findOptionsT) parseDocuments(sort any, projection any) error {
+	if sort != nil {
+		sortDocument, ok := match.ToDocument(sort)
+		if !ok {
+			return errors.New("sort must be a document")
+		}
+		o.sort = sortDocument
+	}
+	if projection != nil {
+		projectionDocument, ok := match.ToDocument(projection)
+		if !ok {
+			return errors.New("projection must be a document")
+		}
+		o.projection = projectionDocument
+	}
+	return nil
+}
+
+// apply sorts, skips, limits and projects the results of a query
+func (o findOptionsT) apply(results []resultT, hasTextScore bool) ([]resultT, error) {
+	err := sortResults(results, o.sort, hasTextScore)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.skip > 0 {
+		if o.skip >= int64(len(results)) {
+			return []resultT{}, nil
+		}
+		results = results[o.skip:]
+	}
+	if o.limit > 0 && int64(len(results)) > o.limit {
+		results = results[:o.limit]
+	}
+
+	if len(o.projection) == 0 {
+		return results, nil
+	}
+
+	projection, err := parseProjection(o.projection, hasTextScore)
+	if err != nil {
+		return nil, err
+	}
+	projectedResults := make([]resultT, len(results))
+	for idx, result := range results {
+		document, err := projection.apply(result.document.bson, result.textScore)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := bson.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		result.document = documentT{id: result.document.id, bson: document, bytes: bytes}
+		projectedResults[idx] = result
+	}
+	return projectedResults, nil
+}
+
+// isTextScoreMeta returns true if the value is {$meta: "textScore"}
+func isTextScoreMeta(value any) bool {
+	document, ok := match.ToDocument(value)
+	return ok && len(document) == 1 && document[0].Key == "$meta" && document[0].Value == "textScore"
+}
+
+// sortResults sorts the results like MongoDB sorts them
+// Arrays are sorted by their smallest element in ascending order and their largest element in descending order
+func sortResults(results []resultT, sortDocument bson.D, hasTextScore bool) error {
+	if len(sortDocument) == 0 {
+		return nil
+	}
+
+	directions := make([]int, len(sortDocument))
+	for idx, entry := range sortDocument {
+		if isTextScoreMeta(entry.Value) {
+			if !hasTextScore {
+				return errNoTextScore
+			}
+			// Text scores are always sorted in descending order
+			directions[idx] = 0
+			continue
+		}
+
+		switch {
+		case match.Compare(entry.Value, 1) == 0:
+			directions[idx] = 1
+		case match.Compare(entry.Value, -1) == 0:
+			directions[idx] = -1
+		default:
+			return fmt.Errorf("invalid sort value for %s, expected 1, -1 or {$meta: \"textScore\"}", entry.Key)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		for idx, entry := range sortDocument {
+			direction := directions[idx]
+			if direction == 0 {
+				if results[i].textScore != results[j].textScore {
+					return results[i].textScore > results[j].textScore
+				}
+				continue
+			}
+
+			result := match.Compare(
+				match.SortValue(results[i].document.bson, entry.Key, direction == -1),
+				match.SortValue(results[j].document.bson, entry.Key, direction == -1),
+			)
+			if result != 0 {
+				return result == -direction
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// projectionT is a parsed projection like {title: 1, score: {$meta: "textScore"}}
+// The fields other than the text score are projected like the $project stage of an aggregation.
+type projectionT struct {
+	// project is nil if the projection only contains text scores
+	project *aggregate.Projection
+	// metaFields are the fields set to the text score
+	metaFields []string
+}
+
+func parseProjection(projection bson.D, hasTextScore bool) (*projectionT, error) {
+	result := &projectionT{}
+	spec := bson.D{}
+	for _, entry := range projection {
+		if isTextScoreMeta(entry.Value) {
+			if !hasTextScore {
+				return nil, errNoTextScore
+			}
+			result.metaFields = append(result.metaFields, entry.Key)
+			continue
+		}
+		spec = append(spec, entry)
+	}
+	if len(spec) == 0 {
+		return result, nil
+	}
+
+	var err error
+	result.project, err = aggregate.CompileProjection(spec)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *projectionT) apply(document bson.D, textScore float64) (bson.D, error) {
+	var result bson.D
+	if p.project == nil {
+		// Copy the document so adding the text scores doesn't modify the document of the collection
+		result = append(bson.D{}, document...)
+	} else {
+		var err error
+		result, err = p.project.Apply(document)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range p.metaFields {
+		result = append(result, bson.E{Key: field, Value: textScore})
+	}
+	return result, nil
+}
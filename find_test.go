@@ -3,8 +3,11 @@ package mongomock
 import (
 	"testing"
 
+	"github.com/mjarkk/mongomock/aggregate"
+	"github.com/mjarkk/mongomock/match"
 	. "github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestFindOneWithoutFilters(t *testing.T) {
@@ -16,7 +19,7 @@ func TestFindOneWithoutFilters(t *testing.T) {
 	NoError(t, err)
 
 	foundResult := MockUser{}
-	err = usersCollection.FindOne(&foundResult, bson.M{})
+	err = usersCollection.FindFirst(&foundResult, bson.M{})
 	NoError(t, err)
 	Equal(t, mockData.ID, foundResult.ID)
 }
@@ -41,3 +44,184 @@ func TestFindWithoutFilters(t *testing.T) {
 	Len(t, foundResultsPtrs, 1)
 	Equal(t, mockData.ID, foundResultsPtrs[0].ID)
 }
+
+func TestFindCursorSnapshot(t *testing.T) {
+	usersCollection := NewDB().Collection("users")
+	NoError(t, usersCollection.Insert(NewMockuser()))
+
+	cursor, err := usersCollection.FindCursor(bson.M{})
+	NoError(t, err)
+	NoError(t, usersCollection.Insert(NewMockuser()))
+
+	count := 0
+	for cursor.Next() {
+		count++
+	}
+	Equal(t, 1, count, "documents inserted after creating the cursor should not be seen")
+}
+
+func TestFindWithInvalidFilter(t *testing.T) {
+	usersCollection := NewDB().Collection("users")
+
+	err := usersCollection.Insert(NewMockuser())
+	NoError(t, err)
+
+	foundResults := []MockUser{}
+	err = usersCollection.Find(&foundResults, bson.M{"username": bson.M{"$in": "Piet"}})
+	ErrorIs(t, err, match.ErrBadValue)
+
+	_, err = usersCollection.Count(bson.M{"username": bson.M{"$foo": "Piet"}})
+	ErrorIs(t, err, match.ErrUnknownOperator)
+}
+
+func TestFindWithOrderedFilter(t *testing.T) {
+	usersCollection := NewDB().Collection("users")
+
+	mockData := NewMockuser()
+	err := usersCollection.Insert(mockData, NewMockuser())
+	NoError(t, err)
+
+	foundResult := MockUser{}
+	err = usersCollection.FindFirst(&foundResult, bson.D{{Key: "_id", Value: mockData.ID}, {Key: "username", Value: "Piet"}})
+	NoError(t, err)
+	Equal(t, mockData.ID, foundResult.ID)
+
+	count, err := usersCollection.Count(bson.D{{Key: "_id", Value: bson.D{{Key: "$ne", Value: mockData.ID}}}})
+	NoError(t, err)
+	Equal(t, uint64(1), count)
+}
+
+func TestFindWithEmbeddedDocument(t *testing.T) {
+	usersCollection := NewDB().Collection("users")
+
+	type address struct {
+		City string `bson:"city"`
+		Zip  string `bson:"zip"`
+	}
+	NoError(t, usersCollection.Insert(bson.M{"username": "foo", "address": address{City: "A", Zip: "1"}}))
+
+	count, err := usersCollection.Count(bson.M{"address": bson.D{{Key: "city", Value: "A"}, {Key: "zip", Value: "1"}}})
+	NoError(t, err)
+	Equal(t, uint64(1), count)
+
+	count, err = usersCollection.Count(bson.M{"address": bson.D{{Key: "zip", Value: "1"}, {Key: "city", Value: "A"}}})
+	NoError(t, err)
+	Equal(t, uint64(0), count)
+
+	count, err = usersCollection.Count(bson.M{"address": bson.D{{Key: "city", Value: "A"}}})
+	NoError(t, err)
+	Equal(t, uint64(0), count)
+}
+
+func TestFindNearSortsByDistance(t *testing.T) {
+	citiesCollection := NewDB().Collection("cities")
+
+	type city struct {
+		Name     string    `bson:"name"`
+		Location []float64 `bson:"location"`
+	}
+	NoError(t, citiesCollection.Insert(city{Name: "Paris", Location: []float64{2.35, 48.86}}))
+	NoError(t, citiesCollection.Insert(city{Name: "Amsterdam", Location: []float64{4.9, 52.37}}))
+	NoError(t, citiesCollection.Insert(city{Name: "Utrecht", Location: []float64{5.12, 52.09}}))
+
+	near := bson.M{"location": bson.M{"$nearSphere": bson.M{
+		"$geometry":    bson.M{"type": "Point", "coordinates": bson.A{4.9, 52.37}},
+		"$maxDistance": 100000,
+	}}}
+	results := []city{}
+	NoError(t, citiesCollection.Find(&results, near))
+	if Len(t, results, 2) {
+		Equal(t, "Amsterdam", results[0].Name)
+		Equal(t, "Utrecht", results[1].Name)
+	}
+
+	_, err := citiesCollection.Count(bson.M{"$or": bson.A{near}})
+	Error(t, err)
+}
+
+func TestFindByUUID(t *testing.T) {
+	sessionsCollection := NewDB().Collection("sessions")
+
+	type UUID [16]byte
+	type session struct {
+		ID   UUID   `bson:"_id"`
+		User string `bson:"user"`
+	}
+	id := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	NoError(t, sessionsCollection.Insert(session{ID: id, User: "foo"}))
+	NoError(t, sessionsCollection.Insert(session{ID: UUID{1}, User: "bar"}))
+
+	result := session{}
+	NoError(t, sessionsCollection.FindFirst(&result, bson.M{"_id": id}))
+	Equal(t, "foo", result.User)
+
+	count, err := sessionsCollection.Count(bson.M{"_id": bson.M{"$in": bson.A{id, UUID{2}}}})
+	NoError(t, err)
+	Equal(t, uint64(1), count)
+}
+
+func TestFindSort(t *testing.T) {
+	citiesCollection := NewDB().Collection("cities")
+	NoError(t, citiesCollection.Insert(
+		bson.M{"name": "Paris", "country": "FR", "population": 2100000},
+		bson.M{"name": "Amsterdam", "country": "NL", "population": 900000},
+		bson.M{"name": "Utrecht", "country": "NL", "population": 360000},
+	))
+
+	results := []bson.M{}
+	NoError(t, citiesCollection.Find(&results, bson.M{}, options.Find().SetSort(bson.D{{Key: "country", Value: -1}, {Key: "population", Value: 1}})))
+	names := []any{}
+	for _, result := range results {
+		names = append(names, result["name"])
+	}
+	Equal(t, []any{"Utrecht", "Amsterdam", "Paris"}, names)
+}
+
+func TestFindSampleRate(t *testing.T) {
+	db := NewDB()
+	numbers := db.Collection("numbers")
+	for idx := 0; idx < 100; idx++ {
+		NoError(t, numbers.Insert(bson.M{"idx": idx}))
+	}
+
+	sample := func() []bson.M {
+		results := []bson.M{}
+		NoError(t, numbers.Find(&results, bson.M{"$sampleRate": 0.3}))
+		return results
+	}
+
+	db.SeedRandom(42)
+	first := sample()
+	Greater(t, len(first), 10)
+	Less(t, len(first), 50)
+	db.SeedRandom(42)
+	Equal(t, first, sample())
+}
+
+func TestFindProjection(t *testing.T) {
+	users := NewDB().Collection("users")
+	NoError(t, users.Insert(
+		bson.M{"_id": 1, "name": "Ada", "address": bson.M{"city": "London", "street": "Main"}, "age": 36},
+	))
+
+	find := func(projection bson.D) (bson.M, error) {
+		result := bson.M{}
+		err := users.FindFirst(&result, bson.M{}, options.FindOne().SetProjection(projection))
+		return result, err
+	}
+
+	result, err := find(bson.D{{Key: "name", Value: 1}, {Key: "address.city", Value: 1}})
+	NoError(t, err)
+	Equal(t, bson.M{"_id": int32(1), "name": "Ada", "address": bson.M{"city": "London"}}, result)
+
+	result, err = find(bson.D{{Key: "_id", Value: 0}, {Key: "address", Value: 0}})
+	NoError(t, err)
+	Equal(t, bson.M{"name": "Ada", "age": int32(36)}, result)
+
+	result, err = find(bson.D{{Key: "name", Value: 1}, {Key: "nextAge", Value: bson.M{"$add": bson.A{"$age", 1}}}})
+	NoError(t, err)
+	Equal(t, bson.M{"_id": int32(1), "name": "Ada", "nextAge": int32(37)}, result)
+
+	_, err = find(bson.D{{Key: "name", Value: 1}, {Key: "age", Value: 0}})
+	ErrorIs(t, err, aggregate.ErrBadValue)
+}
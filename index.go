@@ -0,0 +1,162 @@
+package mongomock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mjarkk/mongomock/match"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrTextIndexRequired is returned for $text queries on collections without a text index
+var ErrTextIndexRequired = errors.New("text index required for $text query")
+
+// indexT describes an index created using CreateIndex
+type indexT struct {
+	name string
+	keys bson.D
+	// unique is set for indexes created with the unique option, $merge requires one on its on fields
+	unique bool
+	// text is set for text indexes
+	text *textIndexT
+}
+
+// CreateIndex creates an index and returns its name
+// Text indexes like {title: "text", body: "text"} are required for $text queries and support the weights,
+// default_language and language_override options.
+// Unique indexes are only used to check the on fields of $merge, other indexes do not change the behavior of the collection.
+func (c *Collection) CreateIndex(model mongo.IndexModel) (string, error) {
+	keys, ok := match.ToDocument(model.Keys)
+	if !ok || len(keys) == 0 {
+		return "", errors.New("index keys must be a non empty document")
+	}
+
+	name := indexName(keys)
+	if model.Options != nil && model.Options.Name != nil {
+		name = *model.Options.Name
+	}
+
+	index := &indexT{name: name, keys: keys, unique: model.Options != nil && model.Options.Unique != nil && *model.Options.Unique}
+	if isTextIndex(keys) {
+		textIndex, err := newTextIndex(keys, model.Options)
+		if err != nil {
+			return "", err
+		}
+		index.text = textIndex
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, existingIndex := range c.indexes {
+		if existingIndex.name == name {
+			if match.Compare(existingIndex.keys, keys) == 0 {
+				return name, nil
+			}
+			return "", fmt.Errorf("an index with the name %s already exists with different keys", name)
+		}
+		if index.text != nil && existingIndex.text != nil {
+			return "", errors.New("only one text index per collection allowed")
+		}
+	}
+
+	if index.text != nil {
+		for idx, document := range c.documents {
+			err := index.text.add(document)
+			if err != nil {
+				for _, indexedDocument := range c.documents[:idx] {
+					index.text.remove(indexedDocument)
+				}
+				return "", err
+			}
+		}
+	}
+
+	c.indexes = append(c.indexes, index)
+	return name, nil
+}
+
+// DropIndex drops an index by its name
+func (c *Collection) DropIndex(name string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for idx, index := range c.indexes {
+		if index.name == name {
+			c.indexes = append(c.indexes[:idx], c.indexes[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+// indexName returns the default name of an index like MongoDB generates it, for example "title_text_body_text"
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// unsafeTextIndex returns the text index of the collection or nil if there is none
+func (c *Collection) unsafeTextIndex() *textIndexT {
+	for _, index := range c.indexes {
+		if index.text != nil {
+			return index.text
+		}
+	}
+	return nil
+}
+
+// unsafeUniqueIndexExists returns true if the collection has a unique index on exactly the fields, in any order
+func (c *Collection) unsafeUniqueIndexExists(fields []string) bool {
+	for _, index := range c.indexes {
+		if !index.unique || len(index.keys) != len(fields) {
+			continue
+		}
+		found := 0
+		for _, key := range index.keys {
+			for _, field := range fields {
+				if key.Key == field {
+					found++
+					break
+				}
+			}
+		}
+		if found == len(fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsafeAddToIndexes adds a new document to the indexes of the collection
+func (c *Collection) unsafeAddToIndexes(document documentT) error {
+	for idx, index := range c.indexes {
+		if index.text == nil {
+			continue
+		}
+		err := index.text.add(document)
+		if err != nil {
+			for _, addedIndex := range c.indexes[:idx] {
+				if addedIndex.text != nil {
+					addedIndex.text.remove(document)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unsafeRemoveFromIndexes removes a document that is about to be removed from the indexes of the collection
+func (c *Collection) unsafeRemoveFromIndexes(document documentT) {
+	for _, index := range c.indexes {
+		if index.text != nil {
+			index.text.remove(document)
+		}
+	}
+}
@@ -24,6 +24,17 @@ func (c *Collection) UnsafeInsert(documents ...any) error {
 		additiveDocuments[idx] = doc
 	}
 
+	for idx, document := range additiveDocuments {
+		err := c.unsafeAddToIndexes(document)
+		if err != nil {
+			// Undo the documents that were already indexed, nothing is inserted
+			for _, indexedDocument := range additiveDocuments[:idx] {
+				c.unsafeRemoveFromIndexes(indexedDocument)
+			}
+			return err
+		}
+	}
+
 	c.documents = append(c.documents, additiveDocuments...)
 	return nil
 }
@@ -0,0 +1,493 @@
+package match
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeOrderT is the canonical order of a bson type as used by MongoDB to compare values of different types
+// See: https://www.mongodb.com/docs/manual/reference/bson-type-comparison-order/
+type typeOrderT int
+
+const (
+	typeOrderMinKey typeOrderT = iota
+	typeOrderUndefined
+	typeOrderNull
+	typeOrderNumber
+	typeOrderString
+	typeOrderObject
+	typeOrderArray
+	typeOrderBinData
+	typeOrderObjectID
+	typeOrderBool
+	typeOrderDate
+	typeOrderTimestamp
+	typeOrderRegex
+	typeOrderDBPointer
+	typeOrderJavaScript
+	typeOrderCodeWithScope
+	typeOrderMaxKey
+)
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	primitivePkgPath = reflect.TypeOf(primitive.ObjectID{}).PkgPath()
+)
+
+// canonicalTypeOrder returns the canonical type order of a value
+func canonicalTypeOrder(value any) typeOrderT {
+	switch value.(type) {
+	case nil, primitive.Null, missingT:
+		return typeOrderNull
+	case primitive.Undefined:
+		return typeOrderUndefined
+	case primitive.MinKey:
+		return typeOrderMinKey
+	case primitive.MaxKey:
+		return typeOrderMaxKey
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64, primitive.Decimal128:
+		return typeOrderNumber
+	case string, primitive.Symbol:
+		return typeOrderString
+	case primitive.ObjectID:
+		return typeOrderObjectID
+	case primitive.DateTime, time.Time:
+		return typeOrderDate
+	case primitive.Timestamp:
+		return typeOrderTimestamp
+	case primitive.Regex:
+		return typeOrderRegex
+	case primitive.Binary, []byte:
+		return typeOrderBinData
+	case primitive.DBPointer:
+		return typeOrderDBPointer
+	case primitive.JavaScript:
+		return typeOrderJavaScript
+	case primitive.CodeWithScope:
+		return typeOrderCodeWithScope
+	case bool:
+		return typeOrderBool
+	case bson.D, bson.Raw:
+		return typeOrderObject
+	}
+
+	reflection, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
+	if isNil {
+		return typeOrderNull
+	}
+	if reflection.IsValid() && typeEncodesItself(reflection.Type()) {
+		return canonicalTypeOrder(convertValue(reflection.Interface()))
+	}
+
+	switch reflection.Kind() {
+	case reflect.Invalid:
+		return typeOrderNull
+	case reflect.Bool:
+		return typeOrderBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return typeOrderNumber
+	case reflect.String:
+		return typeOrderString
+	case reflect.Struct:
+		if reflection.Type() == timeType {
+			return typeOrderDate
+		}
+		return typeOrderObject
+	case reflect.Map:
+		return typeOrderObject
+	case reflect.Slice, reflect.Array:
+		if reflection.Type().Elem().Kind() == reflect.Uint8 {
+			return typeOrderBinData
+		}
+		return typeOrderArray
+	}
+
+	return typeOrderNull
+}
+
+// unwrapComparable unwraps pointers and named basic types into one of the types understood by compareValues
+func unwrapComparable(value any) any {
+	switch value.(type) {
+	case nil, string, bool, bson.D, bson.M, bson.A,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64, bson.Raw,
+		primitive.DateTime, primitive.Symbol, primitive.JavaScript, primitive.ObjectID,
+		primitive.Binary, primitive.Decimal128, primitive.Timestamp, primitive.Regex,
+		primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return value
+	case missingT:
+		return nil
+	}
+
+	reflection, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
+	if isNil || !reflection.IsValid() {
+		return nil
+	}
+	if typeEncodesItself(reflection.Type()) {
+		// Values like bson.RawValue and types implementing bson.ValueMarshaler are matched by the value they encode to
+		return unwrapComparable(convertValue(reflection.Interface()))
+	}
+	if reflection.Type().PkgPath() == primitivePkgPath {
+		return reflection.Interface()
+	}
+
+	switch reflection.Kind() {
+	case reflect.Bool:
+		return reflection.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflection.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflection.Uint()
+	case reflect.Float32, reflect.Float64:
+		return reflection.Float()
+	case reflect.String:
+		return reflection.String()
+	}
+
+	return reflection.Interface()
+}
+
+// compareValues compares two values using MongoDB's comparison order
+// Returns 0 if a == b, -1 if a < b and 1 if a > b
+//
+// Values of different types are ordered by their canonical type order
+func compareValues(a, b any) int {
+	a = unwrapComparable(a)
+	b = unwrapComparable(b)
+
+	aOrder := canonicalTypeOrder(a)
+	bOrder := canonicalTypeOrder(b)
+	if aOrder != bOrder {
+		return compareInts(int64(aOrder), int64(bOrder))
+	}
+
+	switch aOrder {
+	case typeOrderMinKey, typeOrderMaxKey, typeOrderNull, typeOrderUndefined:
+		return 0
+	case typeOrderNumber:
+		return compareNumbers(a, b)
+	case typeOrderString:
+		return strings.Compare(stringValue(a), stringValue(b))
+	case typeOrderObject:
+		return compareDocuments(a, b)
+	case typeOrderArray:
+		aSlice, _ := sliceLikeToSlice(a)
+		bSlice, _ := sliceLikeToSlice(b)
+		for idx := 0; idx < len(aSlice) && idx < len(bSlice); idx++ {
+			result := compareValues(aSlice[idx], bSlice[idx])
+			if result != 0 {
+				return result
+			}
+		}
+		return compareInts(int64(len(aSlice)), int64(len(bSlice)))
+	case typeOrderBinData:
+		// Byte arrays like github.com/google/uuid.UUID are generic binaries like the bson package encodes them,
+		// UUID types implementing bson.ValueMarshaler are already converted into the binary they encode to.
+		aBinary := binaryValue(a)
+		bBinary := binaryValue(b)
+		if len(aBinary.Data) != len(bBinary.Data) {
+			return compareInts(int64(len(aBinary.Data)), int64(len(bBinary.Data)))
+		}
+		if aBinary.Subtype != bBinary.Subtype {
+			return compareInts(int64(aBinary.Subtype), int64(bBinary.Subtype))
+		}
+		return bytes.Compare(aBinary.Data, bBinary.Data)
+	case typeOrderObjectID:
+		aID := a.(primitive.ObjectID)
+		bID := b.(primitive.ObjectID)
+		return bytes.Compare(aID[:], bID[:])
+	case typeOrderBool:
+		aBool := a.(bool)
+		bBool := b.(bool)
+		if aBool == bBool {
+			return 0
+		}
+		if bBool {
+			return -1
+		}
+		return 1
+	case typeOrderDate:
+		return compareInts(int64(dateValue(a)), int64(dateValue(b)))
+	case typeOrderTimestamp:
+		return primitive.CompareTimestamp(a.(primitive.Timestamp), b.(primitive.Timestamp))
+	case typeOrderRegex:
+		aRegex := a.(primitive.Regex)
+		bRegex := b.(primitive.Regex)
+		if aRegex.Pattern != bRegex.Pattern {
+			return strings.Compare(aRegex.Pattern, bRegex.Pattern)
+		}
+		return strings.Compare(aRegex.Options, bRegex.Options)
+	case typeOrderDBPointer:
+		aPointer := a.(primitive.DBPointer)
+		bPointer := b.(primitive.DBPointer)
+		if len(aPointer.DB) != len(bPointer.DB) {
+			return compareInts(int64(len(aPointer.DB)), int64(len(bPointer.DB)))
+		}
+		if aPointer.DB != bPointer.DB {
+			return strings.Compare(aPointer.DB, bPointer.DB)
+		}
+		return bytes.Compare(aPointer.Pointer[:], bPointer.Pointer[:])
+	case typeOrderJavaScript:
+		return strings.Compare(string(a.(primitive.JavaScript)), string(b.(primitive.JavaScript)))
+	case typeOrderCodeWithScope:
+		aCode := a.(primitive.CodeWithScope)
+		bCode := b.(primitive.CodeWithScope)
+		if aCode.Code != bCode.Code {
+			return strings.Compare(string(aCode.Code), string(bCode.Code))
+		}
+		return compareValues(aCode.Scope, bCode.Scope)
+	}
+
+	return 0
+}
+
+// valuesEqual checks if a document value equals a filter value like an equality match in MongoDB does
+// Embedded documents need to have the same fields in the same order and arrays the same entries in the same order.
+// Maps have no field order, so if one of the documents is a map only the fields and their values are compared.
+func valuesEqual(value, filter any) bool {
+	value = unwrapComparable(value)
+	filter = unwrapComparable(filter)
+
+	order := canonicalTypeOrder(value)
+	if order != canonicalTypeOrder(filter) {
+		return false
+	}
+
+	switch order {
+	case typeOrderObject:
+		return documentsEqual(value, filter)
+	case typeOrderArray:
+		valueEntries, _ := sliceLikeToSlice(value)
+		filterEntries, _ := sliceLikeToSlice(filter)
+		if len(valueEntries) != len(filterEntries) {
+			return false
+		}
+		for idx, entry := range valueEntries {
+			if !valuesEqual(entry, filterEntries[idx]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return compareValues(value, filter) == 0
+}
+
+func documentsEqual(value, filter any) bool {
+	valueFields := documentToD(value)
+	filterFields := documentToD(filter)
+	if len(valueFields) != len(filterFields) {
+		return false
+	}
+
+	if !isOrderedDocument(value) || !isOrderedDocument(filter) {
+		filterValues := make(map[string]any, len(filterFields))
+		for _, field := range filterFields {
+			filterValues[field.Key] = field.Value
+		}
+		for _, field := range valueFields {
+			filterValue, ok := filterValues[field.Key]
+			if !ok || !valuesEqual(field.Value, filterValue) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for idx, field := range valueFields {
+		if field.Key != filterFields[idx].Key || !valuesEqual(field.Value, filterFields[idx].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// isOrderedDocument returns false for maps as the order of their keys is unknown
+func isOrderedDocument(document any) bool {
+	switch document.(type) {
+	case bson.D, bson.Raw:
+		return true
+	case bson.M:
+		return false
+	}
+	reflection, _ := MightUnwrapPointersAndInterfaces(reflect.ValueOf(document))
+	return reflection.Kind() != reflect.Map
+}
+
+// compareDocuments compares two documents field by field
+// For every field the canonical type is compared first, then the field name and lastly the value
+func compareDocuments(a, b any) int {
+	aFields := documentToD(a)
+	bFields := documentToD(b)
+
+	for idx := 0; idx < len(aFields) && idx < len(bFields); idx++ {
+		aField := aFields[idx]
+		bField := bFields[idx]
+
+		aOrder := canonicalTypeOrder(unwrapComparable(aField.Value))
+		bOrder := canonicalTypeOrder(unwrapComparable(bField.Value))
+		if aOrder != bOrder {
+			return compareInts(int64(aOrder), int64(bOrder))
+		}
+
+		result := strings.Compare(aField.Key, bField.Key)
+		if result != 0 {
+			return result
+		}
+
+		result = compareValues(aField.Value, bField.Value)
+		if result != 0 {
+			return result
+		}
+	}
+
+	return compareInts(int64(len(aFields)), int64(len(bFields)))
+}
+
+// documentToD converts a document like value into a bson.D
+// Maps have no order so their keys are sorted to keep the result stable, structs keep the order of their fields
+func documentToD(document any) bson.D {
+	switch typedDocument := document.(type) {
+	case bson.D:
+		return typedDocument
+	case bson.M:
+		keys := make([]string, 0, len(typedDocument))
+		for key := range typedDocument {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		result := make(bson.D, len(keys))
+		for idx, key := range keys {
+			result[idx] = bson.E{Key: key, Value: typedDocument[key]}
+		}
+		return result
+	case bson.Raw:
+		return mustConvertToBsonD(typedDocument)
+	}
+
+	reflection, _ := MightUnwrapPointersAndInterfaces(reflect.ValueOf(document))
+	if reflection.Kind() == reflect.Map {
+		return documentToD(mustConvertToBson(document))
+	}
+	if reflection.Kind() == reflect.Struct {
+		description := describeStruct(reflection.Type())
+		if !description.encodesItself {
+			return description.toD(reflection)
+		}
+	}
+	return mustConvertToBsonD(document)
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func stringValue(value any) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case primitive.Symbol:
+		return string(typedValue)
+	}
+	return reflect.ValueOf(value).String()
+}
+
+func binaryValue(value any) primitive.Binary {
+	switch typedValue := value.(type) {
+	case primitive.Binary:
+		return typedValue
+	case []byte:
+		return primitive.Binary{Data: typedValue}
+	}
+
+	reflection := reflect.ValueOf(value)
+	data := make([]byte, reflection.Len())
+	for idx := range data {
+		data[idx] = byte(reflection.Index(idx).Uint())
+	}
+	return primitive.Binary{Data: data}
+}
+
+func dateValue(value any) primitive.DateTime {
+	switch typedValue := value.(type) {
+	case primitive.DateTime:
+		return typedValue
+	case time.Time:
+		return primitive.NewDateTimeFromTime(typedValue)
+	}
+	return 0
+}
+
+// compileComparison compiles a range operator like {$gt: 5}
+// MongoDB applies type bracketing here, values of a different canonical type never match
+// with the exception of MinKey and MaxKey that compare to all other values
+func compileComparison(filter any, comparator comparatorT) valueMatcherT {
+	filter = unwrapComparable(filter)
+	filterOrder := canonicalTypeOrder(filter)
+
+	matchesValue := func(value any) bool {
+		value = unwrapComparable(value)
+
+		valueOrder := canonicalTypeOrder(value)
+		if valueOrder != filterOrder {
+			switch filterOrder {
+			case typeOrderMinKey:
+				return comparator(1)
+			case typeOrderMaxKey:
+				return comparator(-1)
+			}
+			return false
+		}
+
+		if valueOrder == typeOrderNumber {
+			return numbersMatchComparison(value, filter, comparator)
+		}
+
+		return comparator(compareValues(value, filter))
+	}
+
+	return func(value any) bool {
+		if isArray(value) {
+			// Trying to match
+			// Document: { age: [1, 8, 3] }
+			// Query: { age: { $gt: 5 } }
+			entries, _ := sliceLikeToSlice(value)
+			for _, entry := range entries {
+				if matchesValue(entry) {
+					return true
+				}
+			}
+
+			// Arrays are also compared as a whole against array filters
+			if filterOrder != typeOrderArray {
+				return false
+			}
+		}
+
+		return matchesValue(value)
+	}
+}
+
+// isArray returns true if the value is a bson array
+// Note that this excludes slice like values such as primitive.ObjectID and []byte
+func isArray(value any) bool {
+	return canonicalTypeOrder(value) == typeOrderArray
+}
@@ -0,0 +1,578 @@
+package match
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentMatcherT matches a document against a compiled filter document like {foo: "bar", $or: [...]}
+type documentMatcherT func(document any) bool
+
+// valuesMatcherT matches all values a key resolved to against a compiled field filter like {$gt: 5}
+type valuesMatcherT func(values []any) bool
+
+// valueMatcherT matches a single value against a compiled operator like {$gt: 5}
+type valueMatcherT func(value any) bool
+
+// compileFilter compiles a filter document like {foo: "bar", $or: [...]}
+func compileFilter(filter bson.D, path string, options *compileOptionsT) (documentMatcherT, error) {
+	matchers := make([]documentMatcherT, 0, len(filter))
+	for _, entry := range filter {
+		key, value := entry.Key, entry.Value
+		keyPath := joinPath(path, key)
+
+		operator, isOperator := strings.CutPrefix(key, "$")
+		if isOperator {
+			matcher, err := compileTopLevelOperator(operator, value, keyPath, options)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+			continue
+		}
+
+		valuesMatcher, err := compileFieldFilter(value, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Split the key once here instead of for every document
+		keyParts := strings.Split(key, ".")
+		matchers = append(matchers, func(document any) bool {
+			return valuesMatcher(lookupPath(document, keyParts))
+		})
+	}
+
+	switch len(matchers) {
+	case 0:
+		return func(document any) bool { return true }, nil
+	case 1:
+		return matchers[0], nil
+	default:
+		return func(document any) bool {
+			for _, matcher := range matchers {
+				if !matcher(document) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+}
+
+// compileTopLevelOperator compiles operators that apply to the full document like $and, $or, $nor and $text
+func compileTopLevelOperator(operator string, value any, path string, options *compileOptionsT) (documentMatcherT, error) {
+	switch operator {
+	case "and", "or", "nor":
+		entries, isSliceLike := sliceLikeToSlice(value)
+		if !isSliceLike || !isArray(value) || len(entries) == 0 {
+			return nil, newFilterError(path, ErrBadValue, "$%s must be a nonempty array", operator)
+		}
+
+		matchers := make([]documentMatcherT, len(entries))
+		for idx, entry := range entries {
+			entryFilter, ok := toFilterDocument(entry)
+			if !ok {
+				return nil, newFilterError(path, ErrBadValue, "$or/$and/$nor entries need to be full objects")
+			}
+
+			matcher, err := compileFilter(entryFilter, path, options)
+			if err != nil {
+				return nil, err
+			}
+			matchers[idx] = matcher
+		}
+
+		// $and matches if no entry fails, $or and $nor look for an entry that matches
+		lookFor := operator != "and"
+		return func(document any) bool {
+			for _, matcher := range matchers {
+				if matcher(document) == lookFor {
+					return operator == "or"
+				}
+			}
+			return operator != "or"
+		}, nil
+	case "text":
+		return compileText(value, path)
+	case "comment":
+		// Comments don't affect matching, see Matcher.Comment
+		return func(document any) bool { return true }, nil
+	case "sampleRate":
+		rate, ok := floatValue(value)
+		if canonicalTypeOrder(value) != typeOrderNumber || !ok || !(rate >= 0 && rate <= 1) {
+			return nil, newFilterError(path, ErrBadValue, "numeric argument to $sampleRate must be in [0, 1]")
+		}
+		return func(document any) bool {
+			return options.random() < rate
+		}, nil
+	default:
+		return nil, newFilterError(path, ErrUnknownOperator, "unknown top level operator: $%s", operator)
+	}
+}
+
+// compileFieldFilter compiles the filter of a single field like "bar" or {$gt: 5} in {foo: {$gt: 5}}
+func compileFieldFilter(filter any, path string) (valuesMatcherT, error) {
+	filterDocument, ok := toFilterDocument(filter)
+	if ok && isOperatorObject(filterDocument) {
+		return compileOperatorObject(filterDocument, path)
+	}
+
+	matcher, err := compileEqualityOrRegex(filter, path)
+	if err != nil {
+		return nil, err
+	}
+	return anyValueMatches(matcher), nil
+}
+
+// compileOperatorObject compiles an object with operators like {$gt: 1, $lt: 5}
+// A key can resolve to multiple values if the path walks through arrays, an operator matches if any value matches.
+// Negating operators like $ne and $nin only match if none of the values match.
+func compileOperatorObject(filter bson.D, path string) (valuesMatcherT, error) {
+	matchers := make([]valuesMatcherT, 0, len(filter))
+	for _, entry := range filter {
+		key, value := entry.Key, entry.Value
+		operator := strings.TrimPrefix(key, "$")
+		operatorPath := joinPath(path, key)
+
+		switch operator {
+		case "ne":
+			matcher, err := compileEquality(value, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, noValueMatches(matcher))
+		case "not":
+			matcher, err := compileNot(value, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+		case "nin":
+			matcher, err := compileIn(value, operatorPath, operator)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, noValueMatches(matcher))
+		case "exists":
+			shouldExist, err := parseExists(value, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			// {$exists: false} only matches if the key is missing on every path
+			matchers = append(matchers, func(values []any) bool {
+				for _, value := range values {
+					if value != missing {
+						return shouldExist
+					}
+				}
+				return !shouldExist
+			})
+		case "near", "nearSphere":
+			if strings.HasPrefix(path, "$or") || strings.HasPrefix(path, "$nor") {
+				return nil, newFilterError(operatorPath, ErrBadValue, "$%s is not allowed within $or and $nor", operator)
+			}
+			near, err := parseNear(operator, filter, path)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, anyValueMatches(near.matches))
+		case "minDistance", "maxDistance":
+			// These are parsed together with $near and $nearSphere
+			if !hasNearOperator(filter) {
+				return nil, newFilterError(operatorPath, ErrBadValue, "$%s can only be used with $near and $nearSphere", operator)
+			}
+		case "regex":
+			regex, err := parseRegexOperator(filter, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			matcher, err := compileRegex(regex, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, anyValueMatches(matcher))
+		case "options":
+			// This is parsed together with $regex
+			if !hasOperator(filter, "$regex") {
+				return nil, newFilterError(operatorPath, ErrBadValue, "$options needs a $regex")
+			}
+		default:
+			matcher, err := compileOperator(operator, value, operatorPath)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, anyValueMatches(matcher))
+		}
+	}
+
+	switch len(matchers) {
+	case 0:
+		return func(values []any) bool { return true }, nil
+	case 1:
+		return matchers[0], nil
+	}
+	return func(values []any) bool {
+		for _, matcher := range matchers {
+			if !matcher(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileOperator compiles a operator that matches a single value like {$gt: 5} or {$in: [5, 10]}
+func compileOperator(operator string, value any, path string) (valueMatcherT, error) {
+	switch operator {
+	case "eq":
+		return compileEquality(value, path)
+	case "gt":
+		return compileComparison(value, gtComparator), nil
+	case "gte":
+		return compileComparison(value, gteComparator), nil
+	case "lt":
+		return compileComparison(value, ltComparator), nil
+	case "lte":
+		return compileComparison(value, lteComparator), nil
+	case "in":
+		return compileIn(value, path, operator)
+	case "all":
+		// {$all: [a, b]} equals {$and: [{key: a}, {key: b}]}
+		entries, isSliceLike := sliceLikeToSlice(value)
+		if !isSliceLike || !isArray(value) {
+			return nil, newFilterError(path, ErrBadValue, "$all needs an array")
+		}
+
+		matchers := make([]valueMatcherT, len(entries))
+		for idx, entry := range entries {
+			matcher, err := compileEqualityOrRegex(entry, path)
+			if err != nil {
+				return nil, err
+			}
+			matchers[idx] = matcher
+		}
+
+		return func(value any) bool {
+			for _, matcher := range matchers {
+				if !matcher(value) {
+					return false
+				}
+			}
+			return len(matchers) > 0
+		}, nil
+	case "type":
+		types, err := parseTypeFilter(value)
+		if err != nil {
+			return nil, newFilterError(path, ErrBadValue, "%s", err.Error())
+		}
+
+		return func(value any) bool {
+			return valueHasType(value, types)
+		}, nil
+	case "size":
+		if canonicalTypeOrder(value) != typeOrderNumber {
+			return nil, newFilterError(path, ErrBadValue, "$size needs a number")
+		}
+		size, ok := integerValue(value)
+		if !ok {
+			return nil, newFilterError(path, ErrBadValue, "Failed to parse $size. Expected an integer: %v", value)
+		}
+		if size < 0 {
+			return nil, newFilterError(path, ErrBadValue, "Failed to parse $size. Expected a non-negative number: %v", value)
+		}
+
+		return func(value any) bool {
+			if !isArray(value) {
+				return false
+			}
+			entries, _ := sliceLikeToSlice(value)
+			return int64(len(entries)) == size
+		}, nil
+	case "mod":
+		return compileMod(value, path)
+	case "geoWithin", "within":
+		return compileGeoWithin(value, path)
+	case "geoIntersects":
+		return compileGeoIntersects(value, path)
+	case "elemMatch", "bitsAllClear", "bitsAllSet", "bitsAnyClear", "bitsAnySet":
+		return nil, newFilterError(path, ErrNotSupported, "$%s is not supported by mongomock", operator)
+	default:
+		return nil, newFilterError(path, ErrUnknownOperator, "unknown operator: $%s", operator)
+	}
+}
+
+// compileNot compiles the value of the $not operator, an operator object like {$gt: 5} or a regex like /^foo/
+// Unlike $ne this also matches documents where the key is missing, as it inverts the result of the full operator object.
+func compileNot(value any, path string) (valuesMatcherT, error) {
+	if regex, ok := unwrapComparable(value).(primitive.Regex); ok {
+		matcher, err := compileRegex(regex, path)
+		if err != nil {
+			return nil, err
+		}
+		return noValueMatches(matcher), nil
+	}
+
+	filter, ok := toFilterDocument(value)
+	if !ok {
+		return nil, newFilterError(path, ErrBadValue, "$not needs a regex or a document")
+	}
+	if len(filter) == 0 {
+		return nil, newFilterError(path, ErrBadValue, "$not cannot be empty")
+	}
+	if !isOperatorObject(filter) {
+		return nil, newFilterError(path, ErrBadValue, "unknown operator: %s", filter[0].Key)
+	}
+	if hasNearOperator(filter) {
+		return nil, newFilterError(path, ErrBadValue, "$not cannot contain $near or $nearSphere")
+	}
+
+	matcher, err := compileOperatorObject(filter, path)
+	if err != nil {
+		return nil, err
+	}
+	return func(values []any) bool {
+		return !matcher(values)
+	}, nil
+}
+
+// compileMod compiles the value of the $mod operator like {$mod: [4, 0]}
+// Like MongoDB the divisor, remainder and document values are truncated towards zero, so 5.9 is matched as 5.
+func compileMod(value any, path string) (valueMatcherT, error) {
+	entries, isSliceLike := sliceLikeToSlice(value)
+	if !isSliceLike || !isArray(value) {
+		return nil, newFilterError(path, ErrBadValue, "malformed mod, needs to be an array")
+	}
+	switch {
+	case len(entries) < 2:
+		return nil, newFilterError(path, ErrBadValue, "malformed mod, not enough elements")
+	case len(entries) > 2:
+		return nil, newFilterError(path, ErrBadValue, "malformed mod, too many elements")
+	}
+
+	operands := [2]int64{}
+	for idx, name := range []string{"divisor", "remainder"} {
+		if canonicalTypeOrder(entries[idx]) != typeOrderNumber {
+			return nil, newFilterError(path, ErrBadValue, "malformed mod, %s not a number", name)
+		}
+		operand, ok := truncateNumber(entries[idx])
+		if !ok {
+			return nil, newFilterError(path, ErrBadValue, "malformed mod, %s value is invalid", name)
+		}
+		operands[idx] = operand
+	}
+	divisor, remainder := operands[0], operands[1]
+	if divisor == 0 {
+		return nil, newFilterError(path, ErrBadValue, "divisor cannot be 0")
+	}
+
+	matchesValue := func(value any) bool {
+		if canonicalTypeOrder(value) != typeOrderNumber {
+			return false
+		}
+		number, ok := truncateNumber(value)
+		// Go's % truncates like MongoDB's, so -5 % 3 == -2
+		return ok && number%divisor == remainder
+	}
+
+	return func(value any) bool {
+		if isArray(value) {
+			entries, _ := sliceLikeToSlice(value)
+			for _, entry := range entries {
+				if matchesValue(entry) {
+					return true
+				}
+			}
+			return false
+		}
+		return matchesValue(value)
+	}, nil
+}
+
+// compileIn compiles the value of an $in or $nin operator
+func compileIn(value any, path string, operator string) (valueMatcherT, error) {
+	entries, isSliceLike := sliceLikeToSlice(value)
+	if !isSliceLike || !isArray(value) {
+		return nil, newFilterError(path, ErrBadValue, "$%s needs an array", operator)
+	}
+
+	matchers := make([]valueMatcherT, len(entries))
+	for idx, entry := range entries {
+		entryDocument, ok := toFilterDocument(entry)
+		if ok && isOperatorObject(entryDocument) {
+			return nil, newFilterError(path, ErrBadValue, "cannot nest $ under $%s", operator)
+		}
+
+		matcher, err := compileEqualityOrRegex(entry, path)
+		if err != nil {
+			return nil, err
+		}
+		matchers[idx] = matcher
+	}
+
+	return func(value any) bool {
+		for _, matcher := range matchers {
+			if matcher(value) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileEqualityOrRegex compiles a value of an implicit equality, $in, $nin or $all
+// Within these a regex like /^foo/ matches strings by pattern instead of only equal regexes.
+func compileEqualityOrRegex(filter any, path string) (valueMatcherT, error) {
+	if regex, ok := unwrapComparable(filter).(primitive.Regex); ok {
+		return compileRegex(regex, path)
+	}
+	return compileEquality(filter, path)
+}
+
+// compileEquality compiles a filter value that should equal the document value
+// Embedded documents like {address: {city: "A", zip: "1"}} only match if the document is exactly equal, see valuesEqual
+func compileEquality(filter any, path string) (valueMatcherT, error) {
+	filterDocument, isDocument := toFilterDocument(filter)
+	if isDocument {
+		err := checkLiteralDocument(filterDocument, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Unwrapped once up front, values that encode themselves are marshaled to find the value they compare as
+	filter = unwrapComparable(filter)
+	equals := func(value any) bool {
+		return valuesEqual(value, filter)
+	}
+
+	return func(value any) bool {
+		value = unwrapComparable(value)
+		if isArray(value) {
+			// Trying to match
+			// Document: { age: [1, 2, 3] }
+			// Query: { age: 2 }
+			// Note that only one level of arrays is resolved, { age: [[2]] } does not match the query above
+			entries, _ := sliceLikeToSlice(value)
+			for _, entry := range entries {
+				if equals(entry) {
+					return true
+				}
+			}
+		}
+
+		return equals(value)
+	}, nil
+}
+
+// checkLiteralDocument makes sure a document matched by equality does not contain operators like {foo: {bar: {$gt: 1}}}
+// Those are most likely mistakes as nested operators are not applied to embedded documents
+func checkLiteralDocument(document bson.D, path string) error {
+	for _, entry := range document {
+		entryPath := joinPath(path, entry.Key)
+		if strings.HasPrefix(entry.Key, "$") {
+			return newFilterError(entryPath, ErrUnknownOperator, "unknown operator: %s", entry.Key)
+		}
+
+		if canonicalTypeOrder(entry.Value) != typeOrderObject {
+			continue
+		}
+		nestedDocument, _ := toFilterDocument(entry.Value)
+		err := checkLiteralDocument(nestedDocument, entryPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseExists parses the value of the $exists operator
+// Like MongoDB numbers are also accepted, where 0 means false
+func parseExists(value any, path string) (bool, error) {
+	switch canonicalTypeOrder(value) {
+	case typeOrderBool:
+		return unwrapComparable(value).(bool), nil
+	case typeOrderNumber:
+		return compareNumbers(value, 0) != 0, nil
+	default:
+		return false, newFilterError(path, ErrBadValue, "$exists needs a boolean")
+	}
+}
+
+func anyValueMatches(matcher valueMatcherT) valuesMatcherT {
+	return func(values []any) bool {
+		for _, value := range values {
+			if matcher(value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func noValueMatches(matcher valueMatcherT) valuesMatcherT {
+	return func(values []any) bool {
+		for _, value := range values {
+			if matcher(value) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// hasNearOperator returns true if an operator object contains $near or $nearSphere
+func hasNearOperator(filter bson.D) bool {
+	return hasOperator(filter, "$near") || hasOperator(filter, "$nearSphere")
+}
+
+// hasOperator returns true if the operator object contains the operator
+func hasOperator(filter bson.D, operator string) bool {
+	for _, entry := range filter {
+		if entry.Key == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// isOperatorObject returns true if all keys of the filter are operators like {$gt: 1, $lt: 5}
+func isOperatorObject(filter bson.D) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	for _, entry := range filter {
+		if !strings.HasPrefix(entry.Key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// toFilterDocument converts document like values within a filter to a bson.D
+// bson.D and bson.Raw values keep their order, the keys of maps are sorted to keep the result stable
+func toFilterDocument(value any) (bson.D, bool) {
+	switch typedValue := value.(type) {
+	case bson.D:
+		return typedValue, true
+	case bson.M:
+		return documentToD(typedValue), true
+	case bson.Raw:
+		document := bson.D{}
+		err := bson.Unmarshal(typedValue, &document)
+		return document, err == nil
+	}
+	if canonicalTypeOrder(value) != typeOrderObject {
+		return nil, false
+	}
+	return documentToD(value), true
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,46 @@
+package match
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownOperator is returned if a filter contains an operator that does not exist
+	ErrUnknownOperator = errors.New("unknown operator")
+	// ErrBadValue is returned if the value of an operator is invalid, like {$in: "foo"}
+	// MongoDB returns the BadValue error code for these filters
+	ErrBadValue = errors.New("bad value")
+	// ErrNotSupported is returned for valid MongoDB operators that are not supported by mongomock
+	ErrNotSupported = errors.New("operator not supported")
+)
+
+// FilterError describes why a filter is invalid
+// It wraps one of ErrUnknownOperator, ErrBadValue or ErrNotSupported
+type FilterError struct {
+	// Path is the path of the offending clause within the filter, like "tags.$in"
+	Path string
+	// Message is the error message MongoDB would have returned
+	Message string
+	// Err is the kind of error
+	Err error
+}
+
+func (e *FilterError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (at %s)", e.Message, e.Path)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+func newFilterError(path string, err error, format string, args ...any) *FilterError {
+	return &FilterError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+		Err:     err,
+	}
+}
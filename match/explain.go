@@ -0,0 +1,272 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Explanation describes why a document did or did not match a filter
+type Explanation struct {
+	// Matched is true if the document matched the filter
+	Matched bool
+	// Clauses contains the explanation of every clause within the filter
+	Clauses []ClauseExplanation
+}
+
+// ClauseExplanation describes the result of a single clause of a filter like {status: "published"} or {age: {$gt: 5}}
+type ClauseExplanation struct {
+	// Path is the key the clause applies to like "items.sku", empty for top level operators like $or
+	Path string
+	// Operator is the operator of the clause like "$eq", "$gt" or "$or"
+	Operator string
+	// Expected is the value of the operator
+	// For $near, $nearSphere and $regex this is the operator object including $minDistance, $maxDistance and $options.
+	Expected any
+	// Exists is true if the key exists in the document
+	Exists bool
+	// Values contains the values found at the path, a path can resolve to multiple values if it walks through arrays
+	Values []any
+	// Matched is true if the clause matched the document
+	Matched bool
+	// Entries contains the explanations of the filters of top level operators like $and, $or and $nor
+	Entries []Explanation
+}
+
+// Explain matches a document against a filter and explains the result of every clause in the filter
+// This is useful in tests to find out why a document did not match a filter
+func Explain(document any, filter any, options ...CompileOption) (*Explanation, error) {
+	matcher, err := Compile(filter, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &Explanation{Matched: matcher.Match(document)}
+	if filter == nil {
+		return explanation, nil
+	}
+
+	filterDocument, _ := toFilterDocument(filter)
+	explanation.Clauses, err = explainFilter(document, filterDocument, newCompileOptions(options))
+	if err != nil {
+		return nil, err
+	}
+	return explanation, nil
+}
+
+// MatchedClauses returns the number of top level clauses that matched
+func (e *Explanation) MatchedClauses() int {
+	count := 0
+	for _, clause := range e.Clauses {
+		if clause.Matched {
+			count++
+		}
+	}
+	return count
+}
+
+func explainFilter(document any, filter bson.D, options *compileOptionsT) ([]ClauseExplanation, error) {
+	clauses := []ClauseExplanation{}
+	for _, entry := range filter {
+		key, value := entry.Key, entry.Value
+
+		if strings.HasPrefix(key, "$") {
+			clause, err := explainTopLevelOperator(document, key, value, options)
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, clause)
+			continue
+		}
+
+		values := lookupMapKey(document, key)
+		exists := false
+		foundValues := []any{}
+		for _, value := range values {
+			if value != missing {
+				exists = true
+				foundValues = append(foundValues, value)
+			}
+		}
+
+		operators := bson.D{{Key: "$eq", Value: value}}
+		filterDocument, ok := toFilterDocument(value)
+		if ok && isOperatorObject(filterDocument) {
+			operators = filterDocument
+		}
+
+		// $minDistance, $maxDistance and $options only have meaning together with $near, $nearSphere or $regex
+		nearOperators := bson.D{}
+		regexOperators := bson.D{}
+		for _, operator := range operators {
+			switch operator.Key {
+			case "$near", "$nearSphere", "$minDistance", "$maxDistance":
+				nearOperators = append(nearOperators, operator)
+			case "$regex", "$options":
+				regexOperators = append(regexOperators, operator)
+			}
+		}
+
+		for _, operator := range operators {
+			clauseOperators := bson.D{operator}
+			var expected any = operator.Value
+			switch operator.Key {
+			case "$minDistance", "$maxDistance", "$options":
+				// Explained as part of the $near, $nearSphere or $regex clause
+				continue
+			case "$near", "$nearSphere":
+				clauseOperators = nearOperators
+				expected = nearOperators
+			case "$regex":
+				clauseOperators = regexOperators
+				expected = regexOperators
+			}
+
+			matcher, err := compileOperatorObject(clauseOperators, key)
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, ClauseExplanation{
+				Path:     key,
+				Operator: operator.Key,
+				Expected: expected,
+				Exists:   exists,
+				Values:   foundValues,
+				Matched:  matcher(values),
+			})
+		}
+	}
+	return clauses, nil
+}
+
+func explainTopLevelOperator(document any, operator string, value any, options *compileOptionsT) (ClauseExplanation, error) {
+	matcher, err := compileTopLevelOperator(strings.TrimPrefix(operator, "$"), value, operator, options)
+	if err != nil {
+		return ClauseExplanation{}, err
+	}
+	clause := ClauseExplanation{
+		Operator: operator,
+		Expected: value,
+		Matched:  matcher(document),
+	}
+
+	entries, _ := sliceLikeToSlice(value)
+	for _, entry := range entries {
+		entryFilter, _ := toFilterDocument(entry)
+		entryMatcher, err := compileFilter(entryFilter, operator, options)
+		if err != nil {
+			return ClauseExplanation{}, err
+		}
+		entryClauses, err := explainFilter(document, entryFilter, options)
+		if err != nil {
+			return ClauseExplanation{}, err
+		}
+		clause.Entries = append(clause.Entries, Explanation{
+			Matched: entryMatcher(document),
+			Clauses: entryClauses,
+		})
+	}
+
+	return clause, nil
+}
+
+// String returns a human readable explanation
+//
+// Example:
+//
+//	document did not match the filter
+//	✗ field status was "draft", expected "published"
+//	✓ field age was 30, expected $gte 18
+func (e *Explanation) String() string {
+	builder := &strings.Builder{}
+	if e.Matched {
+		builder.WriteString("document matched the filter")
+	} else {
+		builder.WriteString("document did not match the filter")
+	}
+	writeClauses(builder, e.Clauses, 0)
+	return builder.String()
+}
+
+// String returns a human readable explanation of the clause
+// Like: field status was "draft", expected "published"
+func (c ClauseExplanation) String() string {
+	switch c.Operator {
+	case "$and", "$or", "$nor":
+		matchedEntries := 0
+		for _, entry := range c.Entries {
+			if entry.Matched {
+				matchedEntries++
+			}
+		}
+		return fmt.Sprintf("%s with %d of %d matching clauses", c.Operator, matchedEntries, len(c.Entries))
+	case "$text":
+		return "$text search " + formatValue(c.Expected)
+	case "$comment", "$sampleRate":
+		return c.Operator + " " + formatValue(c.Expected)
+	}
+
+	found := "missing"
+	if c.Exists {
+		foundValues := make([]string, len(c.Values))
+		for idx, value := range c.Values {
+			foundValues[idx] = formatValue(value)
+		}
+		found = strings.Join(foundValues, " and ")
+	}
+
+	expected := formatValue(c.Expected)
+	switch c.Operator {
+	case "$eq", "$near", "$nearSphere", "$regex":
+		// Equality has no operator and the others already show their full operator object
+	default:
+		expected = c.Operator + " " + expected
+	}
+
+	return fmt.Sprintf("field %s was %s, expected %s", c.Path, found, expected)
+}
+
+func writeClauses(builder *strings.Builder, clauses []ClauseExplanation, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, clause := range clauses {
+		builder.WriteString("\n" + indent)
+		if clause.Matched {
+			builder.WriteString("✓ ")
+		} else {
+			builder.WriteString("✗ ")
+		}
+		builder.WriteString(clause.String())
+
+		for idx, entry := range clause.Entries {
+			result := "did not match"
+			if entry.Matched {
+				result = "matched"
+			}
+			builder.WriteString(fmt.Sprintf("\n%s  clause %d %s", indent, idx+1, result))
+			writeClauses(builder, entry.Clauses, depth+2)
+		}
+	}
+}
+
+// formatValue formats a value found in a document or filter for an explanation
+func formatValue(value any) string {
+	value = unwrapComparable(value)
+	switch typedValue := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", typedValue)
+	}
+
+	switch canonicalTypeOrder(value) {
+	case typeOrderObject, typeOrderArray:
+		json, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+		if err == nil {
+			// Strip the {"v": ...} wrapper
+			return strings.TrimSuffix(strings.TrimPrefix(string(json), `{"v":`), "}")
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,892 @@
+package match
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// earthRadiusMeters is the radius of the earth MongoDB uses for spherical distances
+const earthRadiusMeters = 6378100.0
+
+// geoEpsilon is the tolerance used to decide if a point lies on a line or equals another point
+const geoEpsilon = 1e-12
+
+// geoPointT is a point with the longitude as x and latitude as y like GeoJSON and legacy coordinate pairs describe them
+type geoPointT struct {
+	x float64
+	y float64
+}
+
+// geometryT is a parsed GeoJSON geometry or legacy coordinate pair
+// Multi geometries and geometry collections are flattened into their points, lines and polygons
+type geometryT struct {
+	points []geoPointT
+	lines  [][]geoPointT
+	// polygons contains the rings of every polygon, the first ring is the exterior ring and the other rings are holes
+	polygons [][][]geoPointT
+}
+
+// vertices returns all points of the geometry
+func (g geometryT) vertices() []geoPointT {
+	vertices := append([]geoPointT{}, g.points...)
+	for _, line := range g.lines {
+		vertices = append(vertices, line...)
+	}
+	for _, polygon := range g.polygons {
+		for _, ring := range polygon {
+			vertices = append(vertices, ring...)
+		}
+	}
+	return vertices
+}
+
+// edges returns all line segments of the lines and polygon rings of the geometry
+func (g geometryT) edges() [][2]geoPointT {
+	edges := [][2]geoPointT{}
+	addEdges := func(line []geoPointT) {
+		for idx := 1; idx < len(line); idx++ {
+			edges = append(edges, [2]geoPointT{line[idx-1], line[idx]})
+		}
+	}
+	for _, line := range g.lines {
+		addEdges(line)
+	}
+	for _, polygon := range g.polygons {
+		for _, ring := range polygon {
+			addEdges(ring)
+		}
+	}
+	return edges
+}
+
+// parseGeoJSON parses a GeoJSON geometry like {type: "Point", coordinates: [5, 52]}
+// The errors are modeled after the errors mongod returns for invalid GeoJSON
+func parseGeoJSON(value any) (geometryT, error) {
+	document, ok := toFilterDocument(value)
+	if !ok {
+		return geometryT{}, errors.New("geometry must be an object")
+	}
+
+	var geometryType string
+	var coordinates any
+	var geometries any
+	for _, entry := range document {
+		switch entry.Key {
+		case "type":
+			geometryType, ok = unwrapComparable(entry.Value).(string)
+			if !ok {
+				return geometryT{}, errors.New("unknown GeoJSON type")
+			}
+		case "coordinates":
+			coordinates = entry.Value
+		case "geometries":
+			geometries = entry.Value
+		}
+	}
+
+	geometry := geometryT{}
+	if geometryType == "GeometryCollection" {
+		entries, ok := sliceLikeToSlice(geometries)
+		if !ok || !isArray(geometries) {
+			return geometryT{}, errors.New("GeometryCollection geometries must be an array")
+		}
+		for _, entry := range entries {
+			nested, err := parseGeoJSON(entry)
+			if err != nil {
+				return geometryT{}, err
+			}
+			geometry.points = append(geometry.points, nested.points...)
+			geometry.lines = append(geometry.lines, nested.lines...)
+			geometry.polygons = append(geometry.polygons, nested.polygons...)
+		}
+		return geometry, nil
+	}
+
+	if !isArray(coordinates) {
+		if geometryType == "" {
+			return geometryT{}, errors.New("unknown GeoJSON type")
+		}
+		return geometryT{}, fmt.Errorf("%s must have a coordinates array", geometryType)
+	}
+
+	switch geometryType {
+	case "Point":
+		point, err := parseGeoJSONPoint(coordinates)
+		if err != nil {
+			return geometryT{}, err
+		}
+		geometry.points = []geoPointT{point}
+	case "MultiPoint":
+		points, err := parseGeoJSONPoints(coordinates, 1)
+		if err != nil {
+			return geometryT{}, err
+		}
+		geometry.points = points
+	case "LineString":
+		line, err := parseGeoJSONLine(coordinates)
+		if err != nil {
+			return geometryT{}, err
+		}
+		geometry.lines = [][]geoPointT{line}
+	case "MultiLineString":
+		entries, _ := sliceLikeToSlice(coordinates)
+		for _, entry := range entries {
+			line, err := parseGeoJSONLine(entry)
+			if err != nil {
+				return geometryT{}, err
+			}
+			geometry.lines = append(geometry.lines, line)
+		}
+	case "Polygon":
+		polygon, err := parseGeoJSONPolygon(coordinates)
+		if err != nil {
+			return geometryT{}, err
+		}
+		geometry.polygons = [][][]geoPointT{polygon}
+	case "MultiPolygon":
+		entries, _ := sliceLikeToSlice(coordinates)
+		for _, entry := range entries {
+			polygon, err := parseGeoJSONPolygon(entry)
+			if err != nil {
+				return geometryT{}, err
+			}
+			geometry.polygons = append(geometry.polygons, polygon)
+		}
+	default:
+		return geometryT{}, errors.New("unknown GeoJSON type")
+	}
+
+	return geometry, nil
+}
+
+func parseGeoJSONPoint(value any) (geoPointT, error) {
+	entries, ok := sliceLikeToSlice(value)
+	if !ok || !isArray(value) || len(entries) < 2 {
+		return geoPointT{}, errors.New("Point must be an array of at least two coordinates")
+	}
+
+	x, xOk := floatValue(entries[0])
+	y, yOk := floatValue(entries[1])
+	if !xOk || !yOk {
+		return geoPointT{}, errors.New("Point must only contain numeric elements")
+	}
+	if x < -180 || x > 180 || y < -90 || y > 90 {
+		return geoPointT{}, fmt.Errorf("longitude/latitude is out of bounds, lng: %v lat: %v", x, y)
+	}
+	return geoPointT{x: x, y: y}, nil
+}
+
+func parseGeoJSONPoints(value any, minimum int) ([]geoPointT, error) {
+	entries, ok := sliceLikeToSlice(value)
+	if !ok || !isArray(value) || len(entries) < minimum {
+		return nil, errors.New("coordinates must be an array of points")
+	}
+
+	points := make([]geoPointT, len(entries))
+	for idx, entry := range entries {
+		point, err := parseGeoJSONPoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		points[idx] = point
+	}
+	return points, nil
+}
+
+func parseGeoJSONLine(value any) ([]geoPointT, error) {
+	points, err := parseGeoJSONPoints(value, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) < 2 {
+		return nil, errors.New("GeoJSON LineString must have at least 2 vertices")
+	}
+	return points, nil
+}
+
+func parseGeoJSONPolygon(value any) ([][]geoPointT, error) {
+	entries, ok := sliceLikeToSlice(value)
+	if !ok || !isArray(value) || len(entries) == 0 {
+		return nil, errors.New("Polygon coordinates must be an array of loops")
+	}
+
+	rings := make([][]geoPointT, len(entries))
+	for idx, entry := range entries {
+		ring, err := parseGeoJSONPoints(entry, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(ring) < 4 {
+			return nil, errors.New("Loop must have at least 4 vertices")
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return nil, errors.New("Loop is not closed, first vertex does not equal last vertex")
+		}
+
+		distinct := map[geoPointT]struct{}{}
+		for _, point := range ring {
+			distinct[point] = struct{}{}
+		}
+		if len(distinct) < 3 {
+			return nil, errors.New("Loop must have at least 3 different vertices")
+		}
+		rings[idx] = ring
+	}
+	return rings, nil
+}
+
+// parseLegacyPoint parses a legacy coordinate pair like [5, 52] or {lng: 5, lat: 52}
+func parseLegacyPoint(value any) (geoPointT, bool) {
+	var coordinates []any
+	switch canonicalTypeOrder(value) {
+	case typeOrderArray:
+		coordinates, _ = sliceLikeToSlice(value)
+	case typeOrderObject:
+		for _, entry := range documentToD(value) {
+			coordinates = append(coordinates, entry.Value)
+		}
+	default:
+		return geoPointT{}, false
+	}
+
+	if len(coordinates) < 2 {
+		return geoPointT{}, false
+	}
+	x, xOk := floatValue(coordinates[0])
+	y, yOk := floatValue(coordinates[1])
+	return geoPointT{x: x, y: y}, xOk && yOk
+}
+
+// documentGeometries returns the geometries stored within a document value
+// A value can be a GeoJSON object, a legacy coordinate pair or an array of these
+func documentGeometries(value any) []geometryT {
+	if document, ok := toFilterDocument(value); ok && len(document) > 0 {
+		if _, hasType := documentField(document, "type"); hasType {
+			geometry, err := parseGeoJSON(document)
+			if err != nil {
+				return nil
+			}
+			return []geometryT{geometry}
+		}
+	}
+
+	point, ok := parseLegacyPoint(value)
+	if ok {
+		return []geometryT{{points: []geoPointT{point}}}
+	}
+
+	if !isArray(value) {
+		return nil
+	}
+	geometries := []geometryT{}
+	entries, _ := sliceLikeToSlice(value)
+	for _, entry := range entries {
+		if isArray(entry) || canonicalTypeOrder(entry) == typeOrderObject {
+			geometries = append(geometries, documentGeometries(entry)...)
+		}
+	}
+	return geometries
+}
+
+// geoVectorT is a point on the unit sphere
+type geoVectorT [3]float64
+
+func toGeoVector(point geoPointT) geoVectorT {
+	lng := point.x * math.Pi / 180
+	lat := point.y * math.Pi / 180
+	return geoVectorT{math.Cos(lat) * math.Cos(lng), math.Cos(lat) * math.Sin(lng), math.Sin(lat)}
+}
+
+func (a geoVectorT) dot(b geoVectorT) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func (a geoVectorT) cross(b geoVectorT) geoVectorT {
+	return geoVectorT{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a geoVectorT) normalize() geoVectorT {
+	length := math.Sqrt(a.dot(a))
+	if length == 0 {
+		return a
+	}
+	return geoVectorT{a[0] / length, a[1] / length, a[2] / length}
+}
+
+// sphericalDistance returns the distance between two points on the unit sphere in radians
+func sphericalDistance(a, b geoPointT) float64 {
+	lat1 := a.y * math.Pi / 180
+	lat2 := b.y * math.Pi / 180
+	deltaLat := lat2 - lat1
+	deltaLng := (b.x - a.x) * math.Pi / 180
+
+	h := math.Pow(math.Sin(deltaLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(deltaLng/2), 2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func planarDistance(a, b geoPointT) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// sphericalRingContains returns true if the point is within a ring where the edges are great circle arcs
+// The winding number is calculated using the angles between the vertices as seen from the point
+func sphericalRingContains(ring []geoPointT, point geoPointT) bool {
+	p := toGeoVector(point)
+	total := 0.0
+	for idx := 1; idx < len(ring); idx++ {
+		a := toGeoVector(ring[idx-1])
+		b := toGeoVector(ring[idx])
+		if sphericalPointOnArc(p, a, b) {
+			return true
+		}
+
+		// Project the vertices on the tangent plane of the point
+		tangentA := geoVectorT{a[0] - a.dot(p)*p[0], a[1] - a.dot(p)*p[1], a[2] - a.dot(p)*p[2]}
+		tangentB := geoVectorT{b[0] - b.dot(p)*p[0], b[1] - b.dot(p)*p[1], b[2] - b.dot(p)*p[2]}
+		total += math.Atan2(p.dot(tangentA.cross(tangentB)), tangentA.dot(tangentB))
+	}
+	return math.Abs(total) > math.Pi
+}
+
+// sphericalPointOnArc returns true if p lies on the shortest great circle arc between a and b
+func sphericalPointOnArc(p, a, b geoVectorT) bool {
+	normal := a.cross(b)
+	if math.Abs(normal.normalize().dot(p)) > 1e-9 {
+		return false
+	}
+	return a.cross(p).dot(normal) >= -geoEpsilon && p.cross(b).dot(normal) >= -geoEpsilon
+}
+
+// sphericalArcsIntersect returns true if the great circle arcs a-b and c-d cross or touch
+func sphericalArcsIntersect(a, b, c, d geoPointT) bool {
+	va, vb, vc, vd := toGeoVector(a), toGeoVector(b), toGeoVector(c), toGeoVector(d)
+	if sphericalPointOnArc(va, vc, vd) || sphericalPointOnArc(vb, vc, vd) ||
+		sphericalPointOnArc(vc, va, vb) || sphericalPointOnArc(vd, va, vb) {
+		return true
+	}
+
+	candidate := va.cross(vb).cross(vc.cross(vd)).normalize()
+	antipode := geoVectorT{-candidate[0], -candidate[1], -candidate[2]}
+	for _, point := range []geoVectorT{candidate, antipode} {
+		if sphericalPointOnArc(point, va, vb) && sphericalPointOnArc(point, vc, vd) {
+			return true
+		}
+	}
+	return false
+}
+
+// sphericalPolygonContains returns true if the point is within the exterior ring and not within a hole
+func sphericalPolygonContains(polygon [][]geoPointT, point geoPointT) bool {
+	if !sphericalRingContains(polygon[0], point) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if sphericalRingContains(hole, point) && !sphericalPointOnRing(hole, point) {
+			return false
+		}
+	}
+	return true
+}
+
+func sphericalPointOnRing(ring []geoPointT, point geoPointT) bool {
+	p := toGeoVector(point)
+	for idx := 1; idx < len(ring); idx++ {
+		if sphericalPointOnArc(p, toGeoVector(ring[idx-1]), toGeoVector(ring[idx])) {
+			return true
+		}
+	}
+	return false
+}
+
+// sphericalContains returns true if the point lies on or within the geometry
+func (g geometryT) sphericalContains(point geoPointT) bool {
+	for _, geometryPoint := range g.points {
+		if sphericalDistance(geometryPoint, point) < 1e-9 {
+			return true
+		}
+	}
+	p := toGeoVector(point)
+	for _, line := range g.lines {
+		for idx := 1; idx < len(line); idx++ {
+			if sphericalPointOnArc(p, toGeoVector(line[idx-1]), toGeoVector(line[idx])) {
+				return true
+			}
+		}
+	}
+	for _, polygon := range g.polygons {
+		if sphericalPolygonContains(polygon, point) {
+			return true
+		}
+	}
+	return false
+}
+
+// sphericalIntersects returns true if two geometries share at least one point
+func (g geometryT) sphericalIntersects(other geometryT) bool {
+	for _, vertex := range g.vertices() {
+		if other.sphericalContains(vertex) {
+			return true
+		}
+	}
+	for _, vertex := range other.vertices() {
+		if g.sphericalContains(vertex) {
+			return true
+		}
+	}
+	for _, edge := range g.edges() {
+		for _, otherEdge := range other.edges() {
+			if sphericalArcsIntersect(edge[0], edge[1], otherEdge[0], otherEdge[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// planarPolygonContains returns true if the point lies within or on the edge of a polygon using the even odd rule
+func planarPolygonContains(polygon []geoPointT, point geoPointT) bool {
+	inside := false
+	for idx := range polygon {
+		a := polygon[idx]
+		b := polygon[(idx+1)%len(polygon)]
+
+		// Points on the edges are within the polygon
+		cross := (b.x-a.x)*(point.y-a.y) - (b.y-a.y)*(point.x-a.x)
+		if math.Abs(cross) < geoEpsilon &&
+			point.x >= math.Min(a.x, b.x) && point.x <= math.Max(a.x, b.x) &&
+			point.y >= math.Min(a.y, b.y) && point.y <= math.Max(a.y, b.y) {
+			return true
+		}
+
+		if (a.y > point.y) != (b.y > point.y) && point.x < (b.x-a.x)*(point.y-a.y)/(b.y-a.y)+a.x {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geoWithinShapeT is the shape of a $geoWithin operator
+type geoWithinShapeT struct {
+	// contains returns true if a point is within the shape
+	contains func(point geoPointT) bool
+	// boundary are the edges of polygon shapes, these can be concave so an edge between two contained points can still leave them
+	boundary [][2]geoPointT
+	// holes are the vertices of the holes of polygon shapes
+	holes     []geoPointT
+	spherical bool
+}
+
+// geometryWithin returns true if all vertices and edges of a geometry are within the shape
+func (s geoWithinShapeT) geometryWithin(geometry geometryT) bool {
+	vertices := geometry.vertices()
+	if len(vertices) == 0 {
+		return false
+	}
+	for _, vertex := range vertices {
+		if !s.contains(vertex) {
+			return false
+		}
+	}
+	for _, edge := range geometry.edges() {
+		if !s.edgeWithin(edge[0], edge[1]) {
+			return false
+		}
+	}
+	// A polygon around a hole of the shape has all its edges within the shape
+	for _, polygon := range geometry.polygons {
+		for _, hole := range s.holes {
+			if sphericalPolygonContains(polygon, hole) && !sphericalPointOnRing(polygon[0], hole) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// edgeWithin returns true if the edge a-b between two contained points stays within the shape
+// The edge is split where it meets the boundary of the shape, every part has to be within the shape.
+func (s geoWithinShapeT) edgeWithin(a, b geoPointT) bool {
+	if len(s.boundary) == 0 {
+		return true
+	}
+
+	positions := []float64{0, 1}
+	for _, edge := range s.boundary {
+		if s.spherical {
+			positions = append(positions, sphericalArcPositions(a, b, edge[0], edge[1])...)
+		} else {
+			positions = append(positions, planarSegmentPositions(a, b, edge[0], edge[1])...)
+		}
+	}
+	sort.Float64s(positions)
+
+	for idx := 1; idx < len(positions); idx++ {
+		if positions[idx]-positions[idx-1] < geoEpsilon {
+			continue
+		}
+		position := (positions[idx-1] + positions[idx]) / 2
+		var middle geoPointT
+		if s.spherical {
+			middle = sphericalInterpolate(a, b, position)
+		} else {
+			middle = geoPointT{x: a.x + (b.x-a.x)*position, y: a.y + (b.y-a.y)*position}
+		}
+		if !s.contains(middle) {
+			return false
+		}
+	}
+	return true
+}
+
+// planarSegmentPositions returns the positions between 0 and 1 on segment a-b where it meets segment c-d
+func planarSegmentPositions(a, b, c, d geoPointT) []float64 {
+	rx, ry := b.x-a.x, b.y-a.y
+	sx, sy := d.x-c.x, d.y-c.y
+	qx, qy := c.x-a.x, c.y-a.y
+	denominator := rx*sy - ry*sx
+
+	if math.Abs(denominator) < geoEpsilon {
+		// Parallel segments only meet if they are on the same line, then the ends of c-d split a-b
+		length := rx*rx + ry*ry
+		if math.Abs(qx*ry-qy*rx) > geoEpsilon || length == 0 {
+			return nil
+		}
+		positions := []float64{}
+		for _, point := range []geoPointT{c, d} {
+			position := ((point.x-a.x)*rx + (point.y-a.y)*ry) / length
+			if position > 0 && position < 1 {
+				positions = append(positions, position)
+			}
+		}
+		return positions
+	}
+
+	position := (qx*sy - qy*sx) / denominator
+	otherPosition := (qx*ry - qy*rx) / denominator
+	if position < 0 || position > 1 || otherPosition < -geoEpsilon || otherPosition > 1+geoEpsilon {
+		return nil
+	}
+	return []float64{position}
+}
+
+// sphericalArcPositions returns the positions between 0 and 1 on great circle arc a-b where it meets arc c-d
+func sphericalArcPositions(a, b, c, d geoPointT) []float64 {
+	va, vb, vc, vd := toGeoVector(a), toGeoVector(b), toGeoVector(c), toGeoVector(d)
+	length := sphericalAngle(va, vb)
+	if length == 0 {
+		return nil
+	}
+
+	points := []geoVectorT{}
+	for _, point := range []geoVectorT{vc, vd} {
+		if sphericalPointOnArc(point, va, vb) {
+			points = append(points, point)
+		}
+	}
+	candidate := va.cross(vb).cross(vc.cross(vd)).normalize()
+	for _, point := range []geoVectorT{candidate, {-candidate[0], -candidate[1], -candidate[2]}} {
+		if sphericalPointOnArc(point, va, vb) && sphericalPointOnArc(point, vc, vd) {
+			points = append(points, point)
+		}
+	}
+
+	positions := make([]float64, len(points))
+	for idx, point := range points {
+		positions[idx] = sphericalAngle(va, point) / length
+	}
+	return positions
+}
+
+// sphericalAngle returns the angle in radians between two points on the unit sphere
+func sphericalAngle(a, b geoVectorT) float64 {
+	cross := a.cross(b)
+	return math.Atan2(math.Sqrt(cross.dot(cross)), a.dot(b))
+}
+
+// sphericalInterpolate returns the point at a position between 0 and 1 on the great circle arc a-b
+func sphericalInterpolate(a, b geoPointT, position float64) geoPointT {
+	va, vb := toGeoVector(a), toGeoVector(b)
+	angle := sphericalAngle(va, vb)
+	if angle == 0 {
+		return a
+	}
+	weightA := math.Sin((1-position)*angle) / math.Sin(angle)
+	weightB := math.Sin(position*angle) / math.Sin(angle)
+	v := geoVectorT{
+		weightA*va[0] + weightB*vb[0],
+		weightA*va[1] + weightB*vb[1],
+		weightA*va[2] + weightB*vb[2],
+	}.normalize()
+	return geoPointT{
+		x: math.Atan2(v[1], v[0]) * 180 / math.Pi,
+		y: math.Asin(v[2]) * 180 / math.Pi,
+	}
+}
+
+// compileGeoWithin compiles the shape of a $geoWithin operator like {$geometry: {...}}, {$box: [...]} or {$centerSphere: [...]}
+func compileGeoWithin(value any, path string) (valueMatcherT, error) {
+	document, ok := toFilterDocument(value)
+	if !ok || len(document) != 1 {
+		return nil, newFilterError(path, ErrBadValue, "$geoWithin needs an object with exactly one shape")
+	}
+
+	shape, err := parseGeoWithinShape(document[0].Key, document[0].Value, joinPath(path, document[0].Key))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(value any) bool {
+		for _, geometry := range documentGeometries(value) {
+			if shape.geometryWithin(geometry) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func parseGeoWithinShape(shape string, value any, path string) (geoWithinShapeT, error) {
+	switch shape {
+	case "$geometry":
+		geometry, err := parseGeoJSON(value)
+		if err != nil {
+			return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "%s", err.Error())
+		}
+		if len(geometry.polygons) == 0 || len(geometry.points) > 0 || len(geometry.lines) > 0 {
+			return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "$geoWithin not supported with provided geometry, only Polygon and MultiPolygon are supported")
+		}
+		shape := geoWithinShapeT{spherical: true, boundary: geometry.edges()}
+		for _, polygon := range geometry.polygons {
+			for _, hole := range polygon[1:] {
+				shape.holes = append(shape.holes, hole...)
+			}
+		}
+		shape.contains = func(point geoPointT) bool {
+			for _, polygon := range geometry.polygons {
+				if sphericalPolygonContains(polygon, point) {
+					return true
+				}
+			}
+			return false
+		}
+		return shape, nil
+	case "$box":
+		points, err := parseLegacyPoints(value, path, 2, 2)
+		if err != nil {
+			return geoWithinShapeT{}, err
+		}
+		minX, maxX := math.Min(points[0].x, points[1].x), math.Max(points[0].x, points[1].x)
+		minY, maxY := math.Min(points[0].y, points[1].y), math.Max(points[0].y, points[1].y)
+		return geoWithinShapeT{contains: func(point geoPointT) bool {
+			return point.x >= minX && point.x <= maxX && point.y >= minY && point.y <= maxY
+		}}, nil
+	case "$polygon":
+		points, err := parseLegacyPoints(value, path, 3, math.MaxInt)
+		if err != nil {
+			return geoWithinShapeT{}, err
+		}
+		shape := geoWithinShapeT{contains: func(point geoPointT) bool {
+			return planarPolygonContains(points, point)
+		}}
+		for idx := range points {
+			shape.boundary = append(shape.boundary, [2]geoPointT{points[idx], points[(idx+1)%len(points)]})
+		}
+		return shape, nil
+	case "$center", "$centerSphere":
+		entries, ok := sliceLikeToSlice(value)
+		if !ok || !isArray(value) || len(entries) != 2 {
+			return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "%s needs an array with a center point and a radius", shape)
+		}
+		center, ok := parseLegacyPoint(entries[0])
+		if !ok {
+			return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "Point must only contain numeric elements")
+		}
+		radius, ok := floatValue(entries[1])
+		if !ok || radius < 0 {
+			return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "radius must be a non-negative number")
+		}
+
+		if shape == "$center" {
+			return geoWithinShapeT{contains: func(point geoPointT) bool {
+				return planarDistance(center, point) <= radius
+			}}, nil
+		}
+		// The radius of $centerSphere is in radians
+		return geoWithinShapeT{contains: func(point geoPointT) bool {
+			return sphericalDistance(center, point) <= radius
+		}}, nil
+	default:
+		return geoWithinShapeT{}, newFilterError(path, ErrBadValue, "unknown geo specifier: %s", shape)
+	}
+}
+
+func parseLegacyPoints(value any, path string, minimum, maximum int) ([]geoPointT, error) {
+	entries, ok := sliceLikeToSlice(value)
+	if !ok || !isArray(value) || len(entries) < minimum || len(entries) > maximum {
+		return nil, newFilterError(path, ErrBadValue, "malformed shape, expected an array of points")
+	}
+
+	points := make([]geoPointT, len(entries))
+	for idx, entry := range entries {
+		point, ok := parseLegacyPoint(entry)
+		if !ok {
+			return nil, newFilterError(path, ErrBadValue, "Point must only contain numeric elements")
+		}
+		points[idx] = point
+	}
+	return points, nil
+}
+
+// compileGeoIntersects compiles a $geoIntersects operator like {$geometry: {type: "Polygon", coordinates: [...]}}
+func compileGeoIntersects(value any, path string) (valueMatcherT, error) {
+	document, ok := toFilterDocument(value)
+	if !ok || len(document) != 1 || document[0].Key != "$geometry" {
+		return nil, newFilterError(path, ErrBadValue, "$geoIntersects needs a $geometry")
+	}
+
+	geometry, err := parseGeoJSON(document[0].Value)
+	if err != nil {
+		return nil, newFilterError(joinPath(path, "$geometry"), ErrBadValue, "%s", err.Error())
+	}
+
+	return func(value any) bool {
+		for _, documentGeometry := range documentGeometries(value) {
+			if documentGeometry.sphericalIntersects(geometry) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// nearT is a parsed $near or $nearSphere operator
+type nearT struct {
+	point     geoPointT
+	spherical bool
+	// meters is true if the distances are in meters, this is the case for GeoJSON points
+	// Otherwise spherical distances are in radians and planar distances in the units of the coordinates
+	meters      bool
+	minDistance float64
+	maxDistance float64
+}
+
+// parseNear parses a $near or $nearSphere operator including the $minDistance and $maxDistance operators next to it
+// Like {$near: {$geometry: {type: "Point", coordinates: [5, 52]}, $maxDistance: 1000}} or {$near: [5, 52], $maxDistance: 0.1}
+func parseNear(operator string, filter bson.D, path string) (*nearT, error) {
+	near := &nearT{spherical: operator == "nearSphere", maxDistance: math.Inf(1)}
+	operatorPath := joinPath(path, "$"+operator)
+
+	var value any
+	distances := bson.D{}
+	for _, entry := range filter {
+		switch entry.Key {
+		case "$" + operator:
+			value = entry.Value
+		case "$minDistance", "$maxDistance":
+			distances = append(distances, entry)
+		}
+	}
+
+	nearDocument, isDocument := toFilterDocument(value)
+	if isDocument {
+		if _, hasGeometry := documentField(nearDocument, "$geometry"); hasGeometry {
+			for _, entry := range nearDocument {
+				switch entry.Key {
+				case "$geometry":
+					geometry, err := parseGeoJSON(entry.Value)
+					if err != nil {
+						return nil, newFilterError(joinPath(operatorPath, "$geometry"), ErrBadValue, "%s", err.Error())
+					}
+					if len(geometry.points) != 1 || len(geometry.lines) > 0 || len(geometry.polygons) > 0 {
+						return nil, newFilterError(operatorPath, ErrBadValue, "invalid point in geo near query $geometry argument")
+					}
+					near.point = geometry.points[0]
+				case "$minDistance", "$maxDistance":
+					distances = append(distances, entry)
+				default:
+					return nil, newFilterError(joinPath(operatorPath, entry.Key), ErrBadValue, "invalid argument in geo near query: %s", entry.Key)
+				}
+			}
+			near.spherical = true
+			near.meters = true
+			return near, near.parseDistances(distances, path)
+		}
+	}
+
+	point, ok := parseLegacyPoint(value)
+	if !ok {
+		return nil, newFilterError(operatorPath, ErrBadValue, "$%s needs a point", operator)
+	}
+	near.point = point
+	return near, near.parseDistances(distances, path)
+}
+
+func (n *nearT) parseDistances(distances bson.D, path string) error {
+	for _, entry := range distances {
+		distance, ok := floatValue(entry.Value)
+		if !ok {
+			return newFilterError(joinPath(path, entry.Key), ErrBadValue, "%s must be a number", entry.Key)
+		}
+		if distance < 0 {
+			return newFilterError(joinPath(path, entry.Key), ErrBadValue, "%s must be non-negative", entry.Key)
+		}
+		if entry.Key == "$minDistance" {
+			n.minDistance = distance
+		} else {
+			n.maxDistance = distance
+		}
+	}
+	return nil
+}
+
+// distance returns the distance from the near point to the closest geometry within a document value
+func (n *nearT) distance(value any) (float64, bool) {
+	found := false
+	closest := math.Inf(1)
+	for _, geometry := range documentGeometries(value) {
+		if n.spherical && len(geometry.polygons) > 0 && geometry.sphericalContains(n.point) {
+			return 0, true
+		}
+		for _, vertex := range geometry.vertices() {
+			var distance float64
+			if n.spherical {
+				distance = sphericalDistance(n.point, vertex)
+				if n.meters {
+					distance *= earthRadiusMeters
+				}
+			} else {
+				distance = planarDistance(n.point, vertex)
+			}
+
+			if distance < closest {
+				closest = distance
+				found = true
+			}
+		}
+	}
+	return closest, found
+}
+
+// matches returns true if the value is within the min and max distance
+func (n *nearT) matches(value any) bool {
+	distance, ok := n.distance(value)
+	return ok && distance >= n.minDistance && distance <= n.maxDistance
+}
+
+// documentDistance returns the distance of the closest value of the key within the document
+func (n *nearT) documentDistance(document any, key string) (float64, bool) {
+	found := false
+	closest := math.Inf(1)
+	for _, value := range lookupMapKey(document, key) {
+		distance, ok := n.distance(value)
+		if ok && distance < closest {
+			closest = distance
+			found = true
+		}
+	}
+	return closest, found
+}
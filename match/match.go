@@ -1,339 +1,244 @@
 package match
 
 import (
-	"fmt"
-	"reflect"
-	"strings"
+	"math/big"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Match matches a document against a filter
 // returns true if it matches
-func Match(document bson.M, filter bson.M) bool {
-	if filter == nil {
-		return true
+//
+// Match panics if the filter is invalid, use Compile to validate a filter upfront.
+// If the same filter is matched against many documents also prefer Compile as it only parses the filter once.
+func Match(document any, filter any) bool {
+	matcher, err := Compile(filter)
+	if err != nil {
+		panic(err.Error())
 	}
 
-	return internalMatch(document, filter)
+	return matcher.Match(document)
 }
 
-func internalMatch(document any, filter bson.M) bool {
-	for filterKey, filterValue := range filter {
-		filterOperator, isOperator := strings.CutPrefix(filterKey, "$")
-		if isOperator {
-			if !valueMatchesOperator(document, filterOperator, filterValue) {
-				return false
-			}
-			continue
-		}
-
-		documentElement := lookupMapKey(reflect.ValueOf(document), filterKey)
-		var value any = nil
-		if documentElement != nil {
-			value = documentElement.Interface()
-		}
-
-		if !valueMatchesFilter(value, filterValue) {
-			return false
-		}
+// Any matches any Go value against a filter, like a struct, a pointer to a struct or a map
+// Structs are matched directly using the field names of their bson tags, without converting them to bson first.
+// Unlike Match this returns a *FilterError for invalid filters instead of panicking.
+func Any(value any, filter any) (bool, error) {
+	matcher, err := Compile(filter)
+	if err != nil {
+		return false, err
 	}
-	return true
+
+	return matcher.Match(value), nil
 }
 
-// valueMatchesFilter checks if the value matches the filter
-// This in the bases is just foo == bar
-// But mongodb supports lots of operators and this function also resolves them
-func valueMatchesFilter(value any, filter any) bool {
-	valueSlice, valueIsSliceLike := sliceLikeToSlice(value)
-	if valueIsSliceLike {
-		matched := sliceLikeValueMatchesSliceLikeFilter(valueSlice, filter)
-		if matched {
-			return true
-		}
-		// Coninue to check if there are other ways to match
-		// Like: Matching filter {$size: 3} against value [4, 2, 0]
+// FilterSlice returns the items matching the filter in their original order
+// This allows using MongoDB filters on in memory lists, see Any for how the items are matched.
+func FilterSlice[T any](items []T, filter any) ([]T, error) {
+	matcher, err := Compile(filter)
+	if err != nil {
+		return nil, err
 	}
 
-	switch typedFilter := filter.(type) {
-	case bson.M:
-		return internalMatch(value, typedFilter)
-	case nil:
-		return value == nil
-	case string:
-		typedValue, ok := value.(string)
-		if !ok {
-			return false
-		}
-		return typedValue == typedFilter
-	case bool:
-		typedValue, ok := value.(bool)
-		if !ok {
-			return false
-		}
-		return typedValue == typedFilter
-	case int, int8, int16, int32, int64,
-		uint, uint8, uint16, uint32, uint64,
-		float32, float64:
-		return numberValueMatchesFilter(value, filter, eqComparator)
-	default:
-		_, filterIsSliceLike := sliceLikeToSlice(filter)
-		if filterIsSliceLike {
-			return false
+	results := []T{}
+	for _, item := range items {
+		if matcher.Match(item) {
+			results = append(results, item)
 		}
+	}
+	return results, nil
+}
 
-		filterReflection, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(filter))
-		switch filterReflection.Kind() {
-		case reflect.Struct, reflect.Map:
-			filter = mustConvertToBson(filter)
-			if isNil {
-				return valueMatchesFilter(nil, filter)
-			}
-			return valueMatchesFilter(value, filter)
-		case reflect.Slice, reflect.Array:
-			return false
-		}
+// Matcher is a compiled filter that can be matched against documents
+type Matcher struct {
+	match documentMatcherT
+	// near is set if the filter contains $near or $nearSphere on the nearKey field
+	near    *nearT
+	nearKey string
+	// comment is the value of the top level $comment operator
+	comment any
+}
 
-		panic("unknown filter type, only bson.M for objects is supported. All basic types should be supported")
+// Compile validates a filter and compiles it into a matcher
+// Unlike Match this returns a *FilterError for invalid filters instead of panicking
+//
+// The filter can be any document like value, so bson.D, bson.M, bson.Raw, maps with string keys and structs.
+// The same goes for nested filters like {$and: [...]} and {foo: {$gt: 5}}.
+// Options like WithRandom change how the filter is compiled.
+func Compile(filter any, options ...CompileOption) (*Matcher, error) {
+	if filter == nil {
+		return &Matcher{}, nil
 	}
-}
 
-func sliceLikeValueMatchesSliceLikeFilter(valueSlice []any, filter any) bool {
-	filterSlice, filterIsSliceLike := sliceLikeToSlice(filter)
-	if !filterIsSliceLike {
-		// Trying to match
-		// Document: { age: [1, 2, 3] }
-		// Query: { age: 2 }
-		for _, value := range valueSlice {
-			if valueMatchesFilter(value, filter) {
-				return true
-			}
+	if raw, ok := filter.(bson.Raw); ok {
+		err := raw.Validate()
+		if err != nil {
+			return nil, newFilterError("", ErrBadValue, "filter is not a valid bson document: %s", err.Error())
 		}
 	}
 
-	if len(filterSlice) != len(valueSlice) {
-		return false
+	filterDocument, ok := toFilterDocument(filter)
+	if !ok {
+		return nil, newFilterError("", ErrBadValue, "filter must be a document")
 	}
 
-	for idx := 0; idx < len(filterSlice); idx++ {
-		filter := filterSlice[idx]
-		value := valueSlice[idx]
-		if !valueMatchesFilter(value, filter) {
-			return false
-		}
+	documentMatcher, err := compileFilter(filterDocument, "", newCompileOptions(options))
+	if err != nil {
+		return nil, err
 	}
 
-	return true
-}
-
-// valueMatchesOperator checks if the value matches the operator filter
-// Like:
-//
-//	Query: { age: { $gt: 5 } }
-//	Document: { age: 10 }
-//	Example: valueMatchesOperator(10, "$gt", 5)
-//
-//	Query: { age: { $in: [5, 10] } }
-//	Document: { age: 10 }
-//	Example: valueMatchesOperator(10, "$in", [5, 10])
-//
-//	Query: { $or: [ { age: 5 }, { age: 10 } ] }
-//	Document: { age: 10 }
-//	Example: valueMatchesOperator(10, "$or", [{age: 5}, {age: 10}])
-func valueMatchesOperator(value any, operator string, operatorFilter any) bool {
-	switch operator {
-	case "eq":
-		return valueMatchesFilter(value, operatorFilter)
-	case "ne", "not":
-		return !valueMatchesFilter(value, operatorFilter)
-	case "gt":
-		return numberValueMatchesFilter(value, operatorFilter, gtComparator)
-	case "gte":
-		return numberValueMatchesFilter(value, operatorFilter, gteComparator)
-	case "lt":
-		return numberValueMatchesFilter(value, operatorFilter, ltComparator)
-	case "lte":
-		return numberValueMatchesFilter(value, operatorFilter, lteComparator)
-	case "and":
-		typedOperatorFilter, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$and operator filter should be a slice")
+	matcher := &Matcher{match: documentMatcher}
+	for _, entry := range filterDocument {
+		if entry.Key == "$comment" {
+			matcher.comment = entry.Value
 		}
+	}
+	err = matcher.findNear(filterDocument, "")
+	if err != nil {
+		return nil, err
+	}
+	return matcher, nil
+}
 
-		for _, andFilter := range typedOperatorFilter {
-			if !valueMatchesFilter(value, andFilter) {
-				return false
+// findNear looks for the $near or $nearSphere operator within the top level fields and top level $and entries of a filter
+func (m *Matcher) findNear(filter bson.D, path string) error {
+	for _, entry := range filter {
+		if entry.Key == "$and" {
+			entries, _ := sliceLikeToSlice(entry.Value)
+			for _, andEntry := range entries {
+				andFilter, _ := toFilterDocument(andEntry)
+				err := m.findNear(andFilter, "$and")
+				if err != nil {
+					return err
+				}
 			}
+			continue
 		}
 
-		return true
-	case "nor":
-		typedOperatorFilter, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$and operator filter should be a slice")
-		}
-
-		for _, andFilter := range typedOperatorFilter {
-			if valueMatchesFilter(value, andFilter) {
-				return false
-			}
+		operators, ok := toFilterDocument(entry.Value)
+		if !ok || !isOperatorObject(operators) || !hasNearOperator(operators) {
+			continue
 		}
-
-		return true
-	case "or":
-		typedOperatorFilter, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$and operator filter should be a slice")
+		if m.near != nil {
+			return newFilterError(joinPath(path, entry.Key), ErrBadValue, "Too many geoNear expressions")
 		}
 
-		for _, andFilter := range typedOperatorFilter {
-			if valueMatchesFilter(value, andFilter) {
-				return true
+		for _, operator := range operators {
+			if operator.Key == "$near" || operator.Key == "$nearSphere" {
+				// The operator is already validated when compiling the filter
+				m.near, _ = parseNear(operator.Key[1:], operators, joinPath(path, entry.Key))
+				m.nearKey = entry.Key
 			}
 		}
+	}
+	return nil
+}
 
-		return false
-	case "in":
-		typedOperatorFilter, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$in operator filter should be a slice")
-		}
-
-		for _, inFilter := range typedOperatorFilter {
-			if valueMatchesFilter(value, inFilter) {
-				return false
-			}
-		}
+// HasNear returns true if the filter contains a $near or $nearSphere operator
+// MongoDB returns the results of these queries sorted by distance, use NearDistance to do the same.
+func (m *Matcher) HasNear() bool {
+	return m != nil && m.near != nil
+}
 
-		return true
-	case "nin":
-		typedOperatorFilter, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$in operator filter should be a slice")
-		}
+// NearDistance returns the distance between the document and the point of the $near or $nearSphere operator in the filter
+// For GeoJSON points the distance is in meters, for legacy coordinate pairs it's in radians for $nearSphere and in coordinate units for $near.
+// Returns false if the filter has no $near or $nearSphere operator or the document has no location.
+func (m *Matcher) NearDistance(document any) (float64, bool) {
+	if !m.HasNear() {
+		return 0, false
+	}
+	return m.near.documentDistance(document, m.nearKey)
+}
 
-		for _, inFilter := range typedOperatorFilter {
-			if !valueMatchesFilter(value, inFilter) {
-				return false
-			}
-		}
+// Comment returns the value of the $comment operator of the filter or nil if the filter has no comment
+// The comment does not affect matching, it's recorded so it can be shown in logs like MongoDB's profiler does.
+func (m *Matcher) Comment() any {
+	if m == nil {
+		return nil
+	}
+	return m.comment
+}
 
+// Match matches a document against the compiled filter
+// returns true if it matches
+func (m *Matcher) Match(document any) bool {
+	if m == nil || m.match == nil {
 		return true
-	case "exists":
-		typedOperatorFilter, ok := operatorFilter.(bool)
-		if !ok {
-			panic("$exists operator filter should be a bool")
-		}
-		if typedOperatorFilter {
-			return value != nil
-		}
-		return value == nil
-	case "type":
-		typedOperatorFilter, ok := operatorFilter.(string)
-		if !ok {
-			panic("$type operator filter should be a string")
-		}
-
-		numberTypes := []reflect.Kind{
-			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
-		}
-		allowedTypesMap := map[string][]reflect.Kind{
-			"double":              {reflect.Float32, reflect.Float64},
-			"string":              {reflect.String},
-			"object":              {reflect.Struct, reflect.Map},
-			"array":               {reflect.Slice, reflect.Array},
-			"binData":             {reflect.Slice, reflect.Array},
-			"undefined":           {reflect.Invalid},
-			"null":                {reflect.Invalid},
-			"objectId":            {reflect.Array}, // FIXME: better checks for this
-			"bool":                {reflect.Bool},
-			"date":                {reflect.Struct, reflect.String},
-			"regex":               {reflect.Struct, reflect.String},
-			"dbPointer":           {},
-			"javascript":          {reflect.String},
-			"symbol":              {},
-			"javascriptWithScope": {},
-			"int":                 numberTypes,
-			"timestamp":           {},
-			"long":                numberTypes,
-			"decimal":             numberTypes,
-			"minKey":              {},
-			"maxKey":              {},
-		}
+	}
 
-		allowedTypes, ok := allowedTypesMap[typedOperatorFilter]
-		if !ok {
-			panic("unknown $type operator filter: " + typedOperatorFilter)
-		}
+	return m.match(document)
+}
 
-		valueKind := reflect.ValueOf(value).Kind()
-		for _, allowedType := range allowedTypes {
-			if valueKind == allowedType {
-				return true
-			}
-		}
+// ToDocument converts a document like value into a bson.D
+// bson.D and bson.Raw values and structs keep their order, the keys of maps are sorted to keep the result stable.
+// Returns false if the value is not a document.
+func ToDocument(value any) (bson.D, bool) {
+	return toFilterDocument(value)
+}
 
-		return false
-	case "all":
-		valueSlice, isSliceLike := sliceLikeToSlice(value)
-		if !isSliceLike {
-			return false
-		}
+// ToArray converts an array like value such as bson.A or a slice of structs into a []any
+// Like bson, byte slices and arrays like primitive.ObjectID are binary data and documents like bson.D are not arrays.
+// Returns false if the value is not an array.
+func ToArray(value any) ([]any, bool) {
+	if !isArray(value) {
+		return nil, false
+	}
+	return sliceLikeToSlice(value)
+}
 
-		filterEntries, isSliceLike := sliceLikeToSlice(operatorFilter)
-		if !isSliceLike {
-			panic("$all operator filter should be a slice")
-		}
+// ToRat converts a number of any type into an exact rational number
+// Returns 0 for NaN, infinity and values that are not numbers.
+func ToRat(number any) *big.Rat {
+	number = normalizeNumber(number)
+	if numberIsNaN(number) || numberInfSign(number) != 0 {
+		return new(big.Rat)
+	}
+	return numberToRat(number)
+}
 
-	outer:
-		for _, filterEntry := range filterEntries {
-			for _, valueEntry := range valueSlice {
-				if valueMatchesFilter(valueEntry, filterEntry) {
-					continue outer
-				}
-			}
-			return false
+// Lookup returns the values of a dotted key like "items.sku" within a document
+// Like MongoDB arrays are walked through, so a key can resolve to multiple values.
+// Returns an empty slice if the key does not exist.
+func Lookup(document any, key string) []any {
+	values := []any{}
+	for _, value := range lookupMapKey(document, key) {
+		if value != missing {
+			values = append(values, value)
 		}
+	}
+	return values
+}
 
-		return true
-	case "elemMatch":
-		// FIXME support this
-		panic("FIXME")
-	case "size":
-		var expectedSize int
-		switch operatorFilter.(type) {
-		case int, int8, int16, int32, int64:
-			expectedSize = int(reflect.ValueOf(operatorFilter).Int())
-		case uint, uint8, uint16, uint32, uint64:
-			expectedSize = int(reflect.ValueOf(operatorFilter).Uint())
-		case float32, float64:
-			expectedSize = int(reflect.ValueOf(operatorFilter).Float())
-		default:
-			panic("$size operator filter should be a number")
-		}
+// SortValue returns the value a document is sorted by for a dotted key like "items.price"
+// Like MongoDB arrays are sorted by their smallest element in ascending order and by their largest element in descending order.
+// Returns nil if the key does not exist, so missing values sort like null.
+func SortValue(document any, key string, descending bool) any {
+	direction := -1
+	if descending {
+		direction = 1
+	}
 
-		valueSlice, isSliceLike := sliceLikeToSlice(value)
-		if !isSliceLike {
-			return false
+	var result any
+	found := false
+	for _, value := range Lookup(document, key) {
+		entries := []any{value}
+		if isArray(value) {
+			entries, _ = sliceLikeToSlice(value)
+		}
+		for _, entry := range entries {
+			if !found || Compare(entry, result) == direction {
+				result = entry
+				found = true
+			}
 		}
-
-		return len(valueSlice) == expectedSize
-	case "bitsAllClear":
-		// FIXME support this
-		panic("FIXME")
-	case "bitsAllSet":
-		// FIXME support this
-		panic("FIXME")
-	case "bitsAnyClear":
-		// FIXME support this
-		panic("FIXME")
-	case "bitsAnySet":
-		// FIXME support this
-		panic("FIXME")
-	default:
-		panic(fmt.Sprintf("unknown operator: $%s on value: %+v with filter: %+v", operator, value, operatorFilter))
 	}
+	return result
+}
+
+// Compare compares two values using MongoDB's comparison order
+// Returns 0 if a == b, -1 if a < b and 1 if a > b
+func Compare(a, b any) int {
+	return compareValues(a, b)
 }
 
 // mustConvertToBson tries to convert the value to bson.M
@@ -351,3 +256,27 @@ func mustConvertToBson(v any) bson.M {
 	}
 	return response
 }
+
+// mustConvertToBsonD tries to convert the value to bson.D
+// Unlike mustConvertToBson this keeps the order of the fields
+func mustConvertToBsonD(v any) bson.D {
+	if raw, ok := v.(bson.Raw); ok {
+		response := bson.D{}
+		err := bson.Unmarshal(raw, &response)
+		if err != nil {
+			panic("failed to convert bson.Raw to bson.D type, error: " + err.Error())
+		}
+		return response
+	}
+
+	b, err := bson.Marshal(v)
+	if err != nil {
+		panic("failed to convert sturct to bson.D type (marshal), error: " + err.Error())
+	}
+	response := bson.D{}
+	err = bson.Unmarshal(b, &response)
+	if err != nil {
+		panic("failed to convert sturct to bson.D type (unmarshal), error: " + err.Error())
+	}
+	return response
+}
@@ -1,11 +1,16 @@
 package match
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
 	"testing"
+	"time"
 
 	. "github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -17,6 +22,14 @@ func mustObjectIDFromHex(hex string) primitive.ObjectID {
 	return id
 }
 
+func mustParseDecimal128(value string) primitive.Decimal128 {
+	decimal, err := primitive.ParseDecimal128(value)
+	if err != nil {
+		panic(err.Error())
+	}
+	return decimal
+}
+
 func TestMatch(t *testing.T) {
 	cases := []struct {
 		Name              string
@@ -48,6 +61,78 @@ func TestMatch(t *testing.T) {
 			bson.M{"foo": bson.M{"bar": "baz"}},
 			bson.M{"foo": bson.M{"bar": "foo"}},
 		},
+		{
+			"nested query through array",
+			bson.M{"items": []bson.M{{"sku": "A1"}, {"sku": "B2"}}},
+			bson.M{"items.sku": "B2"},
+			bson.M{"items.sku": "C3"},
+		},
+		{
+			"nested query through nested arrays",
+			bson.M{"orders": []bson.M{{"items": []bson.M{{"sku": "A1"}}}, {"items": []bson.M{{"sku": "B2"}}}}},
+			bson.M{"orders.items.sku": "B2"},
+			bson.M{"orders.items.sku": "C3"},
+		},
+		{
+			"array index",
+			bson.M{"tags": []string{"urgent", "later"}},
+			bson.M{"tags.0": "urgent"},
+			bson.M{"tags.1": "urgent"},
+		},
+		{
+			"array index into documents",
+			bson.M{"items": []bson.M{{"sku": "A1"}, {"sku": "B2"}}},
+			bson.M{"items.1.sku": "B2"},
+			bson.M{"items.0.sku": "B2"},
+		},
+		{
+			"array index of nested arrays",
+			bson.M{"matrix": [][]int{{1, 2}, {3, 4}}},
+			bson.M{"matrix.1.0": 3},
+			bson.M{"matrix.0.0": 3},
+		},
+		{
+			"numeric field of documents within array",
+			bson.M{"foo": []bson.M{{"0": "bar"}}},
+			bson.M{"foo.0": "bar"},
+			bson.M{"foo.0": "baz"},
+		},
+		{
+			"nested arrays are not traversed by field names",
+			bson.M{"foo": [][]bson.M{{{"bar": "baz"}}}},
+			bson.M{"foo.0.bar": "baz"},
+			bson.M{"foo.bar": "baz"},
+		},
+		{
+			"nested arrays only match one level deep",
+			bson.M{"foo": [][]int{{1, 2}, {3}}},
+			bson.M{"foo": []int{3}},
+			bson.M{"foo": 3},
+		},
+		{
+			"$ne through array",
+			bson.M{"items": []bson.M{{"sku": "A1"}, {"sku": "B2"}}},
+			bson.M{"items.sku": bson.M{"$ne": "C3"}},
+			bson.M{"items.sku": bson.M{"$ne": "A1"}},
+		},
+		{
+			"$gt through array",
+			bson.M{"items": []bson.M{{"qty": 1}, {"qty": 10}}},
+			bson.M{"items.qty": bson.M{"$gt": 5}},
+			bson.M{"items.qty": bson.M{"$gt": 10}},
+		},
+		{
+			"$in",
+			bson.M{"foo": "bar"},
+			bson.M{"foo": bson.M{"$in": []string{"bar", "baz"}}},
+			bson.M{"foo": bson.M{"$in": []string{"baz"}}},
+		},
+		{
+			"$nin",
+			bson.M{"foo": []string{"bar", "baz"}},
+			bson.M{"foo": bson.M{"$nin": []string{"qux"}}},
+			bson.M{"foo": bson.M{"$nin": []string{"baz"}}},
+		},
 		{
 			"array contains",
 			bson.M{"foo": []string{"bar", "baz"}},
@@ -102,6 +187,108 @@ func TestMatch(t *testing.T) {
 			bson.M{"foo": bson.M{"$lte": 4}},
 			bson.M{"foo": bson.M{"$lte": 3}},
 		},
+		{
+			"$gt with strings",
+			bson.M{"foo": "b"},
+			bson.M{"foo": bson.M{"$gt": "a"}},
+			bson.M{"foo": bson.M{"$gt": "c"}},
+		},
+		{
+			"$gt with dates",
+			bson.M{"foo": primitive.NewDateTimeFromTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))},
+			bson.M{"foo": bson.M{"$gt": time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			bson.M{"foo": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))}},
+		},
+		{
+			"$gte with object ids",
+			bson.M{"_id": mustObjectIDFromHex("5a0e7f6c0f291d0f1f2d3e4f")},
+			bson.M{"_id": bson.M{"$gte": mustObjectIDFromHex("5a0e7f6c0f291d0f1f2d3e4f")}},
+			bson.M{"_id": bson.M{"$gte": mustObjectIDFromHex("5a0e7f6c0f291d0f1f2d3e50")}},
+		},
+		{
+			"$lt with timestamps",
+			bson.M{"foo": primitive.Timestamp{T: 10, I: 2}},
+			bson.M{"foo": bson.M{"$lt": primitive.Timestamp{T: 10, I: 3}}},
+			bson.M{"foo": bson.M{"$lt": primitive.Timestamp{T: 9, I: 5}}},
+		},
+		{
+			"$lte with booleans",
+			bson.M{"foo": false},
+			bson.M{"foo": bson.M{"$lte": true}},
+			bson.M{"foo": bson.M{"$lt": false}},
+		},
+		{
+			"$gt with arrays",
+			bson.M{"foo": []int{1, 8, 3}},
+			bson.M{"foo": bson.M{"$gt": 5}},
+			bson.M{"foo": bson.M{"$gt": 8}},
+		},
+		{
+			"$gt type bracketing",
+			bson.M{"foo": "10"},
+			bson.M{"foo": bson.M{"$gt": "1"}},
+			bson.M{"foo": bson.M{"$gt": 1}},
+		},
+		{
+			"$gt with MinKey",
+			bson.M{"foo": "bar"},
+			bson.M{"foo": bson.M{"$gt": primitive.MinKey{}}},
+			bson.M{"foo": bson.M{"$gt": primitive.MaxKey{}}},
+		},
+		{
+			"$lt with MaxKey",
+			bson.M{"foo": 4},
+			bson.M{"foo": bson.M{"$lt": primitive.MaxKey{}}},
+			bson.M{"foo": bson.M{"$lt": primitive.MinKey{}}},
+		},
+		{
+			"floats close to integers",
+			bson.M{"foo": 1.0001},
+			bson.M{"foo": bson.M{"$gt": 1}},
+			bson.M{"foo": 1},
+		},
+		{
+			"large int64 values",
+			bson.M{"foo": int64(9007199254740993)},
+			bson.M{"foo": int64(9007199254740993)},
+			bson.M{"foo": int64(9007199254740992)},
+		},
+		{
+			"large int64 values compared to doubles",
+			bson.M{"foo": int64(9007199254740993)},
+			bson.M{"foo": bson.M{"$gt": float64(9007199254740992)}},
+			bson.M{"foo": float64(9007199254740992)},
+		},
+		{
+			"decimals",
+			bson.M{"foo": mustParseDecimal128("10.50")},
+			bson.M{"foo": mustParseDecimal128("10.5")},
+			bson.M{"foo": mustParseDecimal128("10.51")},
+		},
+		{
+			"decimals compared to other numbers",
+			bson.M{"foo": mustParseDecimal128("10.00")},
+			bson.M{"foo": bson.M{"$eq": 10, "$gt": 9.99, "$lt": int64(11)}},
+			bson.M{"foo": bson.M{"$gt": 10.0}},
+		},
+		{
+			"decimals that can not be represented as doubles",
+			bson.M{"foo": mustParseDecimal128("0.1")},
+			bson.M{"foo": bson.M{"$lt": 0.1}},
+			bson.M{"foo": 0.1},
+		},
+		{
+			"NaN",
+			bson.M{"foo": math.NaN()},
+			bson.M{"foo": bson.M{"$gte": math.NaN()}},
+			bson.M{"foo": bson.M{"$lt": 5}},
+		},
+		{
+			"Infinity",
+			bson.M{"foo": math.Inf(1)},
+			bson.M{"foo": bson.M{"$gt": int64(math.MaxInt64)}},
+			bson.M{"foo": bson.M{"$lt": mustParseDecimal128("Infinity")}},
+		},
 		{
 			"$and",
 			bson.M{"foo": 4, "bar": 5},
@@ -120,6 +307,72 @@ func TestMatch(t *testing.T) {
 			bson.M{"foo": bson.M{"$type": "string"}},
 			bson.M{"foo": bson.M{"$type": "int"}},
 		},
+		{
+			"$type with numeric code",
+			bson.M{"foo": "bar"},
+			bson.M{"foo": bson.M{"$type": 2}},
+			bson.M{"foo": bson.M{"$type": 16}},
+		},
+		{
+			"$type int and long",
+			bson.M{"foo": int32(1), "bar": int64(1)},
+			bson.M{"foo": bson.M{"$type": "int"}, "bar": bson.M{"$type": "long"}},
+			bson.M{"foo": bson.M{"$type": "long"}},
+		},
+		{
+			"$type number alias",
+			bson.M{"foo": 1.5},
+			bson.M{"foo": bson.M{"$type": "number"}},
+			bson.M{"foo": bson.M{"$type": "int"}},
+		},
+		{
+			"$type objectId",
+			bson.M{"foo": mustObjectIDFromHex("5a0e7f6c0f291d0f1f2d3e4f")},
+			bson.M{"foo": bson.M{"$type": "objectId"}},
+			bson.M{"foo": bson.M{"$type": "array"}},
+		},
+		{
+			"$type date",
+			bson.M{"foo": primitive.NewDateTimeFromTime(time.Now())},
+			bson.M{"foo": bson.M{"$type": "date"}},
+			bson.M{"foo": bson.M{"$type": "object"}},
+		},
+		{
+			"$type timestamp",
+			bson.M{"foo": primitive.Timestamp{T: 1, I: 1}},
+			bson.M{"foo": bson.M{"$type": "timestamp"}},
+			bson.M{"foo": bson.M{"$type": "date"}},
+		},
+		{
+			"$type decimal",
+			bson.M{"foo": primitive.NewDecimal128(0, 1)},
+			bson.M{"foo": bson.M{"$type": "decimal"}},
+			bson.M{"foo": bson.M{"$type": "double"}},
+		},
+		{
+			"$type minKey and maxKey",
+			bson.M{"foo": primitive.MinKey{}, "bar": primitive.MaxKey{}},
+			bson.M{"foo": bson.M{"$type": -1}, "bar": bson.M{"$type": "maxKey"}},
+			bson.M{"foo": bson.M{"$type": "maxKey"}},
+		},
+		{
+			"$type with array of types",
+			bson.M{"foo": true},
+			bson.M{"foo": bson.M{"$type": []any{"string", 8}}},
+			bson.M{"foo": bson.M{"$type": []any{"string", 16}}},
+		},
+		{
+			"$type on array elements",
+			bson.M{"foo": bson.A{"bar", int32(1)}},
+			bson.M{"foo": bson.M{"$type": "int"}},
+			bson.M{"foo": bson.M{"$type": "double"}},
+		},
+		{
+			"$type array",
+			bson.M{"foo": bson.A{"bar"}},
+			bson.M{"foo": bson.M{"$type": "array"}},
+			bson.M{"foo": bson.M{"$type": "object"}},
+		},
 		{
 			"$all",
 			bson.M{"foo": []string{"foo", "bar", "baz"}},
@@ -132,20 +385,758 @@ func TestMatch(t *testing.T) {
 			bson.M{"foo": bson.M{"$all": []any{"foo", 1.0}}},
 			bson.M{"foo": bson.M{"$all": []any{"foo", 3}}},
 		},
+		{
+			"$not",
+			bson.M{"foo": 3},
+			bson.M{"foo": bson.M{"$not": bson.M{"$gt": 5}}},
+			bson.M{"foo": bson.M{"$not": bson.M{"$gt": 1, "$lt": 5}}},
+		},
+		{
+			"$not on array",
+			bson.M{"foo": bson.A{1, 8}},
+			bson.M{"foo": bson.M{"$not": bson.M{"$gt": 10}}},
+			bson.M{"foo": bson.M{"$not": bson.M{"$gt": 5}}},
+		},
+		{
+			"$not with regex",
+			bson.M{"foo": "Bar"},
+			bson.M{"foo": bson.M{"$not": primitive.Regex{Pattern: "^b"}}},
+			bson.M{"foo": bson.M{"$not": primitive.Regex{Pattern: "^b", Options: "i"}}},
+		},
+		{
+			"$not with $regex",
+			bson.M{"foo": "Bar"},
+			bson.M{"foo": bson.M{"$not": bson.M{"$regex": "^b"}}},
+			bson.M{"foo": bson.M{"$not": bson.M{"$regex": "^b", "$options": "i"}}},
+		},
+		{
+			"$regex",
+			bson.M{"foo": bson.A{"x", "Bar"}},
+			bson.M{"foo": bson.M{"$regex": primitive.Regex{Pattern: "^b", Options: "i"}}},
+			bson.M{"foo": bson.M{"$regex": "^b"}},
+		},
+		{
+			"implicit regex",
+			bson.M{"foo": "abc"},
+			bson.M{"foo": primitive.Regex{Pattern: "^a"}},
+			bson.M{"foo": primitive.Regex{Pattern: "^b"}},
+		},
+		{
+			"regex within $in",
+			bson.M{"foo": "abc"},
+			bson.M{"foo": bson.M{"$in": bson.A{"x", primitive.Regex{Pattern: "c$"}}}},
+			bson.M{"foo": bson.M{"$in": bson.A{"x", primitive.Regex{Pattern: "^c"}}}},
+		},
+		{
+			"$mod",
+			bson.M{"foo": 10},
+			bson.M{"foo": bson.M{"$mod": bson.A{4, 2}}},
+			bson.M{"foo": bson.M{"$mod": bson.A{4, 0}}},
+		},
+		{
+			"$mod truncates doubles",
+			bson.M{"foo": 5.9},
+			bson.M{"foo": bson.M{"$mod": bson.A{4.7, 1.2}}},
+			bson.M{"foo": bson.M{"$mod": bson.A{3, 0}}},
+		},
+		{
+			"$mod with negative numbers",
+			bson.M{"foo": -5},
+			bson.M{"foo": bson.M{"$mod": bson.A{3, -2}}},
+			bson.M{"foo": bson.M{"$mod": bson.A{3, 1}}},
+		},
+		{
+			"$mod on array elements",
+			bson.M{"foo": bson.A{"bar", 7, mustParseDecimal128("9.5")}},
+			bson.M{"foo": bson.M{"$mod": bson.A{5, 4}}},
+			bson.M{"foo": bson.M{"$mod": bson.A{5, 3}}},
+		},
+		{
+			"$comment",
+			bson.M{"foo": "bar"},
+			bson.M{"foo": "bar", "$comment": "find bars"},
+			bson.M{"foo": "baz", "$comment": "find bars"},
+		},
 	}
 
 	for _, testCase := range cases {
 		t.Run(testCase.Name+" matches case", func(t *testing.T) {
-			match := internalMatch(testCase.Document, testCase.MatchingFilter)
+			match := Match(testCase.Document, testCase.MatchingFilter)
 
 			hint := fmt.Sprintf("filter %+v should match document %+v", testCase.MatchingFilter, testCase.Document)
 			True(t, match, hint)
 		})
 		t.Run(testCase.Name+" not matches case", func(t *testing.T) {
-			match := internalMatch(testCase.Document, testCase.NotMatchingFilter)
+			match := Match(testCase.Document, testCase.NotMatchingFilter)
 
 			hint := fmt.Sprintf("filter %+v should NOT match document %+v", testCase.NotMatchingFilter, testCase.Document)
 			False(t, match, hint)
 		})
 	}
 }
+
+func TestNullAndMissingSemantics(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Document bson.M
+		Filter   bson.M
+		Matches  bool
+	}{
+		{"null matches null", bson.M{"a": nil}, bson.M{"a": nil}, true},
+		{"null matches missing", bson.M{}, bson.M{"a": nil}, true},
+		{"null does not match value", bson.M{"a": 1}, bson.M{"a": nil}, false},
+		{"null matches array containing null", bson.M{"a": bson.A{1, nil}}, bson.M{"a": nil}, true},
+		{"null does not match empty array", bson.M{"a": bson.A{}}, bson.M{"a": nil}, false},
+		{"null matches missing nested key", bson.M{"a": bson.M{}}, bson.M{"a.b": nil}, true},
+		{"null matches missing parent", bson.M{}, bson.M{"a.b": nil}, true},
+		{"null matches key of scalar", bson.M{"a": 1}, bson.M{"a.b": nil}, true},
+		{"null matches key missing in some array documents", bson.M{"a": bson.A{bson.M{"b": 1}, bson.M{"c": 1}}}, bson.M{"a.b": nil}, true},
+		{"null does not match key set in all array documents", bson.M{"a": bson.A{bson.M{"b": 1}, bson.M{"b": 2}}}, bson.M{"a.b": nil}, false},
+		{"null matches missing array index", bson.M{"a": bson.A{1}}, bson.M{"a.1": nil}, true},
+		{"$eq null matches missing", bson.M{}, bson.M{"a": bson.M{"$eq": nil}}, true},
+		{"$ne null does not match null", bson.M{"a": nil}, bson.M{"a": bson.M{"$ne": nil}}, false},
+		{"$ne null does not match missing", bson.M{}, bson.M{"a": bson.M{"$ne": nil}}, false},
+		{"$ne null matches value", bson.M{"a": 1}, bson.M{"a": bson.M{"$ne": nil}}, true},
+		{"$ne null does not match array containing null", bson.M{"a": bson.A{1, nil}}, bson.M{"a": bson.M{"$ne": nil}}, false},
+		{"$ne null does not match partially missing key", bson.M{"a": bson.A{bson.M{"b": 1}, bson.M{"c": 1}}}, bson.M{"a.b": bson.M{"$ne": nil}}, false},
+		{"$ne value matches missing", bson.M{}, bson.M{"a": bson.M{"$ne": 1}}, true},
+		{"$in null matches missing", bson.M{}, bson.M{"a": bson.M{"$in": bson.A{nil, 1}}}, true},
+		{"$nin null does not match missing", bson.M{}, bson.M{"a": bson.M{"$nin": bson.A{nil}}}, false},
+		{"$gte null matches missing", bson.M{}, bson.M{"a": bson.M{"$gte": nil}}, true},
+		{"$lte null matches null", bson.M{"a": nil}, bson.M{"a": bson.M{"$lte": nil}}, true},
+		{"$gt null does not match null", bson.M{"a": nil}, bson.M{"a": bson.M{"$gt": nil}}, false},
+		{"$lt does not match missing", bson.M{}, bson.M{"a": bson.M{"$lt": 5}}, false},
+		{"$exists true matches null", bson.M{"a": nil}, bson.M{"a": bson.M{"$exists": true}}, true},
+		{"$exists true does not match missing", bson.M{}, bson.M{"a": bson.M{"$exists": true}}, false},
+		{"$exists false matches missing", bson.M{}, bson.M{"a": bson.M{"$exists": false}}, true},
+		{"$exists false does not match null", bson.M{"a": nil}, bson.M{"a": bson.M{"$exists": false}}, false},
+		{"$exists true matches empty array", bson.M{"a": bson.A{}}, bson.M{"a": bson.M{"$exists": true}}, true},
+		{"$exists true on nested key", bson.M{"a": bson.M{"b": nil}}, bson.M{"a.b": bson.M{"$exists": true}}, true},
+		{"$exists false on nested key", bson.M{"a": bson.M{"c": 1}}, bson.M{"a.b": bson.M{"$exists": false}}, true},
+		{"$exists true through array", bson.M{"a": bson.A{bson.M{"c": 1}, bson.M{"b": 1}}}, bson.M{"a.b": bson.M{"$exists": true}}, true},
+		{"$exists false through array", bson.M{"a": bson.A{bson.M{"c": 1}, bson.M{"b": 1}}}, bson.M{"a.b": bson.M{"$exists": false}}, false},
+		{"$exists true on array of scalars", bson.M{"a": bson.A{1, 2}}, bson.M{"a.b": bson.M{"$exists": true}}, false},
+		{"$exists true on array index", bson.M{"a": bson.A{nil}}, bson.M{"a.0": bson.M{"$exists": true}}, true},
+		{"$exists false on missing array index", bson.M{"a": bson.A{1}}, bson.M{"a.1": bson.M{"$exists": false}}, true},
+		{"$type null matches null", bson.M{"a": nil}, bson.M{"a": bson.M{"$type": "null"}}, true},
+		{"$type null does not match missing", bson.M{}, bson.M{"a": bson.M{"$type": "null"}}, false},
+		{"$not matches missing", bson.M{}, bson.M{"a": bson.M{"$not": bson.M{"$gt": 5}}}, true},
+		{"$not regex matches missing", bson.M{}, bson.M{"a": bson.M{"$not": primitive.Regex{Pattern: "a"}}}, true},
+		{"$not $exists false does not match missing", bson.M{}, bson.M{"a": bson.M{"$not": bson.M{"$exists": false}}}, false},
+		{"$not $eq null does not match missing", bson.M{}, bson.M{"a": bson.M{"$not": bson.M{"$eq": nil}}}, false},
+		{"$mod does not match missing", bson.M{}, bson.M{"a": bson.M{"$mod": bson.A{2, 0}}}, false},
+		{"$mod does not match null", bson.M{"a": nil}, bson.M{"a": bson.M{"$mod": bson.A{2, 0}}}, false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			hint := fmt.Sprintf("filter %+v matching document %+v", testCase.Filter, testCase.Document)
+			Equal(t, testCase.Matches, Match(testCase.Document, testCase.Filter), hint)
+		})
+	}
+}
+
+func TestCompareNumbers(t *testing.T) {
+	ordered := []any{
+		math.NaN(),
+		math.Inf(-1),
+		mustParseDecimal128("-1E+400"),
+		int64(math.MinInt64),
+		-1.5,
+		int32(-1),
+		mustParseDecimal128("0.1"),
+		0.1,
+		1,
+		1.0001,
+		int64(1<<53 + 1),
+		uint64(math.MaxUint64),
+		mustParseDecimal128("1E+400"),
+		math.Inf(1),
+	}
+
+	for idx := 0; idx < len(ordered)-1; idx++ {
+		a, b := ordered[idx], ordered[idx+1]
+		Equal(t, -1, compareNumbers(a, b), "%v < %v", a, b)
+		Equal(t, 1, compareNumbers(b, a), "%v > %v", b, a)
+		Equal(t, 0, compareNumbers(a, a), "%v == %v", a, a)
+	}
+
+	Equal(t, 0, compareNumbers(int32(1), mustParseDecimal128("1.000")))
+	Equal(t, 0, compareNumbers(uint8(2), 2.0))
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Filter bson.M
+		Path   string
+		Err    error
+	}{
+		{"unknown operator", bson.M{"foo": bson.M{"$foo": 1}}, "foo.$foo", ErrUnknownOperator},
+		{"unknown top level operator", bson.M{"$foo": 1}, "$foo", ErrUnknownOperator},
+		{"operator mixed with fields", bson.M{"foo": bson.M{"$gt": 1, "bar": 2}}, "foo.$gt", ErrUnknownOperator},
+		{"$in without array", bson.M{"foo": bson.M{"$in": "bar"}}, "foo.$in", ErrBadValue},
+		{"$nin without array", bson.M{"foo": bson.M{"$nin": 1}}, "foo.$nin", ErrBadValue},
+		{"$exists with string", bson.M{"foo": bson.M{"$exists": "yes"}}, "foo.$exists", ErrBadValue},
+		{"$type with unknown alias", bson.M{"foo": bson.M{"$type": "text"}}, "foo.$type", ErrBadValue},
+		{"$size with string", bson.M{"foo": bson.M{"$size": "2"}}, "foo.$size", ErrBadValue},
+		{"$size negative", bson.M{"foo": bson.M{"$size": -1}}, "foo.$size", ErrBadValue},
+		{"$and without array", bson.M{"$and": bson.M{"foo": 1}}, "$and", ErrBadValue},
+		{"$or with empty array", bson.M{"$or": bson.A{}}, "$or", ErrBadValue},
+		{"nested in $and", bson.M{"$and": bson.A{bson.M{"foo": bson.M{"$in": 1}}}}, "$and.foo.$in", ErrBadValue},
+		{"nested field", bson.M{"foo": bson.M{"bar": bson.M{"$foo": 1}}}, "foo.bar.$foo", ErrUnknownOperator},
+		{"$not with value", bson.M{"foo": bson.M{"$not": 1}}, "foo.$not", ErrBadValue},
+		{"$not empty", bson.M{"foo": bson.M{"$not": bson.M{}}}, "foo.$not", ErrBadValue},
+		{"$not with field", bson.M{"foo": bson.M{"$not": bson.M{"bar": 1}}}, "foo.$not", ErrBadValue},
+		{"$not with unknown operator", bson.M{"foo": bson.M{"$not": bson.M{"$foo": 1}}}, "foo.$not.$foo", ErrUnknownOperator},
+		{"$options without $regex", bson.M{"foo": bson.M{"$options": "i"}}, "foo.$options", ErrBadValue},
+		{"$regex with number", bson.M{"foo": bson.M{"$regex": 1}}, "foo.$regex", ErrBadValue},
+		{"$regex options set twice", bson.M{"foo": bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: "a", Options: "i"}}, {Key: "$options", Value: "m"}}}, "foo.$regex", ErrBadValue},
+		{"$not with invalid regex", bson.M{"foo": bson.M{"$not": primitive.Regex{Pattern: "("}}}, "foo.$not", ErrBadValue},
+		{"$mod without array", bson.M{"foo": bson.M{"$mod": 2}}, "foo.$mod", ErrBadValue},
+		{"$mod with one element", bson.M{"foo": bson.M{"$mod": bson.A{2}}}, "foo.$mod", ErrBadValue},
+		{"$mod with three elements", bson.M{"foo": bson.M{"$mod": bson.A{2, 1, 0}}}, "foo.$mod", ErrBadValue},
+		{"$mod with string divisor", bson.M{"foo": bson.M{"$mod": bson.A{"2", 1}}}, "foo.$mod", ErrBadValue},
+		{"$mod with NaN remainder", bson.M{"foo": bson.M{"$mod": bson.A{2, math.NaN()}}}, "foo.$mod", ErrBadValue},
+		{"$mod by zero", bson.M{"foo": bson.M{"$mod": bson.A{0.5, 0}}}, "foo.$mod", ErrBadValue},
+		{"$sampleRate above 1", bson.M{"$sampleRate": 1.5}, "$sampleRate", ErrBadValue},
+		{"$sampleRate with string", bson.M{"$sampleRate": "0.5"}, "$sampleRate", ErrBadValue},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			matcher, err := Compile(testCase.Filter)
+			Nil(t, matcher)
+			ErrorIs(t, err, testCase.Err)
+
+			filterErr := &FilterError{}
+			if ErrorAs(t, err, &filterErr) {
+				Equal(t, testCase.Path, filterErr.Path)
+			}
+		})
+	}
+
+	matcher, err := Compile(bson.M{"foo": bson.M{"$in": bson.A{1, 2}, "$exists": 1}})
+	NoError(t, err)
+	True(t, matcher.Match(bson.M{"foo": 2}))
+	False(t, matcher.Match(bson.M{"foo": 3}))
+
+	_, err = Compile(bson.Raw{5, 0, 0, 0, 9})
+	ErrorIs(t, err, ErrBadValue)
+	_, err = Any(bson.M{"foo": 1}, bson.Raw{5, 0, 0, 0, 9})
+	ErrorIs(t, err, ErrBadValue)
+}
+
+func TestSampleRate(t *testing.T) {
+	sample := func(rate float64, options ...CompileOption) []int {
+		matcher, err := Compile(bson.M{"$sampleRate": rate}, options...)
+		NoError(t, err)
+
+		matched := []int{}
+		for idx := 0; idx < 100; idx++ {
+			if matcher.Match(bson.M{"idx": idx}) {
+				matched = append(matched, idx)
+			}
+		}
+		return matched
+	}
+
+	Len(t, sample(0), 0)
+	Len(t, sample(1), 100)
+
+	first := sample(0.3, WithRandom(rand.New(rand.NewSource(42)).Float64))
+	Equal(t, first, sample(0.3, WithRandom(rand.New(rand.NewSource(42)).Float64)))
+	Greater(t, len(first), 10)
+	Less(t, len(first), 50)
+}
+
+func TestComment(t *testing.T) {
+	matcher, err := Compile(bson.D{{Key: "foo", Value: "bar"}, {Key: "$comment", Value: "find bars"}})
+	NoError(t, err)
+	Equal(t, "find bars", matcher.Comment())
+
+	matcher, err = Compile(bson.M{"foo": "bar"})
+	NoError(t, err)
+	Nil(t, matcher.Comment())
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	document := bson.M{
+		"_id":    primitive.NewObjectID(),
+		"name":   "foo",
+		"age":    int32(30),
+		"tags":   bson.A{"a", "b", "c"},
+		"orders": bson.A{bson.M{"sku": "A1", "qty": int32(2)}, bson.M{"sku": "B2", "qty": int32(5)}},
+	}
+	filter := bson.M{
+		"name":       bson.M{"$in": bson.A{"foo", "bar"}},
+		"age":        bson.M{"$gte": 18, "$lt": 65},
+		"orders.sku": "B2",
+		"$or":        bson.A{bson.M{"tags": "c"}, bson.M{"tags": bson.M{"$size": 0}}},
+	}
+
+	matcher, err := Compile(filter)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !matcher.Match(document) {
+			b.Fatal("expected document to match")
+		}
+	}
+}
+
+func TestFilterTypes(t *testing.T) {
+	document := bson.M{"name": "foo", "age": int32(30), "tags": bson.A{"a", "b"}}
+
+	rawFilter, err := bson.Marshal(bson.D{{Key: "name", Value: "foo"}, {Key: "age", Value: bson.D{{Key: "$gte", Value: 18}}}})
+	NoError(t, err)
+
+	type structFilter struct {
+		Name string `bson:"name"`
+		Age  int    `bson:"age,omitempty"`
+	}
+
+	cases := []struct {
+		Name              string
+		MatchingFilter    any
+		NotMatchingFilter any
+	}{
+		{
+			"bson.D",
+			bson.D{{Key: "name", Value: "foo"}, {Key: "age", Value: bson.D{{Key: "$gt", Value: 18}}}},
+			bson.D{{Key: "name", Value: "foo"}, {Key: "age", Value: bson.D{{Key: "$gt", Value: 30}}}},
+		},
+		{
+			"bson.D within $and",
+			bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "name", Value: "foo"}}, bson.D{{Key: "tags", Value: "b"}}}}},
+			bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "name", Value: "foo"}}, bson.D{{Key: "tags", Value: "c"}}}}},
+		},
+		{
+			"bson.Raw",
+			bson.Raw(rawFilter),
+			bson.Raw(mustMarshal(bson.M{"name": "bar"})),
+		},
+		{
+			"map",
+			map[string]any{"tags": map[string]any{"$in": []string{"b", "c"}}},
+			map[string]string{"name": "bar"},
+		},
+		{
+			"struct",
+			structFilter{Name: "foo"},
+			&structFilter{Name: "foo", Age: 31},
+		},
+		{
+			"struct within $or",
+			bson.M{"$or": []any{structFilter{Name: "bar"}, structFilter{Name: "foo", Age: 30}}},
+			bson.M{"$or": []any{structFilter{Name: "bar"}, structFilter{Name: "baz"}}},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			matcher, err := Compile(testCase.MatchingFilter)
+			NoError(t, err)
+			True(t, matcher.Match(document))
+
+			matcher, err = Compile(testCase.NotMatchingFilter)
+			NoError(t, err)
+			False(t, matcher.Match(document))
+		})
+	}
+
+	_, err = Compile("foo")
+	ErrorIs(t, err, ErrBadValue)
+}
+
+func mustMarshal(value any) []byte {
+	bytes, err := bson.Marshal(value)
+	if err != nil {
+		panic(err.Error())
+	}
+	return bytes
+}
+
+func TestExplain(t *testing.T) {
+	document := bson.M{"status": "draft", "age": 30, "tags": bson.A{"a", "b"}}
+	filter := bson.D{
+		{Key: "status", Value: "published"},
+		{Key: "age", Value: bson.M{"$gte": 18}},
+		{Key: "$or", Value: bson.A{bson.M{"tags": "c"}, bson.M{"owner": "bob"}}},
+	}
+
+	explanation, err := Explain(document, filter)
+	NoError(t, err)
+	False(t, explanation.Matched)
+	Equal(t, 1, explanation.MatchedClauses())
+
+	if Len(t, explanation.Clauses, 3) {
+		status := explanation.Clauses[0]
+		Equal(t, "status", status.Path)
+		Equal(t, "$eq", status.Operator)
+		Equal(t, []any{"draft"}, status.Values)
+		False(t, status.Matched)
+		Equal(t, `field status was "draft", expected "published"`, status.String())
+
+		age := explanation.Clauses[1]
+		True(t, age.Matched)
+		Equal(t, "field age was 30, expected $gte 18", age.String())
+
+		or := explanation.Clauses[2]
+		False(t, or.Matched)
+		Len(t, or.Entries, 2)
+		Equal(t, `field owner was missing, expected "bob"`, or.Entries[1].Clauses[0].String())
+	}
+
+	Equal(t, `document did not match the filter
+✗ field status was "draft", expected "published"
+✓ field age was 30, expected $gte 18
+✗ $or with 0 of 2 matching clauses
+  clause 1 did not match
+    ✗ field tags was ["a","b"], expected "c"
+  clause 2 did not match
+    ✗ field owner was missing, expected "bob"`, explanation.String())
+
+	explanation, err = Explain(document, bson.M{"status": "draft"})
+	NoError(t, err)
+	True(t, explanation.Matched)
+
+	_, err = Explain(document, bson.M{"status": bson.M{"$foo": 1}})
+	ErrorIs(t, err, ErrUnknownOperator)
+
+	near := bson.D{{Key: "$near", Value: bson.A{1, 2}}, {Key: "$maxDistance", Value: 1}}
+	explanation, err = Explain(bson.M{"loc": bson.A{1, 2}}, bson.M{"loc": near})
+	NoError(t, err)
+	True(t, explanation.Matched)
+	explanation, err = Explain(bson.M{"loc": bson.A{5, 5}}, bson.M{"loc": near})
+	NoError(t, err)
+	False(t, explanation.Matched)
+	if Len(t, explanation.Clauses, 1) {
+		Equal(t, near, explanation.Clauses[0].Expected)
+		Equal(t, `field loc was [5,5], expected {"$near":[1,2],"$maxDistance":1}`, explanation.Clauses[0].String())
+	}
+}
+
+func TestEmbeddedDocumentEquality(t *testing.T) {
+	address := bson.D{{Key: "city", Value: "A"}, {Key: "zip", Value: "1"}}
+	document := bson.D{{Key: "address", Value: address}, {Key: "history", Value: bson.A{address}}}
+
+	cases := []struct {
+		Name    string
+		Filter  any
+		Matches bool
+	}{
+		{"same fields in the same order", bson.D{{Key: "address", Value: address}}, true},
+		{"different field order", bson.D{{Key: "address", Value: bson.D{{Key: "zip", Value: "1"}, {Key: "city", Value: "A"}}}}, false},
+		{"missing field", bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "A"}}}}, false},
+		{"extra field", bson.D{{Key: "address", Value: append(bson.D{{Key: "street", Value: "B"}}, address...)}}, false},
+		{"map filter ignores field order", bson.M{"address": bson.M{"zip": "1", "city": "A"}}, true},
+		{"map filter with missing field", bson.M{"address": bson.M{"city": "A"}}, false},
+		{"within array", bson.D{{Key: "history", Value: address}}, true},
+		{"within array with different order", bson.D{{Key: "history", Value: bson.D{{Key: "zip", Value: "1"}, {Key: "city", Value: "A"}}}}, false},
+		{"whole array", bson.D{{Key: "history", Value: bson.A{address}}}, true},
+		{"dotted path", bson.M{"address.city": "A"}, true},
+		{"$eq", bson.M{"address": bson.M{"$eq": bson.D{{Key: "city", Value: "A"}}}}, false},
+		{"$in", bson.M{"address": bson.M{"$in": bson.A{address}}}, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			Equal(t, testCase.Matches, Match(document, testCase.Filter))
+		})
+	}
+
+	// Numbers within embedded documents are compared by value
+	True(t, Match(bson.M{"n": bson.D{{Key: "a", Value: int32(1)}}}, bson.M{"n": bson.D{{Key: "a", Value: 1.0}}}))
+}
+
+func TestText(t *testing.T) {
+	document := bson.M{"title": "Brewing coffee", "tags": bson.A{"drinks", "hot"}, "meta": bson.M{"note": "iced"}}
+
+	True(t, Match(document, bson.M{"$text": bson.M{"$search": "brew"}}))
+	True(t, Match(document, bson.M{"$text": bson.M{"$search": "drink"}}))
+	True(t, Match(document, bson.M{"$text": bson.M{"$search": "iced"}}))
+	False(t, Match(document, bson.M{"$text": bson.M{"$search": "coffee -hot"}}))
+	True(t, Match(document, bson.M{"$and": bson.A{bson.M{"$text": bson.M{"$search": "coffee"}}}}))
+
+	_, err := Compile(bson.M{"$or": bson.A{bson.M{"$text": bson.M{"$search": "coffee"}}}})
+	ErrorIs(t, err, ErrBadValue)
+	_, err = Compile(bson.M{"$text": bson.M{"$search": 1}})
+	ErrorIs(t, err, ErrBadValue)
+	_, err = Compile(bson.M{"$text": bson.M{"$search": "coffee", "$language": "klingon"}})
+	ErrorIs(t, err, ErrBadValue)
+	_, err = Compile(bson.M{"$text": bson.M{"$search": "coffee", "$foo": true}})
+	ErrorIs(t, err, ErrBadValue)
+}
+
+func TestGeo(t *testing.T) {
+	point := func(lng, lat float64) bson.M {
+		return bson.M{"type": "Point", "coordinates": bson.A{lng, lat}}
+	}
+	// Roughly the Netherlands
+	netherlands := bson.M{"type": "Polygon", "coordinates": bson.A{bson.A{
+		bson.A{3.3, 50.7}, bson.A{7.2, 50.7}, bson.A{7.2, 53.6}, bson.A{3.3, 53.6}, bson.A{3.3, 50.7},
+	}}}
+	amsterdam := bson.M{"location": point(4.9, 52.37)}
+	paris := bson.M{"location": point(2.35, 48.86)}
+	legacy := bson.M{"location": bson.A{4.9, 52.37}}
+	road := bson.M{"location": bson.M{"type": "LineString", "coordinates": bson.A{bson.A{2.35, 48.86}, bson.A{4.9, 52.37}}}}
+	line := func(coordinates ...bson.A) bson.M {
+		return bson.M{"type": "LineString", "coordinates": bson.A{coordinates[0], coordinates[1]}}
+	}
+	rectangle := func(minLng, minLat, maxLng, maxLat float64) bson.M {
+		return bson.M{"type": "Polygon", "coordinates": bson.A{bson.A{
+			bson.A{minLng, minLat}, bson.A{maxLng, minLat}, bson.A{maxLng, maxLat}, bson.A{minLng, maxLat}, bson.A{minLng, minLat},
+		}}}
+	}
+	// A U shape, the gap between its arms is not part of it
+	uShape := bson.A{bson.A{0, 0}, bson.A{3, 0}, bson.A{3, 3}, bson.A{2, 3}, bson.A{2, 1}, bson.A{1, 1}, bson.A{1, 3}, bson.A{0, 3}, bson.A{0, 0}}
+	concave := bson.M{"type": "Polygon", "coordinates": bson.A{uShape}}
+	acrossArms := bson.M{"location": line(bson.A{0.5, 2}, bson.A{2.5, 2})}
+	alongBase := bson.M{"location": line(bson.A{0.5, 0.5}, bson.A{2.5, 0.5})}
+	withHole := bson.M{"type": "Polygon", "coordinates": bson.A{
+		bson.A{bson.A{0, 0}, bson.A{4, 0}, bson.A{4, 4}, bson.A{0, 4}, bson.A{0, 0}},
+		bson.A{bson.A{1, 1}, bson.A{2, 1}, bson.A{2, 2}, bson.A{1, 2}, bson.A{1, 1}},
+	}}
+
+	cases := []struct {
+		Name     string
+		Document bson.M
+		Filter   bson.M
+		Matches  bool
+	}{
+		{"$geoWithin $geometry", amsterdam, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": netherlands}}}, true},
+		{"$geoWithin $geometry outside", paris, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": netherlands}}}, false},
+		{"$geoWithin $geometry legacy point", legacy, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": netherlands}}}, true},
+		{"$geoWithin $geometry line partly outside", road, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": netherlands}}}, false},
+		{"$geoWithin $box", legacy, bson.M{"location": bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{4, 52}, bson.A{5, 53}}}}}, true},
+		{"$geoWithin $box outside", paris, bson.M{"location": bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{4, 52}, bson.A{5, 53}}}}}, false},
+		{"$geoWithin $polygon", legacy, bson.M{"location": bson.M{"$geoWithin": bson.M{"$polygon": bson.A{bson.A{4, 52}, bson.A{6, 52}, bson.A{4, 54}}}}}, true},
+		{"$geoWithin $center", legacy, bson.M{"location": bson.M{"$geoWithin": bson.M{"$center": bson.A{bson.A{5, 52.4}, 0.2}}}}, true},
+		// Amsterdam to Paris is about 430km
+		{"$geoWithin $centerSphere", paris, bson.M{"location": bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{4.9, 52.37}, 450000.0 / 6378100}}}}, true},
+		{"$geoWithin $centerSphere outside", paris, bson.M{"location": bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{bson.A{4.9, 52.37}, 400000.0 / 6378100}}}}, false},
+		{"$geoIntersects point in polygon", amsterdam, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": netherlands}}}, true},
+		{"$geoIntersects line crossing polygon", road, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": netherlands}}}, true},
+		{"$geoIntersects crossing lines", road, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{"type": "LineString", "coordinates": bson.A{bson.A{3, 51}, bson.A{5, 50}}}}}}, true},
+		{"$geoWithin concave $geometry edge leaves", acrossArms, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": concave}}}, false},
+		{"$geoWithin concave $geometry", alongBase, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": concave}}}, true},
+		{"$geoWithin concave $polygon edge leaves", acrossArms, bson.M{"location": bson.M{"$geoWithin": bson.M{"$polygon": uShape[:8]}}}, false},
+		{"$geoWithin concave $polygon", alongBase, bson.M{"location": bson.M{"$geoWithin": bson.M{"$polygon": uShape[:8]}}}, true},
+		{"$geoWithin polygon around hole", bson.M{"location": rectangle(0.5, 0.5, 3, 3)}, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": withHole}}}, false},
+		{"$geoWithin polygon next to hole", bson.M{"location": rectangle(2.5, 0.5, 3, 3)}, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": withHole}}}, true},
+		{"$geoIntersects crossing lines without vertices inside", bson.M{"location": line(bson.A{0, 0}, bson.A{2, 2})}, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": line(bson.A{0, 2}, bson.A{2, 0})}}}, true},
+		{"$geoIntersects plus of rectangles", bson.M{"location": rectangle(0, 1, 4, 2)}, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": rectangle(1, 0, 2, 4)}}}, true},
+		{"$geoIntersects parallel lines", bson.M{"location": line(bson.A{0, 0}, bson.A{2, 0})}, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": line(bson.A{0, 1}, bson.A{2, 1})}}}, false},
+		{"$geoIntersects disjoint", paris, bson.M{"location": bson.M{"$geoIntersects": bson.M{"$geometry": netherlands}}}, false},
+		{"$near with $maxDistance", paris, bson.M{"location": bson.M{"$near": bson.M{"$geometry": point(4.9, 52.37), "$maxDistance": 450000}}}, true},
+		{"$near too far", paris, bson.M{"location": bson.M{"$near": bson.M{"$geometry": point(4.9, 52.37), "$maxDistance": 400000}}}, false},
+		{"$near with $minDistance", amsterdam, bson.M{"location": bson.M{"$near": bson.M{"$geometry": point(4.9, 52.37), "$minDistance": 1}}}, false},
+		{"$near legacy", legacy, bson.M{"location": bson.M{"$near": bson.A{5, 52.37}, "$maxDistance": 0.2}}, true},
+		{"$nearSphere legacy", legacy, bson.M{"location": bson.M{"$nearSphere": bson.A{5, 52.37}, "$maxDistance": 0.0001}}, false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			Equal(t, testCase.Matches, Match(testCase.Document, testCase.Filter))
+		})
+	}
+
+	matcher, err := Compile(bson.M{"location": bson.M{"$near": bson.M{"$geometry": point(4.9, 52.37)}}})
+	NoError(t, err)
+	True(t, matcher.HasNear())
+	distance, ok := matcher.NearDistance(paris)
+	True(t, ok)
+	InDelta(t, 430000, distance, 10000)
+}
+
+func TestGeoErrors(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Filter  bson.M
+		Message string
+	}{
+		{"unknown type", bson.M{"loc": bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{"type": "Circle", "coordinates": bson.A{1, 2}}}}}, "unknown GeoJSON type"},
+		{"out of bounds", bson.M{"loc": bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{"type": "Point", "coordinates": bson.A{200, 2}}}}}, "longitude/latitude is out of bounds, lng: 200 lat: 2"},
+		{"open loop", bson.M{"loc": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{bson.A{bson.A{0, 0}, bson.A{1, 0}, bson.A{1, 1}, bson.A{0, 1}}}}}}}, "Loop is not closed, first vertex does not equal last vertex"},
+		{"$geoWithin with point", bson.M{"loc": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Point", "coordinates": bson.A{1, 2}}}}}, "$geoWithin not supported with provided geometry, only Polygon and MultiPolygon are supported"},
+		{"unknown shape", bson.M{"loc": bson.M{"$geoWithin": bson.M{"$circle": bson.A{}}}}, "unknown geo specifier: $circle"},
+		{"negative distance", bson.M{"loc": bson.M{"$near": bson.A{1, 2}, "$maxDistance": -1}}, "$maxDistance must be non-negative"},
+		{"$maxDistance without $near", bson.M{"loc": bson.M{"$maxDistance": 1}}, "$maxDistance can only be used with $near and $nearSphere"},
+		{"$near within $or", bson.M{"$or": bson.A{bson.M{"loc": bson.M{"$near": bson.A{1, 2}}}}}, "$near is not allowed within $or and $nor"},
+		{"multiple $near", bson.M{"a": bson.M{"$near": bson.A{1, 2}}, "b": bson.M{"$near": bson.A{1, 2}}}, "Too many geoNear expressions"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			_, err := Compile(testCase.Filter)
+			ErrorIs(t, err, ErrBadValue)
+
+			filterErr := &FilterError{}
+			if ErrorAs(t, err, &filterErr) {
+				Equal(t, testCase.Message, filterErr.Message)
+			}
+		})
+	}
+}
+
+type testAddress struct {
+	City string `bson:"city"`
+	Zip  string `bson:"zip,omitempty"`
+}
+
+type Timestamps struct {
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type testUser struct {
+	Name       string         `bson:"name"`
+	Age        int            `bson:"age,omitempty"`
+	Password   string         `bson:"-"`
+	Address    *testAddress   `bson:"address"`
+	Previous   []testAddress  `bson:"previous"`
+	Score      json.Number    `bson:"score"`
+	Extra      any            `bson:"extra"`
+	Nickname   string         // encoded as "nickname"
+	Labels     map[string]any `bson:",inline"`
+	Timestamps `bson:",inline"`
+}
+
+func TestFilterSlice(t *testing.T) {
+	createdAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := []testUser{
+		{
+			Name:       "alice",
+			Age:        30,
+			Password:   "secret",
+			Address:    &testAddress{City: "Amsterdam", Zip: "1000"},
+			Previous:   []testAddress{{City: "Utrecht"}, {City: "Paris", Zip: "75000"}},
+			Score:      "12.5",
+			Extra:      json.Number("3"),
+			Nickname:   "al",
+			Labels:     map[string]any{"team": "a"},
+			Timestamps: Timestamps{CreatedAt: createdAt},
+		},
+		{Name: "bob", Score: "1"},
+	}
+
+	filters := []struct {
+		Filter  bson.M
+		Matches []string
+	}{
+		{bson.M{"name": "alice"}, []string{"alice"}},
+		{bson.M{"age": bson.M{"$exists": false}}, []string{"bob"}},
+		{bson.M{"age": bson.M{"$gte": 18}}, []string{"alice"}},
+		{bson.M{"password": bson.M{"$exists": true}}, []string{}},
+		{bson.M{"Password": bson.M{"$exists": true}}, []string{}},
+		{bson.M{"address.city": "Amsterdam"}, []string{"alice"}},
+		{bson.M{"address": nil}, []string{"bob"}},
+		{bson.M{"address": bson.M{"city": "Amsterdam", "zip": "1000"}}, []string{"alice"}},
+		{bson.M{"previous.zip": bson.M{"$exists": true}}, []string{"alice"}},
+		{bson.M{"previous": bson.M{"city": "Utrecht"}}, []string{"alice"}},
+		{bson.M{"score": bson.M{"$gt": 10}}, []string{"alice"}},
+		{bson.M{"score": bson.M{"$type": "number"}}, []string{"alice", "bob"}},
+		{bson.M{"extra": 3}, []string{"alice"}},
+		{bson.M{"nickname": "al"}, []string{"alice"}},
+		{bson.M{"team": "a"}, []string{"alice"}},
+		{bson.M{"createdAt": createdAt}, []string{"alice"}},
+		{bson.M{"createdAt": bson.M{"$gt": createdAt}}, []string{}},
+	}
+
+	for _, testCase := range filters {
+		t.Run(fmt.Sprintf("%v", testCase.Filter), func(t *testing.T) {
+			results, err := FilterSlice(users, testCase.Filter)
+			NoError(t, err)
+
+			names := []string{}
+			for _, result := range results {
+				names = append(names, result.Name)
+			}
+			Equal(t, testCase.Matches, names)
+
+			// Matching the struct directly should equal matching the struct converted to bson
+			for _, user := range users {
+				Equal(t, Match(mustConvertToBson(user), testCase.Filter), Match(&user, testCase.Filter), user.Name)
+			}
+		})
+	}
+
+	_, err := FilterSlice(users, bson.M{"name": bson.M{"$foo": 1}})
+	ErrorIs(t, err, ErrUnknownOperator)
+
+	matches, err := Any(users[1], bson.M{"name": "bob"})
+	NoError(t, err)
+	True(t, matches)
+
+	_, err = Any(users[1], bson.M{"$in": 1})
+	Error(t, err)
+}
+
+// UUID is a UUID type that encodes itself as a UUID binary
+type UUID [16]byte
+
+func (u UUID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(primitive.Binary{Subtype: bsontype.BinaryUUID, Data: u[:]})
+}
+
+func TestPrimitiveValues(t *testing.T) {
+	id := UUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	uuidBinary := primitive.Binary{Subtype: 4, Data: id[:]}
+	genericBinary := primitive.Binary{Subtype: 0, Data: id[:]}
+	timestamp := primitive.Timestamp{T: 10, I: 1}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	dateTime := primitive.NewDateTimeFromTime(now)
+	decimal := mustParseDecimal128("1.50")
+
+	raw, err := bson.Marshal(bson.M{"v": uuidBinary})
+	NoError(t, err)
+	rawValue := bson.Raw(raw).Lookup("v")
+
+	cases := []struct {
+		Name     string
+		Document any
+		Filter   bson.M
+		Matches  bool
+	}{
+		{"binary", bson.M{"a": uuidBinary}, bson.M{"a": uuidBinary}, true},
+		{"binary pointer", bson.M{"a": &uuidBinary}, bson.M{"a": uuidBinary}, true},
+		{"binary $in", bson.M{"a": uuidBinary}, bson.M{"a": bson.M{"$in": bson.A{genericBinary, uuidBinary}}}, true},
+		{"binary with other subtype", bson.M{"a": uuidBinary}, bson.M{"a": genericBinary}, false},
+		{"binary $gt by length", bson.M{"a": uuidBinary}, bson.M{"a": bson.M{"$gt": primitive.Binary{Subtype: 5, Data: []byte{1}}}}, true},
+		{"UUID equals UUID binary", bson.M{"a": id}, bson.M{"a": uuidBinary}, true},
+		{"UUID binary equals UUID", bson.M{"a": uuidBinary}, bson.M{"a": id}, true},
+		{"UUID does not equal generic binary", bson.M{"a": genericBinary}, bson.M{"a": id}, false},
+		{"byte array equals generic binary", bson.M{"a": genericBinary}, bson.M{"a": [16]byte(id)}, true},
+		{"byte array does not equal UUID binary", bson.M{"a": uuidBinary}, bson.M{"a": [16]byte(id)}, false},
+		{"UUID does not equal MD5 binary", bson.M{"a": primitive.Binary{Subtype: 5, Data: id[:]}}, bson.M{"a": id}, false},
+		{"UUID pointer", bson.M{"a": &id}, bson.M{"a": uuidBinary}, true},
+		{"UUID $in", bson.M{"a": uuidBinary}, bson.M{"a": bson.M{"$in": bson.A{id}}}, true},
+		{"UUID $nin", bson.M{"a": uuidBinary}, bson.M{"a": bson.M{"$nin": bson.A{id}}}, false},
+		{"UUID struct field", struct {
+			A UUID `bson:"a"`
+		}{id}, bson.M{"a": uuidBinary}, true},
+		{"UUID $type", bson.M{"a": id}, bson.M{"a": bson.M{"$type": "binData"}}, true},
+		{"timestamp", bson.M{"a": timestamp}, bson.M{"a": timestamp}, true},
+		{"timestamp $gt", bson.M{"a": primitive.Timestamp{T: 10, I: 2}}, bson.M{"a": bson.M{"$gt": timestamp}}, true},
+		{"timestamp pointer $in", bson.M{"a": &timestamp}, bson.M{"a": bson.M{"$in": bson.A{timestamp}}}, true},
+		{"timestamp does not equal date", bson.M{"a": timestamp}, bson.M{"a": dateTime}, false},
+		{"date time equals time", bson.M{"a": dateTime}, bson.M{"a": now}, true},
+		{"time equals date time", bson.M{"a": now}, bson.M{"a": dateTime}, true},
+		{"date time $lt", bson.M{"a": dateTime}, bson.M{"a": bson.M{"$lt": now.Add(time.Second)}}, true},
+		{"decimal", bson.M{"a": decimal}, bson.M{"a": 1.5}, true},
+		{"decimal pointer $in", bson.M{"a": &decimal}, bson.M{"a": bson.M{"$in": bson.A{1.5}}}, true},
+		{"decimal $gt", bson.M{"a": decimal}, bson.M{"a": bson.M{"$gt": 1}}, true},
+		{"raw value", bson.M{"a": rawValue}, bson.M{"a": uuidBinary}, true},
+		{"raw value filter", bson.M{"a": uuidBinary}, bson.M{"a": rawValue}, true},
+		{"min key pointer", bson.M{"a": 1}, bson.M{"a": bson.M{"$gt": &primitive.MinKey{}}}, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			Equal(t, testCase.Matches, Match(testCase.Document, testCase.Filter))
+		})
+	}
+}
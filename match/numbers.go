@@ -1,112 +1,257 @@
 package match
 
 import (
+	"math"
+	"math/big"
 	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-type numberComparatorT struct {
-	Int   func(a, b int64) bool
-	Uint  func(a, b uint64) bool
-	Float func(a, b float64) bool
-}
+// comparatorT checks the result of a comparison between a value and a filter
+type comparatorT func(result int) bool
 
-var eqComparator = numberComparatorT{
-	Int:   func(a, b int64) bool { return a == b },
-	Uint:  func(a, b uint64) bool { return a == b },
-	Float: func(a, b float64) bool { return a == b },
-}
-var gtComparator = numberComparatorT{
-	Int:   func(a, b int64) bool { return a > b },
-	Uint:  func(a, b uint64) bool { return a > b },
-	Float: func(a, b float64) bool { return a > b },
-}
-var gteComparator = numberComparatorT{
-	Int:   func(a, b int64) bool { return a >= b },
-	Uint:  func(a, b uint64) bool { return a >= b },
-	Float: func(a, b float64) bool { return a >= b },
+var eqComparator comparatorT = func(result int) bool { return result == 0 }
+var gtComparator comparatorT = func(result int) bool { return result > 0 }
+var gteComparator comparatorT = func(result int) bool { return result >= 0 }
+var ltComparator comparatorT = func(result int) bool { return result < 0 }
+var lteComparator comparatorT = func(result int) bool { return result <= 0 }
+
+// numbersMatchComparison checks if the number value compares to the number filter as expected by the comparator
+// Like MongoDB NaN only equals NaN and never is greater or less than another number
+func numbersMatchComparison(value any, filter any, comparator comparatorT) bool {
+	value = normalizeNumber(value)
+	filter = normalizeNumber(filter)
+
+	valueIsNaN := numberIsNaN(value)
+	filterIsNaN := numberIsNaN(filter)
+	if valueIsNaN || filterIsNaN {
+		return valueIsNaN && filterIsNaN && comparator(0)
+	}
+
+	return comparator(compareNumbers(value, filter))
 }
-var ltComparator = numberComparatorT{
-	Int:   func(a, b int64) bool { return a < b },
-	Uint:  func(a, b uint64) bool { return a < b },
-	Float: func(a, b float64) bool { return a < b },
+
+// compareNumbers compares two numbers exactly
+// Returns 0 if a == b, -1 if a < b and 1 if a > b
+//
+// Numbers are ordered like MongoDB orders them: NaN < -Infinity < finite numbers < +Infinity
+// Integers, doubles and decimals with the same value are equal, so 1 == 1.0 == Decimal128("1.00")
+func compareNumbers(a, b any) int {
+	a = normalizeNumber(a)
+	b = normalizeNumber(b)
+
+	aIsNaN := numberIsNaN(a)
+	bIsNaN := numberIsNaN(b)
+	if aIsNaN || bIsNaN {
+		switch {
+		case aIsNaN && bIsNaN:
+			return 0
+		case aIsNaN:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	aInf := numberInfSign(a)
+	bInf := numberInfSign(b)
+	if aInf != 0 || bInf != 0 {
+		return compareInts(int64(aInf), int64(bInf))
+	}
+
+	switch typedA := a.(type) {
+	case int64:
+		switch typedB := b.(type) {
+		case int64:
+			return compareInts(typedA, typedB)
+		case uint64:
+			// uint64 values are only kept if they do not fit in an int64
+			return -1
+		case float64:
+			if typedA > -1<<53 && typedA < 1<<53 {
+				// The int can be represented exactly as a double
+				return compareFloats(float64(typedA), typedB)
+			}
+		}
+	case uint64:
+		switch typedB := b.(type) {
+		case int64:
+			return 1
+		case uint64:
+			if typedA == typedB {
+				return 0
+			}
+			if typedA < typedB {
+				return -1
+			}
+			return 1
+		}
+	case float64:
+		switch typedB := b.(type) {
+		case float64:
+			return compareFloats(typedA, typedB)
+		case int64:
+			if typedB > -1<<53 && typedB < 1<<53 {
+				return compareFloats(typedA, float64(typedB))
+			}
+		}
+	}
+
+	// Slow path for decimals and large integers compared to doubles
+	return numberToRat(a).Cmp(numberToRat(b))
 }
-var lteComparator = numberComparatorT{
-	Int:   func(a, b int64) bool { return a <= b },
-	Uint:  func(a, b uint64) bool { return a <= b },
-	Float: func(a, b float64) bool { return a <= b },
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
 }
 
-func numberValueMatchesFilter(value any, filter any, numberComparator numberComparatorT) bool {
-	switch typedFilter := filter.(type) {
-	case int, int8, int16, int32, int64:
-		filterInt := reflect.ValueOf(filter).Int()
-		return intFilterMatches(value, filterInt, numberComparator)
-	case uint, uint8, uint16, uint32, uint64:
-		filterUint := reflect.ValueOf(filter).Uint()
-		return uintFilterMatches(value, filterUint, numberComparator)
+// normalizeNumber converts a number into an int64, float64 or primitive.Decimal128
+// Unsigned integers that do not fit in an int64 are kept as uint64
+func normalizeNumber(value any) any {
+	switch typedValue := value.(type) {
+	case int64, float64, primitive.Decimal128:
+		return value
+	case int:
+		return int64(typedValue)
+	case int32:
+		return int64(typedValue)
 	case float32:
-		return floatFilterMatches(value, float64(typedFilter), numberComparator)
+		return float64(typedValue)
+	}
+
+	reflection, _ := MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
+	switch reflection.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflection.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		unsigned := reflection.Uint()
+		if unsigned > math.MaxInt64 {
+			return unsigned
+		}
+		return int64(unsigned)
+	case reflect.Float32, reflect.Float64:
+		return reflection.Float()
+	case reflect.Struct:
+		if decimal, ok := reflection.Interface().(primitive.Decimal128); ok {
+			return decimal
+		}
+	}
+
+	return value
+}
+
+func numberIsNaN(number any) bool {
+	switch typedNumber := number.(type) {
 	case float64:
-		return floatFilterMatches(value, typedFilter, numberComparator)
-	default:
-		return false
+		return math.IsNaN(typedNumber)
+	case primitive.Decimal128:
+		return typedNumber.IsNaN()
 	}
+	return false
 }
 
-func intFilterMatches(value any, filter int64, numberComparator numberComparatorT) bool {
-	switch value.(type) {
-	case int, int8, int16, int32, int64:
-		return numberComparator.Int(reflect.ValueOf(value).Int(), filter)
-	case uint, uint8, uint16, uint32, uint64:
-		return numberComparator.Int(int64(reflect.ValueOf(value).Uint()), filter)
-	case float32, float64:
-		typedValue := reflect.ValueOf(value).Float()
-		if int64(typedValue*1000)%1000 == 0 {
-			return numberComparator.Int(int64(typedValue), filter)
+// numberInfSign returns 1 for +Infinity, -1 for -Infinity and 0 for all other numbers
+func numberInfSign(number any) int {
+	switch typedNumber := number.(type) {
+	case float64:
+		if math.IsInf(typedNumber, 1) {
+			return 1
 		}
-		return numberComparator.Float(typedValue, float64(filter))
-	default:
-		return false
+		if math.IsInf(typedNumber, -1) {
+			return -1
+		}
+	case primitive.Decimal128:
+		return typedNumber.IsInf()
 	}
+	return 0
 }
 
-func uintFilterMatches(value any, filter uint64, numberComparator numberComparatorT) bool {
-	switch value.(type) {
-	case int, int8, int16, int32, int64:
-		typedValue := reflect.ValueOf(value).Int()
-		if typedValue < 0 {
-			return false
+var bigTen = big.NewInt(10)
+
+// numberToRat converts a finite normalized number into an exact rational number
+func numberToRat(number any) *big.Rat {
+	switch typedNumber := number.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(typedNumber)
+	case uint64:
+		return new(big.Rat).SetUint64(typedNumber)
+	case float64:
+		return new(big.Rat).SetFloat64(typedNumber)
+	case primitive.Decimal128:
+		coefficient, exponent, err := typedNumber.BigInt()
+		if err != nil {
+			return new(big.Rat)
 		}
-		return numberComparator.Uint(uint64(typedValue), filter)
-	case uint, uint8, uint16, uint32, uint64:
-		return numberComparator.Uint(reflect.ValueOf(value).Uint(), filter)
-	case float32, float64:
-		typedValue := reflect.ValueOf(value).Float()
-		if typedValue < 0 {
-			return false
+
+		result := new(big.Rat).SetInt(coefficient)
+		if exponent == 0 {
+			return result
 		}
-		if uint64(typedValue*1000)%1000 == 0 {
-			return numberComparator.Uint(uint64(typedValue), filter)
+
+		scale := new(big.Rat).SetInt(new(big.Int).Exp(bigTen, big.NewInt(int64(abs(exponent))), nil))
+		if exponent > 0 {
+			return result.Mul(result, scale)
 		}
-		return numberComparator.Float(typedValue, float64(filter))
-	default:
-		return false
+		return result.Quo(result, scale)
 	}
+	return new(big.Rat)
 }
 
-func floatFilterMatches(value any, filter float64, numberComparator numberComparatorT) bool {
-	if int64(filter*1000)%1000 == 0 {
-		return intFilterMatches(value, int64(filter), numberComparator)
+func abs(value int) int {
+	if value < 0 {
+		return -value
 	}
+	return value
+}
 
-	switch value.(type) {
-	case float32, float64:
-		return numberComparator.Float(reflect.ValueOf(value).Float(), filter)
-	case int, int8, int16, int32, int64:
-		return numberComparator.Float(float64(reflect.ValueOf(value).Int()), filter)
-	case uint, uint8, uint16, uint32, uint64:
-		return numberComparator.Float(float64(reflect.ValueOf(value).Uint()), filter)
+// floatValue converts a number into a float64
+// Returns false if the value is not a number or is NaN.
+func floatValue(value any) (float64, bool) {
+	value = unwrapComparable(value)
+	if canonicalTypeOrder(value) != typeOrderNumber {
+		return 0, false
+	}
+	switch number := normalizeNumber(value).(type) {
+	case int64:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case float64:
+		return number, !math.IsNaN(number)
 	default:
-		return false
+		if infSign := numberInfSign(number); infSign != 0 {
+			return math.Inf(infSign), true
+		}
+		result, _ := numberToRat(number).Float64()
+		return result, !numberIsNaN(number)
+	}
+}
+
+// truncateNumber converts a number into an int64 by truncating it towards zero
+// Returns false for NaN, infinity and numbers that do not fit in an int64.
+func truncateNumber(value any) (int64, bool) {
+	number := normalizeNumber(unwrapComparable(value))
+	switch typedNumber := number.(type) {
+	case int64:
+		return typedNumber, true
+	case uint64:
+		return 0, false
+	}
+	if numberIsNaN(number) || numberInfSign(number) != 0 {
+		return 0, false
+	}
+
+	rat := numberToRat(number)
+	truncated := new(big.Int).Quo(rat.Num(), rat.Denom())
+	if !truncated.IsInt64() {
+		return 0, false
 	}
+	return truncated.Int64(), true
 }
@@ -0,0 +1,32 @@
+package match
+
+import (
+	"math/rand"
+)
+
+// CompileOption changes how a filter is compiled, see Compile
+type CompileOption func(options *compileOptionsT)
+
+// compileOptionsT contains the settings of the compile options passed to Compile
+type compileOptionsT struct {
+	// random returns a random number in [0, 1) for $sampleRate
+	random func() float64
+}
+
+// WithRandom sets the random number generator used by $sampleRate
+// The function must return a number in [0, 1) like rand.Float64.
+// Use a seeded generator within tests to make the documents selected by $sampleRate reproducible.
+func WithRandom(random func() float64) CompileOption {
+	return func(options *compileOptionsT) {
+		options.random = random
+	}
+}
+
+// newCompileOptions applies the compile options on top of the defaults
+func newCompileOptions(options []CompileOption) *compileOptionsT {
+	result := &compileOptionsT{random: rand.Float64}
+	for _, option := range options {
+		option(result)
+	}
+	return result
+}
@@ -2,13 +2,23 @@ package match
 
 import (
 	"reflect"
+	"strconv"
 	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // sliceLikeToSlice converts a slice-like value to a slice of any.
 // A slice-like value is either a slice or an array or a pointer to a slice or an array.
 // Nil slice-like values are returned as empty slices.
 func sliceLikeToSlice(sliceLike any) (slice []any, isSliceLike bool) {
+	switch typedSliceLike := sliceLike.(type) {
+	case bson.A:
+		return typedSliceLike, true
+	case []any:
+		return typedSliceLike, true
+	}
+
 	sliceReflection, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(sliceLike))
 	kind := sliceReflection.Kind()
 	if kind != reflect.Slice && kind != reflect.Array {
@@ -46,36 +56,103 @@ outer:
 	return v, isNil
 }
 
-// lookupMapKey looks up a key in a map.
+// missingT is the type of the missing value
+type missingT struct{}
+
+// missing is the value of a key that does not exist within a document
+// It compares as null but unlike null it does not match {$exists: true} or {$type: "null"}
+var missing = missingT{}
+
+// lookupMapKey looks up all values of a key in a map.
 // Note that the key can also be a nested key like "foo.bar.baz".
-func lookupMapKey(scope reflect.Value, key string) *reflect.Value {
-	nestedFilterkeyParts := strings.Split(key, ".")
-	for _, part := range nestedFilterkeyParts {
-		unwrappedScope, isNil := MightUnwrapPointersAndInterfaces(scope)
-		if isNil {
-			return nil
+//
+// Like MongoDB arrays are traversed implicitly, so "foo.bar" resolves to every bar of foo: [{bar: 1}, {bar: 2}].
+// Numeric key parts also resolve to the array element at that index, so "foo.0" resolves to 1 within foo: [1, 2].
+// Arrays directly nested within arrays are only reachable using numeric key parts.
+//
+// Keys that do not exist resolve to the missing value, this can happen multiple times if only some of
+// the documents within an array contain the key
+func lookupMapKey(scope any, key string) []any {
+	return lookupPath(scope, strings.Split(key, "."))
+}
+
+func lookupPath(scope any, path []string) []any {
+	if len(path) == 0 {
+		return []any{scope}
+	}
+
+	unwrappedScope, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(scope))
+	if isNil || !unwrappedScope.IsValid() {
+		return []any{missing}
+	}
+	scope = unwrappedScope.Interface()
+
+	switch canonicalTypeOrder(scope) {
+	case typeOrderObject:
+		value, ok := documentField(scope, path[0])
+		if !ok {
+			return []any{missing}
+		}
+		return lookupPath(value, path[1:])
+	case typeOrderArray:
+		entries, _ := sliceLikeToSlice(scope)
+		results := []any{}
+
+		index, err := strconv.Atoi(path[0])
+		if err == nil && index >= 0 && index < len(entries) {
+			results = append(results, lookupPath(entries[index], path[1:])...)
 		}
 
-		switch unwrappedScope.Kind() {
-		case reflect.Struct:
-			unwrappedScope = reflect.ValueOf(mustConvertToBson(unwrappedScope.Interface()))
-			if unwrappedScope.IsNil() {
-				return nil
+		for _, entry := range entries {
+			if canonicalTypeOrder(unwrapComparable(entry)) == typeOrderObject {
+				results = append(results, lookupPath(entry, path)...)
 			}
-		case reflect.Map:
-			if unwrappedScope.IsNil() {
-				return nil
+		}
+
+		if len(results) == 0 {
+			return []any{missing}
+		}
+		return results
+	default:
+		return []any{missing}
+	}
+}
+
+// documentField looks up a single field of a document like value
+func documentField(document any, key string) (any, bool) {
+	switch typedDocument := document.(type) {
+	case bson.M:
+		value, ok := typedDocument[key]
+		return value, ok
+	case bson.D:
+		for _, entry := range typedDocument {
+			if entry.Key == key {
+				return entry.Value, true
 			}
-			// continue
-		default:
-			return nil
 		}
+		return nil, false
+	case bson.Raw:
+		return documentField(mustConvertToBsonD(typedDocument), key)
+	}
 
-		scope = unwrappedScope.MapIndex(reflect.ValueOf(part))
-		if !scope.IsValid() {
-			return nil
+	documentReflection := reflect.ValueOf(document)
+	switch documentReflection.Kind() {
+	case reflect.Struct:
+		description := describeStruct(documentReflection.Type())
+		if description.encodesItself {
+			return documentField(mustConvertToBson(document), key)
 		}
+		return description.field(documentReflection, key)
+	case reflect.Map:
+		if documentReflection.IsNil() || documentReflection.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		value := documentReflection.MapIndex(reflect.ValueOf(key).Convert(documentReflection.Type().Key()))
+		if !value.IsValid() {
+			return nil, false
+		}
+		return value.Interface(), true
+	default:
+		return nil, false
 	}
-	scope, _ = MightUnwrapPointersAndInterfaces(scope)
-	return &scope
 }
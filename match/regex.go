@@ -0,0 +1,98 @@
+package match
+
+import (
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// parseRegexOperator parses the $regex operator including the $options operator next to it
+// Like {$regex: "^foo", $options: "i"} or {$regex: /^foo/i}
+func parseRegexOperator(filter bson.D, path string) (primitive.Regex, error) {
+	regex := primitive.Regex{}
+	hasOptions := false
+	for _, entry := range filter {
+		switch entry.Key {
+		case "$regex":
+			switch value := unwrapComparable(entry.Value).(type) {
+			case string:
+				regex.Pattern = value
+			case primitive.Regex:
+				regex.Pattern = value.Pattern
+				if value.Options != "" {
+					if hasOptions || regex.Options != "" {
+						return regex, newFilterError(path, ErrBadValue, "options set in both $regex and $options")
+					}
+					regex.Options = value.Options
+				}
+			default:
+				return regex, newFilterError(path, ErrBadValue, "$regex has to be a string")
+			}
+		case "$options":
+			options, ok := unwrapComparable(entry.Value).(string)
+			if !ok {
+				return regex, newFilterError(path, ErrBadValue, "$options has to be a string")
+			}
+			if regex.Options != "" && options != "" {
+				return regex, newFilterError(path, ErrBadValue, "options set in both $regex and $options")
+			}
+			regex.Options, hasOptions = options, true
+		}
+	}
+	return regex, nil
+}
+
+// compileRegex compiles a regular expression like /^foo/i into a matcher
+// Like MongoDB strings, symbols and arrays of them match if the pattern matches, regular expressions match if they are equal.
+func compileRegex(regex primitive.Regex, path string) (valueMatcherT, error) {
+	flags := ""
+	for _, option := range regex.Options {
+		switch option {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, option) {
+				flags += string(option)
+			}
+		case 'x', 'u':
+			return nil, newFilterError(path, ErrNotSupported, "regex option %c is not supported by mongomock", option)
+		default:
+			return nil, newFilterError(path, ErrBadValue, "invalid flag in regex options: %c", option)
+		}
+	}
+
+	pattern := regex.Pattern
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newFilterError(path, ErrBadValue, "Regular expression is invalid: %s", err.Error())
+	}
+
+	matchesValue := func(value any) bool {
+		switch typedValue := unwrapComparable(value).(type) {
+		case string:
+			return compiled.MatchString(typedValue)
+		case primitive.Symbol:
+			return compiled.MatchString(string(typedValue))
+		case primitive.Regex:
+			return typedValue.Pattern == regex.Pattern && typedValue.Options == regex.Options
+		}
+		return false
+	}
+
+	return func(value any) bool {
+		value = unwrapComparable(value)
+		if isArray(value) {
+			entries, _ := sliceLikeToSlice(value)
+			for _, entry := range entries {
+				if matchesValue(entry) {
+					return true
+				}
+			}
+			return false
+		}
+		return matchesValue(value)
+	}, nil
+}
@@ -0,0 +1,246 @@
+package match
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// structDescriptionT describes how the bson package encodes a struct type
+// This allows looking up fields of structs directly instead of converting the full struct to bson for every lookup
+type structDescriptionT struct {
+	fields []structFieldT
+	byName map[string]int
+	// inlineMap is the index of a map field tagged with inline, nil if there is none
+	inlineMap []int
+	// encodesItself is true if the struct implements its own bson encoding, it's converted to bson before matching
+	encodesItself bool
+}
+
+// structFieldT is a field of a struct as it's encoded by the bson package
+type structFieldT struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	// convert is true if the value of the field might encode differently than it's Go value, see needsConversion
+	convert bool
+}
+
+var (
+	structDescriptions = sync.Map{}
+
+	marshalerType      = reflect.TypeOf((*bson.Marshaler)(nil)).Elem()
+	valueMarshalerType = reflect.TypeOf((*bsoncodec.ValueMarshaler)(nil)).Elem()
+	zeroerType         = reflect.TypeOf((*bsoncodec.Zeroer)(nil)).Elem()
+	jsonNumberType     = reflect.TypeOf(json.Number(""))
+	urlType            = reflect.TypeOf(url.URL{})
+	rawValueType       = reflect.TypeOf(bson.RawValue{})
+
+	encodesItselfCache = sync.Map{}
+)
+
+// describeStruct returns the cached description of a struct type
+func describeStruct(structType reflect.Type) *structDescriptionT {
+	cached, ok := structDescriptions.Load(structType)
+	if ok {
+		return cached.(*structDescriptionT)
+	}
+
+	description := &structDescriptionT{
+		byName:        map[string]int{},
+		encodesItself: typeEncodesItself(structType),
+	}
+	if !description.encodesItself {
+		description.addFields(structType, nil)
+	}
+
+	structDescriptions.Store(structType, description)
+	return description
+}
+
+// addFields adds the fields of a struct type to the description following the rules of bson's StructCodec
+// Inlined fields are added with their full index, like encoding/json fields at a lower depth win over deeper fields with the same name.
+func (d *structDescriptionT) addFields(structType reflect.Type, parentIndex []int) {
+	for idx := 0; idx < structType.NumField(); idx++ {
+		structField := structType.Field(idx)
+		if !structField.IsExported() {
+			continue
+		}
+
+		tags, err := bsoncodec.DefaultStructTagParser(structField)
+		if err != nil || tags.Skip {
+			continue
+		}
+
+		index := append(append([]int{}, parentIndex...), idx)
+		if tags.Inline {
+			fieldType := structField.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			switch fieldType.Kind() {
+			case reflect.Struct:
+				d.addFields(fieldType, index)
+			case reflect.Map:
+				d.inlineMap = index
+			}
+			continue
+		}
+
+		existingIdx, exists := d.byName[tags.Name]
+		if exists {
+			if len(d.fields[existingIdx].index) <= len(index) {
+				continue
+			}
+			d.fields = append(d.fields[:existingIdx], d.fields[existingIdx+1:]...)
+			for name, fieldIdx := range d.byName {
+				if fieldIdx > existingIdx {
+					d.byName[name] = fieldIdx - 1
+				}
+			}
+		}
+
+		d.byName[tags.Name] = len(d.fields)
+		d.fields = append(d.fields, structFieldT{
+			name:      tags.Name,
+			index:     index,
+			omitEmpty: tags.OmitEmpty,
+			convert:   needsConversion(structField.Type, map[reflect.Type]bool{}),
+		})
+	}
+}
+
+// field looks up a single field of a struct value
+func (d *structDescriptionT) field(structValue reflect.Value, key string) (any, bool) {
+	fieldIdx, ok := d.byName[key]
+	if !ok {
+		if d.inlineMap == nil {
+			return nil, false
+		}
+		inlineMap, err := structValue.FieldByIndexErr(d.inlineMap)
+		if err != nil {
+			return nil, false
+		}
+		return documentField(inlineMap.Interface(), key)
+	}
+
+	return d.fields[fieldIdx].value(structValue)
+}
+
+// value returns the value of the field within the struct value like it would be encoded by the bson package
+// Returns false if the field would be left out
+func (f structFieldT) value(structValue reflect.Value) (any, bool) {
+	fieldValue, err := structValue.FieldByIndexErr(f.index)
+	if err != nil {
+		// One of the inlined structs is a nil pointer
+		return nil, false
+	}
+	if f.omitEmpty && isEmptyValue(fieldValue) {
+		return nil, false
+	}
+
+	value := fieldValue.Interface()
+	if f.convert || fieldValue.Kind() == reflect.Interface && !fieldValue.IsNil() && needsConversion(fieldValue.Elem().Type(), map[reflect.Type]bool{}) {
+		return convertValue(value), true
+	}
+	return value, true
+}
+
+// toD converts a struct value into a bson.D
+func (d *structDescriptionT) toD(structValue reflect.Value) bson.D {
+	result := make(bson.D, 0, len(d.fields))
+	for _, field := range d.fields {
+		value, ok := field.value(structValue)
+		if ok {
+			result = append(result, bson.E{Key: field.name, Value: value})
+		}
+	}
+
+	if d.inlineMap != nil {
+		inlineMap, err := structValue.FieldByIndexErr(d.inlineMap)
+		if err == nil && !inlineMap.IsNil() {
+			result = append(result, documentToD(inlineMap.Interface())...)
+		}
+	}
+	return result
+}
+
+// isEmptyValue reports if a value is left out by the omitempty tag
+// This follows the defaults of bson's StructCodec where structs are never empty unless they implement Zeroer
+func isEmptyValue(value reflect.Value) bool {
+	if value.Type().Implements(zeroerType) && (value.Kind() != reflect.Ptr || !value.IsNil()) {
+		return value.Interface().(bsoncodec.Zeroer).IsZero()
+	}
+
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return value.IsNil()
+	}
+	return false
+}
+
+// typeEncodesItself is a cached version of encodesItself
+func typeEncodesItself(valueType reflect.Type) bool {
+	cached, ok := encodesItselfCache.Load(valueType)
+	if ok {
+		return cached.(bool)
+	}
+	result := encodesItself(valueType)
+	encodesItselfCache.Store(valueType, result)
+	return result
+}
+
+// encodesItself returns true if values of the type have their own bson encoding
+func encodesItself(valueType reflect.Type) bool {
+	if valueType.Implements(marshalerType) || valueType.Implements(valueMarshalerType) {
+		return true
+	}
+	pointerType := reflect.PtrTo(valueType)
+	if pointerType.Implements(marshalerType) || pointerType.Implements(valueMarshalerType) {
+		return true
+	}
+	return valueType == jsonNumberType || valueType == urlType || valueType == rawValueType
+}
+
+// needsConversion returns true if values of the type might not be understood by the matcher as they are
+// This is the case for types that encode themselves and for types containing them, like a slice of them.
+func needsConversion(valueType reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[valueType] {
+		return false
+	}
+	visited[valueType] = true
+
+	if typeEncodesItself(valueType) {
+		return true
+	}
+
+	// Fields of structs are converted when they are looked up, so only the container types are walked
+	switch valueType.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return needsConversion(valueType.Elem(), visited)
+	}
+	return false
+}
+
+// convertValue converts a value into the value it would be after encoding and decoding it as bson
+func convertValue(value any) any {
+	document := mustConvertToBsonD(bson.D{{Key: "v", Value: value}})
+	if len(document) == 0 {
+		return nil
+	}
+	return document[0].Value
+}
@@ -0,0 +1,148 @@
+package match
+
+import (
+	"github.com/mjarkk/mongomock/text"
+)
+
+// ParseTextSearch parses the value of a $text operator like {$search: "coffee", $language: "english"}
+func ParseTextSearch(value any) (*text.Search, error) {
+	return parseTextSearch(value, "$text")
+}
+
+func parseTextSearch(value any, path string) (*text.Search, error) {
+	document, ok := toFilterDocument(value)
+	if !ok {
+		return nil, newFilterError(path, ErrBadValue, "$text needs an object")
+	}
+
+	search := &text.Search{}
+	hasSearch := false
+	for _, entry := range document {
+		entryPath := joinPath(path, entry.Key)
+		entryValue := unwrapComparable(entry.Value)
+
+		switch entry.Key {
+		case "$search":
+			searchString, ok := entryValue.(string)
+			if !ok {
+				return nil, newFilterError(entryPath, ErrBadValue, "$search needs a String")
+			}
+			search.Query = text.ParseQuery(searchString)
+			hasSearch = true
+		case "$language":
+			languageName, ok := entryValue.(string)
+			if !ok {
+				return nil, newFilterError(entryPath, ErrBadValue, "$language needs a String")
+			}
+			language, err := text.LookupLanguage(languageName)
+			if err != nil {
+				return nil, newFilterError(entryPath, ErrBadValue, "language %q is not supported", languageName)
+			}
+			search.Language = language
+		case "$caseSensitive", "$diacriticSensitive":
+			sensitive, ok := entryValue.(bool)
+			if !ok {
+				return nil, newFilterError(entryPath, ErrBadValue, "%s needs a boolean", entry.Key)
+			}
+			if entry.Key == "$caseSensitive" {
+				search.Options.CaseSensitive = sensitive
+			} else {
+				search.Options.DiacriticSensitive = sensitive
+			}
+		default:
+			return nil, newFilterError(entryPath, ErrBadValue, "extra fields not allowed: %s", entry.Key)
+		}
+	}
+
+	if !hasSearch {
+		return nil, newFilterError(path, ErrBadValue, "missing $search field for $text operator")
+	}
+	return search, nil
+}
+
+// compileText compiles a $text operator
+// Without a text index all string fields of the document are searched through, as if a wildcard text index exists.
+// Documents can set their language using the language field, the default language is english.
+func compileText(value any, path string) (documentMatcherT, error) {
+	if path != "$text" && path != "$and.$text" {
+		return nil, newFilterError(path, ErrBadValue, "$text is only allowed at the top level or within a top level $and")
+	}
+
+	search, err := parseTextSearch(value, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(document any) bool {
+		_, matched := search.Score(TextFields(document, nil, "language", text.English), text.English)
+		return matched
+	}, nil
+}
+
+// TextFields returns the text of the document to search through
+// weights maps keys to their weight, the key "$**" or nil weights include all string fields with a weight of 1.
+// The language of the document is read from the languageOverride field, the default language is used if it's missing or unsupported.
+func TextFields(document any, weights map[string]float64, languageOverride string, defaultLanguage *text.Language) []text.Field {
+	language := defaultLanguage
+	for _, value := range lookupMapKey(document, languageOverride) {
+		languageName, ok := unwrapComparable(value).(string)
+		if !ok {
+			continue
+		}
+		documentLanguage, err := text.LookupLanguage(languageName)
+		if err == nil {
+			language = documentLanguage
+		}
+	}
+
+	fields := []text.Field{}
+	addStrings := func(value any, weight float64) {
+		walkStrings(value, func(value string) {
+			fields = append(fields, text.Field{Text: value, Weight: weight, Language: language})
+		})
+	}
+
+	wildcardWeight, isWildcard := weights["$**"]
+	if weights == nil {
+		isWildcard = true
+		wildcardWeight = 1
+	}
+	if isWildcard {
+		for _, entry := range documentToD(document) {
+			if entry.Key == languageOverride {
+				continue
+			}
+			weight, ok := weights[entry.Key]
+			if !ok {
+				weight = wildcardWeight
+			}
+			addStrings(entry.Value, weight)
+		}
+		return fields
+	}
+
+	for key, weight := range weights {
+		for _, value := range lookupMapKey(document, key) {
+			addStrings(value, weight)
+		}
+	}
+	return fields
+}
+
+// walkStrings calls fn for every string within a value, including the strings within arrays and embedded documents
+func walkStrings(value any, fn func(value string)) {
+	value = unwrapComparable(value)
+	switch canonicalTypeOrder(value) {
+	case typeOrderString:
+		fn(stringValue(value))
+	case typeOrderArray:
+		entries, _ := sliceLikeToSlice(value)
+		for _, entry := range entries {
+			walkStrings(entry, fn)
+		}
+	case typeOrderObject:
+		for _, entry := range documentToD(value) {
+			walkStrings(entry.Value, fn)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package match
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bsonTypeAliases contains the string aliases accepted by the $type operator
+// See: https://www.mongodb.com/docs/manual/reference/operator/query/type/#available-types
+var bsonTypeAliases = map[string][]bsontype.Type{
+	"double":              {bsontype.Double},
+	"string":              {bsontype.String},
+	"object":              {bsontype.EmbeddedDocument},
+	"array":               {bsontype.Array},
+	"binData":             {bsontype.Binary},
+	"undefined":           {bsontype.Undefined},
+	"objectId":            {bsontype.ObjectID},
+	"bool":                {bsontype.Boolean},
+	"date":                {bsontype.DateTime},
+	"null":                {bsontype.Null},
+	"regex":               {bsontype.Regex},
+	"dbPointer":           {bsontype.DBPointer},
+	"javascript":          {bsontype.JavaScript},
+	"symbol":              {bsontype.Symbol},
+	"javascriptWithScope": {bsontype.CodeWithScope},
+	"int":                 {bsontype.Int32},
+	"timestamp":           {bsontype.Timestamp},
+	"long":                {bsontype.Int64},
+	"decimal":             {bsontype.Decimal128},
+	"minKey":              {bsontype.MinKey},
+	"maxKey":              {bsontype.MaxKey},
+	"number":              {bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128},
+}
+
+// parseTypeFilter parses the value of a $type operator into the bson types it matches
+// The value can be a string alias, a numeric type code or an array of those
+func parseTypeFilter(filter any) ([]bsontype.Type, error) {
+	if isArray(filter) {
+		entries, _ := sliceLikeToSlice(filter)
+		types := []bsontype.Type{}
+		for _, entry := range entries {
+			entryTypes, err := parseTypeFilter(entry)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, entryTypes...)
+		}
+		return types, nil
+	}
+
+	switch canonicalTypeOrder(filter) {
+	case typeOrderString:
+		alias := stringValue(unwrapComparable(filter))
+		types, ok := bsonTypeAliases[alias]
+		if !ok {
+			return nil, fmt.Errorf("unknown type name alias: %s", alias)
+		}
+		return types, nil
+	case typeOrderNumber:
+		code, ok := integerValue(filter)
+		if !ok {
+			return nil, fmt.Errorf("invalid numerical type code: %v", filter)
+		}
+		switch {
+		case code == -1:
+			return []bsontype.Type{bsontype.MinKey}, nil
+		case code == int64(bsontype.MaxKey),
+			code >= int64(bsontype.Double) && code <= int64(bsontype.Decimal128):
+			return []bsontype.Type{bsontype.Type(code)}, nil
+		}
+		return nil, fmt.Errorf("invalid numerical type code: %d", code)
+	default:
+		return nil, errors.New("type must be represented as a number or a string")
+	}
+}
+
+// integerValue returns the number as int64 if it is a whole number
+func integerValue(value any) (int64, bool) {
+	reflection, _ := MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
+	switch reflection.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflection.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if reflection.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(reflection.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		float := reflection.Float()
+		if float != math.Trunc(float) || math.IsInf(float, 0) {
+			return 0, false
+		}
+		return int64(float), true
+	}
+	return 0, false
+}
+
+// valueHasType checks if the value has one of the bson types
+// Arrays also match if any of their elements has one of the types
+func valueHasType(value any, types []bsontype.Type) bool {
+	if value == missing {
+		return false
+	}
+
+	valueType := bsonTypeOf(value)
+	for _, expectedType := range types {
+		if valueType == expectedType {
+			return true
+		}
+	}
+
+	if valueType != bsontype.Array {
+		return false
+	}
+
+	entries, _ := sliceLikeToSlice(value)
+	for _, entry := range entries {
+		entryType := bsonTypeOf(entry)
+		for _, expectedType := range types {
+			if entryType == expectedType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bsonTypeOf returns the bson type a value is stored as
+// Go values are mapped to the type the mongo driver encodes them as
+func bsonTypeOf(value any) bsontype.Type {
+	switch typedValue := value.(type) {
+	case nil, primitive.Null:
+		return bsontype.Null
+	case primitive.Undefined:
+		return bsontype.Undefined
+	case primitive.MinKey:
+		return bsontype.MinKey
+	case primitive.MaxKey:
+		return bsontype.MaxKey
+	case float32, float64:
+		return bsontype.Double
+	case int8, int16, int32, uint8, uint16:
+		return bsontype.Int32
+	case int:
+		if typedValue >= math.MinInt32 && typedValue <= math.MaxInt32 {
+			return bsontype.Int32
+		}
+		return bsontype.Int64
+	case int64, uint, uint32, uint64:
+		return bsontype.Int64
+	case primitive.Decimal128:
+		return bsontype.Decimal128
+	case string:
+		return bsontype.String
+	case primitive.Symbol:
+		return bsontype.Symbol
+	case primitive.JavaScript:
+		return bsontype.JavaScript
+	case primitive.CodeWithScope:
+		return bsontype.CodeWithScope
+	case primitive.ObjectID:
+		return bsontype.ObjectID
+	case primitive.DateTime, time.Time:
+		return bsontype.DateTime
+	case primitive.Timestamp:
+		return bsontype.Timestamp
+	case primitive.Regex:
+		return bsontype.Regex
+	case primitive.Binary, []byte:
+		return bsontype.Binary
+	case primitive.DBPointer:
+		return bsontype.DBPointer
+	case bool:
+		return bsontype.Boolean
+	case bson.D, bson.M, bson.Raw:
+		return bsontype.EmbeddedDocument
+	case bson.A:
+		return bsontype.Array
+	}
+
+	reflection, isNil := MightUnwrapPointersAndInterfaces(reflect.ValueOf(value))
+	if isNil || !reflection.IsValid() {
+		return bsontype.Null
+	}
+	wasUnwrapped := reflect.TypeOf(value) != reflection.Type()
+	if wasUnwrapped && (reflection.Type().PkgPath() == primitivePkgPath || reflection.Type() == timeType) {
+		return bsonTypeOf(reflection.Interface())
+	}
+
+	switch reflection.Kind() {
+	case reflect.Bool:
+		return bsontype.Boolean
+	case reflect.Int:
+		return bsonTypeOf(int(reflection.Int()))
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return bsontype.Int32
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return bsontype.Int64
+	case reflect.Float32, reflect.Float64:
+		return bsontype.Double
+	case reflect.String:
+		return bsontype.String
+	case reflect.Struct, reflect.Map:
+		return bsontype.EmbeddedDocument
+	case reflect.Slice, reflect.Array:
+		if reflection.Type().Elem().Kind() == reflect.Uint8 {
+			return bsontype.Binary
+		}
+		return bsontype.Array
+	}
+
+	return bsontype.Undefined
+}
@@ -0,0 +1,130 @@
+package mongomock
+
+import (
+	"github.com/mjarkk/mongomock/match"
+	"github.com/mjarkk/mongomock/text"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// queryT is a compiled filter
+// The $text clause of a filter is evaluated using the text index of the collection, the rest of the filter by the match package
+type queryT struct {
+	matcher *match.Matcher
+	text    *text.Search
+}
+
+// resultT is a document that matched a query
+type resultT struct {
+	// idx is the index of the document within the documents of the collection
+	idx       int
+	document  documentT
+	textScore float64
+}
+
+// compileQuery compiles a filter of the collection, $sampleRate uses the random number generator of the connection
+func (c *Collection) compileQuery(filter any) (*queryT, error) {
+	// Compile the full filter first so it's fully validated, including the $text clause
+	matcher, err := match.Compile(filter, match.WithRandom(c.randomFloat))
+	if err != nil {
+		return nil, err
+	}
+	if filter == nil {
+		return &queryT{matcher: matcher}, nil
+	}
+
+	filterDocument, _ := match.ToDocument(filter)
+	textValue, filterWithoutText, err := extractText(filterDocument)
+	if err != nil {
+		return nil, err
+	}
+	if textValue == nil {
+		return &queryT{matcher: matcher}, nil
+	}
+
+	search, err := match.ParseTextSearch(textValue)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err = match.Compile(filterWithoutText, match.WithRandom(c.randomFloat))
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryT{matcher: matcher, text: search}, nil
+}
+
+// extractText removes the $text clause from a filter
+// The match package already made sure it's only at the top level or within a top level $and
+func extractText(filter bson.D) (textValue any, filterWithoutText bson.D, err error) {
+	texts := 0
+	filterWithoutText = bson.D{}
+	for _, entry := range filter {
+		switch entry.Key {
+		case "$text":
+			textValue = entry.Value
+			texts++
+			continue
+		case "$and":
+			andWithoutText := bson.A{}
+			andEntries, _ := match.ToArray(entry.Value)
+			for _, andEntry := range andEntries {
+				andFilter, _ := match.ToDocument(andEntry)
+				andFilterWithoutText := bson.D{}
+				for _, andFilterEntry := range andFilter {
+					if andFilterEntry.Key == "$text" {
+						textValue = andFilterEntry.Value
+						texts++
+						continue
+					}
+					andFilterWithoutText = append(andFilterWithoutText, andFilterEntry)
+				}
+				if len(andFilterWithoutText) > 0 {
+					andWithoutText = append(andWithoutText, andFilterWithoutText)
+				}
+			}
+
+			if len(andWithoutText) > 0 {
+				filterWithoutText = append(filterWithoutText, bson.E{Key: "$and", Value: andWithoutText})
+			}
+			continue
+		}
+		filterWithoutText = append(filterWithoutText, entry)
+	}
+
+	if texts > 1 {
+		return nil, nil, &match.FilterError{Path: "$text", Message: "Too many text expressions", Err: match.ErrBadValue}
+	}
+	return textValue, filterWithoutText, nil
+}
+
+// unsafeQuery returns the documents matching the query in the order of the collection
+func (c *Collection) unsafeQuery(query *queryT) ([]resultT, error) {
+	results := []resultT{}
+
+	if query.text == nil {
+		for idx, document := range c.documents {
+			if query.matcher.Match(document.bson) {
+				results = append(results, resultT{idx: idx, document: document})
+			}
+		}
+		return results, nil
+	}
+
+	index := c.unsafeTextIndex()
+	if index == nil {
+		return nil, ErrTextIndexRequired
+	}
+
+	candidates := index.candidates(query.text)
+	for idx, document := range c.documents {
+		if _, ok := candidates[document.id]; !ok {
+			continue
+		}
+		score, matched := query.text.Score(index.fields(document), index.defaultLanguage)
+		if !matched || !query.matcher.Match(document.bson) {
+			continue
+		}
+		results = append(results, resultT{idx: idx, document: document, textScore: score})
+	}
+	return results, nil
+}
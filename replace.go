@@ -1,30 +1,45 @@
 package mongomock
 
 import (
-	"github.com/mjarkk/mongomock/match"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // ReplaceFirst updates the first document in the database that matches the filter
-func (c *Collection) ReplaceFirst(filter bson.M, value any) error {
+func (c *Collection) ReplaceFirst(filter any, value any) error {
+	query, err := c.compileQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	replacementDocument, err := tryNewDocument(value)
+	if err != nil {
+		return err
+	}
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	replacementDocument, err := tryNewDocument(value)
+	results, err := c.unsafeQuery(query)
 	if err != nil {
 		return err
 	}
+	if len(results) == 0 {
+		return mongo.ErrNoDocuments
+	}
 
-	for i, entry := range c.documents {
-		if match.Match(entry.bson, filter) {
-			c.documents[i] = replacementDocument
-			return nil
-		}
+	idx := results[0].idx
+	c.unsafeRemoveFromIndexes(c.documents[idx])
+	err = c.unsafeAddToIndexes(replacementDocument)
+	if err != nil {
+		// Restore the index entries of the document that is kept
+		c.unsafeAddToIndexes(c.documents[idx])
+		return err
 	}
 
-	return mongo.ErrNoDocuments
+	c.documents[idx] = replacementDocument
+	return nil
 }
 
 // ReplaceFirstByID updates a document in the database by its ID
@@ -0,0 +1,87 @@
+package text
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnsupportedLanguage is returned for languages mongomock has no stemmer and stop words for
+var ErrUnsupportedLanguage = errors.New("unsupported language")
+
+// Language describes how the words of a language are stemmed and which words are ignored
+type Language struct {
+	// Name is the name of the language like MongoDB uses it, for example "english"
+	Name      string
+	stopWords map[string]struct{}
+	stem      func(word string) string
+}
+
+var (
+	// English stems words using the Porter stemmer and ignores common english words
+	English = &Language{
+		Name:      "english",
+		stopWords: englishStopWords,
+		stem:      stemEnglish,
+	}
+	// None does not stem words and has no stop words
+	None = &Language{
+		Name:      "none",
+		stopWords: map[string]struct{}{},
+		stem:      func(word string) string { return word },
+	}
+)
+
+var languages = map[string]*Language{
+	"english": English,
+	"en":      English,
+	"none":    None,
+}
+
+// LookupLanguage returns the language by its name or ISO 639-1 code like MongoDB accepts them
+func LookupLanguage(name string) (*Language, error) {
+	language, ok := languages[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrUnsupportedLanguage
+	}
+	return language, nil
+}
+
+// IsStopWord returns true if the lower case word is ignored in this language
+func (l *Language) IsStopWord(word string) bool {
+	_, ok := l.stopWords[strings.ToLower(word)]
+	return ok
+}
+
+// Stem returns the stem of a word
+func (l *Language) Stem(word string) string {
+	return l.stem(word)
+}
+
+var englishStopWords = toSet(
+	"a", "about", "above", "after", "again", "against", "all", "am", "an", "and", "any", "are", "as", "at",
+	"be", "because", "been", "before", "being", "below", "between", "both", "but", "by",
+	"can", "cannot", "could",
+	"did", "do", "does", "doing", "down", "during",
+	"each", "few", "for", "from", "further",
+	"had", "has", "have", "having", "he", "her", "here",
+	"hers", "herself", "him", "himself", "his", "how",
+	"i", "if", "in", "into", "is", "it", "its", "itself",
+	"me", "more", "most", "my", "myself",
+	"no", "nor", "not", "of", "off", "on", "once", "only", "or", "other", "ought", "our", "ours", "ourselves", "out",
+	"over", "own",
+	"same", "she", "should", "so", "some", "such",
+	"than", "that", "the", "their", "theirs", "them", "themselves", "then", "there", "these",
+	"they", "this", "those", "through", "to", "too",
+	"under", "until", "up", "very",
+	"was", "we", "were", "what", "when",
+	"where", "which", "while", "who", "whom", "why", "with", "would",
+	"you", "your", "yours", "yourself", "yourselves",
+)
+
+func toSet(words ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(words))
+	for _, word := range words {
+		set[word] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,194 @@
+package text
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Query is a parsed $search string like `coffee -decaf "iced tea"`
+type Query struct {
+	// Words are searched for, a document matches if it contains any of them
+	// The words of phrases are also included here
+	Words []string
+	// NegatedWords exclude documents that contain them, like -decaf
+	NegatedWords []string
+	// Phrases must all be contained in a document, like "iced tea"
+	Phrases []string
+	// NegatedPhrases exclude documents that contain them, like -"iced tea"
+	NegatedPhrases []string
+}
+
+// ParseQuery parses the $search string of a $text query
+// Words prefixed with a - are negated and text in double quotes is a phrase
+func ParseQuery(search string) Query {
+	query := Query{}
+
+	runes := []rune(search)
+	for idx := 0; idx < len(runes); idx++ {
+		r := runes[idx]
+		if unicode.IsSpace(r) {
+			continue
+		}
+
+		negated := false
+		if r == '-' && idx+1 < len(runes) && !unicode.IsSpace(runes[idx+1]) {
+			negated = true
+			idx++
+			r = runes[idx]
+		}
+
+		if r == '"' {
+			end := idx + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			phrase := string(runes[idx+1 : end])
+			idx = end
+
+			if strings.TrimSpace(phrase) == "" {
+				continue
+			}
+			if negated {
+				query.NegatedPhrases = append(query.NegatedPhrases, phrase)
+			} else {
+				query.Phrases = append(query.Phrases, phrase)
+				query.Words = append(query.Words, Words(phrase)...)
+			}
+			continue
+		}
+
+		end := idx
+		for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '"' {
+			end++
+		}
+		words := Words(string(runes[idx:end]))
+		idx = end - 1
+
+		if negated {
+			query.NegatedWords = append(query.NegatedWords, words...)
+		} else {
+			query.Words = append(query.Words, words...)
+		}
+	}
+
+	return query
+}
+
+// Search is a $text query
+type Search struct {
+	Query Query
+	// Language is used to stem the search terms, if nil the default language of the index is used
+	Language *Language
+	Options  Options
+}
+
+// Field is a field of a document that is searched through
+type Field struct {
+	Text string
+	// Weight is the significance of the field relative to other fields, MongoDB defaults to 1
+	Weight float64
+	// Language is the language of the text
+	Language *Language
+}
+
+// IndexTerms returns the stemmed terms to look up in a text index
+// Indexes are case and diacritic insensitive, so the options of the search are not applied here
+func (s *Search) IndexTerms(defaultLanguage *Language) []string {
+	return s.language(defaultLanguage).terms(s.Query.Words, Options{})
+}
+
+func (s *Search) language(defaultLanguage *Language) *Language {
+	if s.Language != nil {
+		return s.Language
+	}
+	return defaultLanguage
+}
+
+func (l *Language) terms(words []string, options Options) []string {
+	return l.Terms(strings.Join(words, " "), options)
+}
+
+// Score checks if the fields of a document match the search and returns the text score like MongoDB calculates it
+// The default language is used for the search terms if the search has no language
+func (s *Search) Score(fields []Field, defaultLanguage *Language) (score float64, matched bool) {
+	language := s.language(defaultLanguage)
+	searchTerms := toSet(language.terms(s.Query.Words, s.Options)...)
+	if len(searchTerms) == 0 {
+		return 0, false
+	}
+	negatedTerms := toSet(language.terms(s.Query.NegatedWords, s.Options)...)
+
+	matchedTerm := false
+	for _, field := range fields {
+		fieldTerms := field.Language.Terms(field.Text, s.Options)
+		for _, term := range fieldTerms {
+			if _, ok := negatedTerms[term]; ok {
+				return 0, false
+			}
+			if _, ok := searchTerms[term]; ok {
+				matchedTerm = true
+			}
+		}
+		score += scoreTerms(fieldTerms, searchTerms, field.Weight)
+	}
+	if !matchedTerm {
+		return 0, false
+	}
+
+	for _, phrase := range s.Query.Phrases {
+		if !s.containsPhrase(fields, phrase) {
+			return 0, false
+		}
+	}
+	for _, phrase := range s.Query.NegatedPhrases {
+		if s.containsPhrase(fields, phrase) {
+			return 0, false
+		}
+	}
+
+	return score, true
+}
+
+func (s *Search) containsPhrase(fields []Field, phrase string) bool {
+	phrase = Normalize(phrase, s.Options)
+	for _, field := range fields {
+		if strings.Contains(Normalize(field.Text, s.Options), phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// scoreTerms calculates the score of the search terms in the terms of a single field
+// Like MongoDB repeated terms add less and less to the score and the score is scaled by the length of the field
+func scoreTerms(fieldTerms []string, searchTerms map[string]struct{}, weight float64) float64 {
+	type termFrequencyT struct {
+		count     int
+		frequency float64
+		exponent  float64
+	}
+
+	frequencies := map[string]*termFrequencyT{}
+	for _, term := range fieldTerms {
+		if _, ok := searchTerms[term]; !ok {
+			continue
+		}
+
+		data, ok := frequencies[term]
+		if !ok {
+			data = &termFrequencyT{exponent: 1}
+			frequencies[term] = data
+		} else {
+			data.exponent *= 2
+		}
+		data.count++
+		data.frequency += 1 / data.exponent
+	}
+
+	score := 0.0
+	for _, data := range frequencies {
+		coefficient := 0.5*float64(data.count)/float64(len(fieldTerms)) + 0.5
+		score += weight * data.frequency * coefficient
+	}
+	return score
+}
@@ -0,0 +1,327 @@
+package text
+
+// stemEnglish reduces an english word to its stem using the Porter stemming algorithm
+// See: https://tartarus.org/martin/PorterStemmer/
+//
+// The word is expected to be in lower case, words containing non ascii letters are returned as is
+func stemEnglish(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for idx := 0; idx < len(word); idx++ {
+		if word[idx] < 'a' || word[idx] > 'z' {
+			return word
+		}
+	}
+
+	stemmer := &porterStemmer{b: []byte(word), k: len(word) - 1}
+	stemmer.step1ab()
+	if stemmer.k > 0 {
+		stemmer.step1c()
+		stemmer.step2()
+		stemmer.step3()
+		stemmer.step4()
+		stemmer.step5()
+	}
+	return string(stemmer.b[:stemmer.k+1])
+}
+
+// porterStemmer holds the word being stemmed
+// b[0:k+1] is the current word and j is a general offset into it set by ends
+type porterStemmer struct {
+	b []byte
+	k int
+	j int
+}
+
+// cons returns true if b[i] is a consonant
+func (z *porterStemmer) cons(i int) bool {
+	switch z.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		if i == 0 {
+			return true
+		}
+		return !z.cons(i - 1)
+	}
+	return true
+}
+
+// m measures the number of consonant sequences between 0 and j
+// With c a consonant sequence and v a vowel sequence, <..> indicates arbitrary presence:
+//
+//	<c><v>       gives 0
+//	<c>vc<v>     gives 1
+//	<c>vcvc<v>   gives 2
+func (z *porterStemmer) m() int {
+	n := 0
+	i := 0
+	for {
+		if i > z.j {
+			return n
+		}
+		if !z.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > z.j {
+				return n
+			}
+			if z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > z.j {
+				return n
+			}
+			if !z.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// vowelInStem returns true if b[0:j+1] contains a vowel
+func (z *porterStemmer) vowelInStem() bool {
+	for i := 0; i <= z.j; i++ {
+		if !z.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleConsonant returns true if b[j-1:j+1] is a double consonant
+func (z *porterStemmer) doubleConsonant(j int) bool {
+	if j < 1 || z.b[j] != z.b[j-1] {
+		return false
+	}
+	return z.cons(j)
+}
+
+// cvc returns true if b[i-2:i+1] is consonant - vowel - consonant and the last consonant is not w, x or y
+// This is used when trying to restore an e at the end of a short word like cav(e), lov(e), hop(e) or crim(e)
+func (z *porterStemmer) cvc(i int) bool {
+	if i < 2 || !z.cons(i) || z.cons(i-1) || !z.cons(i-2) {
+		return false
+	}
+	switch z.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends returns true if b[0:k+1] ends with s, if so j is set to the end of the remaining stem
+func (z *porterStemmer) ends(s string) bool {
+	length := len(s)
+	if length > z.k+1 || string(z.b[z.k-length+1:z.k+1]) != s {
+		return false
+	}
+	z.j = z.k - length
+	return true
+}
+
+// setTo replaces b[j+1:k+1] with s
+func (z *porterStemmer) setTo(s string) {
+	z.b = append(z.b[:z.j+1], s...)
+	z.k = z.j + len(s)
+}
+
+// replace replaces the suffix matched by ends with s if the remaining stem contains a consonant sequence
+func (z *porterStemmer) replace(s string) {
+	if z.m() > 0 {
+		z.setTo(s)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing
+//
+//	caresses  ->  caress
+//	ponies    ->  poni
+//	cats      ->  cat
+//	feed      ->  feed
+//	agreed    ->  agree
+//	plastered ->  plaster
+//	motoring  ->  motor
+//	hopping   ->  hop
+//	filing    ->  file
+func (z *porterStemmer) step1ab() {
+	if z.b[z.k] == 's' {
+		switch {
+		case z.ends("sses"):
+			z.k -= 2
+		case z.ends("ies"):
+			z.setTo("i")
+		case z.b[z.k-1] != 's':
+			z.k--
+		}
+	}
+
+	if z.ends("eed") {
+		if z.m() > 0 {
+			z.k--
+		}
+		return
+	}
+
+	if (z.ends("ed") || z.ends("ing")) && z.vowelInStem() {
+		z.k = z.j
+		switch {
+		case z.ends("at"):
+			z.setTo("ate")
+		case z.ends("bl"):
+			z.setTo("ble")
+		case z.ends("iz"):
+			z.setTo("ize")
+		case z.doubleConsonant(z.k):
+			z.k--
+			switch z.b[z.k] {
+			case 'l', 's', 'z':
+				z.k++
+			}
+		default:
+			z.j = z.k
+			if z.m() == 1 && z.cvc(z.k) {
+				z.setTo("e")
+			}
+		}
+	}
+}
+
+// step1c turns a terminal y into an i when there is another vowel in the stem
+func (z *porterStemmer) step1c() {
+	if z.ends("y") && z.vowelInStem() {
+		z.b[z.k] = 'i'
+	}
+}
+
+// suffixReplacementT describes a suffix that is replaced by another suffix
+type suffixReplacementT struct {
+	suffix      string
+	replacement string
+}
+
+// replaceSuffix replaces the first matching suffix, only the first suffix that matches is considered
+func (z *porterStemmer) replaceSuffix(replacements []suffixReplacementT) {
+	for _, entry := range replacements {
+		if z.ends(entry.suffix) {
+			z.replace(entry.replacement)
+			return
+		}
+	}
+}
+
+// step2 maps double suffixes to single ones, so -ization (= -ize plus -ation) maps to -ize
+func (z *porterStemmer) step2() {
+	switch z.b[z.k-1] {
+	case 'a':
+		z.replaceSuffix([]suffixReplacementT{{"ational", "ate"}, {"tional", "tion"}})
+	case 'c':
+		z.replaceSuffix([]suffixReplacementT{{"enci", "ence"}, {"anci", "ance"}})
+	case 'e':
+		z.replaceSuffix([]suffixReplacementT{{"izer", "ize"}})
+	case 'l':
+		z.replaceSuffix([]suffixReplacementT{{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"}})
+	case 'o':
+		z.replaceSuffix([]suffixReplacementT{{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}})
+	case 's':
+		z.replaceSuffix([]suffixReplacementT{{"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"}})
+	case 't':
+		z.replaceSuffix([]suffixReplacementT{{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}})
+	case 'g':
+		z.replaceSuffix([]suffixReplacementT{{"logi", "log"}})
+	}
+}
+
+// step3 deals with -ic-, -full, -ness etc
+func (z *porterStemmer) step3() {
+	switch z.b[z.k] {
+	case 'e':
+		z.replaceSuffix([]suffixReplacementT{{"icate", "ic"}, {"ative", ""}, {"alize", "al"}})
+	case 'i':
+		z.replaceSuffix([]suffixReplacementT{{"iciti", "ic"}})
+	case 'l':
+		z.replaceSuffix([]suffixReplacementT{{"ical", "ic"}, {"ful", ""}})
+	case 's':
+		z.replaceSuffix([]suffixReplacementT{{"ness", ""}})
+	}
+}
+
+// step4 removes -ant, -ence etc in a context where the stem has at least 2 consonant sequences
+func (z *porterStemmer) step4() {
+	var suffixes []string
+	switch z.b[z.k-1] {
+	case 'a':
+		suffixes = []string{"al"}
+	case 'c':
+		suffixes = []string{"ance", "ence"}
+	case 'e':
+		suffixes = []string{"er"}
+	case 'i':
+		suffixes = []string{"ic"}
+	case 'l':
+		suffixes = []string{"able", "ible"}
+	case 'n':
+		suffixes = []string{"ant", "ement", "ment", "ent"}
+	case 'o':
+		if z.ends("ion") && z.j >= 0 && (z.b[z.j] == 's' || z.b[z.j] == 't') {
+			break
+		}
+		suffixes = []string{"ou"}
+	case 's':
+		suffixes = []string{"ism"}
+	case 't':
+		suffixes = []string{"ate", "iti"}
+	case 'u':
+		suffixes = []string{"ous"}
+	case 'v':
+		suffixes = []string{"ive"}
+	case 'z':
+		suffixes = []string{"ize"}
+	default:
+		return
+	}
+
+	if suffixes != nil {
+		found := false
+		for _, suffix := range suffixes {
+			if z.ends(suffix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+
+	if z.m() > 1 {
+		z.k = z.j
+	}
+}
+
+// step5 removes a final -e if the stem has more than one consonant sequence and changes -ll to -l
+func (z *porterStemmer) step5() {
+	z.j = z.k
+	if z.b[z.k] == 'e' {
+		m := z.m()
+		if m > 1 || m == 1 && !z.cvc(z.k-1) {
+			z.k--
+		}
+	}
+	if z.b[z.k] == 'l' && z.doubleConsonant(z.k) && z.m() > 1 {
+		z.k--
+	}
+}
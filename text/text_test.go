@@ -0,0 +1,96 @@
+package text
+
+import (
+	"testing"
+
+	. "github.com/stretchr/testify/assert"
+)
+
+func TestStemEnglish(t *testing.T) {
+	cases := map[string]string{
+		"caresses":    "caress",
+		"ponies":      "poni",
+		"cats":        "cat",
+		"feed":        "feed",
+		"agreed":      "agre",
+		"plastered":   "plaster",
+		"motoring":    "motor",
+		"hopping":     "hop",
+		"filing":      "file",
+		"happy":       "happi",
+		"relational":  "relat",
+		"conditional": "condit",
+		"running":     "run",
+		"runs":        "run",
+		"generously":  "gener",
+		"coffee":      "coffe",
+		"café":        "café",
+		"go":          "go",
+	}
+
+	for word, expected := range cases {
+		Equal(t, expected, stemEnglish(word), word)
+	}
+}
+
+func TestTerms(t *testing.T) {
+	Equal(t, []string{"quick", "brown", "fox", "jump", "lazi", "dog"}, English.Terms("The quick brown fox jumps over the lazy dog!", Options{}))
+	Equal(t, []string{"cafe"}, English.Terms("Café", Options{}))
+	Equal(t, []string{"Café"}, English.Terms("Café", Options{CaseSensitive: true, DiacriticSensitive: true}))
+	Equal(t, []string{"Run"}, English.Terms("Running", Options{CaseSensitive: true}))
+	Equal(t, []string{"the", "running"}, None.Terms("The running", Options{}))
+}
+
+func TestParseQuery(t *testing.T) {
+	Equal(t, Query{
+		Words:          []string{"coffee", "iced", "tea", "cake"},
+		NegatedWords:   []string{"decaf"},
+		Phrases:        []string{"iced tea"},
+		NegatedPhrases: []string{"green tea"},
+	}, ParseQuery(`coffee -decaf "iced tea" -"green tea" cake`))
+
+	Equal(t, Query{Words: []string{"sugar", "free"}}, ParseQuery("sugar-free"))
+	Equal(t, Query{Words: []string{"a"}}, ParseQuery(`  a - ""`))
+}
+
+func TestSearchScore(t *testing.T) {
+	fields := []Field{
+		{Text: "Coffee shop", Weight: 10, Language: English},
+		{Text: "We sell coffee and iced tea, coffee is our favorite", Weight: 1, Language: English},
+	}
+
+	cases := []struct {
+		Search  string
+		Options Options
+		Matches bool
+	}{
+		{"coffee", Options{}, true},
+		{"shops", Options{}, true},
+		{"cake", Options{}, false},
+		{"cake coffee", Options{}, true},
+		{"coffee -tea", Options{}, false},
+		{`"iced tea"`, Options{}, true},
+		{`coffee "green tea"`, Options{}, false},
+		{`coffee -"green tea"`, Options{}, true},
+		{"the", Options{}, false},
+		{"COFFEE", Options{}, true},
+		{"COFFEE", Options{CaseSensitive: true}, false},
+		{"Coffee", Options{CaseSensitive: true}, true},
+	}
+
+	for _, testCase := range cases {
+		search := &Search{Query: ParseQuery(testCase.Search), Options: testCase.Options}
+		_, matched := search.Score(fields, English)
+		Equal(t, testCase.Matches, matched, testCase.Search)
+	}
+
+	search := &Search{Query: ParseQuery("coffee")}
+	score, _ := search.Score(fields, English)
+	// title: 10 * 1 * (0.5 * 1/2 + 0.5), body: 1 * 1.5 * (0.5 * 2/6 + 0.5)
+	InDelta(t, 8.5, score, 0.0001)
+
+	// Without stemming shops does not match shop
+	search = &Search{Query: ParseQuery("shops"), Language: None}
+	_, matched := search.Score(fields, English)
+	False(t, matched)
+}
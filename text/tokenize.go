@@ -0,0 +1,81 @@
+package text
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Options controls how words are compared
+type Options struct {
+	// CaseSensitive makes "Coffee" and "coffee" different words
+	CaseSensitive bool
+	// DiacriticSensitive makes "café" and "cafe" different words
+	DiacriticSensitive bool
+}
+
+// Words splits text into words, everything that is not a letter or number separates words
+func Words(text string) []string {
+	return strings.FieldsFunc(text, isDelimiter)
+}
+
+func isDelimiter(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r)
+}
+
+// Normalize lower cases text and removes diacritics unless the options say otherwise
+func Normalize(text string, options Options) string {
+	if !options.DiacriticSensitive {
+		text = removeDiacritics(text)
+	}
+	if !options.CaseSensitive {
+		text = strings.ToLower(text)
+	}
+	return text
+}
+
+func removeDiacritics(text string) string {
+	decomposed := norm.NFD.String(text)
+	builder := strings.Builder{}
+	builder.Grow(len(decomposed))
+	for _, r := range decomposed {
+		if !unicode.Is(unicode.Mn, r) {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// Terms splits text into the terms that are indexed and searched for
+// Stop words are left out and the remaining words are normalized and stemmed.
+func (l *Language) Terms(text string, options Options) []string {
+	words := Words(text)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = Normalize(word, options)
+		if l.IsStopWord(word) {
+			continue
+		}
+		terms = append(terms, l.stemPreservingCase(word))
+	}
+	return terms
+}
+
+// stemPreservingCase stems the lower case word and restores the upper case letters of the stem
+func (l *Language) stemPreservingCase(word string) string {
+	lowerWord := strings.ToLower(word)
+	stem := l.Stem(lowerWord)
+	if lowerWord == word {
+		return stem
+	}
+
+	wordRunes := []rune(word)
+	stemRunes := []rune(stem)
+	for idx, r := range stemRunes {
+		if idx < len(wordRunes) && unicode.ToLower(wordRunes[idx]) == r {
+			stemRunes[idx] = wordRunes[idx]
+		}
+	}
+	return string(stemRunes)
+}
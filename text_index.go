@@ -0,0 +1,144 @@
+package mongomock
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mjarkk/mongomock/match"
+	"github.com/mjarkk/mongomock/text"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// textIndexT is an inverted index of the terms within the text fields of the documents in a collection
+type textIndexT struct {
+	// weights maps the indexed keys to their weight, the key "$**" indexes all string fields
+	weights          map[string]float64
+	defaultLanguage  *text.Language
+	languageOverride string
+	// postings maps terms to the ids of the documents containing them
+	postings map[string]map[uint64]struct{}
+}
+
+func isTextIndex(keys bson.D) bool {
+	for _, key := range keys {
+		if key.Value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+func newTextIndex(keys bson.D, opts *options.IndexOptions) (*textIndexT, error) {
+	index := &textIndexT{
+		weights:          map[string]float64{},
+		defaultLanguage:  text.English,
+		languageOverride: "language",
+		postings:         map[string]map[uint64]struct{}{},
+	}
+
+	for _, key := range keys {
+		if key.Value == "text" {
+			index.weights[key.Key] = 1
+		}
+	}
+
+	if opts == nil {
+		return index, nil
+	}
+
+	if opts.DefaultLanguage != nil {
+		language, err := text.LookupLanguage(*opts.DefaultLanguage)
+		if err != nil {
+			return nil, fmt.Errorf("default_language %q is not supported", *opts.DefaultLanguage)
+		}
+		index.defaultLanguage = language
+	}
+	if opts.LanguageOverride != nil {
+		index.languageOverride = *opts.LanguageOverride
+	}
+	if opts.Weights != nil {
+		weights, ok := match.ToDocument(opts.Weights)
+		if !ok {
+			return nil, errors.New("text index weights must be a document")
+		}
+		for _, weight := range weights {
+			value, ok := weightValue(weight.Value)
+			if !ok || value < 1 || value >= 100000 {
+				return nil, fmt.Errorf("text index weight of %s must be a number between 1 and 99999", weight.Key)
+			}
+			// Fields with a weight are indexed, even if they are not within the keys
+			index.weights[weight.Key] = value
+		}
+	}
+
+	return index, nil
+}
+
+func weightValue(value any) (float64, bool) {
+	switch typedValue := value.(type) {
+	case int:
+		return float64(typedValue), true
+	case int32:
+		return float64(typedValue), true
+	case int64:
+		return float64(typedValue), true
+	case float64:
+		return typedValue, true
+	}
+	return 0, false
+}
+
+// fields returns the indexed text of a document
+func (i *textIndexT) fields(document documentT) []text.Field {
+	return match.TextFields(document.bson, i.weights, i.languageOverride, i.defaultLanguage)
+}
+
+func (i *textIndexT) add(document documentT) error {
+	for _, value := range match.Lookup(document.bson, i.languageOverride) {
+		language, ok := value.(string)
+		if !ok {
+			continue
+		}
+		_, err := text.LookupLanguage(language)
+		if err != nil {
+			return fmt.Errorf("language override unsupported: %s", language)
+		}
+	}
+
+	for _, field := range i.fields(document) {
+		for _, term := range field.Language.Terms(field.Text, text.Options{}) {
+			documents, ok := i.postings[term]
+			if !ok {
+				documents = map[uint64]struct{}{}
+				i.postings[term] = documents
+			}
+			documents[document.id] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (i *textIndexT) remove(document documentT) {
+	for _, field := range i.fields(document) {
+		for _, term := range field.Language.Terms(field.Text, text.Options{}) {
+			documents := i.postings[term]
+			delete(documents, document.id)
+			if len(documents) == 0 {
+				delete(i.postings, term)
+			}
+		}
+	}
+}
+
+// candidates returns the ids of the documents that contain any of the search terms
+// These documents still need to be checked for phrases, negations and case or diacritic sensitivity
+func (i *textIndexT) candidates(search *text.Search) map[uint64]struct{} {
+	candidates := map[uint64]struct{}{}
+	for _, term := range search.IndexTerms(i.defaultLanguage) {
+		for id := range i.postings[term] {
+			candidates[id] = struct{}{}
+		}
+	}
+	return candidates
+}
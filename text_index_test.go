@@ -0,0 +1,148 @@
+package mongomock
+
+import (
+	"testing"
+
+	"github.com/mjarkk/mongomock/match"
+	. "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type article struct {
+	ID       int     `bson:"_id"`
+	Title    string  `bson:"title"`
+	Body     string  `bson:"body"`
+	Language string  `bson:"lang,omitempty"`
+	Score    float64 `bson:"score,omitempty"`
+}
+
+func newArticlesCollection(t *testing.T) *Collection {
+	articles := NewDB().Collection("articles")
+	NoError(t, articles.Insert(
+		article{ID: 1, Title: "Coffee brewing", Body: "How to brew the best coffee"},
+		article{ID: 2, Title: "Tea", Body: "Iced tea is better than coffee"},
+		article{ID: 3, Title: "Cakes", Body: "Baking a cake"},
+		article{ID: 4, Title: "Cafés in Paris", Body: "The running of the cafés", Language: "none"},
+	))
+
+	name, err := articles.CreateIndex(mongo.IndexModel{
+		Keys: bson.D{{Key: "title", Value: "text"}, {Key: "body", Value: "text"}},
+		Options: options.Index().
+			SetWeights(bson.M{"title": 10}).
+			SetLanguageOverride("lang"),
+	})
+	NoError(t, err)
+	Equal(t, "title_text_body_text", name)
+
+	return articles
+}
+
+func TestTextSearch(t *testing.T) {
+	articles := newArticlesCollection(t)
+
+	cases := []struct {
+		Name     string
+		Filter   any
+		Expected []int
+	}{
+		{"single word", bson.M{"$text": bson.M{"$search": "coffee"}}, []int{1, 2}},
+		{"stemmed word", bson.M{"$text": bson.M{"$search": "brewed"}}, []int{1}},
+		{"any word", bson.M{"$text": bson.M{"$search": "cakes tea"}}, []int{2, 3}},
+		{"negation", bson.M{"$text": bson.M{"$search": "coffee -tea"}}, []int{1}},
+		{"phrase", bson.M{"$text": bson.M{"$search": `"iced tea"`}}, []int{2}},
+		{"diacritic insensitive", bson.M{"$text": bson.M{"$search": "cafes", "$language": "none"}}, []int{4}},
+		{"diacritic sensitive", bson.M{"$text": bson.M{"$search": "cafes", "$language": "none", "$diacriticSensitive": true}}, []int{}},
+		{"case sensitive", bson.M{"$text": bson.M{"$search": "coffee", "$caseSensitive": true}}, []int{1, 2}},
+		{"case sensitive title", bson.M{"$text": bson.M{"$search": "Coffee", "$caseSensitive": true}}, []int{1}},
+		{"language override without stemming", bson.M{"$text": bson.M{"$search": "run"}}, []int{}},
+		{"with other filters", bson.M{"$text": bson.M{"$search": "coffee"}, "_id": bson.M{"$gt": 1}}, []int{2}},
+		{"within $and", bson.M{"$and": bson.A{bson.M{"$text": bson.M{"$search": "coffee"}}, bson.M{"_id": 1}}}, []int{1}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			results := []article{}
+			NoError(t, articles.Find(&results, testCase.Filter))
+
+			ids := []int{}
+			for _, result := range results {
+				ids = append(ids, result.ID)
+			}
+			Equal(t, testCase.Expected, ids)
+		})
+	}
+}
+
+func TestTextSearchScore(t *testing.T) {
+	articles := newArticlesCollection(t)
+
+	filter := bson.M{"$text": bson.M{"$search": "coffee"}}
+	results := []article{}
+	err := articles.Find(&results, filter, options.Find().
+		SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetProjection(bson.M{"title": 1, "score": bson.M{"$meta": "textScore"}}))
+	NoError(t, err)
+
+	if Len(t, results, 2) {
+		// The title has a higher weight, so the first article scores best
+		Equal(t, 2, results[1].ID)
+		Equal(t, 1, results[0].ID)
+		Equal(t, "Coffee brewing", results[0].Title)
+		Empty(t, results[0].Body)
+		Greater(t, results[0].Score, results[1].Score)
+	}
+
+	first := article{}
+	err = articles.FindFirst(&first, filter, options.FindOne().SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}))
+	NoError(t, err)
+	Equal(t, 1, first.ID)
+
+	err = articles.Find(&results, bson.M{}, options.Find().SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}))
+	ErrorIs(t, err, errNoTextScore)
+}
+
+func TestTextIndexUpdates(t *testing.T) {
+	articles := newArticlesCollection(t)
+
+	NoError(t, articles.ReplaceFirst(bson.M{"_id": 1}, article{ID: 1, Title: "Espresso"}))
+	NoError(t, articles.DeleteFirst(bson.M{"_id": 2}))
+	NoError(t, articles.Insert(article{ID: 5, Title: "Coffee beans"}))
+
+	count, err := articles.Count(bson.M{"$text": bson.M{"$search": "coffee"}})
+	NoError(t, err)
+	Equal(t, uint64(1), count)
+
+	count, err = articles.Count(bson.M{"$text": bson.M{"$search": "espresso"}})
+	NoError(t, err)
+	Equal(t, uint64(1), count)
+
+	err = articles.Insert(article{ID: 6, Title: "Café", Language: "klingon"})
+	Error(t, err)
+	count, err = articles.Count(nil)
+	NoError(t, err)
+	Equal(t, uint64(4), count)
+}
+
+func TestTextSearchErrors(t *testing.T) {
+	articles := NewDB().Collection("articles")
+	NoError(t, articles.Insert(article{ID: 1, Title: "Coffee"}))
+
+	_, err := articles.Count(bson.M{"$text": bson.M{"$search": "coffee"}})
+	ErrorIs(t, err, ErrTextIndexRequired)
+
+	_, err = articles.Count(bson.M{"$or": bson.A{bson.M{"$text": bson.M{"$search": "coffee"}}, bson.M{"_id": 1}}})
+	ErrorIs(t, err, match.ErrBadValue)
+
+	_, err = articles.Count(bson.M{"$text": bson.M{"$search": "a"}, "$and": bson.A{bson.M{"$text": bson.M{"$search": "b"}}}})
+	ErrorIs(t, err, match.ErrBadValue)
+
+	_, err = articles.Count(bson.M{"$text": bson.M{"$language": "english"}})
+	ErrorIs(t, err, match.ErrBadValue)
+
+	_, err = articles.CreateIndex(mongo.IndexModel{Keys: bson.M{"title": "text"}})
+	NoError(t, err)
+	_, err = articles.CreateIndex(mongo.IndexModel{Keys: bson.M{"body": "text"}})
+	Error(t, err)
+}